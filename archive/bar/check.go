@@ -0,0 +1,61 @@
+package bar
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+)
+
+var ErrOverlappingData = errors.New("Entry data overlaps another entry.")
+
+// Check looks for every problem of the archive that NewReader doesn't reject
+// already, which verifies the header, footer, table checksum and that
+// entry data lies within the archive. It returns an *EntryError for every
+// entry whose data overlaps the data of another, whose name isn't a local
+// path (ErrPathIsNotSimple), which is a link pointing outside of the
+// archive (ErrUnsafeLink) or to a missing file (ErrMissingLinkTarget) or
+// whose data doesn't match its checksum or can't be read.
+func (br *Reader) Check() []error {
+	var errs []error
+	for _, e := range br.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(e.Name)) {
+			errs = append(errs, &EntryError{e.Name, ErrPathIsNotSimple})
+		}
+		if e.Type == TypeSymlink && !localLink(e.Name, e.Linkname) {
+			errs = append(errs, &EntryError{e.Name, ErrUnsafeLink})
+		}
+		if _, err := br.resolve(&e); err != nil {
+			errs = append(errs, &EntryError{e.Name, err})
+		}
+	}
+
+	// Sorted by offset, data overlaps if it starts before the end of the
+	// data before it. Entries of a solid block share its data, theirs
+	// overlaps within the decompressed data of the block.
+	solid := br.flags&FlagSolid != 0
+	entries := slices.Clone(br.Entries)
+	slices.SortStableFunc(entries, compareData)
+	var end, solidEnd uint64
+	for i, e := range entries {
+		shared := solid && i > 0 && e.index == entries[i-1].index &&
+			e.sizeCompressed == entries[i-1].sizeCompressed
+		switch {
+		case shared && e.Size > 0 && e.solidOffset < solidEnd,
+			!shared && i > 0 && e.index < end:
+			errs = append(errs, &EntryError{e.Name, ErrOverlappingData})
+		}
+		if !shared {
+			solidEnd = 0
+		}
+		solidEnd = max(solidEnd, e.solidOffset+e.Size)
+		end = max(end, e.index+e.sizeCompressed)
+	}
+
+	for i := range br.Entries {
+		err := br.verifyEntry(&br.Entries[i])
+		if err != nil {
+			errs = append(errs, &EntryError{br.Entries[i].Name, err})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,97 @@
+package bar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	entries := []testEntry{
+		{"a.txt", TypeFile, "alpha"},
+		{"b.txt", TypeFile, "bravo"},
+		{"data", TypeFile, string(benchData(20 << 10))},
+		{"hard", TypeHardlink, "a.txt"},
+		{"link", TypeSymlink, "a.txt"},
+	}
+	tests := []struct {
+		name   string
+		change func(br *Reader)
+		entry  string
+		want   error
+	}{
+		{"none", func(br *Reader) {}, "", nil},
+		{"data", func(br *Reader) { br.Entries[1].adler ^= 1 }, "b.txt",
+			ErrInvalidChecksum},
+		{"overlap", func(br *Reader) {
+			br.Entries[1].index = br.Entries[0].index + 1
+		}, "b.txt", ErrOverlappingData},
+		{"unsafe name", func(br *Reader) { br.Entries[0].Name = "../a.txt" },
+			"../a.txt", ErrPathIsNotSimple},
+		{"absolute name", func(br *Reader) { br.Entries[0].Name = "/a.txt" },
+			"/a.txt", ErrPathIsNotSimple},
+		{"unsafe link", func(br *Reader) { br.Entries[4].Linkname = "../../x" },
+			"link", ErrUnsafeLink},
+		{"missing target", func(br *Reader) { br.Entries[3].Linkname = "x" },
+			"hard", ErrMissingLinkTarget},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := writeEntries(t, entries)
+			tt.change(br)
+			errs := br.Check()
+			if tt.want == nil {
+				if len(errs) != 0 {
+					t.Errorf("got %v, want no problems", errs)
+				}
+				return
+			}
+
+			var found bool
+			for _, err := range errs {
+				var ee *EntryError
+				if errors.As(err, &ee) && ee.Name == tt.entry &&
+					errors.Is(err, tt.want) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("got %v, want %v for %s", errs, tt.want, tt.entry)
+			}
+		})
+	}
+}
+
+func TestCheckStructure(t *testing.T) {
+	b := writeArchive(t, []testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"}})
+
+	// NewReader rejects these before Check could run.
+	tests := []struct {
+		name   string
+		change func(b []byte)
+		want   error
+	}{
+		{"header", func(b []byte) { b[0] ^= 1 }, ErrUnknownFormat},
+		{"table checksum", func(b []byte) { b[len(b)-8] ^= 1 }, ErrInvalidChecksum},
+		{"table offset", func(b []byte) {
+			binary.LittleEndian.PutUint64(b[len(b)-footerSize:], uint64(len(b)))
+		}, ErrInvalidOffset},
+		{"table", func(b []byte) {
+			table := binary.LittleEndian.Uint64(b[len(b)-footerSize:])
+			b[table] ^= 0xff
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bytes.Clone(b)
+			tt.change(b)
+			_, err := NewReader(bytes.NewReader(b))
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
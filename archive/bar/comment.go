@@ -0,0 +1,50 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+var ErrCommentTooLong = errors.New("Comment is too long.")
+
+// WithComments stores a comment with every entry, see Writer.SetComment.
+// Entries without one store an empty comment.
+func WithComments() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagComments
+		return nil
+	}
+}
+
+// SetComment sets the comment of the current entry, a short note of up to
+// 65535 bytes. It is ignored unless the archive is written with
+// WithComments.
+func (bw *Writer) SetComment(comment string) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
+	if len(comment) > math.MaxUint16 {
+		return ErrCommentTooLong
+	}
+
+	bw.entries[len(bw.entries)-1].Comment = comment
+	return nil
+}
+
+// writeComment writes the comment of e preceded by its 2 byte length.
+func writeComment(w io.Writer, e *Entry) error {
+	buf := make([]byte, 2)
+	wb := wBuf(buf)
+	wb.Uint16(uint16(len(e.Comment)))
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, e.Comment)
+	return err
+}
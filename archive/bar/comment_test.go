@@ -0,0 +1,65 @@
+package bar
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSetComment(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment string
+		opts    []WriterOption
+		want    string
+		err     error
+	}{
+		{"build id", "build 1234", []WriterOption{WithComments()}, "build 1234", nil},
+		{"empty", "", []WriterOption{WithComments()}, "", nil},
+		{"control characters", "a\tb\nc", []WriterOption{WithComments()},
+			"a\tb\nc", nil},
+		{"compact", "note", []WriterOption{WithComments(), WithCompact()},
+			"note", nil},
+		{"longest", strings.Repeat("c", math.MaxUint16),
+			[]WriterOption{WithComments()}, strings.Repeat("c", math.MaxUint16), nil},
+		{"not stored", "note", nil, "", nil},
+		{"too long", strings.Repeat("c", math.MaxUint16+1),
+			[]WriterOption{WithComments()}, "", ErrCommentTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.SetComment(tt.comment)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			err = bw.Create("b.txt")
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes())
+			if got := br.Entries[0].Comment; got != tt.want {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+			if got := br.Entries[1].Comment; got != "" {
+				t.Errorf("b.txt: got %q, want none", got)
+			}
+		})
+	}
+}
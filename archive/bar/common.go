@@ -1,14 +1,81 @@
 // Package bar implements reading and writing of BAR files.
 package bar
 
+import (
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"strings"
+	"time"
+)
+
 const (
-	Version = 1
+	Version = 3
 
-	headerSize = 4
-	entrySize  = 32
-	footerSize = 16
+	headerSize   = 4
+	flagsSize    = 4
+	entrySize    = 32
+	compactSize  = 26 // entry of compact archives, without checksum and perms
+	footerSize   = 24
+	footerSizeV2 = 16 // footer of version 1 and 2, without the table size
 )
 
+// Header flags. A flag may add fields to the header, which follow the
+// flags in the order of the flag bits, and fields to each table entry,
+// which follow the name in the same order. FlagJournal adds fields to the
+// end of the footer, FlagMetadata before them, and FlagNamePool to the
+// start of the table.
+// FlagRawTable adds no fields, the table is written without DEFLATE.
+const (
+	FlagAligned        uint32 = 1 << iota // header: alignment  4 bytes
+	FlagEncrypted                         // header: cipher 1 byte, entry: nonce 12 bytes
+	FlagPassword                          // header: scrypt parameters 22 bytes
+	FlagName                              // header: name length 2 bytes, name
+	FlagHashed                            // entry: SHA-256 of the data 32 bytes
+	FlagJournal                           // footer: end of previous segment 8 bytes, marker 4 bytes
+	FlagCompact                           // entry: no adler32 and permissions
+	FlagNamePool                          // table: directory pool, entry: directory 4 bytes
+	FlagProducer                          // header: length 2 bytes, producer
+	FlagRawTable                          // table: not compressed
+	FlagXattrs                            // entry: count 2 bytes, extended attributes
+	FlagModTime                           // entry: modification time 8 bytes
+	FlagEntryTypes                        // entry: type 1 byte, link target
+	FlagOwner                             // entry: uid and gid 8 bytes, user and group names
+	FlagComments                          // entry: length 2 bytes, comment
+	FlagMetadata                          // footer: offset of the metadata section 8 bytes
+	FlagMethods                           // entry: compression method 1 byte
+	FlagSolid                             // entry: offset in the data of the solid block 8 bytes
+	FlagEncryptedTable                    // table: nonce 12 bytes, encrypted
+
+	knownFlags = FlagAligned | FlagEncrypted | FlagPassword | FlagName |
+		FlagHashed | FlagJournal | FlagCompact | FlagNamePool | FlagProducer |
+		FlagRawTable | FlagXattrs | FlagModTime | FlagEntryTypes | FlagOwner |
+		FlagComments | FlagMetadata | FlagMethods | FlagSolid |
+		FlagEncryptedTable
+)
+
+var flagNames = map[uint32]string{
+	FlagAligned:        "aligned",
+	FlagEncrypted:      "encrypted",
+	FlagPassword:       "password",
+	FlagName:           "name",
+	FlagHashed:         "hashed",
+	FlagJournal:        "journal",
+	FlagCompact:        "compact",
+	FlagNamePool:       "name pool",
+	FlagProducer:       "producer",
+	FlagRawTable:       "raw table",
+	FlagXattrs:         "xattrs",
+	FlagModTime:        "mtime",
+	FlagEntryTypes:     "entry types",
+	FlagOwner:          "owner",
+	FlagComments:       "comments",
+	FlagMetadata:       "metadata",
+	FlagMethods:        "methods",
+	FlagSolid:          "solid",
+	FlagEncryptedTable: "encrypted table",
+}
+
 var (
 	magicNumber = []byte{'B', 'A', 'R'}
 )
@@ -17,11 +84,127 @@ type Entry struct {
 	Name           string
 	Size           uint64
 	Perm           uint16
+	ModTime        time.Time         // zero if not stored
+	Xattrs         map[string][]byte // of archives written with WithXattrs
+	Type           EntryType
+	Linkname       string // target of symbolic and hard links
+	UID, GID       int    // -1 if not stored
+	Uname, Gname   string // names of the owner and group, if stored
+	Comment        string // of archives written with WithComments
+	Method         Method // compression method of the data
 	sizeCompressed uint64
 	index          uint64
 	adler          uint32
+	nonce          []byte
+	hash           []byte
+	solidOffset    uint64 // of the data in the data of the solid block
+	blockSize      uint64 // of the data of the solid block, if any
+}
+
+// EntryError records an error and the name of the entry that caused it.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// FeatureError is returned for archives using header flags this build
+// doesn't support. It matches ErrUnsupportedFeature with errors.Is.
+type FeatureError struct {
+	Flags uint32
+}
+
+func (e *FeatureError) Error() string {
+	var names []string
+	for i := 0; i < 32; i++ {
+		flag := e.Flags & (1 << i)
+		if flag == 0 {
+			continue
+		}
+		if name, ok := flagNames[flag]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("0x%x", flag))
+		}
+	}
+	return "Unsupported features: " + strings.Join(names, ", ") + "."
+}
+
+func (e *FeatureError) Unwrap() error {
+	return ErrUnsupportedFeature
 }
 
 func (e *Entry) Ratio() float64 {
+	if e.blockSize != 0 {
+		return float64(e.sizeCompressed) / float64(e.blockSize)
+	}
 	return float64(e.sizeCompressed) / float64(e.Size)
 }
+
+// CompressedSize returns the number of bytes the data of the entry takes
+// in the archive. Entries of solid archives take their share of the
+// compressed block.
+func (e *Entry) CompressedSize() uint64 {
+	if e.blockSize != 0 {
+		hi, lo := bits.Mul64(e.sizeCompressed, e.Size)
+		if hi < e.blockSize {
+			q, _ := bits.Div64(hi, lo, e.blockSize)
+			return q
+		}
+	}
+	return e.sizeCompressed
+}
+
+// SavedPercent returns the space saved by compression in percent of the
+// size. Entries that didn't shrink, including empty ones, saved 0%.
+func (e *Entry) SavedPercent() float64 {
+	if e.CompressedSize() >= e.Size {
+		return 0
+	}
+	return (1 - e.Ratio()) * 100
+}
+
+// Mode returns Perm and the type as fs.FileMode. Perm stores the setuid,
+// setgid and sticky bits as the unix mode bits 04000, 02000 and 01000,
+// while fs.FileMode has its own flags for them.
+func (e *Entry) Mode() fs.FileMode {
+	mode := fs.FileMode(e.Perm) & fs.ModePerm
+	switch e.Type {
+	case TypeSymlink:
+		mode |= fs.ModeSymlink
+	case TypeDir:
+		mode |= fs.ModeDir
+	}
+	if e.Perm&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if e.Perm&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if e.Perm&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// EntryLocation describes where an entry's compressed data is stored, so it
+// can be fetched and decompressed without parsing the archive. Entries of
+// solid archives share their compressed data with the other entries of
+// their block, their data starts SolidOffset bytes into its decompressed
+// data.
+type EntryLocation struct {
+	Name           string `json:"name"`
+	Offset         uint64 `json:"offset"`
+	CompressedSize uint64 `json:"compressed_size"`
+	Size           uint64 `json:"size"`
+	Adler32        uint32 `json:"adler32"`
+	Method         string `json:"method"`
+	SolidOffset    uint64 `json:"solid_offset,omitempty"`
+}
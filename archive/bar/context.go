@@ -0,0 +1,65 @@
+package bar
+
+import (
+	"context"
+	"io"
+)
+
+// EntryReaderContext is like EntryReader, but reads fail with the error of
+// ctx once it is done, even if reading from the archive blocks. A blocked
+// read is abandoned, not interrupted, so after that the Reader must not be
+// used any more. For a timeout on every read, use a fresh
+// context.WithTimeout per read, or set deadlines on the underlying source
+// if it supports them, like *os.File does for pipes.
+func (br *Reader) EntryReaderContext(ctx context.Context,
+	e *Entry) (io.ReadCloser, error) {
+	raw, err := br.rawReader(e)
+	if err != nil {
+		return nil, err
+	}
+	return br.entryReader(e, &ctxReader{ctx: ctx, r: raw})
+}
+
+// ctxReader reads from r in another goroutine, so it can return as soon as
+// ctx is done. It reads into its own buffer, since an abandoned read may
+// still complete later.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+	buf []byte
+	err error
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (cr *ctxReader) Read(b []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if err := cr.ctx.Err(); err != nil {
+		cr.err = err
+		return 0, err
+	}
+
+	if len(cr.buf) < len(b) {
+		cr.buf = make([]byte, min(len(b), chunkSize))
+	}
+	buf := cr.buf[:min(len(b), len(cr.buf))]
+
+	ch := make(chan readResult, 1)
+	go func() {
+		n, err := cr.r.Read(buf)
+		ch <- readResult{n, err}
+	}()
+
+	select {
+	case res := <-ch:
+		return copy(b, buf[:res.n]), res.err
+	case <-cr.ctx.Done():
+		cr.err = cr.ctx.Err()
+		return 0, cr.err
+	}
+}
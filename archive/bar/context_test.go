@@ -0,0 +1,99 @@
+package bar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// blockingReaderAt blocks reads of the bytes from start to end until
+// release is closed.
+type blockingReaderAt struct {
+	b          []byte
+	start, end int64
+	release    chan struct{}
+}
+
+func (r blockingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > r.start && off < r.end {
+		<-r.release
+	}
+	return bytes.NewReader(r.b).ReadAt(b, off)
+}
+
+func TestEntryReaderContext(t *testing.T) {
+	files := []testFile{{"data", string(benchData(50 << 10))}}
+	b := writeArchive(t, files)
+
+	tests := []struct {
+		name    string
+		blocked bool
+		ctx     func() (context.Context, context.CancelFunc)
+		want    error
+	}{
+		{"not blocked", false, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), time.Minute)
+		}, nil},
+		{"timeout", true, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{"cancelled", true, func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"cancelled before", false, func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := openArchive(t, b)
+			e := &br.Entries[0]
+
+			release := make(chan struct{})
+			defer close(release)
+			r := blockingReaderAt{b: b, release: release}
+			if tt.blocked {
+				r.start = int64(e.index)
+				r.end = int64(e.index + e.sizeCompressed)
+			}
+			br, err := NewReaderAt(r, int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			start := time.Now()
+			er, err := br.EntryReaderContext(ctx, &br.Entries[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(er)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("returned after %v", elapsed)
+			}
+			if err == nil && string(data) != files[0].data {
+				t.Errorf("got %d bytes, want %d", len(data), len(files[0].data))
+			}
+
+			// Reads after an abandoned one keep failing.
+			if err != nil {
+				_, err = er.Read(make([]byte, 10))
+				if !errors.Is(err, tt.want) {
+					t.Errorf("next read: got %v, want %v", err, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package bar
+
+import (
+	"bar/archive/bar/internal/scrypt"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	CipherAESGCM = 1
+	KDFScrypt    = 1
+
+	nonceSize = 12
+	chunkSize = 64 << 10
+	saltSize  = 16
+	keySize   = 32
+	kdfSize   = 6 + saltSize
+
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptMaxLogN = 20
+)
+
+var (
+	ErrMissingKey        = errors.New("Missing decryption key.")
+	ErrNotEncrypted      = errors.New("Archive is not encrypted.")
+	ErrDecryptionFailed  = errors.New("Decryption failed.")
+	ErrUnsupportedCipher = errors.New("Unsupported cipher.")
+	ErrNoPassword        = errors.New("Archive is not password protected.")
+	ErrInvalidKDF        = errors.New("Invalid key derivation parameters.")
+)
+
+// kdfParams are the scrypt parameters stored in the header of password
+// protected archives.
+type kdfParams struct {
+	logN uint8
+	r    uint16
+	p    uint16
+	salt []byte
+}
+
+func newKDFParams() (kdfParams, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	return kdfParams{scryptLogN, scryptR, scryptP, salt}, err
+}
+
+func (kp kdfParams) key(password []byte) ([]byte, error) {
+	if kp.logN > scryptMaxLogN {
+		return nil, ErrInvalidKDF
+	}
+
+	key, err := scrypt.Key(password, kp.salt, 1<<kp.logN, int(kp.r),
+		int(kp.p), keySize)
+	if err != nil {
+		return nil, ErrInvalidKDF
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// Encrypted data is split into chunks of chunkSize bytes, each sealed on
+// its own. The nonce of a chunk is the entry nonce with the chunk number
+// added to its last 8 bytes, and the additional data marks the last chunk,
+// so chunks can't be reordered or dropped.
+func chunkNonce(dst, nonce []byte, n uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	c := binary.BigEndian.Uint64(dst[4:])
+	binary.BigEndian.PutUint64(dst[4:], c+n)
+	return dst
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type gcmWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	n     uint64
+}
+
+func newGCMWriter(w io.Writer, aead cipher.AEAD, nonce []byte) *gcmWriter {
+	return &gcmWriter{w, aead, nonce, make([]byte, 0, chunkSize), 0}
+}
+
+func (gw *gcmWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, since
+		// the last chunk is sealed differently.
+		if len(gw.buf) == chunkSize {
+			err := gw.seal(false)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(gw.buf[len(gw.buf):chunkSize], p)
+		gw.buf = gw.buf[:len(gw.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (gw *gcmWriter) seal(last bool) error {
+	var nonce [nonceSize]byte
+	out := gw.aead.Seal(nil, chunkNonce(nonce[:], gw.nonce, gw.n),
+		gw.buf, chunkAD(last))
+	gw.buf = gw.buf[:0]
+	gw.n++
+
+	_, err := gw.w.Write(out)
+	return err
+}
+
+func (gw *gcmWriter) Close() error {
+	return gw.seal(true)
+}
+
+type gcmReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	left  uint64
+	buf   []byte
+	data  []byte
+	n     uint64
+	err   error
+}
+
+func newGCMReader(r io.Reader, aead cipher.AEAD, nonce []byte,
+	size uint64) *gcmReader {
+	buf := make([]byte, chunkSize+aead.Overhead())
+	return &gcmReader{r: r, aead: aead, nonce: nonce, left: size, buf: buf}
+}
+
+func (gr *gcmReader) Read(p []byte) (int, error) {
+	for len(gr.data) == 0 {
+		if gr.err != nil {
+			return 0, gr.err
+		}
+		gr.err = gr.open()
+	}
+
+	n := copy(p, gr.data)
+	gr.data = gr.data[n:]
+	return n, nil
+}
+
+func (gr *gcmReader) open() error {
+	if gr.left == 0 {
+		return io.EOF
+	}
+
+	size := uint64(len(gr.buf))
+	last := gr.left <= size
+	if last {
+		size = gr.left
+	}
+
+	buf := gr.buf[:size]
+	err := readFull(gr.r, buf)
+	if err != nil {
+		return err
+	}
+	gr.left -= size
+
+	var nonce [nonceSize]byte
+	gr.data, err = gr.aead.Open(buf[:0], chunkNonce(nonce[:], gr.nonce, gr.n),
+		buf, chunkAD(last))
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	gr.n++
+
+	if last {
+		return io.EOF
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package bar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "secret alpha"},
+		{"empty", ""},
+		{"data", string(benchData(100 << 10))},
+	}
+	key16 := bytes.Repeat([]byte{1}, 16)
+	wrongKey := bytes.Repeat([]byte{8}, 32)
+
+	tests := []struct {
+		name     string
+		key      []byte // key written with, or nil
+		readKey  []byte
+		wantOpen error
+		wantRead error
+	}{
+		{"right key", testKey, testKey, nil, nil},
+		{"AES-128", key16, key16, nil, nil},
+		{"wrong key", testKey, wrongKey, nil, ErrDecryptionFailed},
+		{"wrong size", testKey, key16, nil, ErrDecryptionFailed},
+		{"no key", testKey, nil, nil, ErrMissingKey},
+		{"not encrypted", nil, testKey, ErrNotEncrypted, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []WriterOption{WithMethod(MethodStored)}
+			if tt.key != nil {
+				opts = append(opts, WithKey(tt.key))
+			}
+			b := writeArchive(t, files, opts...)
+			plain := bytes.Contains(b, []byte("secret"))
+			if plain != (tt.key == nil) {
+				t.Errorf("data stored in plain text %v, want %v", plain,
+					tt.key == nil)
+			}
+
+			var ropts []ReaderOption
+			if tt.readKey != nil {
+				ropts = append(ropts, WithDecryptionKey(tt.readKey))
+			}
+			br, err := NewReader(bytes.NewReader(b), ropts...)
+			if err != tt.wantOpen {
+				t.Fatalf("NewReader: got %v, want %v", err, tt.wantOpen)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantRead == nil {
+				checkFiles(t, br, files)
+				return
+			}
+			for i := range br.Entries {
+				_, err = br.ReadFile(br.Entries[i].Name)
+				if !errors.Is(err, tt.wantRead) {
+					t.Errorf("%s: got %v, want %v", br.Entries[i].Name, err,
+						tt.wantRead)
+				}
+			}
+		})
+	}
+
+	_, err := NewWriter(io.Discard, WithKey(make([]byte, 20)))
+	if err == nil {
+		t.Error("20 byte key accepted")
+	}
+}
+
+func TestPassword(t *testing.T) {
+	files := []testFile{{"a.txt", "secret alpha"}, {"b.txt", "secret beta"}}
+	password := []byte("correct horse")
+	protected := writeArchive(t, files, WithPassword(password))
+	withKey := writeArchive(t, files, WithKey(testKey))
+
+	tests := []struct {
+		name     string
+		archive  []byte
+		password []byte
+		wantOpen error
+		wantRead error
+	}{
+		{"right password", protected, password, nil, nil},
+		{"wrong password", protected, []byte("battery staple"), nil,
+			ErrDecryptionFailed},
+		{"empty password", protected, []byte{}, nil, ErrDecryptionFailed},
+		{"no password", protected, nil, nil, ErrMissingKey},
+		{"key archive", withKey, password, ErrNoPassword, nil},
+		{"plain archive", writeArchive(t, files), password, ErrNoPassword, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ropts []ReaderOption
+			if tt.password != nil {
+				ropts = append(ropts, WithDecryptionPassword(tt.password))
+			}
+			br, err := NewReader(bytes.NewReader(tt.archive), ropts...)
+			if err != tt.wantOpen {
+				t.Fatalf("NewReader: got %v, want %v", err, tt.wantOpen)
+			}
+			if err != nil {
+				return
+			}
+			if br.Flags()&FlagPassword == 0 {
+				t.Errorf("flags %#x without FlagPassword", br.Flags())
+			}
+			if tt.wantRead == nil {
+				checkFiles(t, br, files)
+				return
+			}
+			_, err = br.ReadFile("a.txt")
+			if !errors.Is(err, tt.wantRead) {
+				t.Errorf("got %v, want %v", err, tt.wantRead)
+			}
+		})
+	}
+
+	// Every archive gets a new salt, so the same password gives another
+	// key.
+	other := writeArchive(t, files, WithPassword(password))
+	if bytes.Equal(other, protected) {
+		t.Error("archives with the same password are equal")
+	}
+}
+
+func TestEncryptedChunks(t *testing.T) {
+	overhead := uint64(16)
+	tests := []struct {
+		name   string
+		size   int
+		chunks uint64
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"chunk less one", chunkSize - 1, 1},
+		{"chunk", chunkSize, 1},
+		{"chunk and one", chunkSize + 1, 2},
+		{"two chunks", 2 * chunkSize, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := []testFile{{"data", string(benchData(tt.size))}}
+			b := writeArchive(t, files, WithMethod(MethodStored), WithKey(testKey))
+			br := openArchive(t, b, WithDecryptionKey(testKey))
+			checkFiles(t, br, files)
+
+			// Every chunk is sealed with its own tag.
+			want := uint64(tt.size) + tt.chunks*overhead
+			if got := br.Entries[0].CompressedSize(); got != want {
+				t.Errorf("compressed size %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestEncryptedTamper(t *testing.T) {
+	data := string(benchData(chunkSize + 100))
+	files := []testFile{{"a.txt", data}, {"b.txt", data}}
+	b := writeArchive(t, files, WithMethod(MethodStored), WithKey(testKey))
+
+	// Entries with the same data have their own nonces, so their
+	// encrypted data differs too.
+	br := openArchive(t, b, WithDecryptionKey(testKey))
+	a, c := br.Entries[0], br.Entries[1]
+	if bytes.Equal(a.nonce, c.nonce) {
+		t.Errorf("entries share the nonce %x", a.nonce)
+	}
+	if bytes.Equal(b[a.index:a.index+64], b[c.index:c.index+64]) {
+		t.Error("same data encrypted the same")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b []byte, br *Reader)
+	}{
+		{"flipped bit", func(b []byte, br *Reader) {
+			b[br.Entries[0].index+10] ^= 1
+		}},
+		{"flipped tag", func(b []byte, br *Reader) {
+			e := br.Entries[0]
+			b[e.index+e.sizeCompressed-1] ^= 1
+		}},
+		{"other nonce", func(b []byte, br *Reader) {
+			br.Entries[0].nonce = br.Entries[1].nonce
+		}},
+		{"dropped chunk", func(b []byte, br *Reader) {
+			e := &br.Entries[0]
+			e.sizeCompressed = chunkSize + 16
+			e.Size = chunkSize
+		}},
+		{"other data", func(b []byte, br *Reader) {
+			br.Entries[0].index = br.Entries[1].index
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bytes.Clone(b)
+			br := openArchive(t, b, WithDecryptionKey(testKey))
+			tt.modify(b, br)
+			_, err := br.ReadFile("a.txt")
+			if !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("got %v, want %v", err, ErrDecryptionFailed)
+			}
+		})
+	}
+}
+
+func TestTableEncryption(t *testing.T) {
+	files := []testFile{{"secret-name.txt", "secret alpha"}, {"b.txt", "bravo"}}
+	password := []byte("correct horse")
+	withKey := writeArchive(t, files, WithKey(testKey), WithTableEncryption())
+
+	tests := []struct {
+		name    string
+		archive []byte
+		ropts   []ReaderOption
+		want    error
+	}{
+		{"right key", withKey, []ReaderOption{WithDecryptionKey(testKey)}, nil},
+		{"wrong key", withKey,
+			[]ReaderOption{WithDecryptionKey(bytes.Repeat([]byte{8}, 32))},
+			ErrDecryptionFailed},
+		{"no key", withKey, nil, ErrMissingKey},
+		{"password", writeArchive(t, files, WithPassword(password),
+			WithTableEncryption()),
+			[]ReaderOption{WithDecryptionPassword(password)}, nil},
+		{"wrong password", writeArchive(t, files, WithPassword(password),
+			WithTableEncryption()),
+			[]ReaderOption{WithDecryptionPassword([]byte("battery staple"))},
+			ErrDecryptionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bytes.Contains(tt.archive, []byte("secret")) {
+				t.Error("names or data stored in plain text")
+			}
+			br, err := NewReader(bytes.NewReader(tt.archive), tt.ropts...)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if br.Flags()&FlagEncryptedTable == 0 {
+				t.Errorf("flags %#x without FlagEncryptedTable", br.Flags())
+			}
+			checkFiles(t, br, files)
+		})
+	}
+
+	_, err := NewWriter(io.Discard, WithTableEncryption())
+	if err != ErrMissingKey {
+		t.Errorf("no key: got %v, want %v", err, ErrMissingKey)
+	}
+}
+
+func TestUnsupportedCipher(t *testing.T) {
+	b := writeArchive(t, []testFile{{"a.txt", "alpha"}}, WithKey(testKey))
+	if b[headerSize+flagsSize] != CipherAESGCM {
+		t.Fatalf("cipher %d, want %d", b[headerSize+flagsSize], CipherAESGCM)
+	}
+	b[headerSize+flagsSize] = CipherAESGCM + 1
+	_, err := NewReader(bytes.NewReader(b), WithDecryptionKey(testKey))
+	if !errors.Is(err, ErrUnsupportedCipher) {
+		t.Errorf("got %v, want %v", err, ErrUnsupportedCipher)
+	}
+}
@@ -0,0 +1,170 @@
+package bar
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+)
+
+// DiffKind tells how an entry differs between two archives.
+type DiffKind int
+
+const (
+	Added DiffKind = iota + 1
+	Removed
+	Changed
+)
+
+// A Difference describes an entry that differs between two archives.
+type Difference struct {
+	Name string
+	Kind DiffKind
+
+	// Fields lists what differs for changed entries: "type", "target",
+	// "size", "perm", "mtime", "owner", "comment" or "data".
+	Fields []string
+}
+
+// Diff compares the entries of a and b by name. Of entries with the same
+// name, the first is used. Modification times, owners and comments are
+// only compared if both archives store them. Data is compared by the
+// SHA-256 of the entries if both archives store it, or by the checksum of
+// the stored data. Only data with different checksums, like data
+// compressed at another level, is decompressed and compared. The
+// differences are sorted by name.
+func Diff(a, b *Reader) ([]Difference, error) {
+	aEntries := firstEntries(a)
+	bEntries := firstEntries(b)
+	mtimes := a.flags&b.flags&FlagModTime != 0
+	owners := a.flags&b.flags&FlagOwner != 0
+	comments := a.flags&b.flags&FlagComments != 0
+
+	var diffs []Difference
+	for name, ea := range aEntries {
+		eb, ok := bEntries[name]
+		if !ok {
+			diffs = append(diffs, Difference{Name: name, Kind: Removed})
+			continue
+		}
+
+		var fields []string
+		if ea.Type != eb.Type {
+			fields = append(fields, "type")
+		}
+		if ea.Linkname != eb.Linkname {
+			fields = append(fields, "target")
+		}
+		if ea.Perm != eb.Perm {
+			fields = append(fields, "perm")
+		}
+		if mtimes && !ea.ModTime.Equal(eb.ModTime) {
+			fields = append(fields, "mtime")
+		}
+		if owners && (ea.UID != eb.UID || ea.GID != eb.GID ||
+			ea.Uname != eb.Uname || ea.Gname != eb.Gname) {
+			fields = append(fields, "owner")
+		}
+		if comments && ea.Comment != eb.Comment {
+			fields = append(fields, "comment")
+		}
+		if ea.Size != eb.Size {
+			fields = append(fields, "size")
+		} else {
+			same, err := sameData(a, b, ea, eb)
+			if err != nil {
+				return nil, &EntryError{name, err}
+			}
+			if !same {
+				fields = append(fields, "data")
+			}
+		}
+		if fields != nil {
+			diffs = append(diffs, Difference{name, Changed, fields})
+		}
+	}
+	for name := range bEntries {
+		if _, ok := aEntries[name]; !ok {
+			diffs = append(diffs, Difference{Name: name, Kind: Added})
+		}
+	}
+
+	slices.SortFunc(diffs, func(x, y Difference) int {
+		return strings.Compare(x.Name, y.Name)
+	})
+	return diffs, nil
+}
+
+func firstEntries(br *Reader) map[string]*Entry {
+	entries := make(map[string]*Entry)
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if _, ok := entries[e.Name]; !ok {
+			entries[e.Name] = e
+		}
+	}
+	return entries
+}
+
+// sameData reports whether ea of a and eb of b have the same data.
+func sameData(a, b *Reader, ea, eb *Entry) (bool, error) {
+	if ea.hash != nil && eb.hash != nil {
+		return bytes.Equal(ea.hash, eb.hash), nil
+	}
+
+	// Encrypted data differs by nonce and compact entries have no
+	// checksum, so only plain stored data can be compared as it is. The
+	// checksums of entries of solid archives are those of their data.
+	plain := (a.flags|b.flags)&(FlagEncrypted|FlagCompact|FlagSolid) == 0
+	if plain && ea.adler == eb.adler && ea.sizeCompressed == eb.sizeCompressed {
+		return true, nil
+	}
+	if a.flags&b.flags&FlagSolid != 0 && (a.flags|b.flags)&FlagCompact == 0 &&
+		ea.adler != eb.adler {
+		return false, nil
+	}
+
+	ra, err := a.EntryReader(ea)
+	if err != nil {
+		return false, err
+	}
+	rb, err := b.EntryReader(eb)
+	if err != nil {
+		return false, err
+	}
+
+	same, err := sameReaders(ra, rb)
+	if err != nil {
+		return false, err
+	}
+	if err := ra.Close(); err != nil {
+		return false, err
+	}
+	if err := rb.Close(); err != nil {
+		return false, err
+	}
+	return same, nil
+}
+
+func sameReaders(ra, rb io.Reader) (bool, error) {
+	bufA := make([]byte, 32<<10)
+	bufB := make([]byte, 32<<10)
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		switch {
+		case errA != nil && !endA:
+			return false, errA
+		case errB != nil && !endB:
+			return false, errB
+		case endA || endB:
+			return endA == endB, nil
+		}
+	}
+}
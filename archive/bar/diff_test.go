@@ -0,0 +1,96 @@
+package bar
+
+import (
+	"compress/flate"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"b.txt", "bravo"},
+		{"data", string(benchData(50 << 10))},
+	}
+	changed := []testFile{
+		{"a.txt", "alpha"},
+		{"b.txt", "brave"},
+		{"data", string(benchData(50 << 10))},
+	}
+	tests := []struct {
+		name  string
+		b     []testFile
+		aOpts []WriterOption
+		bOpts []WriterOption
+		ropts []ReaderOption
+		want  []Difference
+	}{
+		{name: "same", b: files},
+		{
+			name: "data",
+			b:    changed,
+			want: []Difference{{"b.txt", Changed, []string{"data"}}},
+		},
+		{
+			name: "size",
+			b:    []testFile{files[0], {"b.txt", "bravo!"}, files[2]},
+			want: []Difference{{"b.txt", Changed, []string{"size"}}},
+		},
+		{
+			name: "added and removed",
+			b:    []testFile{files[0], files[2], {"c.txt", "charlie"}},
+			want: []Difference{
+				{Name: "b.txt", Kind: Removed},
+				{Name: "c.txt", Kind: Added},
+			},
+		},
+		{
+			name:  "other level",
+			b:     files,
+			aOpts: []WriterOption{WithCompressionLevel(flate.BestSpeed)},
+			bOpts: []WriterOption{WithCompressionLevel(flate.BestCompression)},
+		},
+		{
+			name:  "content index",
+			b:     changed,
+			aOpts: []WriterOption{WithContentIndex()},
+			bOpts: []WriterOption{WithContentIndex()},
+			want:  []Difference{{"b.txt", Changed, []string{"data"}}},
+		},
+		{
+			name:  "compact",
+			b:     changed,
+			aOpts: []WriterOption{WithCompact()},
+			bOpts: []WriterOption{WithCompact()},
+			want:  []Difference{{"b.txt", Changed, []string{"data"}}},
+		},
+		{
+			name:  "solid",
+			b:     changed,
+			aOpts: []WriterOption{WithSolid(1 << 10)},
+			bOpts: []WriterOption{WithSolid(1 << 10)},
+			want:  []Difference{{"b.txt", Changed, []string{"data"}}},
+		},
+		{
+			name:  "encrypted",
+			b:     files,
+			aOpts: []WriterOption{WithKey(testKey)},
+			bOpts: []WriterOption{WithKey(testKey)},
+			ropts: []ReaderOption{WithDecryptionKey(testKey)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := openArchive(t, writeArchive(t, files, tt.aOpts...), tt.ropts...)
+			b := openArchive(t, writeArchive(t, tt.b, tt.bOpts...), tt.ropts...)
+			got, err := Diff(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,615 @@
+package bar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	ErrDuplicatePath = errors.New("Another entry extracts to the same path.")
+	ErrSpecialBits   = errors.New("Restoring setuid or setgid bits.")
+	ErrLinkInPath    = errors.New("Path leads through a symbolic link.")
+)
+
+// parentPerm is used for directories created for the files extracted into
+// them. Stored directory permissions are applied after all files are
+// extracted.
+const parentPerm fs.FileMode = 0755
+
+// specialBits are the setuid, setgid and sticky bits.
+const specialBits = fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// chtimes and lchown restore metadata, tests replace them to make it fail.
+var (
+	chtimes = os.Chtimes
+	lchown  = os.Lchown
+)
+
+// OverwritePolicy decides what ExtractAll does about existing files.
+type OverwritePolicy int
+
+const (
+	FailExisting    OverwritePolicy = iota // extract nothing if a file exists
+	SkipExisting                           // keep existing files
+	ReplaceExisting                        // replace existing files
+	RenameExisting                         // extract to name.1, name.2 etc.
+)
+
+// ExtractOptions control ExtractAll.
+type ExtractOptions struct {
+	// Entries are extracted instead of all entries of the archive, if set.
+	Entries []Entry
+
+	// Route returns the directory an entry is extracted to instead of the
+	// directory passed to ExtractAll, or false if it is skipped.
+	Route func(e *Entry) (string, bool)
+
+	// Transform wraps the data of an entry before it is written.
+	Transform func(e *Entry, r io.Reader) io.Reader
+
+	// Overwrite decides what happens to existing files, by default nothing
+	// is extracted if one of them exists. Existing directories are only
+	// skipped or renamed, never replaced.
+	Overwrite OverwritePolicy
+
+	// Flatten extracts entries without their directories.
+	Flatten bool
+
+	// NoSpecialBits clears the setuid, setgid and sticky bits.
+	NoSpecialBits bool
+
+	// Xattrs restores the extended attributes of the entries.
+	Xattrs bool
+
+	// Owner restores the owner and group of the entries by their ids,
+	// which usually requires root. To restore them by name or to map ids,
+	// change the entries passed in Entries.
+	Owner bool
+
+	// FailOnMetadata stops the extraction if the permissions, modification
+	// time, owner or extended attributes of a file can't be restored,
+	// instead of reporting it to OnWarning.
+	FailOnMetadata bool
+
+	// OnWarning is called for problems that don't stop the extraction:
+	// existing files (matching fs.ErrExist, with Op "overwrite", "skip" or
+	// "rename" and the new path), restored setuid or setgid bits
+	// (ErrSpecialBits) and permissions, modification times, owners or
+	// extended attributes that couldn't be restored.
+	OnWarning func(err error)
+
+	// Buffer is used to copy the data of the entries, if set.
+	Buffer []byte
+
+	// Workers is the number of regular files extracted at once, if the
+	// archive is read from an io.ReaderAt, like an *os.File, and isn't
+	// solid. Each worker gets a buffer of the size of Buffer, and
+	// Transform may be called concurrently.
+	Workers int
+}
+
+// TargetPath returns the path e is extracted to by ExtractAll, or false if
+// it is skipped.
+func (opts *ExtractOptions) TargetPath(dir string, e *Entry) (string, bool) {
+	_, name, ok := opts.targetPath(dir, e)
+	return name, ok
+}
+
+// targetPath is TargetPath, which also returns the directory e is
+// extracted into.
+func (opts *ExtractOptions) targetPath(dir string, e *Entry) (root,
+	name string, ok bool) {
+	if opts.Route != nil {
+		dir, ok = opts.Route(e)
+		if !ok {
+			return "", "", false
+		}
+	}
+
+	if opts.Flatten && e.Type == TypeDir {
+		return "", "", false
+	}
+	if opts.Flatten {
+		return dir, filepath.Join(dir, path.Base(e.Name)), true
+	}
+	return dir, filepath.Join(dir, filepath.FromSlash(e.Name)), true
+}
+
+func (opts *ExtractOptions) warn(err error) {
+	if opts.OnWarning != nil {
+		opts.OnWarning(err)
+	}
+}
+
+// ExtractAll writes the entries of the archive to files below dir. All
+// target paths are checked before any file is written, names that aren't
+// local paths are rejected with ErrPathIsNotSimple, symbolic links
+// pointing outside of the directory they are extracted into with
+// ErrUnsafeLink, entries below symbolic links of the archive with
+// ErrLinkInPath and hard links to files that aren't among the entries with
+// ErrMissingLinkTarget. Directories are created first and links after all
+// files, then the metadata of directories is restored. Existing directories
+// are kept for directory entries regardless of Overwrite.
+//
+// Symbolic links are never followed below dir, or below the directories
+// returned by Route: extracting into a path that leads through one fails
+// with ErrLinkInPath, whether the link was extracted or existed before.
+//
+// Each file is written to a temporary file first, which replaces the target
+// once its checksum is verified. Entries with an invalid checksum are
+// skipped, they are returned joined at the end. Other errors stop the
+// extraction and are returned as *EntryError.
+func (br *Reader) ExtractAll(dir string, opts ExtractOptions) error {
+	entries := opts.Entries
+	if entries == nil {
+		entries = br.Entries
+	}
+
+	files := fileIndex(entries)
+	targets, roots, err := opts.targets(dir, entries, files)
+	if err != nil {
+		return err
+	}
+
+	var (
+		failed    []error
+		regular   []int
+		hardlinks []int
+		links     []int
+		dirs      []int
+	)
+	for i := range entries {
+		switch {
+		case targets[i] == "":
+		case entries[i].Type == TypeHardlink:
+			hardlinks = append(hardlinks, i)
+		case entries[i].Type == TypeSymlink:
+			links = append(links, i)
+		case entries[i].Type == TypeDir:
+			dirs = append(dirs, i)
+		default:
+			regular = append(regular, i)
+		}
+	}
+
+	// Directories are created before any link, which can't lead out of
+	// dir then.
+	for _, i := range dirs {
+		err := mkdirAll(roots[i], targets[i])
+		if err != nil {
+			return &EntryError{entries[i].Name, err}
+		}
+	}
+
+	errs := br.extractFiles(entries, regular, targets, roots, &opts)
+	for _, i := range regular {
+		switch err := errs[i]; {
+		case err == ErrInvalidChecksum:
+			failed = append(failed, &EntryError{entries[i].Name, err})
+		case err != nil:
+			return &EntryError{entries[i].Name, err}
+		}
+	}
+
+	// Hard links point to the files extracted before, or to the existing
+	// files kept instead.
+	for _, i := range hardlinks {
+		e := &entries[i]
+		j := files[e.Linkname]
+		old, ok := targets[j], targets[j] != ""
+		if !ok {
+			old, ok = opts.TargetPath(dir, &entries[j])
+		}
+		err := ErrMissingLinkTarget
+		if ok {
+			err = extractLink(roots[i], targets[i], func(tmp string) error {
+				return os.Link(old, tmp)
+			})
+		}
+		if err != nil {
+			return &EntryError{e.Name, err}
+		}
+	}
+
+	// Symbolic links are created after all files, so no file is written
+	// through a link of the archive.
+	for _, i := range links {
+		e := &entries[i]
+		err := extractLink(roots[i], targets[i], func(tmp string) error {
+			return os.Symlink(filepath.FromSlash(e.Linkname), tmp)
+		})
+		if err == nil {
+			err = restoreOwner(targets[i], e, &opts)
+		}
+		if err != nil {
+			return &EntryError{e.Name, err}
+		}
+	}
+
+	// Directories are finished last, so their permissions don't keep
+	// entries from being written into them and writing them doesn't change
+	// their modification times. Children come before their parents.
+	slices.SortFunc(dirs, func(a, b int) int {
+		return strings.Compare(targets[b], targets[a])
+	})
+	for _, i := range dirs {
+		err := extractDir(roots[i], targets[i], &entries[i], &opts)
+		if err != nil {
+			return &EntryError{entries[i].Name, err}
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// fileIndex returns the index of the first regular file entry with each
+// name, the targets of hard links.
+func fileIndex(entries []Entry) map[string]int {
+	files := make(map[string]int)
+	for i := range entries {
+		e := &entries[i]
+		if _, ok := files[e.Name]; !ok && e.Type == TypeFile {
+			files[e.Name] = i
+		}
+	}
+	return files
+}
+
+// targets returns the paths entries are extracted to, or "" for skipped
+// entries, and the directories they are extracted into. It reports unsafe
+// names, entries below symbolic links of the archive, hard links to files
+// that aren't extracted, entries extracting to the same path and existing
+// files.
+func (opts *ExtractOptions) targets(dir string, entries []Entry,
+	files map[string]int) (targets, roots []string, err error) {
+	targets = make([]string, len(entries))
+	roots = make([]string, len(entries))
+	paths := make([]string, len(entries))
+	names := make(map[string]bool)
+	links := make(map[string]bool)
+	for i := range entries {
+		e := &entries[i]
+		root, name, ok := opts.targetPath(dir, e)
+		if !ok {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(e.Name)) {
+			return nil, nil, &EntryError{e.Name, ErrPathIsNotSimple}
+		}
+		rel := e.Name
+		if opts.Flatten {
+			rel = path.Base(rel)
+		}
+		if e.Type == TypeSymlink && !localLink(rel, e.Linkname) {
+			return nil, nil, &EntryError{e.Name, ErrUnsafeLink}
+		}
+		if _, ok := files[e.Linkname]; e.Type == TypeHardlink && !ok {
+			return nil, nil, &EntryError{e.Name, ErrMissingLinkTarget}
+		}
+
+		if names[name] {
+			return nil, nil, &EntryError{e.Name, &fs.PathError{Op: "extract",
+				Path: name, Err: ErrDuplicatePath}}
+		}
+		names[name] = true
+		paths[i], roots[i] = name, filepath.Clean(root)
+		if e.Type == TypeSymlink {
+			links[name] = true
+		}
+
+		s, err := os.Lstat(name)
+		switch {
+		case err != nil:
+		case e.Type == TypeDir && s.IsDir():
+		case opts.Overwrite == SkipExisting:
+			opts.warn(&fs.PathError{Op: "skip", Path: name, Err: fs.ErrExist})
+			continue
+		case opts.Overwrite == RenameExisting:
+			name = renamed(name, names)
+			names[name] = true
+			opts.warn(&fs.PathError{Op: "rename", Path: name, Err: fs.ErrExist})
+		case opts.Overwrite != ReplaceExisting:
+			return nil, nil, &EntryError{e.Name, &fs.PathError{Op: "extract",
+				Path: name, Err: fs.ErrExist}}
+		case s.IsDir():
+			return nil, nil, &EntryError{e.Name, &fs.PathError{Op: "extract",
+				Path: name, Err: ErrIsDir}}
+		default:
+			opts.warn(&fs.PathError{Op: "overwrite", Path: name,
+				Err: fs.ErrExist})
+		}
+		targets[i] = name
+		if e.Type == TypeSymlink {
+			links[name] = true
+		}
+	}
+
+	// Nothing is extracted through a symbolic link of the archive, wherever
+	// it points to.
+	for i, name := range paths {
+		if name == "" {
+			continue
+		}
+		for p := filepath.Dir(name); p != roots[i]; p = filepath.Dir(p) {
+			if links[p] {
+				return nil, nil, &EntryError{entries[i].Name,
+					&fs.PathError{Op: "extract", Path: p, Err: ErrLinkInPath}}
+			}
+			if p == filepath.Dir(p) {
+				break
+			}
+		}
+	}
+	return targets, roots, nil
+}
+
+// renamed returns name with the first numeric suffix that neither exists
+// nor is taken by another entry.
+func renamed(name string, taken map[string]bool) string {
+	for n := 1; ; n++ {
+		alt := fmt.Sprintf("%s.%d", name, n)
+		_, err := os.Lstat(alt)
+		if errors.Is(err, fs.ErrNotExist) && !taken[alt] {
+			return alt
+		}
+	}
+}
+
+// extractFiles extracts the regular files of entries at the indexes
+// regular with opts.Workers goroutines, and returns the errors by index. It
+// stops at the first error other than ErrInvalidChecksum.
+func (br *Reader) extractFiles(entries []Entry, regular []int, targets,
+	roots []string, opts *ExtractOptions) []error {
+	workers := 1
+	if br.ra != nil && br.flags&FlagSolid == 0 && opts.Workers > 1 {
+		workers = opts.Workers
+	}
+	if workers > 1 && opts.OnWarning != nil {
+		var mu sync.Mutex
+		o := *opts
+		o.OnWarning = func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			opts.OnWarning(err)
+		}
+		opts = &o
+	}
+
+	var (
+		errs = make([]error, len(entries))
+		stop atomic.Bool
+		wg   sync.WaitGroup
+		jobs = make(chan int)
+	)
+	for w := 0; w < workers; w++ {
+		o := opts
+		if w > 0 && opts.Buffer != nil {
+			c := *opts
+			c.Buffer = make([]byte, len(opts.Buffer))
+			o = &c
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if stop.Load() {
+					continue
+				}
+				err := br.extractFile(roots[i], targets[i], &entries[i], o)
+				if err != nil && err != ErrInvalidChecksum {
+					stop.Store(true)
+				}
+				errs[i] = err
+			}
+		}()
+	}
+	for _, i := range regular {
+		if stop.Load() {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+func (br *Reader) extractFile(root, name string, e *Entry,
+	opts *ExtractOptions) error {
+	er, err := br.EntryReader(e)
+	if err != nil {
+		return err
+	}
+
+	err = mkdirAll(root, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = er
+	if opts.Transform != nil {
+		r = opts.Transform(e, r)
+	}
+	err = writeFile(name, e, r, er, opts)
+	if err != nil {
+		return err
+	}
+
+	// Failures leave the file content in place.
+	return restoreMetadata(name, e, opts)
+}
+
+// extractDir restores the metadata of the directory e, after checking
+// that neither it nor its parents were replaced by a symbolic link.
+func extractDir(root, name string, e *Entry, opts *ExtractOptions) error {
+	err := mkdirAll(root, name)
+	if err != nil {
+		return err
+	}
+
+	if opts.Xattrs && e.Xattrs != nil {
+		err = setXattrs(name, e.Xattrs)
+		if err != nil && opts.FailOnMetadata {
+			return err
+		}
+		if err != nil {
+			opts.warn(err)
+		}
+	}
+	return restoreMetadata(name, e, opts)
+}
+
+// mkdirAll creates the directory name below root and its parents like
+// os.MkdirAll, but fails with ErrLinkInPath instead of following a
+// symbolic link below root.
+func mkdirAll(root, name string) error {
+	err := os.MkdirAll(root, parentPerm)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == "." {
+		return err
+	}
+
+	p := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		s, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = os.Mkdir(p, parentPerm)
+			if err == nil {
+				continue
+			}
+			// Created meanwhile, or the error of Mkdir is returned.
+			s, err = os.Lstat(p)
+		}
+		switch {
+		case err != nil:
+			return err
+		case s.Mode()&fs.ModeSymlink != 0:
+			return &fs.PathError{Op: "mkdir", Path: p, Err: ErrLinkInPath}
+		case !s.IsDir():
+			return &fs.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+		}
+	}
+	return nil
+}
+
+// restoreMetadata sets the owner, permissions and modification time of the
+// file or directory name. Failures are reported to OnWarning, unless
+// FailOnMetadata is set.
+func restoreMetadata(name string, e *Entry, opts *ExtractOptions) error {
+	// Changing the owner clears the setuid and setgid bits, so it comes
+	// first.
+	err := restoreOwner(name, e, opts)
+	if err != nil {
+		return err
+	}
+
+	mode := e.Mode() &^ fs.ModeType
+	if opts.NoSpecialBits {
+		mode &^= specialBits
+	}
+	if mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 {
+		opts.warn(&fs.PathError{Op: "chmod", Path: name, Err: ErrSpecialBits})
+	}
+	err = os.Chmod(name, mode)
+	if err == nil && !e.ModTime.IsZero() {
+		err = chtimes(name, e.ModTime, e.ModTime)
+	}
+	if err != nil && opts.FailOnMetadata {
+		return err
+	}
+	if err != nil {
+		opts.warn(err)
+	}
+	return nil
+}
+
+// extractLink creates a link with create at a temporary name next to name,
+// which then replaces name. Permissions and modification times of
+// symbolic links aren't restored, hard links share those of their target.
+func extractLink(root, name string, create func(tmp string) error) error {
+	err := mkdirAll(root, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	// The temporary file only reserves a name for the link.
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".bar-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	err = os.Remove(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	// Renaming a hard link onto another link of the same file leaves it in
+	// place.
+	err = create(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	return os.Rename(tmp.Name(), name)
+}
+
+// writeFile writes the data read from r to a temporary file next to name,
+// which replaces name once closing er verified the checksum. Files with
+// invalid data never appear at name.
+func writeFile(name string, e *Entry, r io.Reader, er io.Closer,
+	opts *ExtractOptions) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".bar-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Set before the permissions, which may not allow writing them.
+	if opts.Xattrs && e.Xattrs != nil {
+		err = setXattrs(tmp.Name(), e.Xattrs)
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			pe.Path = name
+		}
+		if err != nil && !opts.FailOnMetadata {
+			opts.warn(err)
+			err = nil
+		}
+	}
+
+	buf := opts.Buffer
+	if err == nil {
+		err = tmp.Chmod(e.Mode().Perm())
+	}
+	if err == nil && buf != nil {
+		// Hide ReadFrom and WriteTo, they would ignore the buffer.
+		_, err = io.CopyBuffer(struct{ io.Writer }{tmp},
+			struct{ io.Reader }{r}, buf)
+	} else if err == nil {
+		_, err = io.Copy(tmp, r)
+	}
+	if err == nil {
+		err = er.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,1014 @@
+package bar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testEntry is an entry written by writeEntries. data is the target of
+// links.
+type testEntry struct {
+	name string
+	typ  EntryType
+	data string
+}
+
+// writeEntries writes an archive with entry types holding entries.
+func writeEntries(t *testing.T, entries []testEntry) *Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithEntryTypes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		switch e.typ {
+		case TypeSymlink:
+			err = bw.CreateSymlink(e.name, e.data)
+		case TypeHardlink:
+			err = bw.CreateHardlink(e.name, e.data)
+		case TypeDir:
+			err = bw.CreateDir(e.name)
+		default:
+			err = bw.Create(e.name)
+			if err == nil {
+				_, err = bw.Write([]byte(e.data))
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openArchive(t, buf.Bytes())
+}
+
+func TestExtractAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		want    map[string]string // path: data, "dir" or "-> target"
+	}{
+		{
+			name: "files",
+			entries: []testEntry{
+				{"a.txt", TypeFile, "alpha"},
+				{"dir/b.txt", TypeFile, "beta"},
+			},
+			want: map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"},
+		},
+		{
+			name: "links",
+			entries: []testEntry{
+				{"dir", TypeDir, ""},
+				{"dir/a.txt", TypeFile, "alpha"},
+				{"dir/hard.txt", TypeHardlink, "dir/a.txt"},
+				{"dir/sym.txt", TypeSymlink, "a.txt"},
+				{"up", TypeSymlink, "dir"},
+			},
+			want: map[string]string{
+				"dir":          "dir",
+				"dir/a.txt":    "alpha",
+				"dir/hard.txt": "alpha",
+				"dir/sym.txt":  "-> a.txt",
+				"up":           "-> dir",
+			},
+		},
+		{
+			name: "empty dir",
+			entries: []testEntry{
+				{"empty", TypeDir, ""},
+				{"empty/sub", TypeDir, ""},
+			},
+			want: map[string]string{"empty": "dir", "empty/sub": "dir"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := writeEntries(t, tt.entries).ExtractAll(dir, ExtractOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				checkPath(t, filepath.Join(dir, name), want)
+			}
+		})
+	}
+}
+
+// checkPath fails unless name is a file holding want, a directory if want
+// is "dir" or a symbolic link to target if want is "-> target".
+func checkPath(t *testing.T, name, want string) {
+	t.Helper()
+
+	s, err := os.Lstat(name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	switch {
+	case want == "dir":
+		if !s.IsDir() {
+			t.Errorf("%s: not a directory", name)
+		}
+	case len(want) > 3 && want[:3] == "-> ":
+		target, err := os.Readlink(name)
+		if err != nil || target != want[3:] {
+			t.Errorf("%s: link to %q, %v, want %q", name, target, err, want[3:])
+		}
+	default:
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestExtractAllUnsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		want    error
+	}{
+		{
+			name:    "absolute link",
+			entries: []testEntry{{"abs", TypeSymlink, "/etc"}},
+			want:    ErrUnsafeLink,
+		},
+		{
+			name:    "link out",
+			entries: []testEntry{{"dir/up", TypeSymlink, "../.."}},
+			want:    ErrUnsafeLink,
+		},
+		{
+			name: "file through link",
+			entries: []testEntry{
+				{"a", TypeSymlink, "."},
+				{"a/b.txt", TypeFile, "beta"},
+			},
+			want: ErrLinkInPath,
+		},
+		{
+			// Each link points into the directory on its own, but the
+			// second one is created through the first.
+			name: "chained links",
+			entries: []testEntry{
+				{"a", TypeDir, ""},
+				{"a/up", TypeSymlink, ".."},
+				{"a/up/esc", TypeSymlink, "../.."},
+				{"a/up/esc/pwned", TypeDir, ""},
+			},
+			want: ErrLinkInPath,
+		},
+		{
+			name: "dir after link",
+			entries: []testEntry{
+				{"a", TypeSymlink, "b"},
+				{"b", TypeDir, ""},
+				{"a/c", TypeDir, ""},
+			},
+			want: ErrLinkInPath,
+		},
+		{
+			name: "hard link to missing file",
+			entries: []testEntry{
+				{"a.txt", TypeFile, "alpha"},
+				{"b.txt", TypeHardlink, "a.txt"},
+			},
+			want: ErrMissingLinkTarget,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := writeEntries(t, tt.entries)
+			opts := ExtractOptions{}
+			if tt.want == ErrMissingLinkTarget {
+				opts.Entries = br.Entries[1:]
+			}
+
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "target")
+			err := br.ExtractAll(dir, opts)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+
+			// Nothing is written before the paths are checked.
+			ents, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 0 {
+				t.Errorf("extracted %s", ents[0].Name())
+			}
+		})
+	}
+}
+
+func TestExtractAllExistingLink(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+	}{
+		{"file", []testEntry{{"a/b/c.txt", TypeFile, "gamma"}}},
+		{"dir", []testEntry{{"a/b", TypeDir, ""}}},
+		{"symlink", []testEntry{{"a/b", TypeSymlink, "."}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outside := t.TempDir()
+			dir := t.TempDir()
+			err := os.Symlink(outside, filepath.Join(dir, "a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = writeEntries(t, tt.entries).ExtractAll(dir, ExtractOptions{})
+			if !errors.Is(err, ErrLinkInPath) {
+				t.Fatalf("got %v, want %v", err, ErrLinkInPath)
+			}
+			var pe *fs.PathError
+			if !errors.As(err, &pe) || pe.Path != filepath.Join(dir, "a") {
+				t.Errorf("got %v, want the path of the link", err)
+			}
+
+			ents, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 0 {
+				t.Errorf("extracted %s through the link", ents[0].Name())
+			}
+		})
+	}
+}
+
+func TestExtractAllRoute(t *testing.T) {
+	br := writeEntries(t, []testEntry{
+		{"etc/app.conf", TypeFile, "config"},
+		{"var/data.db", TypeFile, "data"},
+		{"tmp/skipped", TypeFile, "skipped"},
+	})
+
+	etc, data := t.TempDir(), t.TempDir()
+	err := br.ExtractAll("", ExtractOptions{
+		Route: func(e *Entry) (string, bool) {
+			switch {
+			case strings.HasPrefix(e.Name, "etc/"):
+				return etc, true
+			case strings.HasPrefix(e.Name, "var/"):
+				return data, true
+			}
+			return "", false
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPath(t, filepath.Join(etc, "etc/app.conf"), "config")
+	checkPath(t, filepath.Join(data, "var/data.db"), "data")
+	for _, dir := range []string{etc, data} {
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ents) != 1 {
+			t.Errorf("%s holds %d files, want 1", dir, len(ents))
+		}
+	}
+}
+
+func TestExtractAllDirPerms(t *testing.T) {
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithEntryTypes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.CreateDir("private")
+	if err == nil {
+		err = bw.SetPerms(0700)
+	}
+	if err == nil {
+		err = bw.CreateDir("private/empty")
+	}
+	if err == nil {
+		err = bw.SetPerms(0750)
+	}
+	if err == nil {
+		err = bw.Create("implicit/a.txt")
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = openArchive(t, buf.Bytes()).ExtractAll(dir, ExtractOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]fs.FileMode{
+		"private":       0700,
+		"private/empty": 0750,
+		"implicit":      parentPerm,
+	} {
+		s, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.IsDir() || s.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, want %v", name, s.Mode(), fs.ModeDir|want)
+		}
+	}
+}
+
+func TestExtractAllWorkers(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 32; i++ {
+		files = append(files, testFile{fmt.Sprintf("dir%d/f%d", i%4, i),
+			string(benchData(1000 + i))})
+	}
+	b := writeArchive(t, files, WithMethod(MethodStored))
+
+	// The data of the second file doesn't match its checksum.
+	br := openArchive(t, b)
+	b[br.Entries[1].index] ^= 1
+
+	var warnings int
+	dir := t.TempDir()
+	err := openFile(t, b).ExtractAll(dir, ExtractOptions{
+		Workers:   4,
+		Buffer:    make([]byte, 512),
+		OnWarning: func(error) { warnings++ },
+	})
+	var ee *EntryError
+	if !errors.As(err, &ee) || ee.Name != files[1].name ||
+		ee.Err != ErrInvalidChecksum {
+		t.Fatalf("got %v, want %v for %s", err, ErrInvalidChecksum,
+			files[1].name)
+	}
+	for i, f := range files {
+		_, err := os.Lstat(filepath.Join(dir, f.name))
+		if i == 1 {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: extracted with invalid data", f.name)
+			}
+			continue
+		}
+		checkPath(t, filepath.Join(dir, f.name), f.data)
+	}
+	if warnings != 0 {
+		t.Errorf("%d warnings", warnings)
+	}
+}
+
+func TestExtractAllMetadataFailure(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithEntryTypes(), WithOwner(),
+		WithFixedModTime(mtime))
+	if err == nil {
+		err = bw.CreateDir("dir")
+	}
+	if err == nil {
+		err = bw.SetOwner(os.Getuid(), os.Getgid(), "", "")
+	}
+	if err == nil {
+		err = bw.Create("dir/a.txt")
+	}
+	if err == nil {
+		err = bw.SetOwner(os.Getuid(), os.Getgid(), "", "")
+	}
+	if err == nil {
+		_, err = bw.Write([]byte("alpha"))
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := openArchive(t, buf.Bytes())
+
+	errChtimes := errors.New("chtimes failed")
+	errLchown := errors.New("lchown failed")
+	failChtimes := func(string, time.Time, time.Time) error { return errChtimes }
+	failLchown := func(string, int, int) error { return errLchown }
+	defer func() {
+		chtimes, lchown = os.Chtimes, os.Lchown
+	}()
+
+	tests := []struct {
+		name     string
+		chtimes  bool // chtimes fails
+		lchown   bool // lchown fails
+		fail     bool // FailOnMetadata
+		want     error
+		warnings int
+	}{
+		{"none", false, false, false, nil, 0},
+		{"chtimes", true, false, false, nil, 2},
+		{"lchown", false, true, false, nil, 2},
+		{"both", true, true, false, nil, 4},
+		{"chtimes strict", true, false, true, errChtimes, 0},
+		{"lchown strict", false, true, true, errLchown, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chtimes, lchown = os.Chtimes, os.Lchown
+			if tt.chtimes {
+				chtimes = failChtimes
+			}
+			if tt.lchown {
+				lchown = failLchown
+			}
+
+			var warnings []error
+			dir := t.TempDir()
+			err := br.ExtractAll(dir, ExtractOptions{
+				Owner:          true,
+				FailOnMetadata: tt.fail,
+				OnWarning:      func(err error) { warnings = append(warnings, err) },
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("got warnings %v, want %d", warnings, tt.warnings)
+			}
+
+			// The content is extracted even when its metadata fails, the
+			// modification time is set after the owner.
+			checkPath(t, filepath.Join(dir, "dir/a.txt"), "alpha")
+			restored := !tt.chtimes && !tt.fail
+			s, err := os.Stat(filepath.Join(dir, "dir/a.txt"))
+			if err == nil && s.ModTime().Equal(mtime) != restored {
+				t.Errorf("modification time %v", s.ModTime())
+			}
+		})
+	}
+}
+
+// upperReader returns the bytes of r in upper case.
+type upperReader struct {
+	r io.Reader
+}
+
+func (u upperReader) Read(b []byte) (int, error) {
+	n, err := u.r.Read(b)
+	copy(b, bytes.ToUpper(b[:n]))
+	return n, err
+}
+
+func TestExtractAllTransform(t *testing.T) {
+	br := writeEntries(t, []testEntry{
+		{"a.txt", TypeFile, "alpha"},
+		{"dir/b.txt", TypeFile, "beta Beta"},
+		{"c.bin", TypeFile, "gamma"},
+		{"link", TypeSymlink, "a.txt"},
+	})
+	upperText := func(e *Entry, r io.Reader) io.Reader {
+		if strings.HasSuffix(e.Name, ".txt") {
+			return upperReader{r}
+		}
+		return r
+	}
+
+	tests := []struct {
+		name      string
+		transform func(e *Entry, r io.Reader) io.Reader
+		workers   int
+		want      map[string]string
+	}{
+		{"none", nil, 1, map[string]string{
+			"a.txt": "alpha", "dir/b.txt": "beta Beta", "c.bin": "gamma",
+			"link": "-> a.txt",
+		}},
+		{"upper", upperText, 1, map[string]string{
+			"a.txt": "ALPHA", "dir/b.txt": "BETA BETA", "c.bin": "gamma",
+			"link": "-> a.txt",
+		}},
+		{"upper workers", upperText, 4, map[string]string{
+			"a.txt": "ALPHA", "dir/b.txt": "BETA BETA", "c.bin": "gamma",
+			"link": "-> a.txt",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := br.ExtractAll(dir, ExtractOptions{Transform: tt.transform,
+				Workers: tt.workers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				checkPath(t, filepath.Join(dir, name), want)
+			}
+		})
+	}
+}
+
+func TestExtractAllFlatten(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		want    map[string]string
+		err     error
+	}{
+		{
+			name: "flatten",
+			entries: []testEntry{
+				{"a", TypeDir, ""},
+				{"a/x.txt", TypeFile, "ax"},
+				{"b/c/y.txt", TypeFile, "bcy"},
+				{"z.txt", TypeFile, "z"},
+			},
+			want: map[string]string{"x.txt": "ax", "y.txt": "bcy", "z.txt": "z"},
+		},
+		{
+			name: "collision",
+			entries: []testEntry{
+				{"a/x.txt", TypeFile, "ax"},
+				{"b/x.txt", TypeFile, "bx"},
+				{"c.txt", TypeFile, "c"},
+			},
+			err: ErrDuplicatePath,
+		},
+		{
+			name: "collision with top level",
+			entries: []testEntry{
+				{"x.txt", TypeFile, "x"},
+				{"b/x.txt", TypeFile, "bx"},
+			},
+			err: ErrDuplicatePath,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := writeEntries(t, tt.entries).ExtractAll(dir,
+				ExtractOptions{Flatten: true})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			for name, want := range tt.want {
+				checkPath(t, filepath.Join(dir, name), want)
+			}
+
+			// Nothing is extracted if names collide, and no directories.
+			names, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != len(tt.want) {
+				t.Errorf("extracted %d files, want %d", len(names), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSpecialBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no setuid, setgid or sticky bits on", runtime.GOOS)
+	}
+
+	tests := []struct {
+		perm    uint16
+		noBits  bool // NoSpecialBits
+		want    fs.FileMode
+		warning bool
+	}{
+		{0755, false, 0755, false},
+		{04755, false, 0755 | fs.ModeSetuid, true},
+		{02755, false, 0755 | fs.ModeSetgid, true},
+		{01755, false, 0755 | fs.ModeSticky, false},
+		{07755, false, 0755 | specialBits, true},
+		{04755, true, 0755, false},
+		{07755, true, 0755, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%o %v", tt.perm, tt.noBits), func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf)
+			if err == nil {
+				err = bw.Create("a.sh")
+			}
+			if err == nil {
+				err = bw.SetPerms(tt.perm)
+			}
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes())
+			var warnings []error
+			dir := t.TempDir()
+			err = br.ExtractAll(dir, ExtractOptions{
+				NoSpecialBits: tt.noBits,
+				OnWarning:     func(err error) { warnings = append(warnings, err) },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := os.Stat(filepath.Join(dir, "a.sh"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Mode() &^ fs.ModeType; got != tt.want {
+				t.Errorf("mode %v, want %v", got, tt.want)
+			}
+			warned := len(warnings) == 1 && errors.Is(warnings[0], ErrSpecialBits)
+			if warned != tt.warning || len(warnings) > 1 {
+				t.Errorf("warnings %v", warnings)
+			}
+		})
+	}
+}
+
+func TestExtractInvalidChecksum(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"dir/b.txt", "bravo"},
+		{"data", string(benchData(50 << 10))},
+	}
+	tests := []struct {
+		name     string
+		corrupt  string
+		existing string // data at the target before extracting
+		policy   OverwritePolicy
+	}{
+		{"new file", "a.txt", "", FailExisting},
+		{"nested", "dir/b.txt", "", FailExisting},
+		{"large", "data", "", FailExisting},
+		{"replaced", "a.txt", "old", ReplaceExisting},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := openArchive(t, writeArchive(t, files))
+			e, err := br.Lookup(tt.corrupt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.adler ^= 1
+
+			dir := t.TempDir()
+			target := filepath.Join(dir, filepath.FromSlash(tt.corrupt))
+			if tt.existing != "" {
+				err := os.WriteFile(target, []byte(tt.existing), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = br.ExtractAll(dir, ExtractOptions{Overwrite: tt.policy})
+			var ee *EntryError
+			if !errors.Is(err, ErrInvalidChecksum) || !errors.As(err, &ee) ||
+				ee.Name != tt.corrupt {
+				t.Fatalf("got %v, want %v for %s", err, ErrInvalidChecksum,
+					tt.corrupt)
+			}
+
+			// The file isn't replaced by the corrupt data, and no temporary
+			// file is left.
+			got, err := os.ReadFile(target)
+			switch {
+			case tt.existing == "" && !errors.Is(err, fs.ErrNotExist):
+				t.Errorf("%s: got %d bytes, %v", tt.corrupt, len(got), err)
+			case tt.existing != "" && string(got) != tt.existing:
+				t.Errorf("%s: got %q, %v, want %q", tt.corrupt, got, err,
+					tt.existing)
+			}
+			var n int
+			filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					n++
+				}
+				return err
+			})
+			want := len(files) - 1
+			if tt.existing != "" {
+				want++
+			}
+			if n != want {
+				t.Errorf("got %d files, want %d", n, want)
+			}
+			for _, f := range files {
+				if f.name != tt.corrupt {
+					checkPath(t, filepath.Join(dir, f.name), f.data)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractAllOptions(t *testing.T) {
+	entries := []testEntry{
+		{"a.txt", TypeFile, "alpha"},
+		{"dir", TypeDir, ""},
+		{"dir/b.txt", TypeFile, "bravo"},
+		{"dir/sub/c.txt", TypeFile, "charlie"},
+	}
+	tests := []struct {
+		name   string
+		opts   func(br *Reader, dir string) ExtractOptions
+		want   map[string]string // path: data or "dir"
+		absent []string
+	}{
+		{
+			name: "entries",
+			opts: func(br *Reader, dir string) ExtractOptions {
+				e, err := br.Lookup("dir/b.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ExtractOptions{Entries: []Entry{*e}}
+			},
+			want:   map[string]string{"dir/b.txt": "bravo"},
+			absent: []string{"a.txt", "dir/sub"},
+		},
+		{
+			name: "route",
+			opts: func(br *Reader, dir string) ExtractOptions {
+				return ExtractOptions{Route: func(e *Entry) (string, bool) {
+					return dir, e.Name != "a.txt"
+				}}
+			},
+			want: map[string]string{
+				"dir":           "dir",
+				"dir/b.txt":     "bravo",
+				"dir/sub/c.txt": "charlie",
+			},
+			absent: []string{"a.txt"},
+		},
+		{
+			name: "flatten",
+			opts: func(br *Reader, dir string) ExtractOptions {
+				return ExtractOptions{Flatten: true}
+			},
+			want: map[string]string{
+				"a.txt": "alpha",
+				"b.txt": "bravo",
+				"c.txt": "charlie",
+			},
+			absent: []string{"dir"},
+		},
+		{
+			name: "transform and workers",
+			opts: func(br *Reader, dir string) ExtractOptions {
+				return ExtractOptions{
+					Workers: 4,
+					Transform: func(e *Entry, r io.Reader) io.Reader {
+						return io.MultiReader(strings.NewReader(e.Name+":"), r)
+					},
+				}
+			},
+			want: map[string]string{
+				"a.txt":         "a.txt:alpha",
+				"dir/b.txt":     "dir/b.txt:bravo",
+				"dir/sub/c.txt": "dir/sub/c.txt:charlie",
+			},
+		},
+		{
+			name: "replace",
+			opts: func(br *Reader, dir string) ExtractOptions {
+				return ExtractOptions{Overwrite: ReplaceExisting}
+			},
+			want: map[string]string{
+				"a.txt":         "alpha",
+				"dir/b.txt":     "bravo",
+				"dir/sub/c.txt": "charlie",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := writeEntries(t, entries)
+			dir := t.TempDir()
+			if tt.opts(br, dir).Overwrite == ReplaceExisting {
+				err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := br.ExtractAll(dir, tt.opts(br, dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				checkPath(t, filepath.Join(dir, filepath.FromSlash(name)), want)
+			}
+			for _, name := range tt.absent {
+				_, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name)))
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s: got %v, want %v", name, err, fs.ErrNotExist)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractAllOverwrite(t *testing.T) {
+	entries := []testEntry{
+		{"a.txt", TypeFile, "alpha"},
+		{"b.txt", TypeFile, "bravo"},
+	}
+	tests := []struct {
+		name     string
+		policy   OverwritePolicy
+		existing map[string]string // path: data before extracting
+		want     map[string]string // path: data after extracting
+		err      error
+		op       string // of the warning for a.txt
+	}{
+		{
+			name:     "fail",
+			policy:   FailExisting,
+			existing: map[string]string{"a.txt": "old"},
+			want:     map[string]string{"a.txt": "old"},
+			err:      fs.ErrExist,
+		},
+		{
+			name:     "skip",
+			policy:   SkipExisting,
+			existing: map[string]string{"a.txt": "old"},
+			want:     map[string]string{"a.txt": "old", "b.txt": "bravo"},
+			op:       "skip",
+		},
+		{
+			name:     "replace",
+			policy:   ReplaceExisting,
+			existing: map[string]string{"a.txt": "old"},
+			want:     map[string]string{"a.txt": "alpha", "b.txt": "bravo"},
+			op:       "overwrite",
+		},
+		{
+			name:     "rename",
+			policy:   RenameExisting,
+			existing: map[string]string{"a.txt": "old"},
+			want: map[string]string{
+				"a.txt":   "old",
+				"a.txt.1": "alpha",
+				"b.txt":   "bravo",
+			},
+			op: "rename",
+		},
+		{
+			name:     "rename taken",
+			policy:   RenameExisting,
+			existing: map[string]string{"a.txt": "old", "a.txt.1": "older"},
+			want: map[string]string{
+				"a.txt":   "old",
+				"a.txt.1": "older",
+				"a.txt.2": "alpha",
+				"b.txt":   "bravo",
+			},
+			op: "rename",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.existing {
+				err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var warnings []error
+			err := writeEntries(t, entries).ExtractAll(dir, ExtractOptions{
+				Overwrite: tt.policy,
+				OnWarning: func(err error) { warnings = append(warnings, err) },
+			})
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			got := make(map[string]string)
+			des, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, de := range des {
+				data, err := os.ReadFile(filepath.Join(dir, de.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[de.Name()] = string(data)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			var ops []string
+			for _, w := range warnings {
+				var pe *fs.PathError
+				if errors.As(w, &pe) && errors.Is(w, fs.ErrExist) {
+					ops = append(ops, pe.Op)
+				}
+			}
+			if want := []string{tt.op}; tt.op != "" &&
+				fmt.Sprint(ops) != fmt.Sprint(want) {
+				t.Errorf("warnings %v, want %v", ops, want)
+			}
+		})
+	}
+
+	// Existing directories aren't replaced by files.
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "a.txt"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeEntries(t, entries).ExtractAll(dir,
+		ExtractOptions{Overwrite: ReplaceExisting})
+	if !errors.Is(err, ErrIsDir) {
+		t.Errorf("directory: got %v, want %v", err, ErrIsDir)
+	}
+}
+
+// countingReader counts the bytes read from r into n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestExtractAllProgress(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []testFile
+	}{
+		{"none", nil},
+		{"empty", []testFile{{"empty", ""}}},
+		{"files", []testFile{
+			{"a.txt", "alpha"},
+			{"dir/b.txt", "bravo"},
+			{"data", string(benchData(100 << 10))},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := openArchive(t, writeArchive(t, tt.files))
+			var size int
+			for _, f := range tt.files {
+				size += len(f.data)
+			}
+			if br.TotalSize() != uint64(size) {
+				t.Errorf("total %d, want %d", br.TotalSize(), size)
+			}
+
+			var done atomic.Int64
+			err := br.ExtractAll(t.TempDir(), ExtractOptions{
+				Workers: 2,
+				Transform: func(e *Entry, r io.Reader) io.Reader {
+					return countingReader{r, &done}
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done.Load() != int64(br.TotalSize()) {
+				t.Errorf("read %d bytes, want %d", done.Load(), br.TotalSize())
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Open opens the named entry or directory, which makes Reader a fs.FS.
+// Directories are synthesized from the entry names, with the metadata of
+// their directory entries if the archive has them. With WithCaseFold,
+// entries are matched like in Lookup.
+func (br *Reader) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	e, err := br.Lookup(name)
+	switch {
+	case err == nil && e.Type == TypeHardlink:
+		c, err := br.linkAs(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &file{br: br, e: c}, nil
+	case err == nil && e.Type != TypeDir:
+		return &file{br: br, e: e}, nil
+	case err != nil && err != ErrEntryNotFound:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	entries, ok := br.dirs()[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &dir{name: name, e: e, entries: entries}, nil
+}
+
+// Stat returns a fs.FileInfo describing the named entry or directory.
+func (br *Reader) Stat(name string) (fs.FileInfo, error) {
+	f, err := br.Open(name)
+	if err != nil {
+		err.(*fs.PathError).Op = "stat"
+		return nil, err
+	}
+	return f.Stat()
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func (br *Reader) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, ok := br.dirs()[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(entries), nil
+}
+
+// dirs returns the contents of each directory of the archive, built on
+// first use. Entries with names that aren't valid fs paths are left out.
+func (br *Reader) dirs() map[string][]fs.DirEntry {
+	if br.dirIndex != nil {
+		return br.dirIndex
+	}
+
+	// Directories with an entry are listed with its metadata.
+	stored := make(map[string]*Entry)
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if _, ok := stored[e.Name]; !ok && e.Type == TypeDir {
+			stored[e.Name] = e
+		}
+	}
+
+	br.dirIndex = map[string][]fs.DirEntry{".": nil}
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if !fs.ValidPath(e.Name) || e.Name == "." {
+			continue
+		}
+
+		// A directory already seen as the parent of an entry is listed.
+		if e.Type == TypeDir {
+			if _, seen := br.dirIndex[e.Name]; seen {
+				continue
+			}
+			br.dirIndex[e.Name] = nil
+		}
+
+		// Hard links are listed like Open returns them.
+		if e.Type == TypeHardlink {
+			if c, err := br.linkAs(e); err == nil {
+				e = c
+			}
+		}
+
+		var de fs.DirEntry = fs.FileInfoToDirEntry(entryInfo{e})
+		name := e.Name
+		for {
+			parent := path.Dir(name)
+			_, seen := br.dirIndex[parent]
+			br.dirIndex[parent] = append(br.dirIndex[parent], de)
+			if seen || parent == "." {
+				break
+			}
+			if d, ok := stored[parent]; ok {
+				de = fs.FileInfoToDirEntry(entryInfo{d})
+			} else {
+				de = fs.FileInfoToDirEntry(dirInfo(path.Base(parent)))
+			}
+			name = parent
+		}
+	}
+
+	for _, entries := range br.dirIndex {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+	return br.dirIndex
+}
+
+// linkAs returns the target of the hard link e under the name of e, which
+// is how Open and ReadDir present hard links.
+func (br *Reader) linkAs(e *Entry) (*Entry, error) {
+	t, err := br.linkTarget(e)
+	if err != nil {
+		return nil, err
+	}
+	c := *t
+	c.Name = e.Name
+	return &c, nil
+}
+
+type entryInfo struct {
+	e *Entry
+}
+
+func (ei entryInfo) Name() string       { return path.Base(ei.e.Name) }
+func (ei entryInfo) Size() int64        { return int64(ei.e.Size) }
+func (ei entryInfo) Mode() fs.FileMode  { return ei.e.Mode() }
+func (ei entryInfo) ModTime() time.Time { return ei.e.ModTime }
+func (ei entryInfo) IsDir() bool        { return ei.e.Type == TypeDir }
+func (ei entryInfo) Sys() any           { return ei.e }
+
+type dirInfo string
+
+func (di dirInfo) Name() string       { return string(di) }
+func (di dirInfo) Size() int64        { return 0 }
+func (di dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (di dirInfo) ModTime() time.Time { return time.Time{} }
+func (di dirInfo) IsDir() bool        { return true }
+func (di dirInfo) Sys() any           { return nil }
+
+type file struct {
+	br *Reader
+	e  *Entry
+	er io.ReadCloser
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return entryInfo{f.e}, nil
+}
+
+// Read reads the entry data and verifies its checksum at the end.
+func (f *file) Read(b []byte) (int, error) {
+	if f.er == nil {
+		er, err := f.br.EntryReader(f.e)
+		if err != nil {
+			return 0, err
+		}
+		f.er = er
+	}
+
+	n, err := f.er.Read(b)
+	if err == io.EOF {
+		if cerr := f.er.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	name    string
+	e       *Entry // directory entry, if any
+	entries []fs.DirEntry
+	off     int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	if d.e != nil {
+		return entryInfo{d.e}, nil
+	}
+	return dirInfo(path.Base(d.name)), nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: ErrIsDir}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.off:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		entries = entries[:min(n, len(entries))]
+	}
+	d.off += len(entries)
+	return slices.Clone(entries), nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+var ErrIsDir = errors.New("Is a directory.")
@@ -0,0 +1,139 @@
+package bar
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFS(t *testing.T) {
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithEntryTypes(), WithModTimes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, f := range []struct {
+		name, data string
+		typ        EntryType
+	}{
+		{"a.txt", "hello world", TypeFile},
+		{"dir", "", TypeDir},
+		{"dir/b.txt", "beta", TypeFile},
+		{"hl", "a.txt", TypeHardlink},
+		{"sub/deep/c.txt", "gamma", TypeFile},
+		{"sub/empty", "", TypeDir},
+	} {
+		switch f.typ {
+		case TypeDir:
+			err = bw.CreateDir(f.name)
+		case TypeHardlink:
+			err = bw.CreateHardlink(f.name, f.data)
+		default:
+			err = bw.Create(f.name)
+			if err == nil {
+				_, err = bw.Write([]byte(f.data))
+			}
+		}
+		if err == nil {
+			err = bw.SetModTime(mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := openArchive(t, buf.Bytes())
+	err = fstest.TestFS(br, "a.txt", "dir/b.txt", "hl", "sub/deep/c.txt",
+		"sub/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"dir/b.txt", "beta"},
+		{"dir/sub/c.txt", "gamma"},
+		{"other/deep/d.txt", "delta"},
+	}
+	br := openArchive(t, writeArchive(t, files))
+
+	// Every entry and its parent directories, in lexical order.
+	want := []string{".", "a.txt", "dir", "dir/b.txt", "dir/sub",
+		"dir/sub/c.txt", "other", "other/deep", "other/deep/d.txt"}
+	var got []string
+	err := fs.WalkDir(br, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() == strings.HasSuffix(name, ".txt") {
+			t.Errorf("%s: IsDir %v", name, d.IsDir())
+		}
+		got = append(got, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("visited %q, want %q", got, want)
+	}
+}
+
+func TestCaseFold(t *testing.T) {
+	files := []testFile{
+		{"README.md", "readme"},
+		{"dir/Makefile", "make"},
+		{"x.txt", "lower"},
+		{"X.TXT", "upper"},
+	}
+	b := writeArchive(t, files)
+
+	tests := []struct {
+		name    string
+		fold    bool
+		want    string // name of the entry found
+		err     error  // of Lookup
+		statErr error
+	}{
+		{"README.md", false, "README.md", nil, nil},
+		{"readme.md", false, "", ErrEntryNotFound, fs.ErrNotExist},
+		{"readme.md", true, "README.md", nil, nil},
+		{"DIR/makefile", true, "dir/Makefile", nil, nil},
+		{"x.txt", true, "x.txt", nil, nil},
+		{"X.TXT", true, "X.TXT", nil, nil},
+		{"x.TXT", false, "", ErrEntryNotFound, fs.ErrNotExist},
+		{"x.TXT", true, "", ErrAmbiguousName, ErrAmbiguousName},
+		{"other", true, "", ErrEntryNotFound, fs.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		var opts []ReaderOption
+		if tt.fold {
+			opts = append(opts, WithCaseFold())
+		}
+		br := openArchive(t, b, opts...)
+
+		e, err := br.Lookup(tt.name)
+		if err != tt.err || err == nil && e.Name != tt.want {
+			t.Errorf("Lookup(%s), fold %v: got %v, want %s, %v", tt.name,
+				tt.fold, err, tt.want, tt.err)
+		}
+		_, err = br.Stat(tt.name)
+		if !errors.Is(err, tt.statErr) {
+			t.Errorf("Stat(%s), fold %v: got %v, want %v", tt.name, tt.fold,
+				err, tt.statErr)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+// Package lz4 implements the LZ4 frame format with a fast greedy block
+// compressor, as described in the LZ4 frame and block format
+// specifications.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrCorrupt = errors.New("Corrupt LZ4 data.")
+	errClosed  = errors.New("Write after close.")
+)
+
+const (
+	magic = 0x184d2204
+
+	// Frames are written with independent blocks of up to 64 KiB and no
+	// checksums, which the caller keeps.
+	flg       = 1<<6 | 1<<5
+	bd        = 4 << 4
+	blockSize = 64 << 10
+
+	minMatch   = 4
+	mfLimit    = 12 // a match starts at least 12 bytes before the end
+	lastLits   = 5  // the last 5 bytes are always literals
+	maxOffset  = 65535
+	hashLog    = 14
+	windowSize = 64 << 10
+)
+
+// Writer compresses data to an LZ4 frame.
+type Writer struct {
+	w      io.Writer
+	buf    []byte
+	out    []byte
+	table  [1 << hashLog]int32
+	header bool
+	err    error
+}
+
+// NewWriter returns a writer compressing data to w. Close must be called to
+// end the frame.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:   w,
+		buf: make([]byte, 0, blockSize),
+		out: make([]byte, 4, 4+blockSize+blockSize/255+16),
+	}
+}
+
+func (zw *Writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if zw.err != nil {
+			return n, zw.err
+		}
+
+		m := min(len(p), blockSize-len(zw.buf))
+		zw.buf = append(zw.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(zw.buf) == blockSize {
+			zw.err = zw.flush()
+		}
+	}
+	return n, zw.err
+}
+
+// Close writes the buffered data and the end of the frame. It doesn't close
+// the underlying writer.
+func (zw *Writer) Close() error {
+	if zw.err != nil {
+		return zw.err
+	}
+
+	zw.err = zw.flush()
+	if zw.err != nil {
+		return zw.err
+	}
+	_, zw.err = zw.w.Write(make([]byte, 4))
+	if zw.err != nil {
+		return zw.err
+	}
+	zw.err = errClosed
+	return nil
+}
+
+func (zw *Writer) flush() error {
+	if !zw.header {
+		zw.header = true
+		h := []byte{0, 0, 0, 0, flg, bd, 0}
+		binary.LittleEndian.PutUint32(h, magic)
+		h[6] = byte(Checksum(h[4:6]) >> 8)
+		_, err := zw.w.Write(h)
+		if err != nil {
+			return err
+		}
+	}
+	if len(zw.buf) == 0 {
+		return nil
+	}
+
+	// Blocks that don't shrink are stored uncompressed, marked by the high
+	// bit of their size.
+	zw.out = compressBlock(zw.out[:4], zw.buf, &zw.table)
+	size := uint32(len(zw.out) - 4)
+	block := zw.out
+	if size >= uint32(len(zw.buf)) {
+		block = append(zw.out[:4], zw.buf...)
+		size = uint32(len(zw.buf)) | 1<<31
+	}
+	binary.LittleEndian.PutUint32(block, size)
+	zw.buf = zw.buf[:0]
+	_, err := zw.w.Write(block)
+	return err
+}
+
+// compressBlock appends the LZ4 sequences of src to dst. Matches are found
+// greedily with a hash table of the last position of every 4 byte value.
+func compressBlock(dst, src []byte, table *[1 << hashLog]int32) []byte {
+	for i := range table {
+		table[i] = -1
+	}
+
+	n := len(src)
+	anchor := 0
+	for i := 0; i+mfLimit < n; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := hash(seq)
+		ref := int(table[h])
+		table[h] = int32(i)
+		if ref < 0 || i-ref > maxOffset ||
+			binary.LittleEndian.Uint32(src[ref:]) != seq {
+			// Skip faster through data without matches.
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+
+		end := i + minMatch
+		for end < n-lastLits && src[end] == src[ref+end-i] {
+			end++
+		}
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i--
+			ref--
+		}
+
+		dst = appendSequence(dst, src[anchor:i], i-ref, end-i)
+		i = end
+		anchor = end
+	}
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+func hash(seq uint32) uint32 {
+	return seq * 2654435761 >> (32 - hashLog)
+}
+
+// appendSequence appends the literals lits followed by a match of length
+// ml at offset, or only the literals if ml is 0.
+func appendSequence(dst, lits []byte, offset, ml int) []byte {
+	token := byte(min(len(lits), 15)) << 4
+	if ml > 0 {
+		token |= byte(min(ml-minMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(lits) >= 15 {
+		dst = appendLength(dst, len(lits)-15)
+	}
+	dst = append(dst, lits...)
+	if ml == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if ml-minMatch >= 15 {
+		dst = appendLength(dst, ml-minMatch-15)
+	}
+	return dst
+}
+
+func appendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// Reader decompresses an LZ4 frame. Blocks may depend on earlier ones and
+// checksums are verified, but frames with a dictionary are not supported.
+type Reader struct {
+	r        io.Reader
+	header   bool
+	maxBlock int
+	linked   bool
+	blockSum bool
+	content  *Digest
+	buf      []byte // the window of linked blocks followed by the last block
+	out      []byte // the unread data of the last block
+	err      error
+}
+
+// NewReader returns a reader decompressing the frame read from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (zr *Reader) Read(p []byte) (int, error) {
+	for len(zr.out) == 0 {
+		if zr.err != nil {
+			return 0, zr.err
+		}
+		zr.err = zr.next()
+	}
+
+	n := copy(p, zr.out)
+	zr.out = zr.out[n:]
+	return n, nil
+}
+
+// next decodes the next block into out, or returns io.EOF after the end of
+// the frame.
+func (zr *Reader) next() error {
+	if !zr.header {
+		err := zr.readHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	var b [4]byte
+	err := readFull(zr.r, b[:])
+	if err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(b[:])
+	if size == 0 {
+		return zr.end()
+	}
+
+	stored := size&(1<<31) != 0
+	size &^= 1 << 31
+	if int(size) > zr.maxBlock {
+		return ErrCorrupt
+	}
+	block := make([]byte, size)
+	err = readFull(zr.r, block)
+	if err != nil {
+		return err
+	}
+	if zr.blockSum {
+		err = readFull(zr.r, b[:])
+		if err != nil {
+			return err
+		}
+		if Checksum(block) != binary.LittleEndian.Uint32(b[:]) {
+			return ErrCorrupt
+		}
+	}
+
+	// Linked blocks may refer to the last 64 KiB of the blocks before.
+	var window int
+	if zr.linked {
+		start := max(len(zr.buf)-windowSize, 0)
+		window = copy(zr.buf, zr.buf[start:])
+	}
+	zr.buf = zr.buf[:window]
+
+	if stored {
+		zr.buf = append(zr.buf, block...)
+	} else {
+		zr.buf, err = decompressBlock(zr.buf, block, window+zr.maxBlock)
+		if err != nil {
+			return err
+		}
+	}
+	zr.out = zr.buf[window:]
+	if zr.content != nil {
+		zr.content.Write(zr.out)
+	}
+	return nil
+}
+
+func (zr *Reader) readHeader() error {
+	var b [6]byte
+	err := readFull(zr.r, b[:])
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b[:]) != magic {
+		return ErrCorrupt
+	}
+
+	flags, desc := b[4], b[5]
+	if flags>>6 != 1 || flags&0b11 != 0 || desc&0b10001111 != 0 {
+		return ErrCorrupt
+	}
+	bsize := desc >> 4 & 0b111
+	if bsize < 4 {
+		return ErrCorrupt
+	}
+	zr.maxBlock = 1 << (8 + 2*bsize)
+	zr.linked = flags&(1<<5) == 0
+	zr.blockSum = flags&(1<<4) != 0
+	if flags&(1<<2) != 0 {
+		zr.content = NewDigest()
+	}
+
+	// The content size is only covered by the header checksum.
+	hlen := 2
+	if flags&(1<<3) != 0 {
+		hlen += 8
+	}
+	h := make([]byte, hlen+1)
+	copy(h, b[4:6])
+	err = readFull(zr.r, h[2:])
+	if err != nil {
+		return err
+	}
+	if byte(Checksum(h[:hlen])>>8) != h[hlen] {
+		return ErrCorrupt
+	}
+
+	zr.buf = make([]byte, 0, windowSize+zr.maxBlock)
+	zr.header = true
+	return nil
+}
+
+// end verifies the content checksum after the last block.
+func (zr *Reader) end() error {
+	if zr.content != nil {
+		var b [4]byte
+		err := readFull(zr.r, b[:])
+		if err != nil {
+			return err
+		}
+		if zr.content.Sum32() != binary.LittleEndian.Uint32(b[:]) {
+			return ErrCorrupt
+		}
+	}
+	return io.EOF
+}
+
+// decompressBlock appends the data of the sequences in src to dst, whose
+// contents are the window matches may refer to. The result must not be
+// longer than limit.
+func decompressBlock(dst, src []byte, limit int) ([]byte, error) {
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, ErrCorrupt
+		}
+		token := src[i]
+		i++
+
+		n := int(token >> 4)
+		if n == 15 {
+			var ok bool
+			n, i, ok = readLength(src, i, n)
+			if !ok {
+				return nil, ErrCorrupt
+			}
+		}
+		if n > len(src)-i || n > limit-len(dst) {
+			return nil, ErrCorrupt
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+
+		// The last sequence has no match.
+		if i == len(src) {
+			return dst, nil
+		}
+
+		if len(src)-i < 2 {
+			return nil, ErrCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, ErrCorrupt
+		}
+
+		n = int(token & 15)
+		if n == 15 {
+			var ok bool
+			n, i, ok = readLength(src, i, n)
+			if !ok {
+				return nil, ErrCorrupt
+			}
+		}
+		n += minMatch
+		if n > limit-len(dst) {
+			return nil, ErrCorrupt
+		}
+
+		// Matches may overlap the data they produce.
+		pos := len(dst) - offset
+		for n > 0 {
+			m := min(n, offset)
+			dst = append(dst, dst[pos:pos+m]...)
+			pos += m
+			n -= m
+		}
+	}
+}
+
+// readLength adds the length bytes starting at src[i] to n and returns it
+// with the index after them.
+func readLength(src []byte, i, n int) (int, int, bool) {
+	for {
+		if i >= len(src) {
+			return 0, 0, false
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, true
+		}
+	}
+}
+
+func readFull(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,317 @@
+package lz4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t testing.TB, name string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decompress(b []byte) ([]byte, error) {
+	return io.ReadAll(NewReader(bytes.NewReader(b)))
+}
+
+func compress(t testing.TB, data []byte, chunk int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := NewWriter(&buf)
+	for p := data; len(p) > 0; {
+		n, err := zw.Write(p[:min(chunk, len(p))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The files in testdata were written by the lz4 command, version 1.9.4,
+// with the level or options in their names. The .block files are the
+// first block of the .lz4 files of the same name, readme.block that of
+// readme-1.lz4.
+func TestReader(t *testing.T) {
+	readme := readFile(t, "readme.txt")
+	tests := []struct {
+		file string
+		want []byte
+	}{
+		{"readme-1.lz4", readme},
+		{"readme-9.lz4", readme},
+		{"readme-bx.lz4", readme},
+		{"readme-size.lz4", readme},
+		{"readme-nocheck.lz4", readme},
+		{"readme-x10.lz4", bytes.Repeat(readme, 10)},
+		{"readme-x10-bd.lz4", bytes.Repeat(readme, 10)},
+		{"zeros.lz4", make([]byte, 300000)},
+		{"random.lz4", readFile(t, "random.bin")},
+		{"empty.lz4", []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := decompress(readFile(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDecompressBlock(t *testing.T) {
+	tests := []struct {
+		file string
+		want []byte
+	}{
+		{"readme.block", readFile(t, "readme.txt")},
+		{"zeros.block", make([]byte, 300000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			block := readFile(t, tt.file)
+			got, err := decompressBlock(nil, block, len(tt.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+
+			_, err = decompressBlock(nil, block, len(tt.want)-1)
+			if err != ErrCorrupt {
+				t.Errorf("past limit: got %v, want %v", err, ErrCorrupt)
+			}
+			_, err = decompressBlock(nil, block[:len(block)-1], len(tt.want))
+			if err != ErrCorrupt {
+				t.Errorf("truncated: got %v, want %v", err, ErrCorrupt)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	frame := readFile(t, "readme-bx.lz4")
+	change := func(i int, b byte) []byte {
+		c := bytes.Clone(frame)
+		if i < 0 {
+			i += len(c)
+		}
+		c[i] = b
+		return c
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.ErrUnexpectedEOF},
+		{"truncated", frame[:len(frame)-10], io.ErrUnexpectedEOF},
+		{"no end mark", frame[:len(frame)-8], io.ErrUnexpectedEOF},
+		{"magic", change(0, 0x05), ErrCorrupt},
+		{"version", change(4, frame[4]^1<<7), ErrCorrupt},
+		{"dictionary", change(4, frame[4]|1), ErrCorrupt},
+		{"header checksum", change(6, frame[6]^1), ErrCorrupt},
+		{"block checksum", change(20, frame[20]^1), ErrCorrupt},
+		{"content checksum", change(-1, frame[len(frame)-1]^1), ErrCorrupt},
+		{"legacy frame", readFile(t, "readme-legacy.lz4"), ErrCorrupt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decompress(tt.data)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	// Some changes, like another offset of the same bytes, still give
+	// the data, anything else fails the content checksum at last.
+	readme := readFile(t, "readme.txt")
+	frame := readFile(t, "readme-1.lz4")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		c := bytes.Clone(frame)
+		c[r.Intn(len(c))] ^= 1 << r.Intn(8)
+		got, err := decompress(c)
+		if err == nil && !bytes.Equal(got, readme) {
+			t.Fatalf("changed data read without error")
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 300000)
+	r.Read(random)
+	readme := readFile(t, "readme.txt")
+	mixed := bytes.Clone(random)
+	for i := 0; i < len(mixed); i += 2000 {
+		copy(mixed[i:], readme[:1000])
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		grows bool // blocks that don't shrink are stored
+	}{
+		{"empty", nil, true},
+		{"byte", []byte{'a'}, true},
+		{"short", []byte("hello, hello, hello"), true},
+		{"text", readme, false},
+		{"repeated", bytes.Repeat(readme, 200), false},
+		{"zeros", make([]byte, 3<<20), false},
+		{"random", random, true},
+		{"mixed", mixed, false},
+		{"block", random[:blockSize], true},
+	}
+
+	lz4Cmd, _ := exec.LookPath("lz4")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, chunk := range []int{1000, 1 << 20} {
+				b := compress(t, tt.data, chunk)
+				got, err := decompress(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("got %d bytes, want %d", len(got), len(tt.data))
+				}
+				if grows := len(b) > len(tt.data); grows != tt.grows {
+					t.Errorf("%d bytes compressed to %d", len(tt.data), len(b))
+				}
+
+				if lz4Cmd == "" {
+					continue
+				}
+				cmd := exec.Command(lz4Cmd, "-d", "-c")
+				cmd.Stdin = bytes.NewReader(b)
+				got, err = cmd.Output()
+				if err != nil || !bytes.Equal(got, tt.data) {
+					t.Errorf("lz4 -d: %d bytes, %v", len(got), err)
+				}
+			}
+		})
+	}
+}
+
+// TestBlockLengths compresses literals and matches around the lengths
+// whose encoding takes another byte.
+func TestBlockLengths(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+
+	lz4Cmd, _ := exec.LookPath("lz4")
+	var table [1 << hashLog]int32
+	for _, n := range []int{0, 1, 4, 14, 15, 16, 18, 19, 20, 269, 270, 271,
+		524, 525, 526, 10000} {
+		// A run of random literals, then a match of n bytes of an
+		// earlier run, then the literals that end every block.
+		lits := random(max(n, 8))
+		var src []byte
+		src = append(src, lits...)
+		src = append(src, '|')
+		src = append(src, lits[:n]...)
+		src = append(src, random(lastLits+8)...)
+
+		block := compressBlock(nil, src, &table)
+		got, err := decompressBlock(nil, block, len(src))
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%d: got %x, want %x", n, got, src)
+		}
+		if n >= 16 && len(block) >= len(src) {
+			t.Errorf("%d: %d bytes compressed to %d", n, len(src), len(block))
+		}
+
+		if lz4Cmd == "" {
+			continue
+		}
+		cmd := exec.Command(lz4Cmd, "-d", "-c")
+		cmd.Stdin = bytes.NewReader(compress(t, src, len(src)))
+		got, err = cmd.Output()
+		if err != nil || !bytes.Equal(got, src) {
+			t.Errorf("%d: lz4 -d: %d bytes, %v", n, len(got), err)
+		}
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	zw := NewWriter(io.Discard)
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zw.Write([]byte("late"))
+	if !errors.Is(err, errClosed) {
+		t.Errorf("got %v, want %v", err, errClosed)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+	for _, tt := range tests {
+		if got := Checksum([]byte(tt.data)); got != tt.want {
+			t.Errorf("Checksum(%q) = %#x, want %#x", tt.data, got, tt.want)
+		}
+	}
+
+	// Writes of any size give the same checksum.
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	d := NewDigest()
+	for i := 0; i < len(data); i += i%7 + 1 {
+		d.Write(data[i:min(i+i%7+1, len(data))])
+	}
+	if d.Sum32() != Checksum(data) {
+		t.Errorf("got %#x, want %#x", d.Sum32(), Checksum(data))
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	for _, name := range []string{"readme-1.lz4", "readme-x10-bd.lz4", "zeros.lz4"} {
+		f.Add(readFile(f, name))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		decompress(b)
+	})
+}
@@ -0,0 +1,96 @@
+package lz4
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	prime1 uint32 = 2654435761
+	prime2 uint32 = 2246822519
+	prime3 uint32 = 3266489917
+	prime4 uint32 = 668265263
+	prime5 uint32 = 374761393
+)
+
+// Digest computes the xxHash32 checksum with seed 0, which LZ4 frames use
+// for their header, blocks and content.
+type Digest struct {
+	v     [4]uint32
+	buf   [16]byte
+	n     int // bytes in buf
+	total uint64
+}
+
+func NewDigest() *Digest {
+	// The initial state wraps around, which constants can't.
+	p1, p2 := prime1, prime2
+	return &Digest{v: [4]uint32{p1 + p2, p2, 0, -p1}}
+}
+
+// Checksum returns the xxHash32 checksum of b.
+func Checksum(b []byte) uint32 {
+	d := NewDigest()
+	d.Write(b)
+	return d.Sum32()
+}
+
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+	if d.n > 0 {
+		m := copy(d.buf[d.n:], b)
+		d.n += m
+		b = b[m:]
+		if d.n < len(d.buf) {
+			return n, nil
+		}
+		d.rounds(d.buf[:])
+		d.n = 0
+	}
+
+	full := len(b) &^ 15
+	d.rounds(b[:full])
+	d.n = copy(d.buf[:], b[full:])
+	return n, nil
+}
+
+func (d *Digest) rounds(b []byte) {
+	for ; len(b) >= 16; b = b[16:] {
+		for i := range d.v {
+			d.v[i] = round(d.v[i], binary.LittleEndian.Uint32(b[4*i:]))
+		}
+	}
+}
+
+func round(acc, input uint32) uint32 {
+	return bits.RotateLeft32(acc+input*prime2, 13) * prime1
+}
+
+func (d *Digest) Sum32() uint32 {
+	var h uint32
+	if d.total >= 16 {
+		h = bits.RotateLeft32(d.v[0], 1) + bits.RotateLeft32(d.v[1], 7) +
+			bits.RotateLeft32(d.v[2], 12) + bits.RotateLeft32(d.v[3], 18)
+	} else {
+		h = prime5
+	}
+	h += uint32(d.total)
+
+	b := d.buf[:d.n]
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * prime3
+		h = bits.RotateLeft32(h, 17) * prime4
+	}
+	for _, c := range b {
+		h += uint32(c) * prime5
+		h = bits.RotateLeft32(h, 11) * prime1
+	}
+
+	h ^= h >> 15
+	h *= prime2
+	h ^= h >> 13
+	h *= prime3
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,140 @@
+// Package scrypt implements the scrypt key derivation function as defined
+// in RFC 7914.
+package scrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var ErrInvalidParams = errors.New("Invalid scrypt parameters.")
+
+// Key derives a key of keyLen bytes from password and salt. N must be a
+// power of two greater than one.
+func Key(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 || r <= 0 || p <= 0 ||
+		uint64(r)*uint64(p) >= 1<<30 || r > (1<<31-1)/128/p ||
+		N > (1<<31-1)/128/r {
+		return nil, ErrInvalidParams
+	}
+
+	b := pbkdf2(password, salt, 1, p*128*r)
+
+	x := make([]uint32, 32*r)
+	y := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*N)
+	for i := 0; i < p; i++ {
+		roMix(b[i*128*r:(i+1)*128*r], r, N, x, y, v)
+	}
+
+	return pbkdf2(password, b, 1, keyLen), nil
+}
+
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	size := prf.Size()
+
+	var dk []byte
+	u := make([]byte, size)
+	t := make([]byte, size)
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+func roMix(b []byte, r, N int, x, y, v []uint32) {
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+
+	for i := 0; i < N; i++ {
+		copy(v[i*32*r:], x)
+		blockMix(x, y, r)
+	}
+	for i := 0; i < N; i++ {
+		j := int(x[(2*r-1)*16] & uint32(N-1))
+		for k := range x {
+			x[k] ^= v[j*32*r+k]
+		}
+		blockMix(x, y, r)
+	}
+
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+}
+
+// blockMix mixes b in place, using y as scratch space.
+func blockMix(b, y []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for j := range t {
+			t[j] ^= b[i*16+j]
+		}
+		salsa8(&t)
+		// Even blocks go to the first half, odd blocks to the second.
+		copy(y[(i/2+(i%2)*r)*16:], t[:])
+	}
+	copy(b, y)
+}
+
+func salsa8(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
@@ -0,0 +1,91 @@
+package scrypt
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The test vectors of RFC 7914, section 12.
+func TestKey(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		N, r, p  int
+		want     string
+	}{
+		{"", "", 16, 1, 1,
+			"77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442" +
+				"fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16,
+			"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+				"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1,
+			"7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2" +
+				"d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+		{"pleaseletmein", "SodiumChloride", 1048576, 8, 1,
+			"2101cb9b6a511aaeaddbbe09cf70f881ec568d574a2ffd4dabe5ee9820adaa47" +
+				"8e56fd8f4ba5d09ffa1c6d927c40f4c337304049e8a952fbcbf45c6fa77a41a4"},
+	}
+
+	for _, tt := range tests {
+		// The last vector takes 1 GiB of memory.
+		if tt.N > 1<<16 && testing.Short() {
+			continue
+		}
+		got, err := Key([]byte(tt.password), []byte(tt.salt), tt.N, tt.r,
+			tt.p, 64)
+		if err != nil {
+			t.Fatalf("N=%d: %v", tt.N, err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("N=%d: got %x, want %s", tt.N, got, tt.want)
+		}
+	}
+}
+
+// The test vectors of PBKDF2-HMAC-SHA256 of RFC 7914, section 11.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		iter     int
+		want     string
+	}{
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, tt := range tests {
+		got := pbkdf2([]byte(tt.password), []byte(tt.salt), tt.iter, 64)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%q: got %x, want %s", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestKeyParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		N, r, p int
+	}{
+		{"N of 1", 1, 8, 1},
+		{"N not a power of two", 1000, 8, 1},
+		{"zero r", 16, 0, 1},
+		{"zero p", 16, 8, 0},
+		{"r times p too large", 16, 1 << 15, 1 << 15},
+		{"N too large", 1 << 30, 8, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Key([]byte("password"), []byte("salt"), tt.N, tt.r, tt.p, 32)
+			if err != ErrInvalidParams {
+				t.Errorf("got %v, want %v", err, ErrInvalidParams)
+			}
+		})
+	}
+}
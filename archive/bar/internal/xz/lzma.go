@@ -0,0 +1,391 @@
+package xz
+
+import "math/bits"
+
+const (
+	numStates    = 12
+	litStates    = 7 // states after a literal
+	posStatesMax = 1 << 4
+
+	minMatchLen = 2
+	maxMatchLen = 273
+
+	lenToPosStates = 4
+	posSlotBits    = 6
+	alignBits      = 4
+	endPosModel    = 14
+	fullDistances  = 1 << (endPosModel >> 1)
+)
+
+// lenCoder holds the probabilities of match lengths, which are coded as
+// 3 bits per position state for lengths up to 17 and 8 bits above.
+type lenCoder struct {
+	choice  prob
+	choice2 prob
+	low     [posStatesMax][1 << 3]prob
+	mid     [posStatesMax][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+func (lc *lenCoder) reset() {
+	lc.choice = probInit
+	lc.choice2 = probInit
+	for i := range lc.low {
+		resetProbs(lc.low[i][:])
+		resetProbs(lc.mid[i][:])
+	}
+	resetProbs(lc.high[:])
+}
+
+// model is the state of LZMA shared by the encoder and decoder: the
+// probabilities, the state of the last symbols and the last four
+// distances. lc, lp and pb are the literal context, literal position and
+// position bits.
+type model struct {
+	lc, lp, pb int
+
+	literal    []prob
+	isMatch    [numStates << 4]prob
+	isRep      [numStates]prob
+	isRepG0    [numStates]prob
+	isRepG1    [numStates]prob
+	isRepG2    [numStates]prob
+	isRep0Long [numStates << 4]prob
+	posSlot    [lenToPosStates][1 << posSlotBits]prob
+	posSpecial [fullDistances - endPosModel]prob
+	align      [1 << alignBits]prob
+	matchLen   lenCoder
+	repLen     lenCoder
+
+	state int
+	reps  [4]uint32
+}
+
+func newModel(lc, lp, pb int) *model {
+	m := &model{lc: lc, lp: lp, pb: pb}
+	m.literal = make([]prob, 0x300<<(lc+lp))
+	m.reset()
+	return m
+}
+
+// props returns the properties byte of the model.
+func (m *model) props() byte {
+	return byte((m.pb*5+m.lp)*9 + m.lc)
+}
+
+// parseProps returns lc, lp and pb of a properties byte. LZMA2 limits
+// lc + lp to 4.
+func parseProps(b byte) (int, int, int, bool) {
+	if b >= 9*5*5 {
+		return 0, 0, 0, false
+	}
+	lc := int(b % 9)
+	b /= 9
+	lp, pb := int(b%5), int(b/5)
+	return lc, lp, pb, lc+lp <= 4
+}
+
+func (m *model) reset() {
+	resetProbs(m.literal)
+	resetProbs(m.isMatch[:])
+	resetProbs(m.isRep[:])
+	resetProbs(m.isRepG0[:])
+	resetProbs(m.isRepG1[:])
+	resetProbs(m.isRepG2[:])
+	resetProbs(m.isRep0Long[:])
+	for i := range m.posSlot {
+		resetProbs(m.posSlot[i][:])
+	}
+	resetProbs(m.posSpecial[:])
+	resetProbs(m.align[:])
+	m.matchLen.reset()
+	m.repLen.reset()
+	m.state = 0
+	m.reps = [4]uint32{}
+}
+
+// literalProbs returns the probabilities of the literal at pos following
+// prev.
+func (m *model) literalProbs(pos uint64, prev byte) []prob {
+	lp := uint32(pos)&(1<<m.lp-1)<<m.lc + uint32(prev)>>(8-m.lc)
+	return m.literal[0x300*lp:][:0x300]
+}
+
+func (m *model) posState(pos uint64) uint32 {
+	return uint32(pos) & (1<<m.pb - 1)
+}
+
+func (m *model) literalDone() {
+	switch {
+	case m.state < 4:
+		m.state = 0
+	case m.state < 10:
+		m.state -= 3
+	default:
+		m.state -= 6
+	}
+}
+
+func (m *model) matchDone(s, t int) {
+	if m.state < litStates {
+		m.state = s
+	} else {
+		m.state = t
+	}
+}
+
+// posSlot returns the slot of the distance dist, which gives its highest
+// two bits and the number of bits below them.
+func posSlot(dist uint32) uint32 {
+	if dist < 4 {
+		return dist
+	}
+	n := uint32(bits.Len32(dist)) - 1
+	return n<<1 | dist>>(n-1)&1
+}
+
+func lenState(l uint32) uint32 {
+	return min(l-minMatchLen, lenToPosStates-1)
+}
+
+// Encoding of the symbols. pos is the position of the symbol in the data
+// since the last dictionary reset.
+
+func (m *model) encodeLiteral(rc *rangeEncoder, pos uint64, b, prev,
+	match byte) {
+	rc.bit(&m.isMatch[m.state<<4+int(m.posState(pos))], 0)
+	probs := m.literalProbs(pos, prev)
+	if m.state < litStates {
+		rc.tree(probs, 8, uint32(b))
+	} else {
+		// After a match, the byte at rep0 is used as context until the
+		// first bit that differs from it.
+		mb := uint32(match) << 1
+		offset := uint32(0x100)
+		symbol := uint32(1)
+		for i := 7; i >= 0; i-- {
+			bit := uint32(b) >> i & 1
+			matchBit := mb & offset
+			mb <<= 1
+			rc.bit(&probs[offset+matchBit+symbol], bit)
+			symbol = symbol<<1 | bit
+			if bit != 0 {
+				offset = matchBit
+			} else {
+				offset &^= matchBit
+			}
+		}
+	}
+	m.literalDone()
+}
+
+func (m *model) encodeLen(rc *rangeEncoder, lc *lenCoder, l, ps uint32) {
+	l -= minMatchLen
+	switch {
+	case l < 8:
+		rc.bit(&lc.choice, 0)
+		rc.tree(lc.low[ps][:], 3, l)
+	case l < 16:
+		rc.bit(&lc.choice, 1)
+		rc.bit(&lc.choice2, 0)
+		rc.tree(lc.mid[ps][:], 3, l-8)
+	default:
+		rc.bit(&lc.choice, 1)
+		rc.bit(&lc.choice2, 1)
+		rc.tree(lc.high[:], 8, l-16)
+	}
+}
+
+// encodeMatch encodes a match of length l at distance dist + 1.
+func (m *model) encodeMatch(rc *rangeEncoder, pos uint64, dist, l uint32) {
+	ps := m.posState(pos)
+	rc.bit(&m.isMatch[m.state<<4+int(ps)], 1)
+	rc.bit(&m.isRep[m.state], 0)
+	m.encodeLen(rc, &m.matchLen, l, ps)
+
+	slot := posSlot(dist)
+	rc.tree(m.posSlot[lenState(l)][:], posSlotBits, slot)
+	if slot >= 4 {
+		footer := int(slot>>1 - 1)
+		base := (2 | slot&1) << footer
+		reduced := dist - base
+		if slot < endPosModel {
+			rc.reverseTree(m.posSpecial[:], int(base-slot)-1, footer, reduced)
+		} else {
+			rc.direct(reduced>>alignBits, footer-alignBits)
+			rc.reverseTree(m.align[:], 0, alignBits, reduced)
+		}
+	}
+
+	m.reps = [4]uint32{dist, m.reps[0], m.reps[1], m.reps[2]}
+	m.matchDone(7, 10)
+}
+
+// encodeRep encodes a match of length l at the distance of reps[i].
+func (m *model) encodeRep(rc *rangeEncoder, pos uint64, i int, l uint32) {
+	ps := m.posState(pos)
+	rc.bit(&m.isMatch[m.state<<4+int(ps)], 1)
+	rc.bit(&m.isRep[m.state], 1)
+	if i == 0 {
+		rc.bit(&m.isRepG0[m.state], 0)
+		rc.bit(&m.isRep0Long[m.state<<4+int(ps)], 1)
+	} else {
+		rc.bit(&m.isRepG0[m.state], 1)
+		if i == 1 {
+			rc.bit(&m.isRepG1[m.state], 0)
+		} else {
+			rc.bit(&m.isRepG1[m.state], 1)
+			rc.bit(&m.isRepG2[m.state], uint32(i-2))
+		}
+		dist := m.reps[i]
+		copy(m.reps[1:i+1], m.reps[:i])
+		m.reps[0] = dist
+	}
+	m.encodeLen(rc, &m.repLen, l, ps)
+	m.matchDone(8, 11)
+}
+
+// encodeShortRep encodes a single byte at the distance of reps[0].
+func (m *model) encodeShortRep(rc *rangeEncoder, pos uint64) {
+	ps := m.posState(pos)
+	rc.bit(&m.isMatch[m.state<<4+int(ps)], 1)
+	rc.bit(&m.isRep[m.state], 1)
+	rc.bit(&m.isRepG0[m.state], 0)
+	rc.bit(&m.isRep0Long[m.state<<4+int(ps)], 0)
+	m.matchDone(9, 11)
+}
+
+// decode appends the data of the chunk read by rc to dict until it holds
+// end bytes. The last total bytes of dict were written since the last
+// dictionary reset, matches may refer to at most dictSize of them.
+func (m *model) decode(rc *rangeDecoder, dict []byte, end int, total uint64,
+	dictSize int) ([]byte, bool) {
+	for len(dict) < end {
+		pos := total
+		ps := m.posState(pos)
+		if rc.bit(&m.isMatch[m.state<<4+int(ps)]) == 0 {
+			var prev, match byte
+			if total > 0 {
+				prev = dict[len(dict)-1]
+			}
+			if m.state >= litStates {
+				match = dict[len(dict)-int(m.reps[0])-1]
+			}
+			dict = append(dict, m.decodeLiteral(rc, pos, prev, match))
+			total++
+			if rc.overrun() {
+				return nil, false
+			}
+			continue
+		}
+
+		var l uint32
+		if rc.bit(&m.isRep[m.state]) == 0 {
+			l = m.decodeLen(rc, &m.matchLen, ps)
+			dist, ok := m.decodeDist(rc, l)
+			if !ok {
+				return nil, false
+			}
+			m.reps = [4]uint32{dist, m.reps[0], m.reps[1], m.reps[2]}
+			m.matchDone(7, 10)
+		} else {
+			if total == 0 {
+				return nil, false
+			}
+			if rc.bit(&m.isRepG0[m.state]) == 0 {
+				if rc.bit(&m.isRep0Long[m.state<<4+int(ps)]) == 0 {
+					if rc.overrun() || uint64(m.reps[0]) >= total {
+						return nil, false
+					}
+					m.matchDone(9, 11)
+					dict = append(dict, dict[len(dict)-int(m.reps[0])-1])
+					total++
+					continue
+				}
+			} else {
+				i := 1
+				if rc.bit(&m.isRepG1[m.state]) != 0 {
+					i = 2 + int(rc.bit(&m.isRepG2[m.state]))
+				}
+				dist := m.reps[i]
+				copy(m.reps[1:i+1], m.reps[:i])
+				m.reps[0] = dist
+			}
+			l = m.decodeLen(rc, &m.repLen, ps)
+			m.matchDone(8, 11)
+		}
+
+		dist := uint64(m.reps[0]) + 1
+		if rc.overrun() || dist > total || dist > uint64(dictSize) ||
+			int(l) > end-len(dict) {
+			return nil, false
+		}
+		// Matches may overlap the data they produce.
+		from := len(dict) - int(dist)
+		for n := int(l); n > 0; {
+			k := min(n, int(dist))
+			dict = append(dict, dict[from:from+k]...)
+			from += k
+			n -= k
+		}
+		total += uint64(l)
+	}
+	return dict, true
+}
+
+func (m *model) decodeLiteral(rc *rangeDecoder, pos uint64, prev,
+	match byte) byte {
+	probs := m.literalProbs(pos, prev)
+	symbol := uint32(1)
+	if m.state < litStates {
+		for symbol < 0x100 {
+			symbol = symbol<<1 | rc.bit(&probs[symbol])
+		}
+	} else {
+		mb := uint32(match) << 1
+		offset := uint32(0x100)
+		for symbol < 0x100 {
+			matchBit := mb & offset
+			mb <<= 1
+			bit := rc.bit(&probs[offset+matchBit+symbol])
+			symbol = symbol<<1 | bit
+			if bit != 0 {
+				offset = matchBit
+			} else {
+				offset &^= matchBit
+			}
+		}
+	}
+	m.literalDone()
+	return byte(symbol)
+}
+
+func (m *model) decodeLen(rc *rangeDecoder, lc *lenCoder, ps uint32) uint32 {
+	switch {
+	case rc.bit(&lc.choice) == 0:
+		return minMatchLen + rc.tree(lc.low[ps][:], 3)
+	case rc.bit(&lc.choice2) == 0:
+		return minMatchLen + 8 + rc.tree(lc.mid[ps][:], 3)
+	default:
+		return minMatchLen + 16 + rc.tree(lc.high[:], 8)
+	}
+}
+
+// decodeDist decodes the distance of a match of length l, minus one. The
+// end marker of LZMA isn't valid in LZMA2.
+func (m *model) decodeDist(rc *rangeDecoder, l uint32) (uint32, bool) {
+	slot := rc.tree(m.posSlot[lenState(l)][:], posSlotBits)
+	if slot < 4 {
+		return slot, true
+	}
+
+	footer := int(slot>>1 - 1)
+	dist := (2 | slot&1) << footer
+	if slot < endPosModel {
+		dist += rc.reverseTree(m.posSpecial[:], int(dist-slot)-1, footer)
+	} else {
+		dist += rc.direct(footer-alignBits) << alignBits
+		dist += rc.reverseTree(m.align[:], 0, alignBits)
+	}
+	return dist, dist != 0xffffffff
+}
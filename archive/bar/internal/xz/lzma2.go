@@ -0,0 +1,436 @@
+package xz
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	dictSize = 8 << 20
+
+	// LZMA2 chunks hold up to 2 MiB of data, compressed to at most 64 KiB.
+	maxChunkSize      = 1 << 21
+	maxCompressedSize = 1 << 16
+	maxStoredSize     = 1 << 16
+
+	// A symbol never takes more than this many bytes, so a chunk is ended
+	// when the next symbol might not fit.
+	maxSymbolSize = 128
+
+	hashBits   = 20
+	chainDepth = 48
+	niceLen    = 128
+
+	// The window keeps dictSize bytes before the next byte to encode and
+	// the current chunk, and is shifted in steps of at least shiftSize.
+	shiftSize  = 2 << 20
+	windowSize = dictSize + 2*shiftSize
+
+	lc, lp, pb = 3, 0, 2
+)
+
+// encoder compresses data to LZMA2 chunks with a greedy match finder using
+// hash chains, with one step of lazy matching.
+type encoder struct {
+	w  io.Writer
+	m  *model
+	rc rangeEncoder
+
+	window []byte
+	base   uint64  // position of window[0] in the data
+	pos    int     // next byte to encode in window
+	head   []int32 // last position in window of every hash, or -1
+	chain  []int32 // previous position with the same hash, or -1
+
+	chunk     int  // start of the current chunk in window
+	first     bool // no chunk written yet
+	needProps bool // the next LZMA chunk must reset the state
+	err       error
+}
+
+func newEncoder(w io.Writer) *encoder {
+	e := &encoder{w: w, m: newModel(lc, lp, pb), first: true, needProps: true}
+	e.head = make([]int32, 1<<hashBits)
+	for i := range e.head {
+		e.head[i] = -1
+	}
+	e.rc.reset()
+	return e
+}
+
+func (e *encoder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && e.err == nil {
+		e.shift()
+		k := min(len(p), windowSize-len(e.window))
+		e.window = append(e.window, p[:k]...)
+		for range p[:k] {
+			e.chain = append(e.chain, -1)
+		}
+		p = p[k:]
+
+		// Matches are only searched with the longest possible match
+		// ahead, except at the end.
+		for e.err == nil && len(e.window)-e.pos >= maxMatchLen {
+			e.encodeSymbol()
+		}
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+	return n, nil
+}
+
+// Close encodes the rest of the data and writes the end of the LZMA2 data.
+func (e *encoder) Close() error {
+	for e.err == nil && e.pos < len(e.window) {
+		e.encodeSymbol()
+	}
+	if e.err == nil && e.pos > e.chunk {
+		e.err = e.flushChunk()
+	}
+	if e.err != nil {
+		return e.err
+	}
+	_, e.err = e.w.Write([]byte{0})
+	return e.err
+}
+
+// shift drops the data that can't be referred to any more.
+func (e *encoder) shift() {
+	n := min(e.pos-dictSize, e.chunk)
+	if n < shiftSize {
+		return
+	}
+
+	e.window = e.window[:copy(e.window, e.window[n:])]
+	e.chain = e.chain[:copy(e.chain, e.chain[n:])]
+	for _, t := range [][]int32{e.head, e.chain} {
+		for i, v := range t {
+			t[i] = max(v-int32(n), -1)
+		}
+	}
+	e.base += uint64(n)
+	e.pos -= n
+	e.chunk -= n
+}
+
+func (e *encoder) hash(i int) uint32 {
+	v := binary.LittleEndian.Uint32(e.window[i:])
+	return v * 2654435761 >> (32 - hashBits)
+}
+
+// insert adds the position i to the hash chains.
+func (e *encoder) insert(i int) {
+	if i+4 > len(e.window) {
+		return
+	}
+	h := e.hash(i)
+	e.chain[i] = e.head[h]
+	e.head[h] = int32(i)
+}
+
+// findMatch returns the length and distance minus one of the longest match
+// at i of at most n bytes, or 0 if there is none of at least 4 bytes.
+func (e *encoder) findMatch(i, n int) (int, uint32) {
+	if i+4 > len(e.window) {
+		return 0, 0
+	}
+
+	var best int
+	var dist uint32
+	cand := e.head[e.hash(i)]
+	for depth := 0; cand >= 0 && depth < chainDepth; depth++ {
+		c := int(cand)
+		if i-c > dictSize {
+			break
+		}
+		if best < n && e.window[c+best] == e.window[i+best] {
+			l := e.matchLen(c, i, n)
+			if l > best {
+				best, dist = l, uint32(i-c-1)
+				if l >= niceLen {
+					break
+				}
+			}
+		}
+		cand = e.chain[c]
+	}
+	if best < 4 {
+		return 0, 0
+	}
+	return best, dist
+}
+
+func (e *encoder) matchLen(a, b, n int) int {
+	l := 0
+	for l < n && e.window[a+l] == e.window[b+l] {
+		l++
+	}
+	return l
+}
+
+// encodeSymbol encodes the next literal or match and ends the chunk when it
+// is full.
+func (e *encoder) encodeSymbol() {
+	m := e.m
+	i := e.pos
+	pos := e.base + uint64(i) // in the data
+	n := min(len(e.window)-i, maxMatchLen)
+
+	repLen, rep := 0, 0
+	for k, r := range m.reps {
+		d := int(r) + 1
+		if uint64(d) > pos || d > i {
+			continue
+		}
+		if l := e.matchLen(i-d, i, n); l > repLen {
+			repLen, rep = l, k
+		}
+	}
+
+	l, dist := e.findMatch(i, n)
+	e.insert(i)
+
+	// Repeated distances are cheap, a longer match is taken only if it is
+	// longer by two bytes. A match is deferred by a literal if the next
+	// byte starts a longer one.
+	switch {
+	case repLen >= minMatchLen && repLen+1 >= l:
+		m.encodeRep(&e.rc, pos, rep, uint32(repLen))
+		e.advance(repLen)
+	case l > 0 && !e.betterNext(i+1, l):
+		m.encodeMatch(&e.rc, pos, dist, uint32(l))
+		e.advance(l)
+	default:
+		var prev, match byte
+		if pos > 0 {
+			prev = e.window[i-1]
+		}
+		d := int(m.reps[0]) + 1
+		if uint64(d) <= pos && d <= i {
+			match = e.window[i-d]
+		}
+		if uint64(d) <= pos && d <= i && match == e.window[i] {
+			m.encodeShortRep(&e.rc, pos)
+		} else {
+			m.encodeLiteral(&e.rc, pos, e.window[i], prev, match)
+		}
+		e.pos++
+	}
+
+	if e.pos-e.chunk > maxChunkSize-maxMatchLen ||
+		e.rc.size() > maxCompressedSize-maxSymbolSize {
+		e.err = e.flushChunk()
+	}
+}
+
+// betterNext reports whether the match at i is longer than l + 1.
+func (e *encoder) betterNext(i, l int) bool {
+	if l >= niceLen || i >= len(e.window) {
+		return false
+	}
+	next, _ := e.findMatch(i, min(len(e.window)-i, maxMatchLen))
+	return next > l+1
+}
+
+// advance moves past a match of length l, adding the positions in it to
+// the hash chains.
+func (e *encoder) advance(l int) {
+	for k := 1; k < l; k++ {
+		e.insert(e.pos + k)
+	}
+	e.pos += l
+}
+
+// flushChunk writes the symbols encoded since the start of the chunk. Data
+// that doesn't shrink is written as stored chunks instead, after which the
+// state is reset.
+func (e *encoder) flushChunk() error {
+	e.rc.flush()
+	data := e.window[e.chunk:e.pos]
+	u, c := len(data), len(e.rc.out)
+
+	if c >= u || c > maxCompressedSize {
+		for len(data) > 0 {
+			k := min(len(data), maxStoredSize)
+			ctrl := byte(2)
+			if e.first {
+				ctrl = 1 // dictionary reset
+			}
+			e.first = false
+			h := []byte{ctrl, byte((k - 1) >> 8), byte(k - 1)}
+			_, err := e.w.Write(h)
+			if err == nil {
+				_, err = e.w.Write(data[:k])
+			}
+			if err != nil {
+				return err
+			}
+			data = data[k:]
+		}
+		e.m.reset()
+		e.needProps = true
+	} else {
+		// Control bits: 0x80 LZMA, 0x20 state reset, 0x40 new
+		// properties and 0x60 dictionary reset.
+		ctrl := byte(0x80 | (u-1)>>16)
+		switch {
+		case e.first:
+			ctrl |= 0x60
+		case e.needProps:
+			ctrl |= 0x40
+		}
+		h := []byte{ctrl, byte((u - 1) >> 8), byte(u - 1),
+			byte((c - 1) >> 8), byte(c - 1)}
+		if ctrl >= 0xc0 {
+			h = append(h, e.m.props())
+		}
+		_, err := e.w.Write(h)
+		if err == nil {
+			_, err = e.w.Write(e.rc.out)
+		}
+		if err != nil {
+			return err
+		}
+		e.first = false
+		e.needProps = false
+	}
+
+	e.rc.reset()
+	e.chunk = e.pos
+	return nil
+}
+
+// decoder decompresses LZMA2 data read from r, one chunk at a time.
+type decoder struct {
+	r        io.Reader
+	dictSize int
+	m        *model
+	rc       rangeDecoder
+
+	dict  []byte // the history followed by the data not read yet
+	out   int    // start of the data not read yet
+	total uint64 // bytes since the last dictionary reset
+
+	needDictReset bool
+	needProps     bool
+	in            []byte
+	err           error
+}
+
+func newDecoder(r io.Reader, dictSize int) *decoder {
+	return &decoder{r: r, dictSize: dictSize, needDictReset: true,
+		needProps: true}
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for d.out == len(d.dict) {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.dict[d.out:])
+	d.out += n
+	return n, nil
+}
+
+// next decodes the next chunk, or returns io.EOF at the end of the data.
+func (d *decoder) next() error {
+	// Keep dictSize bytes of history, trimmed in steps of shiftSize.
+	if n := len(d.dict) - d.dictSize; n >= shiftSize {
+		d.dict = d.dict[:copy(d.dict, d.dict[n:])]
+		d.out -= n
+	}
+
+	var h [6]byte
+	err := readFull(d.r, h[:1])
+	if err != nil {
+		return err
+	}
+	ctrl := h[0]
+	switch {
+	case ctrl == 0:
+		return io.EOF
+	case ctrl == 1 || ctrl >= 0xe0:
+		d.dict = d.dict[:0]
+		d.out = 0
+		d.total = 0
+		d.needDictReset = false
+		d.needProps = true
+	case d.needDictReset || (ctrl > 2 && ctrl < 0x80):
+		return ErrCorrupt
+	}
+
+	if ctrl < 0x80 {
+		err = readFull(d.r, h[:2])
+		if err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(h[:])) + 1
+		start := len(d.dict)
+		d.dict = append(d.dict, make([]byte, n)...)
+		err = readFull(d.r, d.dict[start:])
+		if err != nil {
+			return err
+		}
+		d.total += uint64(n)
+		return nil
+	}
+
+	hlen := 4
+	if ctrl >= 0xc0 {
+		hlen++
+	}
+	err = readFull(d.r, h[:hlen])
+	if err != nil {
+		return err
+	}
+	u := int(ctrl&0x1f)<<16 + int(binary.BigEndian.Uint16(h[:])) + 1
+	c := int(binary.BigEndian.Uint16(h[2:])) + 1
+
+	switch {
+	case ctrl >= 0xc0:
+		lc, lp, pb, ok := parseProps(h[4])
+		if !ok {
+			return ErrCorrupt
+		}
+		d.m = newModel(lc, lp, pb)
+		d.needProps = false
+	case d.needProps:
+		return ErrCorrupt
+	case ctrl >= 0xa0:
+		d.m.reset()
+	}
+
+	if cap(d.in) < c {
+		d.in = make([]byte, c)
+	}
+	d.in = d.in[:c]
+	err = readFull(d.r, d.in)
+	if err != nil {
+		return err
+	}
+	if !d.rc.init(d.in) {
+		return ErrCorrupt
+	}
+
+	start := len(d.dict)
+	dict, ok := d.m.decode(&d.rc, d.dict, start+u, d.total, d.dictSize)
+	if !ok || !d.rc.finished() {
+		return ErrCorrupt
+	}
+	d.dict = dict
+	d.total += uint64(u)
+	return nil
+}
+
+func readFull(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package xz
+
+import "encoding/binary"
+
+// prob is the probability of a 0 bit, out of 1 << 11.
+type prob uint16
+
+const (
+	probBits  = 11
+	probInit  = 1 << (probBits - 1)
+	moveBits  = 5
+	topValue  = 1 << 24
+	rcMaxTail = 5 // bytes written by flush
+)
+
+func resetProbs(probs []prob) {
+	for i := range probs {
+		probs[i] = probInit
+	}
+}
+
+// rangeEncoder is the range encoder of LZMA. The carry of low is
+// propagated into the pending bytes, of which cacheSize are held back:
+// the cache byte followed by 0xff bytes.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func (rc *rangeEncoder) reset() {
+	rc.low = 0
+	rc.rng = 0xffffffff
+	rc.cache = 0
+	rc.cacheSize = 1
+	rc.out = rc.out[:0]
+}
+
+// size returns an upper bound of the number of bytes written after flush.
+func (rc *rangeEncoder) size() int {
+	return len(rc.out) + rc.cacheSize + rcMaxTail
+}
+
+func (rc *rangeEncoder) shiftLow() {
+	if uint32(rc.low) < 0xff000000 || rc.low>>32 != 0 {
+		carry := byte(rc.low >> 32)
+		b := rc.cache
+		for ; rc.cacheSize > 0; rc.cacheSize-- {
+			rc.out = append(rc.out, b+carry)
+			b = 0xff
+		}
+		rc.cache = byte(rc.low >> 24)
+	}
+	rc.cacheSize++
+	rc.low = uint64(uint32(rc.low) << 8)
+}
+
+func (rc *rangeEncoder) bit(p *prob, b uint32) {
+	bound := (rc.rng >> probBits) * uint32(*p)
+	if b == 0 {
+		rc.rng = bound
+		*p += (1<<probBits - *p) >> moveBits
+	} else {
+		rc.low += uint64(bound)
+		rc.rng -= bound
+		*p -= *p >> moveBits
+	}
+	for rc.rng < topValue {
+		rc.rng <<= 8
+		rc.shiftLow()
+	}
+}
+
+// direct encodes the n low bits of v with fixed probabilities.
+func (rc *rangeEncoder) direct(v uint32, n int) {
+	for n > 0 {
+		n--
+		rc.rng >>= 1
+		if v>>n&1 != 0 {
+			rc.low += uint64(rc.rng)
+		}
+		if rc.rng < topValue {
+			rc.rng <<= 8
+			rc.shiftLow()
+		}
+	}
+}
+
+// tree encodes the n low bits of v, highest first, with probs indexed by
+// the bits seen so far.
+func (rc *rangeEncoder) tree(probs []prob, n int, v uint32) {
+	m := uint32(1)
+	for i := n - 1; i >= 0; i-- {
+		b := v >> i & 1
+		rc.bit(&probs[m], b)
+		m = m<<1 | b
+	}
+}
+
+// reverseTree encodes the n low bits of v, lowest first, with the
+// probabilities at probs[off+1:].
+func (rc *rangeEncoder) reverseTree(probs []prob, off int, n int, v uint32) {
+	m := 1
+	for i := 0; i < n; i++ {
+		b := v & 1
+		v >>= 1
+		rc.bit(&probs[off+m], b)
+		m = m<<1 | int(b)
+	}
+}
+
+func (rc *rangeEncoder) flush() {
+	for i := 0; i < rcMaxTail; i++ {
+		rc.shiftLow()
+	}
+}
+
+// rangeDecoder decodes the data of a single LZMA2 chunk. Reads past the end
+// of in return 0 and are reported by finished.
+type rangeDecoder struct {
+	rng  uint32
+	code uint32
+	in   []byte
+	pos  int
+}
+
+func (rc *rangeDecoder) init(in []byte) bool {
+	if len(in) < rcMaxTail || in[0] != 0 {
+		return false
+	}
+	rc.rng = 0xffffffff
+	rc.code = binary.BigEndian.Uint32(in[1:])
+	rc.in = in
+	rc.pos = rcMaxTail
+	return rc.code != 0xffffffff
+}
+
+// overrun reports whether more bytes were read than in holds.
+func (rc *rangeDecoder) overrun() bool {
+	return rc.pos > len(rc.in)
+}
+
+// finished reports whether all of in was read and the data ended cleanly.
+func (rc *rangeDecoder) finished() bool {
+	return rc.pos == len(rc.in) && rc.code == 0
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < topValue {
+		rc.rng <<= 8
+		rc.code <<= 8
+		if rc.pos < len(rc.in) {
+			rc.code |= uint32(rc.in[rc.pos])
+		}
+		rc.pos++
+	}
+}
+
+func (rc *rangeDecoder) bit(p *prob) uint32 {
+	bound := (rc.rng >> probBits) * uint32(*p)
+	var b uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (1<<probBits - *p) >> moveBits
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*p -= *p >> moveBits
+		b = 1
+	}
+	rc.normalize()
+	return b
+}
+
+func (rc *rangeDecoder) direct(n int) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		rc.rng >>= 1
+		v <<= 1
+		if rc.code >= rc.rng {
+			rc.code -= rc.rng
+			v |= 1
+		}
+		rc.normalize()
+	}
+	return v
+}
+
+func (rc *rangeDecoder) tree(probs []prob, n int) uint32 {
+	m := uint32(1)
+	for i := 0; i < n; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+func (rc *rangeDecoder) reverseTree(probs []prob, off int, n int) uint32 {
+	var v uint32
+	m := 1
+	for i := 0; i < n; i++ {
+		b := rc.bit(&probs[off+m])
+		m = m<<1 | int(b)
+		v |= b << i
+	}
+	return v
+}
@@ -0,0 +1,484 @@
+// Package xz implements the xz container format with LZMA2 compression, as
+// described in the .xz file format specification. Streams are written as a
+// single block with a CRC64 check.
+package xz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+var (
+	ErrCorrupt     = errors.New("Corrupt xz data.")
+	ErrUnsupported = errors.New("Unsupported xz data.")
+	errClosed      = errors.New("Write after close.")
+)
+
+var (
+	headerMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+	footerMagic = []byte{'Y', 'Z'}
+
+	crc64Table = crc64.MakeTable(crc64.ECMA)
+)
+
+const (
+	checkNone   = 0
+	checkCRC32  = 1
+	checkCRC64  = 4
+	checkSHA256 = 10
+
+	filterLZMA2 = 0x21
+
+	// The dictionary size of written streams, 8 MiB.
+	dictProp = 24
+)
+
+// Writer compresses data to an xz stream.
+type Writer struct {
+	w     *countWriter
+	enc   *encoder
+	check hash.Hash64
+	size  uint64 // of the uncompressed data
+	err   error
+}
+
+// NewWriter returns a writer compressing data to w. Close must be called to
+// end the stream.
+func NewWriter(w io.Writer) *Writer {
+	cw := &countWriter{w: w}
+	return &Writer{w: cw, enc: newEncoder(cw), check: crc64.New(crc64Table)}
+}
+
+func (zw *Writer) Write(p []byte) (int, error) {
+	if zw.err != nil {
+		return 0, zw.err
+	}
+	if zw.w.n == 0 {
+		zw.err = zw.writeHeaders()
+		if zw.err != nil {
+			return 0, zw.err
+		}
+	}
+
+	var n int
+	n, zw.err = zw.enc.Write(p)
+	zw.check.Write(p[:n])
+	zw.size += uint64(n)
+	return n, zw.err
+}
+
+// Close writes the end of the block, the index and the stream footer. It
+// doesn't close the underlying writer.
+func (zw *Writer) Close() error {
+	if zw.err != nil {
+		return zw.err
+	}
+	if zw.w.n == 0 {
+		zw.err = zw.writeHeaders()
+		if zw.err != nil {
+			return zw.err
+		}
+	}
+
+	zw.err = zw.enc.Close()
+	if zw.err != nil {
+		return zw.err
+	}
+	var buf []byte
+	buf = append(buf, make([]byte, padding(zw.w.n))...)
+	buf = binary.LittleEndian.AppendUint64(buf, zw.check.Sum64())
+
+	// The unpadded size of the block covers its header, data and check.
+	unpadded := zw.w.n - streamHeaderSize + 8
+	index := []byte{0, 1}
+	index = binary.AppendUvarint(index, unpadded)
+	index = binary.AppendUvarint(index, zw.size)
+	index = append(index, make([]byte, padding(uint64(len(index))))...)
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+	buf = append(buf, index...)
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, 0, checkCRC64)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(footer))
+	buf = append(buf, footer...)
+	buf = append(buf, footerMagic...)
+
+	_, zw.err = zw.w.Write(buf)
+	if zw.err != nil {
+		return zw.err
+	}
+	zw.err = errClosed
+	return nil
+}
+
+const (
+	blockHeaderSize  = 12
+	streamHeaderSize = 12
+)
+
+// writeHeaders writes the stream header and the header of the only block.
+func (zw *Writer) writeHeaders() error {
+	flags := []byte{0, checkCRC64}
+	h := append([]byte{}, headerMagic...)
+	h = append(h, flags...)
+	h = binary.LittleEndian.AppendUint32(h, crc32.ChecksumIEEE(flags))
+
+	// A single LZMA2 filter without the optional sizes.
+	block := []byte{blockHeaderSize/4 - 1, 0, filterLZMA2, 1, dictProp, 0, 0, 0}
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(block))
+	_, err := zw.w.Write(append(h, block...))
+	return err
+}
+
+type countWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
+// Reader decompresses an xz stream. Streams may have several blocks and any
+// of the checks CRC32, CRC64 and SHA-256, but the only supported filter is
+// LZMA2.
+type Reader struct {
+	r      *countReader
+	header bool
+	check  byte
+
+	block      *decoder
+	hash       hash.Hash
+	start      uint64 // of the current block
+	headerSize uint64
+	flags      byte   // of the block header
+	compressed uint64 // the sizes in the block header
+	wantSize   uint64
+	size       uint64 // of the data of the current block
+
+	records [][2]uint64 // unpadded and uncompressed sizes of the blocks
+	err     error
+}
+
+// NewReader returns a reader decompressing the stream read from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: &countReader{r: r}}
+}
+
+func (zr *Reader) Read(p []byte) (int, error) {
+	for {
+		if zr.err != nil {
+			return 0, zr.err
+		}
+		if zr.block == nil {
+			zr.err = zr.next()
+			continue
+		}
+
+		n, err := zr.block.Read(p)
+		if zr.hash != nil {
+			zr.hash.Write(p[:n])
+		}
+		zr.size += uint64(n)
+		if err == io.EOF {
+			zr.err = zr.endBlock()
+		} else if err != nil {
+			zr.err = err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// next reads the stream header if needed and the next block header, or
+// returns io.EOF after the index and the stream footer.
+func (zr *Reader) next() error {
+	if !zr.header {
+		err := zr.readHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	start := zr.r.n
+	var b [1024]byte
+	err := readFull(zr.r, b[:1])
+	if err != nil {
+		return err
+	}
+	if b[0] == 0 {
+		return zr.readIndex()
+	}
+
+	size := (int(b[0]) + 1) * 4
+	h := b[:size]
+	err = readFull(zr.r, h[1:])
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(h[:size-4]) !=
+		binary.LittleEndian.Uint32(h[size-4:]) {
+		return ErrCorrupt
+	}
+
+	flags := h[1]
+	if flags&0x3c != 0 {
+		return ErrUnsupported
+	}
+	v := bytes.NewReader(h[2 : size-4])
+	if flags&0x40 != 0 {
+		zr.compressed, err = readUvarint(v)
+		if err != nil || zr.compressed == 0 {
+			return ErrCorrupt
+		}
+	}
+	if flags&0x80 != 0 {
+		zr.wantSize, err = readUvarint(v)
+		if err != nil {
+			return ErrCorrupt
+		}
+	}
+
+	// Only a single LZMA2 filter is supported.
+	id, err := readUvarint(v)
+	if err != nil {
+		return ErrCorrupt
+	}
+	plen, err := readUvarint(v)
+	if err != nil || plen > uint64(v.Len()) {
+		return ErrCorrupt
+	}
+	if flags&3 != 0 || id != filterLZMA2 {
+		return ErrUnsupported
+	}
+	prop, _ := v.ReadByte()
+	if plen != 1 || prop > 40 {
+		return ErrCorrupt
+	}
+	for v.Len() > 0 {
+		if c, _ := v.ReadByte(); c != 0 {
+			return ErrCorrupt
+		}
+	}
+
+	dict := 2 | int(prop)&1
+	dict <<= prop/2 + 11
+	if prop == 40 {
+		dict = 0xffffffff
+	}
+	zr.block = newDecoder(zr.r, dict)
+	zr.hash = newCheck(zr.check)
+	zr.start = start
+	zr.headerSize = uint64(size)
+	zr.flags = flags
+	zr.size = 0
+	return nil
+}
+
+// endBlock verifies the sizes and the check of the block that was read.
+func (zr *Reader) endBlock() error {
+	compressed := zr.r.n - zr.start - zr.headerSize
+	if zr.flags&0x40 != 0 && compressed != zr.compressed ||
+		zr.flags&0x80 != 0 && zr.size != zr.wantSize {
+		return ErrCorrupt
+	}
+
+	err := readPadding(zr.r, compressed)
+	if err != nil {
+		return err
+	}
+	sum := make([]byte, checkSize(zr.check))
+	err = readFull(zr.r, sum)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checkSum(zr.check, zr.hash), sum) {
+		return ErrCorrupt
+	}
+
+	unpadded := zr.headerSize + compressed + uint64(len(sum))
+	zr.records = append(zr.records, [2]uint64{unpadded, zr.size})
+	zr.block = nil
+	return nil
+}
+
+func (zr *Reader) readHeader() error {
+	var b [12]byte
+	err := readFull(zr.r, b[:])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b[:6], headerMagic) || crc32.ChecksumIEEE(b[6:8]) !=
+		binary.LittleEndian.Uint32(b[8:]) {
+		return ErrCorrupt
+	}
+	if b[6] != 0 || b[7]&0xf0 != 0 {
+		return ErrUnsupported
+	}
+	switch b[7] {
+	case checkNone, checkCRC32, checkCRC64, checkSHA256:
+	default:
+		return ErrUnsupported
+	}
+	zr.check = b[7]
+	zr.header = true
+	return nil
+}
+
+// readIndex verifies the index against the blocks that were read, and the
+// stream footer after it. The index indicator was already read.
+func (zr *Reader) readIndex() error {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{0})
+	r := &countReader{r: io.TeeReader(zr.r, crc), n: 1}
+
+	n, err := readUvarint(r)
+	if err != nil {
+		return err
+	}
+	if n != uint64(len(zr.records)) {
+		return ErrCorrupt
+	}
+	for _, rec := range zr.records {
+		for _, want := range rec {
+			v, err := readUvarint(r)
+			if err != nil {
+				return err
+			}
+			if v != want {
+				return ErrCorrupt
+			}
+		}
+	}
+	err = readPadding(r, r.n)
+	if err != nil {
+		return err
+	}
+	sum := crc.Sum32()
+	size := r.n + 4
+
+	// The CRC32 of the index, then the footer: its CRC32, the size of the
+	// index, the stream flags and the magic bytes.
+	var b [16]byte
+	err = readFull(zr.r, b[:])
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b[:]) != sum ||
+		crc32.ChecksumIEEE(b[8:14]) != binary.LittleEndian.Uint32(b[4:]) ||
+		!bytes.Equal(b[14:], footerMagic) {
+		return ErrCorrupt
+	}
+	if binary.LittleEndian.Uint32(b[8:]) != uint32(size/4-1) ||
+		b[12] != 0 || b[13] != zr.check {
+		return ErrCorrupt
+	}
+	return io.EOF
+}
+
+// readPadding reads the zero bytes padding n bytes to a multiple of four.
+func readPadding(r io.Reader, n uint64) error {
+	var b [3]byte
+	pad := b[:padding(n)]
+	err := readFull(r, pad)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pad, make([]byte, len(pad))) {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func padding(n uint64) int {
+	return int(-n & 3)
+}
+
+type countReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
+func (cr *countReader) ReadByte() (byte, error) {
+	var b [1]byte
+	err := readFull(cr, b[:])
+	return b[0], err
+}
+
+// readUvarint reads a variable length integer of at most 9 bytes, which
+// must not end with a zero byte unless it is the only one.
+func readUvarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, ErrCorrupt
+			}
+			return v, nil
+		}
+	}
+	return 0, ErrCorrupt
+}
+
+func newCheck(check byte) hash.Hash {
+	switch check {
+	case checkCRC32:
+		return crc32.NewIEEE()
+	case checkCRC64:
+		return crc64.New(crc64Table)
+	case checkSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+func checkSize(check byte) int {
+	switch check {
+	case checkCRC32:
+		return 4
+	case checkCRC64:
+		return 8
+	case checkSHA256:
+		return 32
+	}
+	return 0
+}
+
+// checkSum returns the check of a block as stored, the CRCs being little
+// endian.
+func checkSum(check byte, h hash.Hash) []byte {
+	switch check {
+	case checkCRC32:
+		return binary.LittleEndian.AppendUint32(nil,
+			h.(hash.Hash32).Sum32())
+	case checkCRC64:
+		return binary.LittleEndian.AppendUint64(nil,
+			h.(hash.Hash64).Sum64())
+	case checkSHA256:
+		return h.Sum(nil)
+	}
+	return []byte{}
+}
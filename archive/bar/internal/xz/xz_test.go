@@ -0,0 +1,204 @@
+package xz
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t testing.TB, name string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decompress(b []byte) ([]byte, error) {
+	return io.ReadAll(NewReader(bytes.NewReader(b)))
+}
+
+func compress(t testing.TB, data []byte, chunk int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := NewWriter(&buf)
+	for p := data; len(p) > 0; {
+		n, err := zw.Write(p[:min(chunk, len(p))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The files in testdata were written by the xz command, version 5.6.4,
+// with the level or options in their names.
+func TestReader(t *testing.T) {
+	readme := readFile(t, "readme.txt")
+	tests := []struct {
+		file string
+		want []byte
+	}{
+		{"readme-0.xz", readme},
+		{"readme-9e.xz", readme},
+		{"readme-crc32.xz", readme},
+		{"readme-none.xz", readme},
+		{"readme-sha256.xz", readme},
+		{"readme-blocks.xz", readme},
+		{"readme-x10.xz", bytes.Repeat(readme, 10)},
+		{"zeros.xz", make([]byte, 300000)},
+		{"random.xz", readFile(t, "random.bin")},
+		{"empty.xz", []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := decompress(readFile(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	stream := readFile(t, "readme-0.xz")
+	change := func(i int, b byte) []byte {
+		c := bytes.Clone(stream)
+		if i < 0 {
+			i += len(c)
+		}
+		c[i] = b
+		return c
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.ErrUnexpectedEOF},
+		{"truncated", stream[:len(stream)/2], io.ErrUnexpectedEOF},
+		{"no footer", stream[:len(stream)-12], io.ErrUnexpectedEOF},
+		{"magic", change(0, 0xfe), ErrCorrupt},
+		{"stream flags", change(7, 5), ErrCorrupt},
+		{"footer magic", change(-1, 'X'), ErrCorrupt},
+		{"x86 filter", readFile(t, "readme-x86.xz"), ErrUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decompress(tt.data)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	// Changed bits are found by the CRC32 of the headers and the data, or
+	// by the LZMA2 decoder.
+	stream := readFile(t, "readme-crc32.xz")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		c := bytes.Clone(stream)
+		c[r.Intn(len(c))] ^= 1 << r.Intn(8)
+		_, err := decompress(c)
+		if err == nil {
+			t.Fatalf("changed data read without error")
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 300000)
+	r.Read(random)
+	readme := readFile(t, "readme.txt")
+	mixed := bytes.Clone(random)
+	for i := 0; i < len(mixed); i += 2000 {
+		copy(mixed[i:], readme[:1000])
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		grows bool // random data is stored in uncompressed chunks
+	}{
+		{"empty", nil, true},
+		{"byte", []byte{'a'}, true},
+		{"short", []byte("hello, hello, hello"), true},
+		{"text", readme, false},
+		{"repeated", bytes.Repeat(readme, 200), false},
+		{"zeros", make([]byte, 3<<20), false},
+		{"random", random, true},
+		{"mixed", mixed, false},
+	}
+
+	xzCmd, _ := exec.LookPath("xz")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, chunk := range []int{1000, 1 << 20} {
+				b := compress(t, tt.data, chunk)
+				got, err := decompress(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("got %d bytes, want %d", len(got), len(tt.data))
+				}
+				if grows := len(b) > len(tt.data); grows != tt.grows {
+					t.Errorf("%d bytes compressed to %d", len(tt.data), len(b))
+				}
+
+				if xzCmd == "" {
+					continue
+				}
+				cmd := exec.Command(xzCmd, "-d", "-c")
+				cmd.Stdin = bytes.NewReader(b)
+				got, err = cmd.Output()
+				if err != nil || !bytes.Equal(got, tt.data) {
+					t.Errorf("xz -d: %d bytes, %v", len(got), err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	zw := NewWriter(io.Discard)
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zw.Write([]byte("late"))
+	if !errors.Is(err, errClosed) {
+		t.Errorf("got %v, want %v", err, errClosed)
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	for _, name := range []string{"readme-0.xz", "readme-blocks.xz", "zeros.xz"} {
+		f.Add(readFile(f, name))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		decompress(b)
+	})
+}
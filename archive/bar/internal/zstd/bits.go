@@ -0,0 +1,131 @@
+package zstd
+
+import "math/bits"
+
+// forwardReader reads the bits of b from the start, the low bits of every
+// byte first. FSE table descriptions are read this way.
+type forwardReader struct {
+	b   []byte
+	pos int // in bits
+}
+
+// read returns the next n bits, n at most 32, or false at the end of b.
+func (fr *forwardReader) read(n uint) (uint32, bool) {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		if fr.pos>>3 >= len(fr.b) {
+			return 0, false
+		}
+		v |= uint32(fr.b[fr.pos>>3]>>(fr.pos&7)&1) << i
+		fr.pos++
+	}
+	return v, true
+}
+
+// backwardReader reads the bits of a bitstream from its end, the high bits
+// first, after the highest set bit of the last byte, which marks the end.
+// Huffman and FSE coded data is read this way.
+type backwardReader struct {
+	b    []byte // the bytes not loaded into v
+	v    uint64 // the low n bits are the next bits
+	n    uint
+	over bool // more bits were read than there are
+}
+
+func newBackwardReader(b []byte) (backwardReader, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return backwardReader{}, ErrCorrupt
+	}
+	last := b[len(b)-1]
+	n := uint(bits.Len8(last)) - 1
+	br := backwardReader{b: b[:len(b)-1], v: uint64(last) & (1<<n - 1), n: n}
+	br.fill()
+	return br, nil
+}
+
+func (br *backwardReader) fill() {
+	for br.n <= 56 && len(br.b) > 0 {
+		br.v = br.v<<8 | uint64(br.b[len(br.b)-1])
+		br.b = br.b[:len(br.b)-1]
+		br.n += 8
+	}
+}
+
+// read returns the next n bits, n at most 56. Reading past the start of
+// the bitstream returns zero bits and sets over.
+func (br *backwardReader) read(n uint) uint64 {
+	if br.n < n {
+		br.fill()
+		if br.n < n {
+			v := br.v << (n - br.n)
+			br.v, br.n, br.over = 0, 0, true
+			return v
+		}
+	}
+	br.n -= n
+	v := br.v >> br.n
+	br.v &= 1<<br.n - 1
+	return v
+}
+
+// peek returns the next n bits without reading them, followed by zero bits
+// at the start of the bitstream.
+func (br *backwardReader) peek(n uint) uint64 {
+	if br.n < n {
+		br.fill()
+		if br.n < n {
+			return br.v << (n - br.n)
+		}
+	}
+	return br.v >> (br.n - n)
+}
+
+// skip reads n bits after peek.
+func (br *backwardReader) skip(n uint) {
+	if br.n < n {
+		br.v, br.n, br.over = 0, 0, true
+		return
+	}
+	br.n -= n
+	br.v &= 1<<br.n - 1
+}
+
+// done reports whether the bitstream was read exactly to its start.
+func (br *backwardReader) done() bool {
+	return br.n == 0 && len(br.b) == 0 && !br.over
+}
+
+// bitWriter appends bits to b, the low bits of every byte first. Written
+// bitstreams are read backwards, see close.
+type bitWriter struct {
+	b []byte
+	v uint64 // the low n bits are not in b yet
+	n uint
+}
+
+// write appends the low n bits of v, n at most 32.
+func (bw *bitWriter) write(v uint64, n uint) {
+	bw.v |= (v & (1<<n - 1)) << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.b = append(bw.b, byte(bw.v))
+		bw.v >>= 8
+		bw.n -= 8
+	}
+}
+
+// flush appends the last byte, padded with zero bits.
+func (bw *bitWriter) flush() []byte {
+	if bw.n > 0 {
+		bw.b = append(bw.b, byte(bw.v))
+		bw.v, bw.n = 0, 0
+	}
+	return bw.b
+}
+
+// close ends a bitstream read backwards with a set bit, which a
+// backwardReader starts after.
+func (bw *bitWriter) close() []byte {
+	bw.write(1, 1)
+	return bw.flush()
+}
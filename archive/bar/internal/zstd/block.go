@@ -0,0 +1,333 @@
+package zstd
+
+import "encoding/binary"
+
+const (
+	litRaw = iota
+	litRLE
+	litCompressed
+	litTreeless
+)
+
+const (
+	modePredefined = iota
+	modeRLE
+	modeCompressed
+	modeRepeat
+)
+
+const (
+	maxLLSym = 35
+	maxOFSym = 31
+	maxMLSym = 52
+
+	maxLLLog = 9
+	maxOFLog = 8
+	maxMLLog = 9
+)
+
+// The baselines and numbers of extra bits of the literal length and match
+// length codes.
+var (
+	llBase = [maxLLSym + 1]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048,
+		4096, 8192, 16384, 32768, 65536,
+	}
+	llBits = [maxLLSym + 1]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+	mlBase = [maxMLSym + 1]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027,
+		2051, 4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [maxMLSym + 1]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10,
+		11, 12, 13, 14, 15, 16,
+	}
+)
+
+// The predefined distributions of the codes.
+var (
+	llNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	ofNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+	mlNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+
+	llPredefined = mustFSETable(llNorm, 6)
+	ofPredefined = mustFSETable(ofNorm, 5)
+	mlPredefined = mustFSETable(mlNorm, 6)
+)
+
+// decoder holds the state the blocks of a frame share: the tables blocks
+// may repeat and the repeated offsets.
+type decoder struct {
+	huff       []huffEntry
+	huffLog    uint
+	ll, of, ml fseTable
+	reps       [3]int
+	lits       []byte
+}
+
+func (d *decoder) reset() {
+	d.huff = d.huff[:0]
+	d.ll, d.of, d.ml = fseTable{}, fseTable{}, fseTable{}
+	d.reps = [3]int{1, 4, 8}
+}
+
+// decompressBlock appends the data of the compressed block src to dst,
+// whose contents are the window matches may refer to. The result must not
+// be longer than limit.
+func (d *decoder) decompressBlock(dst, src []byte, limit int) ([]byte, error) {
+	lits, n, err := d.readLiterals(src)
+	if err != nil {
+		return nil, err
+	}
+	return d.execSequences(dst, src[n:], lits, limit)
+}
+
+// readLiterals returns the literals of the literals section at the start of
+// src and its size.
+func (d *decoder) readLiterals(src []byte) ([]byte, int, error) {
+	if len(src) == 0 {
+		return nil, 0, ErrCorrupt
+	}
+	typ, format := src[0]&3, src[0]>>2&3
+
+	if typ == litRaw || typ == litRLE {
+		var size, n int
+		switch format {
+		case 0, 2:
+			size, n = int(src[0]>>3), 1
+		case 1:
+			if len(src) < 2 {
+				return nil, 0, ErrCorrupt
+			}
+			size, n = int(src[0]>>4)|int(src[1])<<4, 2
+		case 3:
+			if len(src) < 3 {
+				return nil, 0, ErrCorrupt
+			}
+			size, n = int(src[0]>>4)|int(src[1])<<4|int(src[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return nil, 0, ErrCorrupt
+		}
+		if typ == litRaw {
+			if n+size > len(src) {
+				return nil, 0, ErrCorrupt
+			}
+			return src[n : n+size], n + size, nil
+		}
+		if n+1 > len(src) {
+			return nil, 0, ErrCorrupt
+		}
+		d.lits = d.lits[:0]
+		for i := 0; i < size; i++ {
+			d.lits = append(d.lits, src[n])
+		}
+		return d.lits, n + 1, nil
+	}
+
+	// The sizes of Huffman coded literals take 10, 14 or 18 bits.
+	n, sizeBits, streams := 3, 10, 4
+	switch format {
+	case 0:
+		streams = 1
+	case 2:
+		n, sizeBits = 4, 14
+	case 3:
+		n, sizeBits = 5, 18
+	}
+	if len(src) < n {
+		return nil, 0, ErrCorrupt
+	}
+	var b [8]byte
+	copy(b[:], src[:n])
+	h := binary.LittleEndian.Uint64(b[:])
+	mask := uint64(1)<<sizeBits - 1
+	size := int(h >> 4 & mask)
+	csize := int(h >> (4 + sizeBits) & mask)
+	if size > maxBlockSize || n+csize > len(src) {
+		return nil, 0, ErrCorrupt
+	}
+	data := src[n : n+csize]
+
+	// Treeless literals use the table of the block before.
+	if typ == litCompressed {
+		m, err := d.readHuffTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = data[m:]
+	} else if len(d.huff) == 0 {
+		return nil, 0, ErrCorrupt
+	}
+	lits, err := d.decodeLiterals(d.lits[:0], data, size, streams)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.lits = lits
+	return lits, n + csize, nil
+}
+
+// execSequences appends the literals and matches of the sequences section
+// src to dst, followed by the literals left.
+func (d *decoder) execSequences(dst, src, lits []byte, limit int) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, ErrCorrupt
+	}
+	nseq, i := int(src[0]), 1
+	switch {
+	case nseq == 0:
+		if len(src) != 1 || len(lits) > limit-len(dst) {
+			return nil, ErrCorrupt
+		}
+		return append(dst, lits...), nil
+	case nseq == 255:
+		if len(src) < 3 {
+			return nil, ErrCorrupt
+		}
+		nseq, i = int(src[1])|int(src[2])<<8+0x7f00, 3
+	case nseq >= 128:
+		if len(src) < 2 {
+			return nil, ErrCorrupt
+		}
+		nseq, i = (nseq-128)<<8|int(src[1]), 2
+	}
+	if i >= len(src) || src[i]&3 != 0 {
+		return nil, ErrCorrupt
+	}
+	modes := src[i]
+	i++
+
+	for _, t := range []struct {
+		table  *fseTable
+		mode   byte
+		maxSym int
+		maxLog uint
+		predef fseTable
+	}{
+		{&d.ll, modes >> 6, maxLLSym, maxLLLog, llPredefined},
+		{&d.of, modes >> 4 & 3, maxOFSym, maxOFLog, ofPredefined},
+		{&d.ml, modes >> 2 & 3, maxMLSym, maxMLLog, mlPredefined},
+	} {
+		switch t.mode {
+		case modePredefined:
+			*t.table = t.predef
+		case modeRLE:
+			if i >= len(src) || int(src[i]) > t.maxSym {
+				return nil, ErrCorrupt
+			}
+			*t.table = rleTable(src[i])
+			i++
+		case modeCompressed:
+			norm, log, n, err := readNCount(src[i:], t.maxSym, t.maxLog)
+			if err != nil {
+				return nil, err
+			}
+			*t.table, err = newFSETable(norm, log)
+			if err != nil {
+				return nil, err
+			}
+			i += n
+		case modeRepeat:
+			if t.table.entries == nil {
+				return nil, ErrCorrupt
+			}
+		}
+	}
+
+	br, err := newBackwardReader(src[i:])
+	if err != nil {
+		return nil, err
+	}
+	llState := br.read(d.ll.log)
+	ofState := br.read(d.of.log)
+	mlState := br.read(d.ml.log)
+
+	for n := 0; n < nseq; n++ {
+		ll, of, ml := d.ll.entries[llState], d.of.entries[ofState],
+			d.ml.entries[mlState]
+
+		// The extra bits of the offset come first.
+		ov := 1<<of.sym + int(br.read(uint(of.sym)))
+		mlen := int(mlBase[ml.sym]) + int(br.read(uint(mlBits[ml.sym])))
+		llen := int(llBase[ll.sym]) + int(br.read(uint(llBits[ll.sym])))
+		offset := d.offset(ov, llen)
+
+		if n < nseq-1 {
+			llState = uint64(ll.base) + br.read(uint(ll.bits))
+			mlState = uint64(ml.base) + br.read(uint(ml.bits))
+			ofState = uint64(of.base) + br.read(uint(of.bits))
+		}
+		if br.over {
+			return nil, ErrCorrupt
+		}
+
+		if llen > len(lits) || llen+mlen > limit-len(dst) {
+			return nil, ErrCorrupt
+		}
+		dst = append(dst, lits[:llen]...)
+		lits = lits[llen:]
+		if offset <= 0 || offset > len(dst) {
+			return nil, ErrCorrupt
+		}
+
+		// Matches may overlap the data they produce.
+		pos := len(dst) - offset
+		for mlen > 0 {
+			m := min(mlen, offset)
+			dst = append(dst, dst[pos:pos+m]...)
+			pos += m
+			mlen -= m
+		}
+	}
+	if !br.done() || len(lits) > limit-len(dst) {
+		return nil, ErrCorrupt
+	}
+	return append(dst, lits...), nil
+}
+
+// offset returns the offset of the offset value ov of a sequence with llen
+// literals and updates the repeated offsets. Values 1 to 3 repeat one of
+// the last offsets, shifted by one without literals.
+func (d *decoder) offset(ov, llen int) int {
+	if ov > 3 {
+		d.reps = [3]int{ov - 3, d.reps[0], d.reps[1]}
+		return ov - 3
+	}
+
+	i := ov - 1
+	if llen == 0 {
+		i++
+	}
+	switch i {
+	case 0:
+		return d.reps[0]
+	case 1:
+		d.reps = [3]int{d.reps[1], d.reps[0], d.reps[2]}
+	case 2:
+		d.reps = [3]int{d.reps[2], d.reps[0], d.reps[1]}
+	case 3:
+		d.reps = [3]int{d.reps[0] - 1, d.reps[0], d.reps[1]}
+	}
+	return d.reps[0]
+}
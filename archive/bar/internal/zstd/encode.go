@@ -0,0 +1,319 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+const (
+	minMatch = 4
+	hashLog  = 16
+)
+
+// seq is a sequence of a block being compressed: llen literals followed by
+// a match of mlen bytes with the offset value ov.
+type seq struct {
+	llen, mlen, ov uint32
+}
+
+// encoder holds the state the blocks of a frame share and buffers reused
+// for every block.
+type encoder struct {
+	table [1 << hashLog]int32 // positions in the window, or -1
+	reps  [3]int
+	seqs  []seq
+	lits  []byte
+	codes [3][]uint8
+}
+
+func newEncoder() *encoder {
+	enc := &encoder{reps: [3]int{1, 4, 8}}
+	for i := range enc.table {
+		enc.table[i] = -1
+	}
+	return enc
+}
+
+// shift moves the positions in the hash table n bytes back, after the
+// window moved.
+func (enc *encoder) shift(n int) {
+	for i, p := range enc.table {
+		enc.table[i] = max(p-int32(n), -1)
+	}
+}
+
+func hash(v uint64) uint32 {
+	return uint32(v << 16 * 0xcf1bbcdcb7a56463 >> (64 - hashLog))
+}
+
+// compressBlock appends the compressed block of buf[start:], which may
+// refer to buf[:start], to dst. It returns false if the block doesn't
+// shrink, the repeated offsets are kept then.
+func (enc *encoder) compressBlock(dst, buf []byte, start int) ([]byte, bool) {
+	reps := enc.reps
+	enc.findSequences(buf, start)
+	n := len(dst)
+	dst = appendLiterals(dst, enc.lits)
+	dst = enc.appendSequences(dst)
+	if len(dst)-n >= len(buf)-start {
+		enc.reps = reps
+		return dst[:n], false
+	}
+	return dst, true
+}
+
+// findSequences finds the sequences of buf[start:] and the literals they
+// copy, with a hash table of the last position of every 6 byte value. The
+// last offset is tried first, and a match is put off by one byte if a
+// longer one starts there.
+func (enc *encoder) findSequences(buf []byte, start int) {
+	enc.seqs = enc.seqs[:0]
+	enc.lits = enc.lits[:0]
+	end := len(buf)
+	anchor := start
+	for i := start; i+8 <= end; {
+		ref, m := enc.match(buf, i, anchor)
+		if ref < 0 {
+			// Skip faster through data without matches.
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+		if i+9 <= end {
+			if ref2, m2 := enc.match(buf, i+1, anchor); ref2 >= 0 && m2-(i+1) > m-i {
+				i, ref, m = i+1, ref2, m2
+			}
+		}
+
+		for i > anchor && ref > 0 && buf[i-1] == buf[ref-1] {
+			i--
+			ref--
+		}
+		enc.addSequence(buf[anchor:i], i-ref, m-i)
+		if m+8 <= end {
+			enc.table[hash(binary.LittleEndian.Uint64(buf[m-2:]))] = int32(m - 2)
+		}
+		i = m
+		anchor = m
+	}
+	enc.lits = append(enc.lits, buf[anchor:]...)
+}
+
+// match returns the start and end of a match at i, or -1.
+func (enc *encoder) match(buf []byte, i, anchor int) (int, int) {
+	v := binary.LittleEndian.Uint64(buf[i:])
+	h := hash(v)
+	ref := int(enc.table[h])
+	enc.table[h] = int32(i)
+
+	rep := i - enc.reps[0]
+	switch {
+	case i > anchor && rep >= 0 && uint32(binary.LittleEndian.Uint64(buf[rep:])) == uint32(v):
+		ref = rep
+	case ref < 0 || i-ref > windowSize ||
+		uint32(binary.LittleEndian.Uint64(buf[ref:])) != uint32(v):
+		return -1, 0
+	}
+	m := i + minMatch
+	for m < len(buf) && buf[m] == buf[ref+m-i] {
+		m++
+	}
+	return ref, m
+}
+
+// addSequence adds the sequence of lits and a match and updates the
+// repeated offsets like the decoder.
+func (enc *encoder) addSequence(lits []byte, offset, mlen int) {
+	ov := offset + 3
+	if offset == enc.reps[0] && len(lits) > 0 {
+		ov = 1
+	} else {
+		enc.reps = [3]int{offset, enc.reps[0], enc.reps[1]}
+	}
+	enc.seqs = append(enc.seqs, seq{uint32(len(lits)), uint32(mlen), uint32(ov)})
+	enc.lits = append(enc.lits, lits...)
+}
+
+// appendLiterals appends the literals section of lits, Huffman coded if
+// that saves space.
+func appendLiterals(dst, lits []byte) []byte {
+	var counts [256]int
+	last := 0
+	for _, b := range lits {
+		counts[b]++
+		last = max(last, int(b))
+	}
+	distinct := 0
+	for _, c := range counts {
+		if c > 0 {
+			distinct++
+		}
+	}
+
+	switch {
+	case distinct == 1 && len(lits) > 1:
+		return append(appendLitHeader(dst, litRLE, len(lits)), lits[0])
+	case len(lits) < 32 || distinct == 1:
+		return append(appendLitHeader(dst, litRaw, len(lits)), lits...)
+	}
+
+	lengths := huffLengths(counts[:last+1])
+	codes, log := huffCodes(lengths)
+	n := len(dst)
+	dst, ok := appendHuffTable(append(dst, make([]byte, 5)...), lengths, log, last)
+	if !ok {
+		return append(appendLitHeader(dst[:n], litRaw, len(lits)), lits...)
+	}
+	streams := 1
+	if len(lits) < 1024 {
+		dst = appendStream(dst, lits, codes)
+	} else {
+		streams = 4
+		seg := (len(lits) + 3) / 4
+		jump := len(dst)
+		dst = append(dst, make([]byte, 6)...)
+		for i := 0; i < 4; i++ {
+			s := len(dst)
+			dst = appendStream(dst, lits[min(i*seg, len(lits)):min((i+1)*seg, len(lits))], codes)
+			if i < 3 {
+				binary.LittleEndian.PutUint16(dst[jump+2*i:], uint16(len(dst)-s))
+			}
+		}
+	}
+
+	// The header takes 3 to 5 bytes, depending on the sizes.
+	csize := len(dst) - n - 5
+	format, hlen, sizeBits := 0, 3, 10
+	switch {
+	case streams == 1 && csize < 1<<10:
+	case max(len(lits), csize) < 1<<10:
+		format = 1
+	case max(len(lits), csize) < 1<<14:
+		format, hlen, sizeBits = 2, 4, 14
+	default:
+		format, hlen, sizeBits = 3, 5, 18
+	}
+	if streams == 1 && format != 0 || csize+hlen >= len(lits) {
+		return append(appendLitHeader(dst[:n], litRaw, len(lits)), lits...)
+	}
+	h := uint64(litCompressed) | uint64(format)<<2 | uint64(len(lits))<<4 |
+		uint64(csize)<<(4+sizeBits)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], h)
+	copy(dst[n:], b[:hlen])
+	return append(dst[:n+hlen], dst[n+5:]...)
+}
+
+// appendLitHeader appends the header of raw or RLE literals.
+func appendLitHeader(dst []byte, typ byte, size int) []byte {
+	switch {
+	case size < 1<<5:
+		return append(dst, typ|byte(size)<<3)
+	case size < 1<<12:
+		return append(dst, typ|1<<2|byte(size)<<4, byte(size>>4))
+	}
+	return append(dst, typ|3<<2|byte(size)<<4, byte(size>>4), byte(size>>12))
+}
+
+// appendSequences appends the sequences section of enc.seqs. The codes of
+// each kind are FSE coded with a table of their own, the predefined one or
+// as the only code that occurs.
+func (enc *encoder) appendSequences(dst []byte) []byte {
+	n := len(enc.seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8)+128, byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return dst
+	}
+
+	for i := range enc.codes {
+		enc.codes[i] = enc.codes[i][:0]
+	}
+	for _, s := range enc.seqs {
+		enc.codes[0] = append(enc.codes[0], code(s.llen, llBase[:]))
+		enc.codes[1] = append(enc.codes[1], uint8(bits.Len32(s.ov)-1))
+		enc.codes[2] = append(enc.codes[2], code(s.mlen, mlBase[:]))
+	}
+
+	modes := len(dst)
+	dst = append(dst, 0)
+	var fse [3]*fseEncoder
+	for i, t := range []struct {
+		maxLog uint
+		norm   []int16
+		log    uint
+	}{
+		{maxLLLog, llNorm, 6},
+		{maxOFLog, ofNorm, 5},
+		{maxMLLog, mlNorm, 6},
+	} {
+		var mode byte
+		mode, fse[i], dst = appendTable(dst, enc.codes[i], t.maxLog, t.norm, t.log)
+		dst[modes] |= mode << (6 - 2*i)
+	}
+
+	// The last sequence is encoded first, the states of the first one are
+	// written last.
+	bw := bitWriter{b: dst}
+	last := n - 1
+	for i := last; i >= 0; i-- {
+		s := enc.seqs[i]
+		llc, ofc, mlc := enc.codes[0][i], enc.codes[1][i], enc.codes[2][i]
+		if i == last {
+			fse[0].init(llc)
+			fse[1].init(ofc)
+			fse[2].init(mlc)
+		} else {
+			fse[1].encode(&bw, ofc)
+			fse[2].encode(&bw, mlc)
+			fse[0].encode(&bw, llc)
+		}
+		bw.write(uint64(s.llen-llBase[llc]), uint(llBits[llc]))
+		bw.write(uint64(s.mlen-mlBase[mlc]), uint(mlBits[mlc]))
+		bw.write(uint64(s.ov)-1<<ofc, uint(ofc))
+	}
+	fse[2].flush(&bw)
+	fse[1].flush(&bw)
+	fse[0].flush(&bw)
+	return bw.close()
+}
+
+// code returns the code of v with the baselines base.
+func code(v uint32, base []uint32) uint8 {
+	i := sort.Search(len(base), func(i int) bool { return base[i] > v })
+	return uint8(i - 1)
+}
+
+// appendTable chooses how the codes of one kind are coded, appends the
+// table description of the mode and returns them with their encoder.
+func appendTable(dst, codes []uint8, maxLog uint, predef []int16,
+	predefLog uint) (byte, *fseEncoder, []byte) {
+	counts := make([]int, 1<<8)
+	distinct, last := 0, 0
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+		last = max(last, int(c))
+	}
+	counts = counts[:last+1]
+	if distinct == 1 {
+		return modeRLE, nil, append(dst, byte(last))
+	}
+
+	log := tableLog(len(codes), distinct, last, maxLog)
+	norm := normalize(counts, len(codes), log)
+	n := len(dst)
+	dst = appendNCount(dst, norm, log)
+	if cost(counts, predef, predefLog) <= cost(counts, norm, log)+float64(8*(len(dst)-n)) {
+		return modePredefined, newFSEEncoder(predef, predefLog), dst[:n]
+	}
+	return modeCompressed, newFSEEncoder(norm, log), dst
+}
@@ -0,0 +1,361 @@
+package zstd
+
+import (
+	"math"
+	"math/bits"
+)
+
+// fseEntry is a state of an FSE decoding table: the symbol it decodes and
+// the next state, base plus the next bits bits.
+type fseEntry struct {
+	sym  uint8
+	bits uint8
+	base uint16
+}
+
+// fseTable is an FSE decoding table with 1<<log states.
+type fseTable struct {
+	log     uint
+	entries []fseEntry
+}
+
+// readNCount reads the normalized counts of the symbols up to maxSym and
+// the accuracy log, at most maxLog, of an FSE table description. A count of
+// -1 is a probability of less than 1. It also returns the size of the
+// description.
+func readNCount(b []byte, maxSym int, maxLog uint) ([]int16, uint, int, error) {
+	fr := forwardReader{b: b}
+	v, ok := fr.read(4)
+	log := uint(v) + 5
+	if !ok || log > maxLog {
+		return nil, 0, 0, ErrCorrupt
+	}
+
+	norm := make([]int16, maxSym+1)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbits := log + 1
+	prev0 := false
+	for sym := 0; remaining > 1; sym++ {
+		// Runs of symbols with count 0 follow one, in steps of 2 bits.
+		if prev0 {
+			for {
+				r, ok := fr.read(2)
+				if !ok {
+					return nil, 0, 0, ErrCorrupt
+				}
+				sym += int(r)
+				if r != 3 {
+					break
+				}
+			}
+		}
+		if sym > maxSym {
+			return nil, 0, 0, ErrCorrupt
+		}
+
+		// Small values take a bit less than large ones.
+		limit := 2*threshold - 1 - remaining
+		low, ok := fr.read(nbits - 1)
+		value := int(low)
+		if ok && value >= limit {
+			var high uint32
+			high, ok = fr.read(1)
+			value |= int(high) << (nbits - 1)
+			if value >= threshold {
+				value -= limit
+			}
+		}
+		if !ok {
+			return nil, 0, 0, ErrCorrupt
+		}
+
+		count := value - 1
+		norm[sym] = int16(count)
+		prev0 = count == 0
+		if count < 0 {
+			count = -count
+		}
+		remaining -= count
+		if remaining < 1 {
+			return nil, 0, 0, ErrCorrupt
+		}
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	return norm, log, (fr.pos + 7) / 8, nil
+}
+
+// spread returns the symbol of every state of a table with the normalized
+// counts norm, spreading the states of each symbol over the table. Symbols
+// with probabilities of less than 1 get the last states.
+func spread(norm []int16, log uint) ([]uint8, bool) {
+	size := 1 << log
+	syms := make([]uint8, size)
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			syms[high] = uint8(s)
+			high--
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	mask := size - 1
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			syms[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	return syms, pos == 0
+}
+
+// newFSETable builds the decoding table of the normalized counts norm.
+func newFSETable(norm []int16, log uint) (fseTable, error) {
+	syms, ok := spread(norm, log)
+	if !ok {
+		return fseTable{}, ErrCorrupt
+	}
+
+	size := 1 << log
+	next := make([]uint16, len(norm))
+	for s, c := range norm {
+		next[s] = uint16(c)
+		if c == -1 {
+			next[s] = 1
+		}
+	}
+	entries := make([]fseEntry, size)
+	for u, s := range syms {
+		state := next[s]
+		next[s]++
+		nbits := log + 1 - uint(bits.Len16(state))
+		entries[u] = fseEntry{
+			sym:  s,
+			bits: uint8(nbits),
+			base: state<<nbits - uint16(size),
+		}
+	}
+	return fseTable{log, entries}, nil
+}
+
+// rleTable returns a table whose only state decodes sym without reading
+// bits.
+func rleTable(sym uint8) fseTable {
+	return fseTable{0, []fseEntry{{sym: sym}}}
+}
+
+// mustFSETable returns the table of the predefined distribution norm.
+func mustFSETable(norm []int16, log uint) fseTable {
+	t, err := newFSETable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// fseSymbol holds how a symbol moves an FSE encoder to its next state.
+type fseSymbol struct {
+	deltaBits  uint32
+	deltaState int32
+}
+
+// fseEncoder encodes the symbols of an FSE table. Symbols are encoded in
+// reverse, the decoder reads the states from the end of the bitstream. A
+// nil encoder encodes the only symbol of an RLE table, without bits.
+type fseEncoder struct {
+	log    uint
+	states []uint16
+	syms   []fseSymbol
+	state  uint32
+}
+
+// newFSEEncoder returns an encoder for the table of the normalized counts
+// norm.
+func newFSEEncoder(norm []int16, log uint) *fseEncoder {
+	size := 1 << log
+	syms, _ := spread(norm, log)
+	cumul := make([]int, len(norm)+1)
+	for s, c := range norm {
+		cumul[s+1] = cumul[s] + max(int(c), 0)
+		if c == -1 {
+			cumul[s+1]++
+		}
+	}
+
+	enc := &fseEncoder{
+		log:    log,
+		states: make([]uint16, size),
+		syms:   make([]fseSymbol, len(norm)),
+	}
+	for u, s := range syms {
+		enc.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := 0
+	for s, c := range norm {
+		switch c {
+		case 0:
+		case -1, 1:
+			enc.syms[s] = fseSymbol{uint32(log<<16 - uint(size)), int32(total - 1)}
+			total++
+		default:
+			out := log + 1 - uint(bits.Len(uint(c-1)))
+			enc.syms[s] = fseSymbol{
+				uint32(out<<16) - uint32(int(c)<<out),
+				int32(total - int(c)),
+			}
+			total += int(c)
+		}
+	}
+	return enc
+}
+
+// init starts with the state decoding sym, the last symbol, without
+// writing bits.
+func (enc *fseEncoder) init(sym uint8) {
+	if enc == nil {
+		return
+	}
+	s := enc.syms[sym]
+	nbits := (s.deltaBits + 1<<15) >> 16
+	v := nbits<<16 - s.deltaBits
+	enc.state = uint32(enc.states[int32(v>>nbits)+s.deltaState])
+}
+
+// encode writes the bits leading from the state decoding sym to the
+// current state.
+func (enc *fseEncoder) encode(bw *bitWriter, sym uint8) {
+	if enc == nil {
+		return
+	}
+	s := enc.syms[sym]
+	nbits := (enc.state + s.deltaBits) >> 16
+	bw.write(uint64(enc.state), uint(nbits))
+	enc.state = uint32(enc.states[int32(enc.state>>nbits)+s.deltaState])
+}
+
+// flush writes the first state.
+func (enc *fseEncoder) flush(bw *bitWriter) {
+	if enc == nil {
+		return
+	}
+	bw.write(uint64(enc.state), enc.log)
+}
+
+// normalize scales counts, whose sum is total, to normalized counts with a
+// sum of 1<<log. Every symbol that occurs keeps a count of at least 1.
+func normalize(counts []int, total int, log uint) []int16 {
+	size := 1 << log
+	norm := make([]int16, len(counts))
+	sum, largest := 0, -1
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := max((c*size+total/2)/total, 1)
+		norm[s] = int16(n)
+		sum += n
+		if largest < 0 || c > counts[largest] {
+			largest = s
+		}
+	}
+
+	for sum > size {
+		s := 0
+		for i := range norm {
+			if norm[i] > norm[s] {
+				s = i
+			}
+		}
+		norm[s]--
+		sum--
+	}
+	norm[largest] += int16(size - sum)
+	return norm
+}
+
+// tableLog returns the accuracy log of a table for n symbols, of which
+// distinct differ and the largest is maxSym, like the reference encoder.
+func tableLog(n, distinct, maxSym int, maxLog uint) uint {
+	log := min(bits.Len(uint(n-1))-3, int(maxLog))
+	log = max(log, min(bits.Len(uint(n)), bits.Len(uint(maxSym))+1))
+	log = min(max(log, 5), int(maxLog))
+	for 1<<log < distinct {
+		log++
+	}
+	return uint(log)
+}
+
+// appendNCount appends the description of the table with the normalized
+// counts norm.
+func appendNCount(dst []byte, norm []int16, log uint) []byte {
+	last := len(norm) - 1
+	for norm[last] == 0 {
+		last--
+	}
+
+	bw := bitWriter{b: dst}
+	bw.write(uint64(log-5), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbits := log + 1
+	prev0 := false
+	for sym := 0; sym <= last; sym++ {
+		if prev0 {
+			start := sym
+			for norm[sym] == 0 {
+				sym++
+			}
+			n := sym - start
+			for ; n >= 3; n -= 3 {
+				bw.write(3, 2)
+			}
+			bw.write(uint64(n), 2)
+		}
+
+		count := int(norm[sym])
+		limit := 2*threshold - 1 - remaining
+		remaining -= max(count, -count)
+		count++
+		if count >= threshold {
+			count += limit
+		}
+		if count < limit {
+			bw.write(uint64(count), nbits-1)
+		} else {
+			bw.write(uint64(count), nbits)
+		}
+		prev0 = count == 1
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	return bw.flush()
+}
+
+// cost estimates the bits taking count symbols of each kind with the
+// normalized counts norm, or +Inf if a symbol that occurs has none.
+func cost(counts []int, norm []int16, log uint) float64 {
+	var c float64
+	for s, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		p := float64(max(norm[s], 1)) / float64(uint(1)<<log)
+		c -= float64(n) * math.Log2(p)
+	}
+	return c
+}
@@ -0,0 +1,419 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"slices"
+)
+
+const (
+	maxHuffBits = 11
+
+	// Weights are written directly for at most 128 symbols.
+	maxDirectWeights = 128
+)
+
+// huffEntry is an entry of a Huffman decoding table, indexed by the next
+// bits of the bitstream.
+type huffEntry struct {
+	sym  uint8
+	bits uint8
+}
+
+// readHuffTable reads the description of a Huffman table into d.huff and
+// returns its size.
+func (d *decoder) readHuffTable(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, ErrCorrupt
+	}
+	var weights [256]uint8
+	var count, n int
+	if h := int(b[0]); h >= 128 {
+		// Direct weights of 4 bits.
+		count = h - 127
+		n = 1 + (count+1)/2
+		if n > len(b) {
+			return 0, ErrCorrupt
+		}
+		for i := 0; i < count; i++ {
+			w := b[1+i/2]
+			if i%2 == 0 {
+				w >>= 4
+			}
+			weights[i] = w & 15
+		}
+	} else {
+		n = 1 + h
+		if n > len(b) {
+			return 0, ErrCorrupt
+		}
+		var err error
+		count, err = readWeights(b[1:n], weights[:255])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The weight of the last symbol completes the tree.
+	var sum int
+	for _, w := range weights[:count] {
+		if w > maxHuffBits {
+			return 0, ErrCorrupt
+		}
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+	if sum == 0 {
+		return 0, ErrCorrupt
+	}
+	log := bits.Len(uint(sum))
+	rest := 1<<log - sum
+	if log > maxHuffBits || rest&(rest-1) != 0 {
+		return 0, ErrCorrupt
+	}
+	weights[count] = uint8(bits.Len(uint(rest)))
+	count++
+
+	// Symbols with the smallest weights, the longest codes, come first.
+	var start [maxHuffBits + 2]int
+	for _, w := range weights[:count] {
+		if w > 0 {
+			start[w] += 1 << (w - 1)
+		}
+	}
+	next := 0
+	for w := 1; w <= log; w++ {
+		next, start[w] = next+start[w], next
+	}
+
+	d.huff = slices.Grow(d.huff[:0], 1<<log)[:1<<log]
+	d.huffLog = uint(log)
+	for s, w := range weights[:count] {
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{uint8(s), uint8(log + 1 - int(w))}
+		for i := 0; i < 1<<(w-1); i++ {
+			d.huff[start[w]+i] = e
+		}
+		start[w] += 1 << (w - 1)
+	}
+	return n, nil
+}
+
+// readWeights decodes the FSE coded weights of b into weights and returns
+// their number. Two states take turns, until the bitstream ends.
+func readWeights(b []byte, weights []uint8) (int, error) {
+	norm, log, n, err := readNCount(b, maxHuffBits+1, 6)
+	if err != nil {
+		return 0, err
+	}
+	t, err := newFSETable(norm, log)
+	if err != nil {
+		return 0, err
+	}
+	br, err := newBackwardReader(b[n:])
+	if err != nil {
+		return 0, err
+	}
+
+	s1, s2 := br.read(log), br.read(log)
+	if br.over {
+		return 0, ErrCorrupt
+	}
+	count := 0
+	for {
+		if count+3 > len(weights) {
+			return 0, ErrCorrupt
+		}
+		e := t.entries[s1]
+		weights[count] = e.sym
+		count++
+		s1 = uint64(e.base) + br.read(uint(e.bits))
+		if br.over {
+			weights[count] = t.entries[s2].sym
+			return count + 1, nil
+		}
+
+		e = t.entries[s2]
+		weights[count] = e.sym
+		count++
+		s2 = uint64(e.base) + br.read(uint(e.bits))
+		if br.over {
+			weights[count] = t.entries[s1].sym
+			return count + 1, nil
+		}
+	}
+}
+
+// decodeLiterals appends n literals decoded with d.huff from src, which
+// holds 1 or 4 streams.
+func (d *decoder) decodeLiterals(dst, src []byte, n, streams int) ([]byte, error) {
+	if streams == 1 {
+		return d.decodeStream(dst, src, n)
+	}
+
+	// A jump table holds the sizes of the first 3 streams.
+	if len(src) < 6 {
+		return nil, ErrCorrupt
+	}
+	var sizes [4]int
+	rest := len(src) - 6
+	for i := 0; i < 3; i++ {
+		sizes[i] = int(binary.LittleEndian.Uint16(src[2*i:]))
+		rest -= sizes[i]
+	}
+	sizes[3] = rest
+	seg := (n + 3) / 4
+	if rest < 0 || n-3*seg < 0 {
+		return nil, ErrCorrupt
+	}
+
+	src = src[6:]
+	for i, size := range sizes {
+		m := seg
+		if i == 3 {
+			m = n - 3*seg
+		}
+		var err error
+		dst, err = d.decodeStream(dst, src[:size], m)
+		if err != nil {
+			return nil, err
+		}
+		src = src[size:]
+	}
+	return dst, nil
+}
+
+// decodeStream appends the n literals of the stream src.
+func (d *decoder) decodeStream(dst, src []byte, n int) ([]byte, error) {
+	br, err := newBackwardReader(src)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		e := d.huff[br.peek(d.huffLog)]
+		br.skip(uint(e.bits))
+		dst = append(dst, e.sym)
+	}
+	if !br.done() {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// huffCode is the code of a symbol, written in bits bits.
+type huffCode struct {
+	code uint16
+	bits uint8
+}
+
+// huffLengths returns the lengths of the Huffman codes of the symbols with
+// counts, at most maxHuffBits. At least 2 symbols must occur.
+func huffLengths(counts []int) []uint8 {
+	var syms []int
+	for s, c := range counts {
+		if c > 0 {
+			syms = append(syms, s)
+		}
+	}
+	slices.SortStableFunc(syms, func(a, b int) int {
+		return counts[a] - counts[b]
+	})
+
+	// Leaves and the nodes joining them are taken from two queues sorted by
+	// their counts, nodes are created in order.
+	n := len(syms)
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range syms {
+		weight[i] = counts[s]
+	}
+	leaf, node := 0, n
+	take := func(next int) int {
+		if leaf < n && (node >= next || weight[leaf] <= weight[node]) {
+			leaf++
+			return leaf - 1
+		}
+		node++
+		return node - 1
+	}
+	for next := n; next < 2*n-1; next++ {
+		a := take(next)
+		b := take(next)
+		weight[next] = weight[a] + weight[b]
+		parent[a], parent[b] = next, next
+	}
+	depth := make([]int, 2*n-1)
+	for i := 2*n - 3; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+	}
+
+	lengths := make([]uint8, len(counts))
+	for i, s := range syms {
+		lengths[s] = uint8(depth[i])
+	}
+	limitLengths(lengths, counts)
+	return lengths
+}
+
+// limitLengths shortens codes longer than maxHuffBits and lengthens others
+// until the codes fit, then shortens codes until they fill the tree, which
+// the weights of the last symbol require.
+func limitLengths(lengths []uint8, counts []int) {
+	const target = 1 << maxHuffBits
+	sum := 0
+	for s, l := range lengths {
+		if l > maxHuffBits {
+			lengths[s] = maxHuffBits
+		}
+		if l > 0 {
+			sum += target >> lengths[s]
+		}
+	}
+
+	// Lengthening a code of length l adds target>>(l+1) to the space left,
+	// shortening it takes target>>l.
+	for sum > target {
+		s := -1
+		for i, l := range lengths {
+			if l == 0 || l == maxHuffBits {
+				continue
+			}
+			if s < 0 || l > lengths[s] || l == lengths[s] && counts[i] < counts[s] {
+				s = i
+			}
+		}
+		lengths[s]++
+		sum -= target >> lengths[s]
+	}
+	for sum < target {
+		s := -1
+		for i, l := range lengths {
+			if l <= 1 || target>>l > target-sum {
+				continue
+			}
+			if s < 0 || l > lengths[s] || l == lengths[s] && counts[i] > counts[s] {
+				s = i
+			}
+		}
+		if s < 0 {
+			return
+		}
+		sum += target >> lengths[s]
+		lengths[s]--
+	}
+}
+
+// huffCodes returns the codes of the symbols with lengths, assigned like
+// the decoding table of their weights, and the longest length.
+func huffCodes(lengths []uint8) ([]huffCode, int) {
+	log := int(slices.Max(lengths))
+	var start [maxHuffBits + 2]int
+	for _, l := range lengths {
+		if l > 0 {
+			w := log + 1 - int(l)
+			start[w] += 1 << (w - 1)
+		}
+	}
+	next := 0
+	for w := 1; w <= log; w++ {
+		next, start[w] = next+start[w], next
+	}
+
+	codes := make([]huffCode, len(lengths))
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		w := log + 1 - int(l)
+		codes[s] = huffCode{uint16(start[w] >> (w - 1)), l}
+		start[w] += 1 << (w - 1)
+	}
+	return codes, log
+}
+
+// appendHuffTable appends the description of the Huffman table with
+// lengths, whose longest length is log and whose last symbol is last. The
+// weights are FSE coded if that is shorter than writing them directly. It
+// returns false if neither fits.
+func appendHuffTable(dst []byte, lengths []uint8, log, last int) ([]byte, bool) {
+	weights := make([]uint8, last)
+	for s, l := range lengths[:last] {
+		if l > 0 {
+			weights[s] = uint8(log + 1 - int(l))
+		}
+	}
+
+	n := len(dst)
+	dst = append(dst, 0)
+	dst, ok := appendWeights(dst, weights)
+	size := len(dst) - n - 1
+	if ok && size < 128 && (size < (last+1)/2 || last > maxDirectWeights) {
+		dst[n] = byte(size)
+		return dst, true
+	}
+	if last > maxDirectWeights {
+		return dst[:n], false
+	}
+
+	dst = append(dst[:n], byte(127+last))
+	for i := 0; i < last; i += 2 {
+		b := weights[i] << 4
+		if i+1 < last {
+			b |= weights[i+1]
+		}
+		dst = append(dst, b)
+	}
+	return dst, true
+}
+
+// appendWeights appends the FSE coded weights, which two states take turns
+// encoding like readWeights decodes them. It returns false if all weights
+// are the same.
+func appendWeights(dst, weights []uint8) ([]byte, bool) {
+	var counts [maxHuffBits + 1]int
+	distinct, last := 0, 0
+	for _, w := range weights {
+		if counts[w] == 0 {
+			distinct++
+		}
+		counts[w]++
+		last = max(last, int(w))
+	}
+	if distinct < 2 {
+		return dst, false
+	}
+
+	log := tableLog(len(weights), distinct, last, 6)
+	norm := normalize(counts[:last+1], len(weights), log)
+	dst = appendNCount(dst, norm, log)
+
+	// The first state decodes the weights at even indices. The last two
+	// weights start the states, without bits.
+	var states [2]*fseEncoder
+	for i := range states {
+		states[i] = newFSEEncoder(norm, log)
+	}
+	n := len(weights)
+	states[(n-1)%2].init(weights[n-1])
+	states[(n-2)%2].init(weights[n-2])
+	bw := bitWriter{b: dst}
+	for i := n - 3; i >= 0; i-- {
+		states[i%2].encode(&bw, weights[i])
+	}
+	states[1].flush(&bw)
+	states[0].flush(&bw)
+	return bw.close(), true
+}
+
+// appendStream appends the Huffman coded stream of lits.
+func appendStream(dst, lits []byte, codes []huffCode) []byte {
+	bw := bitWriter{b: dst}
+	for i := len(lits) - 1; i >= 0; i-- {
+		c := codes[lits[i]]
+		bw.write(uint64(c.code), uint(c.bits))
+	}
+	return bw.close()
+}
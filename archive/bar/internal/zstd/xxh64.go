@@ -0,0 +1,109 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// Digest computes the xxHash64 checksum with seed 0, whose low 32 bits are
+// the content checksum of Zstandard frames.
+type Digest struct {
+	v     [4]uint64
+	buf   [32]byte
+	n     int // bytes in buf
+	total uint64
+}
+
+func NewDigest() *Digest {
+	// The initial state wraps around, which constants can't.
+	p1, p2 := prime1, prime2
+	return &Digest{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+// Checksum returns the xxHash64 checksum of b.
+func Checksum(b []byte) uint64 {
+	d := NewDigest()
+	d.Write(b)
+	return d.Sum64()
+}
+
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+	if d.n > 0 {
+		m := copy(d.buf[d.n:], b)
+		d.n += m
+		b = b[m:]
+		if d.n < len(d.buf) {
+			return n, nil
+		}
+		d.rounds(d.buf[:])
+		d.n = 0
+	}
+
+	full := len(b) &^ 31
+	d.rounds(b[:full])
+	d.n = copy(d.buf[:], b[full:])
+	return n, nil
+}
+
+func (d *Digest) rounds(b []byte) {
+	for ; len(b) >= 32; b = b[32:] {
+		for i := range d.v {
+			d.v[i] = round(d.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+		}
+	}
+}
+
+func round(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*prime2, 31) * prime1
+}
+
+func mergeRound(acc, v uint64) uint64 {
+	acc ^= round(0, v)
+	return acc*prime1 + prime4
+}
+
+func (d *Digest) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v[0], 1) + bits.RotateLeft64(d.v[1], 7) +
+			bits.RotateLeft64(d.v[2], 12) + bits.RotateLeft64(d.v[3], 18)
+		for _, v := range d.v {
+			h = mergeRound(h, v)
+		}
+	} else {
+		h = prime5
+	}
+	h += d.total
+
+	b := d.buf[:d.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,362 @@
+// Package zstd implements the Zstandard format with a fast greedy
+// compressor, as described in RFC 8878. Frames are written with a window of
+// 1 MiB and a content checksum.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+var (
+	ErrCorrupt     = errors.New("Corrupt zstd data.")
+	ErrUnsupported = errors.New("Unsupported zstd data.")
+	errClosed      = errors.New("Write after close.")
+)
+
+const (
+	frameMagic     = 0xfd2fb528
+	skippableMagic = 0x184d2a50 // the low 4 bits may differ
+
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+
+	maxBlockSize = 128 << 10
+
+	// Frames with larger windows need more memory than readers allow.
+	maxWindowSize = 1 << 27
+
+	// The window of written frames, 1 MiB.
+	windowLog  = 20
+	windowSize = 1 << windowLog
+)
+
+// Writer compresses data to a Zstandard frame.
+type Writer struct {
+	w      io.Writer
+	enc    *encoder
+	buf    []byte // the window followed by the data of the next block
+	pos    int    // where the next block starts in buf
+	out    []byte
+	check  *Digest
+	header bool
+	err    error
+}
+
+// NewWriter returns a writer compressing data to w. Close must be called to
+// end the frame.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, enc: newEncoder(), check: NewDigest()}
+}
+
+func (zw *Writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if zw.err != nil {
+			return n, zw.err
+		}
+
+		m := min(len(p), maxBlockSize-(len(zw.buf)-zw.pos))
+		zw.buf = append(zw.buf, p[:m]...)
+		zw.check.Write(p[:m])
+		p = p[m:]
+		n += m
+		if len(zw.buf)-zw.pos == maxBlockSize {
+			zw.err = zw.flush(false)
+		}
+	}
+	return n, zw.err
+}
+
+// Close writes the buffered data as the last block, followed by the
+// content checksum. It doesn't close the underlying writer.
+func (zw *Writer) Close() error {
+	if zw.err != nil {
+		return zw.err
+	}
+
+	zw.err = zw.flush(true)
+	if zw.err != nil {
+		return zw.err
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(zw.check.Sum64()))
+	_, zw.err = zw.w.Write(b[:])
+	if zw.err != nil {
+		return zw.err
+	}
+	zw.err = errClosed
+	return nil
+}
+
+func (zw *Writer) flush(last bool) error {
+	if !zw.header {
+		zw.header = true
+		h := []byte{0, 0, 0, 0, 1 << 2, (windowLog - 10) << 3}
+		binary.LittleEndian.PutUint32(h, frameMagic)
+		_, err := zw.w.Write(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Blocks that don't shrink are stored raw.
+	block := zw.buf[zw.pos:]
+	typ := blockCompressed
+	out, ok := zw.enc.compressBlock(zw.out[:0], zw.buf, zw.pos)
+	if !ok {
+		out = append(out[:0], block...)
+		typ = blockRaw
+	}
+	zw.out = out
+
+	h := uint32(len(out))<<3 | uint32(typ)<<1
+	if last {
+		h |= 1
+	}
+	_, err := zw.w.Write([]byte{byte(h), byte(h >> 8), byte(h >> 16)})
+	if err == nil {
+		_, err = zw.w.Write(out)
+	}
+
+	// Matches refer to the last 1 MiB, the window moves once it is twice
+	// as large.
+	zw.pos = len(zw.buf)
+	if zw.pos >= 2*windowSize {
+		n := zw.pos - windowSize
+		zw.buf = zw.buf[:copy(zw.buf, zw.buf[n:])]
+		zw.pos -= n
+		zw.enc.shift(n)
+	}
+	return err
+}
+
+// Reader decompresses Zstandard frames, which may follow each other and
+// skippable frames. Checksums are verified, but frames with a dictionary
+// are not supported.
+type Reader struct {
+	r        io.Reader
+	frames   int
+	inFrame  bool
+	window   int
+	maxBlock int
+	content  *Digest
+	size     uint64 // of the data of the frame so far
+	fcs      uint64 // the size of the data of the frame if known
+	hasFCS   bool
+	d        decoder
+	buf      []byte // the window followed by the last block
+	block    []byte
+	out      []byte // the unread data of the last block
+	err      error
+}
+
+// NewReader returns a reader decompressing the frames read from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (zr *Reader) Read(p []byte) (int, error) {
+	for len(zr.out) == 0 {
+		if zr.err != nil {
+			return 0, zr.err
+		}
+		zr.err = zr.next()
+	}
+
+	n := copy(p, zr.out)
+	zr.out = zr.out[n:]
+	return n, nil
+}
+
+// next decodes the next block into out, or returns io.EOF after the last
+// frame.
+func (zr *Reader) next() error {
+	if !zr.inFrame {
+		err := zr.readHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	var b [3]byte
+	err := readFull(zr.r, b[:])
+	if err != nil {
+		return err
+	}
+	h := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	last, typ, size := h&1 != 0, h>>1&3, h>>3
+	if size > zr.maxBlock {
+		return ErrCorrupt
+	}
+
+	// Blocks may refer to the window before them, which moves once the
+	// data kept is twice as large.
+	if len(zr.buf) > 2*zr.window {
+		zr.buf = zr.buf[:copy(zr.buf, zr.buf[len(zr.buf)-zr.window:])]
+	}
+	start := len(zr.buf)
+
+	switch typ {
+	case blockRaw:
+		zr.buf = slices.Grow(zr.buf, size)[:start+size]
+		err = readFull(zr.r, zr.buf[start:])
+	case blockRLE:
+		err = readFull(zr.r, b[:1])
+		for i := 0; i < size && err == nil; i++ {
+			zr.buf = append(zr.buf, b[0])
+		}
+	case blockCompressed:
+		zr.block = slices.Grow(zr.block[:0], size)[:size]
+		err = readFull(zr.r, zr.block)
+		if err == nil {
+			zr.buf, err = zr.d.decompressBlock(zr.buf, zr.block,
+				start+zr.maxBlock)
+		}
+	default:
+		err = ErrCorrupt
+	}
+	if err != nil {
+		return err
+	}
+
+	zr.out = zr.buf[start:]
+	zr.size += uint64(len(zr.out))
+	if zr.content != nil {
+		zr.content.Write(zr.out)
+	}
+	if last {
+		return zr.end()
+	}
+	return nil
+}
+
+// readHeader reads the header of the next frame, skipping skippable
+// frames.
+func (zr *Reader) readHeader() error {
+	var b [4]byte
+	for {
+		_, err := io.ReadFull(zr.r, b[:])
+		if err == io.EOF && zr.frames > 0 {
+			return io.EOF
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		zr.frames++
+
+		magic := binary.LittleEndian.Uint32(b[:])
+		if magic&^0xf != skippableMagic {
+			if magic != frameMagic {
+				return ErrCorrupt
+			}
+			break
+		}
+		err = readFull(zr.r, b[:])
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(io.Discard, zr.r, int64(binary.LittleEndian.Uint32(b[:])))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := readFull(zr.r, b[:1])
+	if err != nil {
+		return err
+	}
+	desc := b[0]
+	if desc&(1<<3) != 0 {
+		return ErrCorrupt
+	}
+	single := desc&(1<<5) != 0
+	wdLen := 1
+	if single {
+		wdLen = 0
+	}
+	idLen := [4]int{0, 1, 2, 4}[desc&3]
+	fcsLen := [4]int{0, 2, 4, 8}[desc>>6]
+	if single && fcsLen == 0 {
+		fcsLen = 1
+	}
+	var h [13]byte
+	err = readFull(zr.r, h[:wdLen+idLen+fcsLen])
+	if err != nil {
+		return err
+	}
+
+	var window uint64
+	if !single {
+		exp, mantissa := h[0]>>3, h[0]&7
+		base := uint64(1) << (10 + exp)
+		window = base + base/8*uint64(mantissa)
+	}
+	var id [4]byte
+	copy(id[:], h[wdLen:wdLen+idLen])
+	if binary.LittleEndian.Uint32(id[:]) != 0 {
+		return ErrUnsupported
+	}
+	var fcs [8]byte
+	copy(fcs[:], h[wdLen+idLen:wdLen+idLen+fcsLen])
+	zr.fcs = binary.LittleEndian.Uint64(fcs[:])
+	if fcsLen == 2 {
+		zr.fcs += 256
+	}
+	zr.hasFCS = fcsLen > 0
+	if single {
+		window = zr.fcs
+	}
+	if window > maxWindowSize {
+		return ErrUnsupported
+	}
+
+	zr.window = int(window)
+	zr.maxBlock = min(zr.window, maxBlockSize)
+	zr.content = nil
+	if desc&(1<<2) != 0 {
+		zr.content = NewDigest()
+	}
+	zr.size = 0
+	zr.buf = zr.buf[:0]
+	zr.d.reset()
+	zr.inFrame = true
+	return nil
+}
+
+// end verifies the size and the content checksum of the frame after its
+// last block.
+func (zr *Reader) end() error {
+	zr.inFrame = false
+	if zr.hasFCS && zr.size != zr.fcs {
+		return ErrCorrupt
+	}
+	if zr.content != nil {
+		var b [4]byte
+		err := readFull(zr.r, b[:])
+		if err != nil {
+			return err
+		}
+		if uint32(zr.content.Sum64()) != binary.LittleEndian.Uint32(b[:]) {
+			return ErrCorrupt
+		}
+	}
+	return nil
+}
+
+func readFull(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+package zstd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t testing.TB, name string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decompress(b []byte) ([]byte, error) {
+	return io.ReadAll(NewReader(bytes.NewReader(b)))
+}
+
+func compress(t testing.TB, data []byte, chunk int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := NewWriter(&buf)
+	for p := data; len(p) > 0; {
+		n, err := zw.Write(p[:min(chunk, len(p))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The files in testdata were written by the zstd command, version 1.5.6,
+// with the level or options in their names.
+func TestReader(t *testing.T) {
+	readme := readFile(t, "readme.txt")
+	tests := []struct {
+		file string
+		want []byte
+	}{
+		{"readme-1.zst", readme},
+		{"readme-19.zst", readme},
+		{"readme-nocheck.zst", readme},
+		{"readme-stream.zst", readme},
+		{"readme-x10.zst", bytes.Repeat(readme, 10)},
+		{"zeros.zst", make([]byte, 300000)},
+		{"random.zst", readFile(t, "random.bin")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := decompress(readFile(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReaderFrames(t *testing.T) {
+	readme := readFile(t, "readme.txt")
+	frame := readFile(t, "readme-1.zst")
+	skippable := []byte{0x5e, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'a', 'b', 'c'}
+
+	var b []byte
+	b = append(b, skippable...)
+	b = append(b, frame...)
+	b = append(b, compress(t, []byte("more"), 1)...)
+	b = append(b, skippable...)
+	got, err := decompress(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(readme[:len(readme):len(readme)], "more"...); !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	frame := readFile(t, "readme-1.zst")
+	change := func(i int, b byte) []byte {
+		c := bytes.Clone(frame)
+		if i < 0 {
+			i += len(c)
+		}
+		c[i] = b
+		return c
+	}
+
+	// Frames of 1 byte, with a dictionary id of 1 byte or a block of the
+	// reserved type.
+	dict := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x21, 7, 1, 1, 0, 0, 'a'}
+	reserved := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 1, 7, 0, 0, 'a'}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.ErrUnexpectedEOF},
+		{"truncated", frame[:len(frame)-10], io.ErrUnexpectedEOF},
+		{"no checksum", frame[:len(frame)-4], io.ErrUnexpectedEOF},
+		{"magic", change(0, 0x29), ErrCorrupt},
+		{"reserved bit", change(4, frame[4]|1<<3), ErrCorrupt},
+		{"checksum", change(-1, frame[len(frame)-1]^1), ErrCorrupt},
+		{"reserved block", reserved, ErrCorrupt},
+		{"dictionary", dict, ErrUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decompress(tt.data)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	frame := readFile(t, "readme-19.zst")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		c := bytes.Clone(frame)
+		c[r.Intn(len(c))] ^= 1 << r.Intn(8)
+		_, err := decompress(c)
+		if err == nil {
+			t.Fatalf("changed data read without error")
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 300000)
+	r.Read(random)
+	readme := readFile(t, "readme.txt")
+	high := bytes.Clone(readme)
+	for i := range high {
+		high[i] |= 0x80
+	}
+	mixed := bytes.Clone(random)
+	for i := 0; i < len(mixed); i += 2000 {
+		copy(mixed[i:], readme[:1000])
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		grows bool // random data is stored in raw blocks
+	}{
+		{"empty", nil, true},
+		{"byte", []byte{'a'}, true},
+		{"short", []byte("hello, hello, hello"), true},
+		{"text", readme, false},
+		{"high bytes", high, false},
+		{"repeated", bytes.Repeat(readme, 200), false},
+		{"zeros", make([]byte, 3<<20), false},
+		{"random", random, true},
+		{"mixed", mixed, false},
+		{"block", random[:maxBlockSize], true},
+	}
+
+	zstdCmd, _ := exec.LookPath("zstd")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, chunk := range []int{1000, 1 << 20} {
+				b := compress(t, tt.data, chunk)
+				got, err := decompress(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("got %d bytes, want %d", len(got), len(tt.data))
+				}
+				if grows := len(b) > len(tt.data); grows != tt.grows {
+					t.Errorf("%d bytes compressed to %d", len(tt.data), len(b))
+				}
+
+				if zstdCmd == "" {
+					continue
+				}
+				cmd := exec.Command(zstdCmd, "-d", "-c")
+				cmd.Stdin = bytes.NewReader(b)
+				got, err = cmd.Output()
+				if err != nil || !bytes.Equal(got, tt.data) {
+					t.Errorf("zstd -d: %d bytes, %v", len(got), err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	zw := NewWriter(io.Discard)
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zw.Write([]byte("late"))
+	if !errors.Is(err, errClosed) {
+		t.Errorf("got %v, want %v", err, errClosed)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, tt := range tests {
+		if got := Checksum([]byte(tt.data)); got != tt.want {
+			t.Errorf("Checksum(%q) = %#x, want %#x", tt.data, got, tt.want)
+		}
+	}
+
+	// Writes of any size give the same checksum.
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	d := NewDigest()
+	for i := 0; i < len(data); i += i%7 + 1 {
+		d.Write(data[i:min(i+i%7+1, len(data))])
+	}
+	if d.Sum64() != Checksum(data) {
+		t.Errorf("got %#x, want %#x", d.Sum64(), Checksum(data))
+	}
+}
+
+// TestPredefined checks that the predefined distributions add up.
+func TestPredefined(t *testing.T) {
+	for _, tt := range []struct {
+		norm []int16
+		log  uint
+	}{{llNorm, 6}, {ofNorm, 5}, {mlNorm, 6}} {
+		var sum int
+		for _, c := range tt.norm {
+			sum += max(int(c), -int(c))
+		}
+		if sum != 1<<tt.log {
+			t.Errorf("sum %d, want %d", sum, 1<<tt.log)
+		}
+	}
+	if len(llNorm) != len(llBase) || len(mlNorm) != len(mlBase) {
+		t.Error("distributions and codes differ in length")
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	for _, name := range []string{"readme-1.zst", "readme-19.zst", "zeros.zst"} {
+		f.Add(readFile(f, name))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		decompress(b)
+	})
+}
+
+// BenchmarkReader decompresses data the Writer compressed.
+func BenchmarkReader(b *testing.B) {
+	data := bytes.Repeat(readFile(b, "readme.txt"), 64)
+	frame := compress(b, data, len(data))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := io.Copy(io.Discard, NewReader(bytes.NewReader(frame)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	data := bytes.Repeat(readFile(b, "readme.txt"), 64)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		zw := NewWriter(io.Discard)
+		zw.Write(data)
+		err := zw.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
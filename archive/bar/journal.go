@@ -0,0 +1,101 @@
+package bar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNoJournal    = errors.New("Archive has no journal.")
+	ErrSignAppended = errors.New("Appended archive can't be signed.")
+)
+
+// journalSize is the size of the footer fields of journaled archives: the
+// end of the previous segment (8 bytes) and journalMarker.
+const journalSize = 12
+
+var journalMarker = []byte{'B', 'A', 'R', 'J'}
+
+// WithJournal allows entries to be appended to the archive later, see
+// NewAppender.
+func WithJournal() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagJournal
+		return nil
+	}
+}
+
+// NewAppender adds entries to the journaled archive read by r, which must be
+// stored in w. The new entries are written with their own table after the
+// end of r, so the existing data stays untouched. Until Close succeeds the
+// archive reads as before when opened with Lenient.
+//
+// Appending uses the settings of r like WithSettingsFrom. Names already in
+// the archive are not checked, Lookup returns the first entry of a name.
+func NewAppender(w io.WriteSeeker, r *Reader, level int) (*Writer, error) {
+	if !validLevel(level) {
+		return nil, ErrInvalidLevel
+	}
+	if r.flags&FlagJournal == 0 {
+		return nil, ErrNoJournal
+	}
+
+	// Drop the data of an append that didn't finish.
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		err := t.Truncate(r.size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := w.Seek(r.size, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := &Writer{
+		w:        w,
+		index:    uint64(r.size),
+		prev:     uint64(r.size),
+		level:    level,
+		validate: ValidateName,
+		err:      ErrNoValidEntry,
+	}
+	WithSettingsFrom(r)(bw)
+	return bw, nil
+}
+
+// recoverIndex searches backwards from size for the footer of the last
+// complete segment of a journaled archive, skipping an unfinished append.
+func (br *Reader) recoverIndex(size int64) error {
+	buf := make([]byte, 64<<10)
+	for end := size; end > headerSize; {
+		start := max(end-int64(len(buf)), headerSize)
+		b := buf[:end-start]
+		_, err := br.r.Seek(start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		err = readFull(br.r, b)
+		if err != nil {
+			return err
+		}
+
+		for i := len(b); i > 0; {
+			i = bytes.LastIndex(b[:i], journalMarker)
+			if i < 0 {
+				break
+			}
+			if br.readIndex(start+int64(i+len(journalMarker))) == nil {
+				return nil
+			}
+		}
+
+		if start == headerSize {
+			break
+		}
+		// A marker may start in this chunk and end in the next one.
+		end = start + int64(len(journalMarker)) - 1
+	}
+	return ErrInvalidOffset
+}
@@ -0,0 +1,112 @@
+package bar
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendFiles adds files to the journaled archive name, like a separate
+// run of a program would. Unless finish is set, it stops before closing
+// the writer, like a run that died.
+func appendFiles(t *testing.T, name string, files []testFile, finish bool) {
+	t.Helper()
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	br, err := NewReader(f, Lenient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := NewAppender(f, br, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		err = bw.Create(file.name)
+		if err == nil {
+			_, err = bw.Write([]byte(file.data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if finish {
+		err = bw.Close()
+	} else {
+		err = bw.CloseEntry()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.bar")
+	first := []testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"}}
+	err := os.WriteFile(name, writeArchive(t, first, WithJournal()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		files  []testFile
+		finish bool
+		want   []testFile // read strictly, or nil if that fails
+	}{
+		{"second run", []testFile{{"c.txt", "charlie"}}, true,
+			[]testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"},
+				{"c.txt", "charlie"}}},
+		{"third run", []testFile{{"d.txt", "delta"},
+			{"data", string(benchData(50 << 10))}}, true,
+			[]testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"},
+				{"c.txt", "charlie"}, {"d.txt", "delta"},
+				{"data", string(benchData(50 << 10))}}},
+		{"died", []testFile{{"e.txt", "echo"}}, false, nil},
+		{"after dying", []testFile{{"f.txt", "foxtrot"}}, true,
+			[]testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"},
+				{"c.txt", "charlie"}, {"d.txt", "delta"},
+				{"data", string(benchData(50 << 10))}, {"f.txt", "foxtrot"}}},
+	}
+
+	want := first
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appendFiles(t, name, tt.files, tt.finish)
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == nil {
+				_, err := NewReader(bytes.NewReader(b))
+				if err == nil {
+					t.Error("unfinished append read strictly")
+				}
+			} else {
+				want = tt.want
+				checkFiles(t, openArchive(t, b), want)
+			}
+			checkFiles(t, openArchive(t, b, Lenient()), want)
+		})
+	}
+
+	// Archives without journal can't be appended to.
+	br := openArchive(t, writeArchive(t, first))
+	f, err := os.Create(filepath.Join(t.TempDir(), "b.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = NewAppender(f, br, flate.DefaultCompression)
+	if !errors.Is(err, ErrNoJournal) {
+		t.Errorf("got %v, want %v", err, ErrNoJournal)
+	}
+}
@@ -0,0 +1,126 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+var (
+	ErrNoMetadata     = errors.New("Archive has no metadata section.")
+	ErrCreatorTooLong = errors.New("Creator too long.")
+)
+
+// metadata describes the archive as a whole. It is stored in a section
+// before the table, see WithMetadata.
+type metadata struct {
+	creator string
+	created time.Time
+	comment string
+}
+
+// WithMetadata stores a metadata section with the creator of the archive,
+// its creation time and a comment, see Writer.SetArchiveComment. A zero
+// created is stored as none.
+func WithMetadata(creator string, created time.Time) WriterOption {
+	return func(bw *Writer) error {
+		if len(creator) > math.MaxUint16 {
+			return ErrCreatorTooLong
+		}
+		bw.flags |= FlagMetadata
+		bw.meta.creator = creator
+		bw.meta.created = created
+		return nil
+	}
+}
+
+// SetArchiveComment sets the comment describing the archive. It can be
+// called until the writer is closed and returns ErrNoMetadata unless the
+// archive is written with WithMetadata.
+func (bw *Writer) SetArchiveComment(comment string) error {
+	if bw.err == ErrWriteAfterClose {
+		return bw.err
+	}
+	if bw.flags&FlagMetadata == 0 {
+		return ErrNoMetadata
+	}
+	if uint64(len(comment)) > math.MaxUint32 {
+		return ErrCommentTooLong
+	}
+
+	bw.meta.comment = comment
+	return nil
+}
+
+// ArchiveCreator returns the creator stored with WithMetadata, or "" if
+// the archive has none.
+func (br *Reader) ArchiveCreator() string {
+	return br.meta.creator
+}
+
+// ArchiveCreated returns the creation time stored with WithMetadata, or the
+// zero time if the archive has none.
+func (br *Reader) ArchiveCreated() time.Time {
+	return br.meta.created
+}
+
+// ArchiveComment returns the comment set with Writer.SetArchiveComment, or
+// "" if the archive has none. Journaled archives use the metadata of the
+// last append.
+func (br *Reader) ArchiveComment() string {
+	return br.meta.comment
+}
+
+// writeMetadata writes the metadata section: the creation time, the creator
+// preceded by its 2 byte length and the comment preceded by its 4 byte
+// length. It returns the number of bytes written.
+func writeMetadata(w io.Writer, m *metadata) (int, error) {
+	buf := make([]byte, 8+2+len(m.creator)+4+len(m.comment))
+	wb := wBuf(buf)
+	wb.Uint64(uint64(unixNano(m.created)))
+	wb.Uint16(uint16(len(m.creator)))
+	copy(wb, m.creator)
+	wb = wb[len(m.creator):]
+	wb.Uint32(uint32(len(m.comment)))
+	copy(wb, m.comment)
+	return w.Write(buf)
+}
+
+// readMetadata reads a metadata section written by writeMetadata, which
+// must take up all of r.
+func readMetadata(r io.Reader) (metadata, error) {
+	var m metadata
+	buf := make([]byte, 8)
+	err := readFull(r, buf)
+	if err != nil {
+		return m, err
+	}
+	rb := rBuf(buf)
+	if t := int64(rb.Uint64()); t != 0 {
+		m.created = time.Unix(0, t)
+	}
+
+	m.creator, err = readString(r)
+	if err != nil {
+		return m, err
+	}
+
+	buf = make([]byte, 4)
+	err = readFull(r, buf)
+	if err != nil {
+		return m, err
+	}
+	rb = rBuf(buf)
+
+	// The comment takes up the rest of the section.
+	comment, err := io.ReadAll(r)
+	if err != nil {
+		return m, err
+	}
+	if uint64(len(comment)) != uint64(rb.Uint32()) {
+		return m, ErrCorruptData
+	}
+	m.comment = string(comment)
+	return m, nil
+}
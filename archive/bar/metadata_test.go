@@ -0,0 +1,100 @@
+package bar
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		creator string
+		created time.Time
+		comment string
+		opts    []WriterOption
+		ropts   []ReaderOption
+	}{
+		{"all", "user", created, "nightly build", nil, nil},
+		{"no comment", "user", created, "", nil, nil},
+		{"no time", "user", time.Time{}, "note", nil, nil},
+		{"long comment", "", created, strings.Repeat("c", 100<<10), nil, nil},
+		{"compact", "user", created, "note", []WriterOption{WithCompact()}, nil},
+		{"encrypted", "user", created, "note", []WriterOption{WithKey(testKey)},
+			[]ReaderOption{WithDecryptionKey(testKey)}},
+	}
+
+	files := []testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]WriterOption{WithMetadata(tt.creator, tt.created)},
+				tt.opts...)
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				err = bw.Create(f.name)
+				if err == nil {
+					_, err = bw.Write([]byte(f.data))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The comment can be set after the entries.
+			err = bw.SetArchiveComment(tt.comment)
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.SetArchiveComment("late")
+			if err != ErrWriteAfterClose {
+				t.Errorf("after Close: got %v, want %v", err, ErrWriteAfterClose)
+			}
+
+			br := openArchive(t, buf.Bytes(), tt.ropts...)
+			checkFiles(t, br, files)
+			if br.ArchiveCreator() != tt.creator ||
+				!br.ArchiveCreated().Equal(tt.created) ||
+				br.ArchiveComment() != tt.comment {
+				t.Errorf("got %q, %v, %d bytes, want %q, %v, %d bytes",
+					br.ArchiveCreator(), br.ArchiveCreated(),
+					len(br.ArchiveComment()), tt.creator, tt.created,
+					len(tt.comment))
+			}
+		})
+	}
+}
+
+func TestMetadataErrors(t *testing.T) {
+	_, err := NewWriter(io.Discard, WithMetadata(strings.Repeat("u",
+		math.MaxUint16+1), time.Time{}))
+	if err != ErrCreatorTooLong {
+		t.Errorf("creator: got %v, want %v", err, ErrCreatorTooLong)
+	}
+
+	bw, err := NewWriter(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.SetArchiveComment("note")
+	if err != ErrNoMetadata {
+		t.Errorf("no metadata: got %v, want %v", err, ErrNoMetadata)
+	}
+
+	br := openArchive(t, writeArchive(t, []testFile{{"a.txt", "alpha"}}))
+	if br.ArchiveCreator() != "" || !br.ArchiveCreated().IsZero() ||
+		br.ArchiveComment() != "" {
+		t.Errorf("got %q, %v, %q, want no metadata", br.ArchiveCreator(),
+			br.ArchiveCreated(), br.ArchiveComment())
+	}
+}
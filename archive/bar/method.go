@@ -0,0 +1,319 @@
+package bar
+
+import (
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"bar/archive/bar/internal/lz4"
+	"bar/archive/bar/internal/xz"
+	"bar/archive/bar/internal/zstd"
+)
+
+var (
+	ErrUnsupportedMethod = errors.New("Unsupported compression method.")
+	ErrInvalidRatio      = errors.New("Invalid compression ratio.")
+)
+
+// DefaultStoreRatio is a ratio for WithAutoStore storing data that saves
+// less than 5% when compressed.
+const DefaultStoreRatio = 0.95
+
+// sampleSize is the size of the start of the data of an entry compressed to
+// find out whether it compresses, see WithAutoStore.
+const sampleSize = 64 << 10
+
+// Method is the compression method of the data of an entry.
+type Method uint8
+
+const (
+	MethodDeflate Method = iota // raw DEFLATE, the method of all older archives
+	MethodGzip                  // a gzip member, readable by gzip tools
+	MethodLZ4                   // an LZ4 frame, fast but larger than DEFLATE
+	MethodXZ                    // an xz stream, slow but smaller than DEFLATE
+	MethodBzip2                 // a bzip2 stream, only kept as it is, see CreateCompressed
+	MethodStored                // the data as it is, for data that doesn't compress
+	MethodZstd                  // a Zstandard frame, about as small as DEFLATE and faster to read
+)
+
+var methodNames = map[Method]string{
+	MethodDeflate: "deflate",
+	MethodGzip:    "gzip",
+	MethodLZ4:     "lz4",
+	MethodXZ:      "xz",
+	MethodBzip2:   "bzip2",
+	MethodStored:  "stored",
+	MethodZstd:    "zstd",
+}
+
+func (m Method) String() string {
+	if name, ok := methodNames[m]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseMethod returns the method with the given name, as returned by
+// Method.String.
+func ParseMethod(name string) (Method, error) {
+	for m, n := range methodNames {
+		if n == name {
+			return m, nil
+		}
+	}
+	return 0, ErrUnsupportedMethod
+}
+
+// WithMethod compresses the data of new entries with m instead of DEFLATE
+// and stores the method of every entry, see Writer.SetMethod.
+func WithMethod(m Method) WriterOption {
+	return func(bw *Writer) error {
+		if !canCompress(m) {
+			return ErrUnsupportedMethod
+		}
+		bw.flags |= FlagMethods
+		bw.method = m
+		return nil
+	}
+}
+
+// WithAutoStore stores the data of an entry as it is, with MethodStored,
+// if its first 64 KiB don't compress to less than ratio of their size with
+// fast DEFLATE, so already compressed files like videos don't grow. The
+// ratio must be greater than 0 and at most 1, see DefaultStoreRatio.
+func WithAutoStore(ratio float64) WriterOption {
+	return func(bw *Writer) error {
+		if !(ratio > 0 && ratio <= 1) {
+			return ErrInvalidRatio
+		}
+		bw.flags |= FlagMethods
+		bw.ratio = ratio
+		return nil
+	}
+}
+
+// SetMethod sets the compression method of the current entry. It must be
+// called before data is written. Archives not written with WithMethod only
+// store DEFLATE data.
+func (bw *Writer) SetMethod(m Method) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
+	if !canCompress(m) {
+		return ErrUnsupportedMethod
+	}
+	if bw.flags&FlagMethods == 0 && m != MethodDeflate {
+		return ErrIncompatibleEntry
+	}
+
+	if bw.block != nil {
+		if m == bw.block.method {
+			return nil
+		}
+		err := bw.ownBlock()
+		if err != nil {
+			bw.err = err
+			return err
+		}
+	}
+	err := bw.curr.SetMethod(m)
+	if err != nil {
+		return err
+	}
+	bw.entries[len(bw.entries)-1].Method = m
+	return nil
+}
+
+// CreateCompressed adds an entry whose data is the stream compressed with m
+// read from r, which is stored as it is. The stream is decompressed once to
+// find the size of the data, so corrupt streams are rejected. This keeps
+// the streams of data converted from other formats, including bzip2 streams,
+// which can't be written otherwise. Archives not written with WithMethod
+// only store DEFLATE data.
+func (bw *Writer) CreateCompressed(name string, m Method, r io.Reader) error {
+	if _, ok := methodNames[m]; !ok {
+		return ErrUnsupportedMethod
+	}
+	if bw.flags&FlagMethods == 0 && m != MethodDeflate {
+		return ErrIncompatibleEntry
+	}
+
+	err := bw.Create(name)
+	if err != nil {
+		return err
+	}
+	bw.entries[len(bw.entries)-1].Method = m
+
+	// The stream is a solid block of its own.
+	err = bw.ownBlock()
+	if err != nil {
+		bw.err = err
+		return err
+	}
+
+	var content io.Writer = io.Discard
+	switch {
+	case bw.block != nil && bw.content != nil:
+		content = io.MultiWriter(bw.content, bw.solidSum)
+	case bw.block != nil:
+		content = bw.solidSum
+	case bw.content != nil:
+		content = bw.content
+	}
+	err = bw.curr.storeCompressed(r, m, content)
+	if err == nil {
+		err = bw.CloseEntry()
+	}
+	if err == nil && bw.block != nil {
+		err = bw.closeBlock(len(bw.entries))
+	}
+	if err != nil {
+		bw.err = err
+	}
+	return err
+}
+
+// canCompress reports whether data can be compressed with m.
+func canCompress(m Method) bool {
+	_, ok := methodNames[m]
+	return ok && m != MethodBzip2
+}
+
+// newCompressor returns a writer compressing data to w with m at level.
+// LZ4, xz and zstd have a single level, stored data none.
+func newCompressor(w io.Writer, m Method, level int) (io.WriteCloser, error) {
+	switch m {
+	case MethodDeflate:
+		return flate.NewWriter(w, level)
+	case MethodGzip:
+		return gzip.NewWriterLevel(w, level)
+	case MethodLZ4:
+		return lz4.NewWriter(w), nil
+	case MethodXZ:
+		return xz.NewWriter(w), nil
+	case MethodStored:
+		return nopCloser{w}, nil
+	case MethodZstd:
+		return zstd.NewWriter(w), nil
+	}
+	return nil, ErrUnsupportedMethod
+}
+
+// newDecompressor returns a reader decompressing the data of r compressed
+// with m.
+func newDecompressor(r io.Reader, m Method) (io.Reader, error) {
+	switch m {
+	case MethodDeflate:
+		return newFlateReader(r), nil
+	case MethodGzip:
+		zr, err := gzip.NewReader(r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, gzipError(err)
+		}
+		return gzipReader{zr}, nil
+	case MethodLZ4:
+		return lz4Reader{lz4.NewReader(r)}, nil
+	case MethodXZ:
+		return xzReader{xz.NewReader(r)}, nil
+	case MethodBzip2:
+		return bzip2Reader{bzip2.NewReader(r)}, nil
+	case MethodStored:
+		return r, nil
+	case MethodZstd:
+		return zstdReader{zstd.NewReader(r)}, nil
+	}
+	return nil, ErrUnsupportedMethod
+}
+
+// gzipReader reports corrupt gzip streams as ErrCorruptData, like
+// flateReader.
+type gzipReader struct {
+	r io.Reader
+}
+
+func (zr gzipReader) Read(b []byte) (int, error) {
+	n, err := zr.r.Read(b)
+	return n, gzipError(err)
+}
+
+// lz4Reader reports corrupt LZ4 frames as ErrCorruptData, like flateReader.
+type lz4Reader struct {
+	r io.Reader
+}
+
+func (zr lz4Reader) Read(b []byte) (int, error) {
+	n, err := zr.r.Read(b)
+	if err == lz4.ErrCorrupt {
+		err = fmt.Errorf("%w (%w)", ErrCorruptData, err)
+	}
+	return n, err
+}
+
+// xzReader reports corrupt xz streams as ErrCorruptData, like flateReader.
+// Streams using filters or checks this package doesn't support are reported
+// as ErrUnsupportedMethod.
+type xzReader struct {
+	r io.Reader
+}
+
+func (zr xzReader) Read(b []byte) (int, error) {
+	n, err := zr.r.Read(b)
+	switch err {
+	case xz.ErrCorrupt:
+		err = fmt.Errorf("%w (%w)", ErrCorruptData, err)
+	case xz.ErrUnsupported:
+		err = fmt.Errorf("%w (%w)", ErrUnsupportedMethod, err)
+	}
+	return n, err
+}
+
+// zstdReader reports corrupt Zstandard frames as ErrCorruptData, like
+// flateReader. Frames with a dictionary are reported as
+// ErrUnsupportedMethod.
+type zstdReader struct {
+	r io.Reader
+}
+
+func (zr zstdReader) Read(b []byte) (int, error) {
+	n, err := zr.r.Read(b)
+	switch err {
+	case zstd.ErrCorrupt:
+		err = fmt.Errorf("%w (%w)", ErrCorruptData, err)
+	case zstd.ErrUnsupported:
+		err = fmt.Errorf("%w (%w)", ErrUnsupportedMethod, err)
+	}
+	return n, err
+}
+
+// bzip2Reader reports corrupt bzip2 streams as ErrCorruptData, like
+// flateReader.
+type bzip2Reader struct {
+	r io.Reader
+}
+
+func (zr bzip2Reader) Read(b []byte) (int, error) {
+	n, err := zr.r.Read(b)
+	var se bzip2.StructuralError
+	if errors.As(err, &se) {
+		err = fmt.Errorf("%w (%w)", ErrCorruptData, err)
+	}
+	return n, err
+}
+
+func gzipError(err error) error {
+	var ce flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.As(err, &ce) {
+		err = fmt.Errorf("%w (%w)", ErrCorruptData, err)
+	}
+	return err
+}
@@ -0,0 +1,544 @@
+package bar
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"hash/adler32"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestStoredAndLevelZero(t *testing.T) {
+	// Stored data that happens to be a DEFLATE stream is read as it is.
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err == nil {
+		_, err = fw.Write(bytes.Repeat([]byte("inner "), 100))
+	}
+	if err == nil {
+		err = fw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   []WriterOption
+		data   []byte
+		method Method
+		framed bool // compressed data is larger than the data
+	}{
+		{"level 0", []WriterOption{WithCompressionLevel(flate.NoCompression)},
+			benchData(100 << 10), MethodDeflate, true},
+		{"stored", []WriterOption{WithMethod(MethodStored)},
+			benchData(100 << 10), MethodStored, false},
+		{"stored deflate stream", []WriterOption{WithMethod(MethodStored)},
+			deflated.Bytes(), MethodStored, false},
+		{"level 0 deflate stream",
+			[]WriterOption{WithCompressionLevel(flate.NoCompression)},
+			deflated.Bytes(), MethodDeflate, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := []testFile{{"data", string(tt.data)}}
+			br := openArchive(t, writeArchive(t, files, tt.opts...))
+			checkFiles(t, br, files)
+
+			e := &br.Entries[0]
+			if e.Method != tt.method {
+				t.Errorf("method %v, want %v", e.Method, tt.method)
+			}
+			if framed := e.CompressedSize() > e.Size; framed != tt.framed {
+				t.Errorf("compressed size %d for %d bytes", e.CompressedSize(),
+					e.Size)
+			}
+
+			raw, err := br.rawReader(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := io.ReadAll(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(stored, tt.data) == tt.framed {
+				t.Errorf("data is stored with framing %v, want %v", !tt.framed,
+					tt.framed)
+			}
+		})
+	}
+}
+
+func TestZstd(t *testing.T) {
+	files := []testFile{
+		{"empty", ""},
+		{"short", "hello, hello"},
+		{"data", string(benchData(300 << 10))},
+	}
+	br := openArchive(t, writeArchive(t, files, WithMethod(MethodZstd)))
+	checkFiles(t, br, files)
+
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if e.Method != MethodZstd {
+			t.Errorf("%s: method %v, want %v", e.Name, e.Method, MethodZstd)
+		}
+	}
+	if m, err := ParseMethod("zstd"); m != MethodZstd || err != nil {
+		t.Errorf("ParseMethod(zstd) = %v, %v", m, err)
+	}
+
+	// The frames of other methods aren't Zstandard frames.
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err == nil {
+		_, err = fw.Write([]byte("not zstd"))
+	}
+	if err == nil {
+		err = fw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newDecompressor(&buf, MethodZstd)
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if !errors.Is(err, ErrCorruptData) {
+		t.Errorf("got %v, want %v", err, ErrCorruptData)
+	}
+}
+
+// failingReaderAt fails reads of the bytes from start to end.
+type failingReaderAt struct {
+	b          []byte
+	start, end int64
+}
+
+var errRead = errors.New("read failed")
+
+func (r failingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > r.start && off < r.end {
+		return 0, errRead
+	}
+	return bytes.NewReader(r.b).ReadAt(b, off)
+}
+
+func TestCorruptData(t *testing.T) {
+	files := []testFile{{"data", string(benchData(50 << 10))}}
+	tests := []struct {
+		name   string
+		method Method
+	}{
+		{"deflate", MethodDeflate},
+		{"gzip", MethodGzip},
+		{"lz4", MethodLZ4},
+		{"xz", MethodXZ},
+		{"zstd", MethodZstd},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := writeArchive(t, files, WithMethod(tt.method))
+			e := openArchive(t, b).Entries[0]
+
+			// Changed bytes and the checksum to match them, so the
+			// decompressor sees them.
+			corrupt := bytes.Clone(b)
+			block := corrupt[e.index : e.index+e.sizeCompressed]
+			for i := range block {
+				block[i] = 0xff
+			}
+			br := openArchive(t, corrupt)
+			br.Entries[0].adler = adler32.Checksum(block)
+			_, err := br.ReadFile("data")
+			if !errors.Is(err, ErrCorruptData) {
+				t.Errorf("changed data: got %v, want %v", err, ErrCorruptData)
+			}
+
+			// Failed reads aren't corrupt data.
+			br, err = NewReaderAt(failingReaderAt{b, int64(e.index) + 10,
+				int64(e.index + e.sizeCompressed)}, int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = br.ReadFile("data")
+			if !errors.Is(err, errRead) || errors.Is(err, ErrCorruptData) {
+				t.Errorf("failed read: got %v, want %v", err, errRead)
+			}
+		})
+	}
+}
+
+func TestGzip(t *testing.T) {
+	files := []testFile{
+		{"empty", ""},
+		{"a.txt", "alpha"},
+		{"data", string(benchData(100 << 10))},
+	}
+	br := openArchive(t, writeArchive(t, files, WithMethod(MethodGzip)))
+	checkFiles(t, br, files)
+
+	// The stored data of each entry is a gzip member other tools can read.
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if e.Method != MethodGzip {
+			t.Errorf("%s: method %v, want %v", e.Name, e.Method, MethodGzip)
+		}
+		raw, err := br.rawReader(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", e.Name, err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil || string(data) != files[i].data {
+			t.Errorf("%s: gzip read %d bytes, %v, want %d", e.Name, len(data),
+				err, len(files[i].data))
+		}
+	}
+}
+
+func TestSetMethod(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []WriterOption
+		method Method
+		write  bool // data is written before SetMethod
+		want   error
+		next   Method // of the entry after
+	}{
+		{"gzip", []WriterOption{WithMethod(MethodDeflate)}, MethodGzip, false, nil,
+			MethodDeflate},
+		{"deflate", []WriterOption{WithMethod(MethodGzip)}, MethodDeflate, false, nil,
+			MethodGzip},
+		{"deflate only", nil, MethodDeflate, false, nil, MethodDeflate},
+		{"without methods", nil, MethodGzip, false, ErrIncompatibleEntry, 0},
+		{"after write", []WriterOption{WithMethod(MethodDeflate)}, MethodGzip, true,
+			ErrMethodAfterWrite, 0},
+		{"bzip2", []WriterOption{WithMethod(MethodDeflate)}, MethodBzip2, false,
+			ErrUnsupportedMethod, 0},
+		{"unknown", []WriterOption{WithMethod(MethodDeflate)}, Method(100), false,
+			ErrUnsupportedMethod, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err == nil && tt.write {
+				_, err = bw.Write([]byte("alpha"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.SetMethod(tt.method)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			// Only the current entry uses the method.
+			_, err = bw.Write([]byte("alpha"))
+			if err == nil {
+				err = bw.Create("b.txt")
+			}
+			if err == nil {
+				_, err = bw.Write([]byte("bravo"))
+			}
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			br := openArchive(t, buf.Bytes())
+			checkFiles(t, br, []testFile{{"a.txt", "alpha"}, {"b.txt", "bravo"}})
+			if m := br.Entries[0].Method; m != tt.method {
+				t.Errorf("a.txt: method %v, want %v", m, tt.method)
+			}
+			if m := br.Entries[1].Method; m != tt.next {
+				t.Errorf("b.txt: method %v, want %v", m, tt.next)
+			}
+		})
+	}
+}
+
+func TestLZ4(t *testing.T) {
+	files := []testFile{
+		{"empty", ""},
+		{"a.txt", "alpha"},
+		{"data", string(benchData(300 << 10))},
+	}
+	br := openArchive(t, writeArchive(t, files, WithMethod(MethodLZ4)))
+	checkFiles(t, br, files)
+
+	// The stored data of each entry is an LZ4 frame.
+	magic := []byte{0x04, 0x22, 0x4d, 0x18}
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if e.Method != MethodLZ4 {
+			t.Errorf("%s: method %v, want %v", e.Name, e.Method, MethodLZ4)
+		}
+		raw, err := br.rawReader(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := io.ReadAll(raw)
+		if err != nil || !bytes.HasPrefix(stored, magic) {
+			t.Errorf("%s: stored %x, %v, want an LZ4 frame", e.Name,
+				stored[:min(len(stored), 8)], err)
+		}
+	}
+
+	// LZ4 is larger than DEFLATE, but still compresses.
+	size := func(opts ...WriterOption) uint64 {
+		e, err := openArchive(t, writeArchive(t, files, opts...)).Lookup("data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.CompressedSize()
+	}
+	lz4, deflate := size(WithMethod(MethodLZ4)), size()
+	if lz4 >= uint64(len(files[2].data)) || lz4 < deflate {
+		t.Errorf("%d bytes with LZ4, %d with DEFLATE for %d", lz4, deflate,
+			len(files[2].data))
+	}
+}
+
+func TestXZ(t *testing.T) {
+	files := []testFile{
+		{"empty", ""},
+		{"a.txt", "alpha"},
+		{"data", string(benchData(300 << 10))},
+	}
+	br := openArchive(t, writeArchive(t, files, WithMethod(MethodXZ)))
+	checkFiles(t, br, files)
+
+	// The stored data of each entry is an xz stream.
+	magic := []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+	for i := range br.Entries {
+		e := &br.Entries[i]
+		if e.Method != MethodXZ {
+			t.Errorf("%s: method %v, want %v", e.Name, e.Method, MethodXZ)
+		}
+		raw, err := br.rawReader(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := io.ReadAll(raw)
+		if err != nil || !bytes.HasPrefix(stored, magic) {
+			t.Errorf("%s: stored %x, %v, want an xz stream", e.Name,
+				stored[:min(len(stored), 8)], err)
+		}
+	}
+	if m, err := ParseMethod("xz"); m != MethodXZ || err != nil {
+		t.Errorf("ParseMethod(xz) = %v, %v", m, err)
+	}
+
+	// Mixed with DEFLATE entries.
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithMethod(MethodDeflate))
+	for i, f := range files {
+		if err == nil {
+			err = bw.Create(f.name)
+		}
+		if err == nil && i%2 == 0 {
+			err = bw.SetMethod(MethodXZ)
+		}
+		if err == nil {
+			_, err = bw.Write([]byte(f.data))
+		}
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, openArchive(t, buf.Bytes()), files)
+}
+
+// bzip2Hello is "hello, hello, hello\n" 50 times, compressed with bzip2.
+const bzip2Hello = "425a6839314159265359d11a51ff0001065100001040040244a000508600" +
+	"2950d0f22e11688baa4611622ea91e291f177245385090d11a51ff"
+
+func TestCreateCompressed(t *testing.T) {
+	data := strings.Repeat("hello, hello, hello\n", 50)
+	bz, err := hex.DecodeString(bzip2Hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err = zw.Write([]byte(data))
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := bytes.Clone(bz)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	tests := []struct {
+		name   string
+		opts   []WriterOption
+		method Method
+		stream []byte
+		want   error
+		ropts  []ReaderOption
+	}{
+		{"bzip2", []WriterOption{WithMethod(MethodDeflate)}, MethodBzip2, bz, nil,
+			nil},
+		{"gzip", []WriterOption{WithMethod(MethodDeflate)}, MethodGzip,
+			gz.Bytes(), nil, nil},
+		{"solid", []WriterOption{WithMethod(MethodDeflate), WithSolid(1 << 10)},
+			MethodBzip2, bz, nil, nil},
+		{"encrypted", []WriterOption{WithMethod(MethodDeflate), WithKey(testKey)},
+			MethodBzip2, bz, nil, []ReaderOption{WithDecryptionKey(testKey)}},
+		{"corrupt", []WriterOption{WithMethod(MethodDeflate)}, MethodBzip2,
+			corrupt, ErrCorruptData, nil},
+		{"wrong method", []WriterOption{WithMethod(MethodDeflate)}, MethodGzip,
+			bz, ErrCorruptData, nil},
+		{"without methods", nil, MethodBzip2, bz, ErrIncompatibleEntry, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err == nil {
+				_, err = bw.Write([]byte("alpha"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.CreateCompressed("hello.txt", tt.method,
+				bytes.NewReader(tt.stream))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			err = bw.Create("b.txt")
+			if err == nil {
+				_, err = bw.Write([]byte("bravo"))
+			}
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes(), tt.ropts...)
+			checkFiles(t, br, []testFile{
+				{"a.txt", "alpha"},
+				{"hello.txt", data},
+				{"b.txt", "bravo"},
+			})
+			e, err := br.Lookup("hello.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Method != tt.method || e.Size != uint64(len(data)) {
+				t.Errorf("method %v, size %d, want %v, %d", e.Method, e.Size,
+					tt.method, len(data))
+			}
+		})
+	}
+}
+
+// randomData returns n bytes that don't compress.
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(2)).Read(b)
+	return b
+}
+
+func TestAutoStore(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		chunk  int // size of the writes, all at once if 0
+		opts   []WriterOption
+		method Method
+	}{
+		{"random", randomData(200 << 10), 0, nil, MethodStored},
+		{"random short", randomData(1 << 10), 0, nil, MethodStored},
+		{"random in pieces", randomData(200 << 10), 1000, nil, MethodStored},
+		{"text", benchData(200 << 10), 0, nil, MethodDeflate},
+		{"text short", benchData(1 << 10), 0, nil, MethodDeflate},
+		{"text in pieces", benchData(200 << 10), 1000, nil, MethodDeflate},
+		{"text zstd", benchData(200 << 10), 0,
+			[]WriterOption{WithMethod(MethodZstd)}, MethodZstd},
+		{"random zstd", randomData(200 << 10), 0,
+			[]WriterOption{WithMethod(MethodZstd)}, MethodStored},
+		{"text solid", benchData(200 << 10), 0,
+			[]WriterOption{WithSolid(16 << 10)}, MethodDeflate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]WriterOption{WithAutoStore(DefaultStoreRatio)},
+				tt.opts...)
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, opts...)
+			if err == nil {
+				err = bw.Create("data")
+			}
+			chunk := tt.chunk
+			if chunk == 0 {
+				chunk = len(tt.data)
+			}
+			for p := tt.data; err == nil && len(p) > 0; {
+				n := min(chunk, len(p))
+				_, err = bw.Write(p[:n])
+				p = p[n:]
+			}
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes())
+			checkFiles(t, br, []testFile{{"data", string(tt.data)}})
+			e := br.Entries[0]
+			if e.Method != tt.method {
+				t.Errorf("method %v, want %v", e.Method, tt.method)
+			}
+			if tt.method == MethodStored && e.CompressedSize() != e.Size {
+				t.Errorf("stored %d bytes for %d", e.CompressedSize(), e.Size)
+			}
+		})
+	}
+
+	for _, ratio := range []float64{0, -1, 1.5, math.NaN()} {
+		_, err := NewWriter(io.Discard, WithAutoStore(ratio))
+		if err != ErrInvalidRatio {
+			t.Errorf("ratio %v: got %v, want %v", ratio, err, ErrInvalidRatio)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package bar
+
+import "os"
+
+// OpenMmap opens the archive at path. Memory mapping isn't supported on
+// this platform, so the archive is read from the file, which the returned
+// function closes.
+func OpenMmap(path string) (*Reader, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return br, f.Close, nil
+}
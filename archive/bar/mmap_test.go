@@ -0,0 +1,57 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenMmap(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"data", string(benchData(300 << 10))},
+	}
+	tests := []struct {
+		name string
+		data []byte // nil for a missing file
+		want error
+	}{
+		{"archive", writeArchive(t, files), nil},
+		{"empty", []byte{}, io.ErrUnexpectedEOF},
+		{"not an archive", []byte("not an archive"), ErrUnknownFormat},
+		{"missing", nil, fs.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "a.bar")
+			if tt.data != nil {
+				err := os.WriteFile(name, tt.data, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			br, unmap, err := OpenMmap(name)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			checkFiles(t, br, files)
+			err = br.VerifyAll()
+			if err != nil {
+				t.Error(err)
+			}
+
+			err = unmap()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package bar
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// OpenMmap opens the archive at path by mapping it into memory. The
+// returned function unmaps the archive, after which the Reader must not be
+// used any more.
+func OpenMmap(path string) (*Reader, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	s, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The mapping must fit in an int, which is 32 bits on some platforms.
+	if int64(int(s.Size())) != s.Size() {
+		return nil, nil, &fs.PathError{Op: "mmap", Path: path, Err: syscall.EFBIG}
+	}
+
+	var data []byte
+	if s.Size() > 0 {
+		data, err = syscall.Mmap(int(f.Fd()), 0, int(s.Size()),
+			syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	unmap := func() error {
+		if data == nil {
+			return nil
+		}
+		err := syscall.Munmap(data)
+		data = nil
+		return err
+	}
+
+	br, err := NewReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		unmap()
+		return nil, nil, err
+	}
+	return br, unmap, nil
+}
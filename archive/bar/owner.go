@@ -0,0 +1,120 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+var ErrInvalidOwner = errors.New("Invalid owner.")
+
+// noID is stored for the uid or gid of entries without one.
+const noID = math.MaxUint32
+
+// WithOwner stores the owner and group of every entry, see
+// Writer.SetOwner. Entries without one store none.
+func WithOwner() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagOwner
+		return nil
+	}
+}
+
+// SetOwner sets the uid and gid of the current entry and optionally the
+// names of its owner and group. An id of -1 is stored as none. It is
+// ignored unless the archive is written with WithOwner.
+func (bw *Writer) SetOwner(uid, gid int, user, group string) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
+
+	if !validID(uid) || !validID(gid) || len(user) > math.MaxUint16 ||
+		len(group) > math.MaxUint16 {
+		return ErrInvalidOwner
+	}
+
+	e := &bw.entries[len(bw.entries)-1]
+	e.UID, e.GID = uid, gid
+	e.Uname, e.Gname = user, group
+	return nil
+}
+
+func validID(id int) bool {
+	return id >= -1 && int64(id) < noID
+}
+
+// writeOwner writes the uid and gid of e, then the names of its owner and
+// group preceded by their 2 byte length.
+func writeOwner(w io.Writer, e *Entry) error {
+	buf := make([]byte, 8)
+	wb := wBuf(buf)
+	wb.Uint32(uint32(e.UID))
+	wb.Uint32(uint32(e.GID))
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{e.Uname, e.Gname} {
+		buf := make([]byte, 2)
+		wb := wBuf(buf)
+		wb.Uint16(uint16(len(name)))
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(w, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readOwner reads the owner of e written by writeOwner.
+func readOwner(r io.Reader, e *Entry) error {
+	buf := make([]byte, 8)
+	err := readFull(r, buf)
+	if err != nil {
+		return err
+	}
+
+	rb := rBuf(buf)
+	e.UID, e.GID = readID(rb.Uint32()), readID(rb.Uint32())
+
+	e.Uname, err = readString(r)
+	if err != nil {
+		return err
+	}
+	e.Gname, err = readString(r)
+	return err
+}
+
+func readID(id uint32) int {
+	if id == noID {
+		return -1
+	}
+	return int(id)
+}
+
+// restoreOwner sets the owner and group of name to those of e, if
+// ExtractOptions.Owner is set. Failures are reported to OnWarning, unless
+// FailOnMetadata is set.
+func restoreOwner(name string, e *Entry, opts *ExtractOptions) error {
+	if !opts.Owner || (e.UID < 0 && e.GID < 0) {
+		return nil
+	}
+
+	err := lchown(name, e.UID, e.GID)
+	if err != nil && opts.FailOnMetadata {
+		return err
+	}
+	if err != nil {
+		opts.warn(err)
+	}
+	return nil
+}
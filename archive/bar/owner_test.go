@@ -0,0 +1,72 @@
+package bar
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSetOwner(t *testing.T) {
+	tests := []struct {
+		name        string
+		uid, gid    int
+		user, group string
+		opts        []WriterOption
+		want        error
+		wantUID     int
+		wantGID     int
+		wantUser    string
+		wantGroup   string
+	}{
+		{"ids", 1000, 100, "", "", []WriterOption{WithOwner()}, nil,
+			1000, 100, "", ""},
+		{"names", 0, 0, "root", "wheel", []WriterOption{WithOwner()}, nil,
+			0, 0, "root", "wheel"},
+		{"none", -1, -1, "", "", []WriterOption{WithOwner()}, nil,
+			-1, -1, "", ""},
+		{"largest", math.MaxUint32 - 1, 0, "", "", []WriterOption{WithOwner()},
+			nil, math.MaxUint32 - 1, 0, "", ""},
+		{"compact", 1000, 100, "user", "", []WriterOption{WithOwner(), WithCompact()},
+			nil, 1000, 100, "user", ""},
+		{"not stored", 1000, 100, "user", "group", nil, nil, -1, -1, "", ""},
+		{"negative", -2, 0, "", "", []WriterOption{WithOwner()}, ErrInvalidOwner,
+			0, 0, "", ""},
+		{"too large", 0, math.MaxUint32, "", "", []WriterOption{WithOwner()},
+			ErrInvalidOwner, 0, 0, "", ""},
+		{"long name", 0, 0, strings.Repeat("u", math.MaxUint16+1), "",
+			[]WriterOption{WithOwner()}, ErrInvalidOwner, 0, 0, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.SetOwner(tt.uid, tt.gid, tt.user, tt.group)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e := openArchive(t, buf.Bytes()).Entries[0]
+			if e.UID != tt.wantUID || e.GID != tt.wantGID ||
+				e.Uname != tt.wantUser || e.Gname != tt.wantGroup {
+				t.Errorf("got %d:%d %q:%q, want %d:%d %q:%q", e.UID, e.GID,
+					e.Uname, e.Gname, tt.wantUID, tt.wantGID, tt.wantUser,
+					tt.wantGroup)
+			}
+		})
+	}
+}
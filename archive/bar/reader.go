@@ -2,32 +2,234 @@ package bar
 
 import (
 	"bufio"
+	"bytes"
 	"compress/flate"
+	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash"
 	"hash/adler32"
 	"io"
+	"io/fs"
+	"math"
 	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrUnknownFormat      = errors.New("Unknown file format.")
 	ErrUnsupportedVersion = errors.New("Unsupported BAR version.")
+	ErrUnsupportedFeature = errors.New("Unsupported feature.")
 	ErrInvalidChecksum    = errors.New("Invalid checksum.")
+	ErrInvalidOffset      = errors.New("Invalid offset.")
+	ErrCorruptData        = errors.New("Corrupt data.")
+	ErrEntryNotFound      = errors.New("Entry not found.")
+	ErrAmbiguousName      = errors.New("Ambiguous entry name.")
+	ErrLimitExceeded      = errors.New("Entry size limit exceeded.")
+	ErrEmptyName          = errors.New("Empty entry name.")
 )
 
+// maxTrailingBytes is the number of bytes a lenient reader skips at most
+// when searching for the footer.
+const maxTrailingBytes = 16
+
 type Reader struct {
-	Entries []Entry
-	r       io.ReadSeeker
+	Entries   []Entry
+	r         io.ReadSeeker
+	ra        io.ReaderAt
+	size      int64
+	tableSize uint64
+	version   byte
+	flags     uint32
+	alignment uint32
+	aead      cipher.AEAD
+	kdf       kdfParams
+	name      string
+	producer  string
+	meta      metadata
+
+	skipTableChecksum bool
+	caseFold          bool
+	maxEntrySize      uint64
+	lenient           bool
+	key               []byte
+	password          []byte
+
+	dirIndex map[string][]fs.DirEntry
+
+	// The block of a solid archive the last entry was read from.
+	blockMu sync.Mutex
+	block   *solidBlock
 }
 
-func NewReader(r io.ReadSeeker) (*Reader, error) {
-	header := make([]byte, headerSize)
-	_, err := r.Read(header)
-	if err == io.EOF {
+type ReaderOption func(*Reader)
+
+// WithoutTableChecksum skips verifying the checksum of the entry table,
+// which saves hashing the table of trusted archives.
+func WithoutTableChecksum() ReaderOption {
+	return func(br *Reader) {
+		br.skipTableChecksum = true
+	}
+}
+
+// WithCaseFold makes Lookup match names case-insensitively if no name
+// matches exactly.
+func WithCaseFold() ReaderOption {
+	return func(br *Reader) {
+		br.caseFold = true
+	}
+}
+
+// WithMaxEntrySize makes ReadFile reject entries larger than n bytes.
+func WithMaxEntrySize(n uint64) ReaderOption {
+	return func(br *Reader) {
+		br.maxEntrySize = n
+	}
+}
+
+// WithDecryptionKey sets the key of an encrypted archive like SetKey, which
+// is needed to open archives written with WithTableEncryption. NewReader
+// returns ErrNotEncrypted for archives that aren't encrypted.
+func WithDecryptionKey(key []byte) ReaderOption {
+	return func(br *Reader) {
+		br.key = key
+	}
+}
+
+// WithDecryptionPassword derives the key of a password protected archive
+// like SetPassword. NewReader returns ErrNoPassword for other archives.
+func WithDecryptionPassword(password []byte) ReaderOption {
+	return func(br *Reader) {
+		br.password = password
+	}
+}
+
+// Lenient makes NewReader recover archives followed by up to
+// maxTrailingBytes of junk, like a newline appended by a transfer tool.
+func Lenient() ReaderOption {
+	return func(br *Reader) {
+		br.lenient = true
+	}
+}
+
+func NewReader(r io.ReadSeeker, opts ...ReaderOption) (*Reader, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return NewReaderSize(r, size, opts...)
+}
+
+// NewReaderAt reads an archive stored in the first size bytes of r. Entry
+// data is read with ReadAt, so entries can be read concurrently. If the
+// size is unknown, it can be found with ProbeSize.
+func NewReaderAt(r io.ReaderAt, size int64,
+	opts ...ReaderOption) (*Reader, error) {
+	return NewReaderSize(io.NewSectionReader(r, 0, size), size, opts...)
+}
+
+// ProbeSize returns the size of the data of r, for readers that can't
+// report it. r must return io.EOF for reads past the end. Single bytes are
+// read at doubling offsets until one is past the end, then the end is found
+// by bisection, which takes about 2*log2(size) reads.
+func ProbeSize(r io.ReaderAt) (int64, error) {
+	has := func(off int64) (bool, error) {
+		var b [1]byte
+		n, err := r.ReadAt(b[:], off)
+		switch {
+		case n == 1:
+			return true, nil
+		case err == io.EOF:
+			return false, nil
+		case err == nil:
+			return false, io.ErrNoProgress
+		}
+		return false, err
+	}
+
+	ok, err := has(0)
+	if !ok || err != nil {
+		return 0, err
+	}
+
+	// A byte is at lo but not at hi.
+	lo, hi := int64(0), int64(1)
+	for {
+		ok, err := has(hi)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		if hi > math.MaxInt64/2 {
+			return 0, ErrInvalidOffset
+		}
+		lo, hi = hi, hi*2
+	}
+
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := has(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
+
+// NewReaderPrefix reads an archive whose first bytes were already read from
+// r, e.g. to detect the format. prefix holds those bytes. If r can't seek,
+// the rest of the archive is read into memory.
+func NewReaderPrefix(prefix []byte, r io.Reader,
+	opts ...ReaderOption) (*Reader, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		data = append(slices.Clip(prefix), data...)
+		return NewReader(bytes.NewReader(data), opts...)
+	}
+
+	base, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &prefixReader{prefix: prefix, r: rs, base: base}
+	return NewReaderSize(pr, int64(len(prefix))+end-base, opts...)
+}
+
+// NewReaderSize reads an archive stored in the first size bytes of r.
+func NewReaderSize(r io.ReadSeeker, size int64,
+	opts ...ReaderOption) (*Reader, error) {
+	if size < headerSize {
 		return nil, io.ErrUnexpectedEOF
 	}
+
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	err = readFull(r, header)
 	if err != nil {
 		return nil, err
 	}
@@ -39,89 +241,836 @@ func NewReader(r io.ReadSeeker) (*Reader, error) {
 		return nil, ErrUnknownFormat
 	}
 
-	if version != Version {
+	if version < 1 || version > Version {
 		return nil, ErrUnsupportedVersion
 	}
 
-	_, err = r.Seek(-footerSize, io.SeekEnd)
+	// The footer is read relative to size, an archive too short to hold
+	// it is truncated.
+	if size < headerSize+footerLen(version) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	br := &Reader{r: r, size: size, version: version}
+	if ra, ok := r.(io.ReaderAt); ok {
+		br.ra = ra
+	}
+	for _, opt := range opts {
+		opt(br)
+	}
+	if version >= 2 {
+		err = br.readHeaderFields()
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case br.password != nil:
+		err = br.SetPassword(br.password)
+	case br.key != nil:
+		err = br.SetKey(br.key)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	footer := make([]byte, footerSize)
-	_, err = r.Read(footer)
-	if err == io.EOF {
-		return nil, io.ErrUnexpectedEOF
+	err = br.readIndex(size)
+	for n := int64(1); err != nil && br.lenient && n <= maxTrailingBytes; n++ {
+		if br.readIndex(size-n) == nil {
+			err = nil
+		}
+	}
+	if err != nil && br.lenient && br.flags&FlagJournal != 0 {
+		if br.recoverIndex(size) == nil {
+			err = nil
+		}
 	}
 	if err != nil {
 		return nil, err
 	}
+	return br, nil
+}
+
+// readIndex reads the footer and the entry table of an archive that ends
+// after size bytes. Journaled archives have a table for every append,
+// which are read from the last one back.
+func (br *Reader) readIndex(size int64) error {
+	var (
+		segments  [][]Entry
+		tableSize uint64
+		meta      metadata
+	)
+	for end := size; ; {
+		entries, prev, err := br.readSegment(end)
+		if err != nil {
+			return err
+		}
+		if segments == nil {
+			meta = br.meta
+		}
+		segments = append(segments, entries)
+		tableSize += br.tableSize
+		if prev == 0 {
+			break
+		}
+		end = prev
+	}
+
+	br.Entries = nil
+	for i := len(segments) - 1; i >= 0; i-- {
+		br.Entries = append(br.Entries, segments[i]...)
+	}
+	if br.flags&FlagSolid != 0 {
+		setBlockSizes(br.Entries)
+	}
+	br.tableSize = tableSize
+	br.meta = meta
+	br.size = size
+	return nil
+}
+
+// readSegment reads the footer and the table ending after size bytes. It
+// returns the end of the previous segment, which is 0 for the first one.
+func (br *Reader) readSegment(size int64) ([]Entry, int64, error) {
+	r := br.r
+	fsize := footerLen(br.version)
+	if br.flags&FlagMetadata != 0 {
+		fsize += 8
+	}
+	if br.flags&FlagJournal != 0 {
+		fsize += journalSize
+	}
+	if size < headerSize+fsize {
+		return nil, 0, ErrInvalidOffset
+	}
+
+	end, err := r.Seek(size-fsize, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	footer := make([]byte, fsize)
+	err = readFull(r, footer)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	rb := rBuf(footer)
 	table := rb.Uint64()
+	br.tableSize = 0
+	if br.version >= 3 {
+		br.tableSize = rb.Uint64()
+	}
 	adler := rb.Uint32()
 	count := rb.Uint32()
+	var meta uint64
+	if br.flags&FlagMetadata != 0 {
+		meta = rb.Uint64()
+	}
+
+	// Segments start after the header or the end of the previous one.
+	var prev uint64
+	start := uint64(headerSize)
+	if br.flags&FlagJournal != 0 {
+		prev = rb.Uint64()
+		if !bytes.Equal(rb, journalMarker) {
+			return nil, 0, ErrCorruptData
+		}
+		if prev != 0 {
+			start = prev
+		}
+	}
+
+	if table < start || table > uint64(end) {
+		return nil, 0, ErrInvalidOffset
+	}
+
+	// The metadata section ends where the table starts.
+	br.meta = metadata{}
+	dataEnd := table
+	if br.flags&FlagMetadata != 0 {
+		dataEnd = meta
+		if meta < start || meta > table {
+			return nil, 0, ErrInvalidOffset
+		}
+		_, err = r.Seek(int64(meta), io.SeekStart)
+		if err != nil {
+			return nil, 0, err
+		}
+		br.meta, err = readMetadata(io.LimitReader(r, int64(table-meta)))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Every entry takes at least entrySize bytes of the table, so a count
+	// that doesn't fit is rejected before allocating the entries.
+	esize := uint64(entrySize)
+	if br.flags&FlagCompact != 0 {
+		esize = compactSize
+	}
+	if br.version >= 3 && uint64(count)*esize > br.tableSize {
+		return nil, 0, ErrCorruptData
+	}
 
 	_, err = r.Seek(int64(table), io.SeekStart)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	ar := newAdlerReader(r)
-	fr := flate.NewReader(ar)
-	entries := make([]Entry, count)
-	for i, _ := range entries {
-		buf := make([]byte, entrySize)
-		_, err = fr.Read(buf)
-		if err == io.EOF {
-			return nil, io.ErrUnexpectedEOF
+	// The table must not be hashed past its end, so reads are limited
+	// to the region between the table index and the footer.
+	tr := io.LimitReader(r, end-int64(table))
+	var nonce []byte
+	if br.flags&FlagEncryptedTable != 0 {
+		if br.aead == nil {
+			return nil, 0, ErrMissingKey
 		}
+		nonce = make([]byte, nonceSize)
+		err = readFull(tr, nonce)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var ar *adlerReader
+	var src io.Reader
+	if br.skipTableChecksum {
+		src = bufio.NewReader(tr)
+	} else {
+		ar = newAdlerReader(tr)
+		src = ar
+	}
+	if nonce != nil {
+		sealed := uint64(end) - table - nonceSize
+		src = bufio.NewReader(newGCMReader(src, br.aead, nonce, sealed))
+	}
+
+	entries, err := br.readTable(src, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ar != nil && ar.Adler() != adler {
+		return nil, 0, ErrInvalidChecksum
+	}
+
+	// Entry data must lie between the start of the segment and the table
+	// or metadata, which also keeps offsets and sizes in the range of int64.
+	for _, e := range entries {
+		if e.index < start || e.index > dataEnd ||
+			e.sizeCompressed > dataEnd-e.index {
+			return nil, 0, ErrInvalidOffset
+		}
+	}
+	return entries, int64(prev), nil
+}
+
+func (br *Reader) readTable(r io.Reader, count uint32) ([]Entry, error) {
+	fr := r
+	if br.flags&FlagRawTable == 0 {
+		fr = newFlateReader(r)
+	}
+	var tr io.Reader = fr
+	lr := &io.LimitedReader{R: fr, N: int64(br.tableSize)}
+	if br.version >= 3 {
+		tr = lr
+	}
+
+	var pool []string
+	if br.flags&FlagNamePool != 0 {
+		var err error
+		pool, err = readPool(tr)
 		if err != nil {
 			return nil, err
 		}
+	}
 
+	// The count and the table size may both be forged, so the entries grow
+	// with the table read.
+	entries := make([]Entry, 0, min(count, 1024))
+	for i := uint32(0); i < count; i++ {
 		var e Entry
-		r := rBuf(buf)
-		e.sizeCompressed = r.Uint64()
-		e.Size = r.Uint64()
-		e.index = r.Uint64()
+		err := br.readEntry(tr, &e, pool)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	// Drain the end of the table so the checksum covers all of it.
+	n, err := io.Copy(io.Discard, fr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries must take up the whole table, and exactly the stored
+	// table size where there is one.
+	if n != 0 || (br.version >= 3 && lr.N != 0) {
+		return nil, ErrCorruptData
+	}
+	return entries, nil
+}
+
+// readPool reads the directories of an archive with FlagNamePool.
+func readPool(r io.Reader) ([]string, error) {
+	buf := make([]byte, 4)
+	err := readFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	rb := rBuf(buf)
+	count := rb.Uint32()
+
+	// The pool grows with the directories read, so a forged count can't
+	// cause a large allocation.
+	var pool []string
+	for i := uint32(0); i < count; i++ {
+		buf := make([]byte, 2)
+		err := readFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		rb := rBuf(buf)
+
+		dir := make([]byte, rb.Uint16())
+		err = readFull(r, dir)
+		if err != nil {
+			return nil, err
+		}
+		pool = append(pool, string(dir))
+	}
+	return pool, nil
+}
+
+func (br *Reader) readEntry(fr io.Reader, e *Entry, pool []string) error {
+	compact := br.flags&FlagCompact != 0
+	buf := make([]byte, entrySize)
+	if compact {
+		buf = buf[:compactSize]
+	}
+	err := readFull(fr, buf)
+	if err != nil {
+		return err
+	}
+
+	r := rBuf(buf)
+	e.sizeCompressed = r.Uint64()
+	e.Size = r.Uint64()
+	e.index = r.Uint64()
+	e.Perm = 0644
+	e.UID, e.GID = -1, -1
+	if e.Size > math.MaxInt64 {
+		return ErrCorruptData
+	}
+	if !compact {
 		e.adler = r.Uint32()
 		e.Perm = r.Uint16()
-		nlen := r.Uint16()
+	}
+	nlen := r.Uint16()
 
-		sbuf := make([]byte, nlen)
-		_, err = fr.Read(sbuf)
+	sbuf := make([]byte, nlen)
+	err = readFull(fr, sbuf)
+	if err != nil {
+		return err
+	}
+	e.Name = string(sbuf)
+
+	if br.flags&FlagEncrypted != 0 {
+		e.nonce = make([]byte, nonceSize)
+		err = readFull(fr, e.nonce)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagHashed != 0 {
+		e.hash = make([]byte, sha256.Size)
+		err = readFull(fr, e.hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagNamePool != 0 {
+		buf := make([]byte, 4)
+		err = readFull(fr, buf)
+		if err != nil {
+			return err
+		}
+		rb := rBuf(buf)
+
+		dir := rb.Uint32()
 		switch {
-		case err == io.EOF && i == int(count-1):
-			break
-		case err == io.EOF:
-			return nil, io.ErrUnexpectedEOF
-		case err != nil:
-			return nil, err
+		case dir > uint32(len(pool)):
+			return ErrCorruptData
+		case dir > 0:
+			e.Name = pool[dir-1] + e.Name
 		}
-		e.Name = string(sbuf)
+	}
 
-		entries[i] = e
+	if br.flags&FlagXattrs != 0 {
+		e.Xattrs, err = readXattrs(fr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagModTime != 0 {
+		buf := make([]byte, 8)
+		err = readFull(fr, buf)
+		if err != nil {
+			return err
+		}
+		rb := rBuf(buf)
+
+		if t := int64(rb.Uint64()); t != 0 {
+			e.ModTime = time.Unix(0, t)
+		}
+	}
+
+	if br.flags&FlagEntryTypes != 0 {
+		err = readType(fr, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagOwner != 0 {
+		err = readOwner(fr, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagComments != 0 {
+		e.Comment, err = readString(fr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagMethods != 0 {
+		buf := make([]byte, 1)
+		err = readFull(fr, buf)
+		if err != nil {
+			return err
+		}
+		e.Method = Method(buf[0])
 	}
 
-	if ar.Adler() != adler {
-		println(ar.Adler())
-		println("adler:", adler)
-		return nil, ErrInvalidChecksum
+	if br.flags&FlagSolid != 0 {
+		buf := make([]byte, 8)
+		err = readFull(fr, buf)
+		if err != nil {
+			return err
+		}
+		rb := rBuf(buf)
+		e.solidOffset = rb.Uint64()
 	}
 
-	return &Reader{entries, r}, nil
+	// Writers reject empty names, only crafted tables contain them.
+	if e.Name == "" {
+		return ErrEmptyName
+	}
+	return nil
 }
 
+func (br *Reader) readHeaderFields() error {
+	buf := make([]byte, flagsSize)
+	err := readFull(br.r, buf)
+	if err != nil {
+		return err
+	}
+
+	br.flags = binary.LittleEndian.Uint32(buf)
+	if br.flags&^knownFlags != 0 {
+		return &FeatureError{br.flags &^ knownFlags}
+	}
+
+	if br.flags&FlagAligned != 0 {
+		buf := make([]byte, 4)
+		err := readFull(br.r, buf)
+		if err != nil {
+			return err
+		}
+		br.alignment = binary.LittleEndian.Uint32(buf)
+	}
+
+	if br.flags&FlagEncrypted != 0 {
+		buf := make([]byte, 1)
+		err := readFull(br.r, buf)
+		if err != nil {
+			return err
+		}
+		if buf[0] != CipherAESGCM {
+			return ErrUnsupportedCipher
+		}
+	}
+
+	if br.flags&FlagPassword != 0 {
+		buf := make([]byte, kdfSize)
+		err := readFull(br.r, buf)
+		if err != nil {
+			return err
+		}
+
+		rb := rBuf(buf)
+		if rb.Uint8() != KDFScrypt {
+			return ErrInvalidKDF
+		}
+		br.kdf.logN = rb.Uint8()
+		br.kdf.r = rb.Uint16()
+		br.kdf.p = rb.Uint16()
+		br.kdf.salt = rb
+	}
+
+	if br.flags&FlagName != 0 {
+		br.name, err = readString(br.r)
+		if err != nil {
+			return err
+		}
+	}
+
+	if br.flags&FlagProducer != 0 {
+		br.producer, err = readString(br.r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readString reads a string preceded by its 2 byte length.
+func readString(r io.Reader) (string, error) {
+	buf := make([]byte, 2)
+	err := readFull(r, buf)
+	if err != nil {
+		return "", err
+	}
+
+	s := make([]byte, binary.LittleEndian.Uint16(buf))
+	err = readFull(r, s)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// SetPassword derives the decryption key of a password protected archive.
+// A wrong password is only detected when reading entry data.
+func (br *Reader) SetPassword(password []byte) error {
+	if br.flags&FlagPassword == 0 {
+		return ErrNoPassword
+	}
+
+	key, err := br.kdf.key(password)
+	if err != nil {
+		return err
+	}
+	return br.SetKey(key)
+}
+
+// SetKey sets the key used to decrypt the data of an encrypted archive.
+func (br *Reader) SetKey(key []byte) error {
+	if br.flags&FlagEncrypted == 0 {
+		return ErrNotEncrypted
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	br.aead = aead
+	return nil
+}
+
+// Version returns the format version of the archive.
+func (br *Reader) Version() byte {
+	return br.version
+}
+
+// TableSize returns the uncompressed size of the entry table. It is 0 for
+// archives older than version 3, which don't store it.
+func (br *Reader) TableSize() uint64 {
+	return br.tableSize
+}
+
+// ArchiveName returns the name stored with WithArchiveName, or "" if the
+// archive has none.
+func (br *Reader) ArchiveName() string {
+	return br.name
+}
+
+// Producer returns the program that wrote the archive, as stored with
+// WithProducer, or "" if the archive doesn't say.
+func (br *Reader) Producer() string {
+	return br.producer
+}
+
+// TotalSize returns the uncompressed size of all entries. To report the
+// progress of extracting them, count the data read from the readers passed
+// to ExtractOptions.Transform against it.
+func (br *Reader) TotalSize() uint64 {
+	var size uint64
+	for _, e := range br.Entries {
+		size += e.Size
+	}
+	return size
+}
+
+// TableCompressed reports whether the table is compressed with DEFLATE.
+func (br *Reader) TableCompressed() bool {
+	return br.flags&FlagRawTable == 0
+}
+
+// Flags returns the header flags of the archive, which tell the optional
+// features it uses.
+func (br *Reader) Flags() uint32 {
+	return br.flags
+}
+
+func (br *Reader) EntryNames() []string {
+	names := make([]string, len(br.Entries))
+	for i, e := range br.Entries {
+		names[i] = e.Name
+	}
+	return names
+}
+
+// Lookup returns the entry with the given name. With WithCaseFold, a name
+// that has no exact match may match a single entry case-insensitively,
+// otherwise ErrAmbiguousName is returned.
+func (br *Reader) Lookup(name string) (*Entry, error) {
+	for i := range br.Entries {
+		if br.Entries[i].Name == name {
+			return &br.Entries[i], nil
+		}
+	}
+	if !br.caseFold {
+		return nil, ErrEntryNotFound
+	}
+
+	var e *Entry
+	for i := range br.Entries {
+		if strings.EqualFold(br.Entries[i].Name, name) {
+			if e != nil {
+				return nil, ErrAmbiguousName
+			}
+			e = &br.Entries[i]
+		}
+	}
+	if e == nil {
+		return nil, ErrEntryNotFound
+	}
+	return e, nil
+}
+
+// OffsetManifest returns the location of the data of every entry. Method
+// is the compression method of the data, like "deflate" for raw DEFLATE
+// data, followed by "+aes-gcm" if the data is encrypted after compressing
+// it.
+func (br *Reader) OffsetManifest() []EntryLocation {
+	locs := make([]EntryLocation, len(br.Entries))
+	for i, e := range br.Entries {
+		method := e.Method.String()
+		if br.flags&FlagEncrypted != 0 {
+			method += "+aes-gcm"
+		}
+
+		locs[i] = EntryLocation{
+			Name:           e.Name,
+			Offset:         e.index,
+			CompressedSize: e.sizeCompressed,
+			Size:           e.Size,
+			Adler32:        e.adler,
+			Method:         method,
+			SolidOffset:    e.solidOffset,
+		}
+	}
+	return locs
+}
+
+// BlockIndex maps the hex encoded SHA-256 of the data of each entry to its
+// location, for archives written with WithContentIndex. Of entries with
+// the same data, the first is used. It returns nil for other archives.
+func (br *Reader) BlockIndex() map[string]EntryLocation {
+	if br.flags&FlagHashed == 0 {
+		return nil
+	}
+
+	index := make(map[string]EntryLocation)
+	for i, loc := range br.OffsetManifest() {
+		key := hex.EncodeToString(br.Entries[i].hash)
+		if _, ok := index[key]; !ok {
+			index[key] = loc
+		}
+	}
+	return index
+}
+
+// VerifyAll reads the data of every entry and verifies its checksum. It
+// returns the first failure as an *EntryError.
+func (br *Reader) VerifyAll() error {
+	for i := range br.Entries {
+		err := br.verifyEntry(&br.Entries[i])
+		if err != nil {
+			return &EntryError{br.Entries[i].Name, err}
+		}
+	}
+	return nil
+}
+
+func (br *Reader) verifyEntry(e *Entry) error {
+	er, err := br.EntryReader(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, er)
+	if err != nil {
+		return err
+	}
+	return er.Close()
+}
+
+func (br *Reader) rawReader(e *Entry) (io.Reader, error) {
+	if br.ra != nil {
+		return io.NewSectionReader(br.ra, int64(e.index),
+			int64(e.sizeCompressed)), nil
+	}
+	return &sectionReader{br.r, int64(e.index), int64(e.sizeCompressed)}, nil
+}
+
+// EntryReader returns a reader for the data of e. Readers of different
+// entries may be used alternately. If the archive is read from an
+// io.ReaderAt, like an *os.File, they may also be used concurrently.
 func (br *Reader) EntryReader(e *Entry) (io.ReadCloser, error) {
-	_, err := br.r.Seek(int64(e.index), io.SeekStart)
+	if br.flags&FlagSolid != 0 {
+		return br.solidEntryReader(e, nil)
+	}
+
+	raw, err := br.rawReader(e)
 	if err != nil {
 		return nil, err
 	}
+	return br.entryReader(e, raw)
+}
+
+func (br *Reader) entryReader(e *Entry, raw io.Reader) (io.ReadCloser, error) {
+	if br.flags&FlagSolid != 0 {
+		return br.solidEntryReader(e, raw)
+	}
 
-	ar := newAdlerReader(br.r)
-	fr := flate.NewReader(ar)
-	return &entryReader{ar, fr, int64(e.Size), e.adler, nil}, nil
+	ar := newAdlerReader(raw)
+	var src io.Reader = ar
+	if br.flags&FlagEncrypted != 0 {
+		if br.aead == nil {
+			return nil, ErrMissingKey
+		}
+		src = newGCMReader(ar, br.aead, e.nonce, e.sizeCompressed)
+	}
+
+	// The method is that of the entry, never guessed from the data:
+	// DEFLATE data written at level 0 is made of stored blocks of the
+	// stream, while MethodStored data has no framing.
+	dr, err := newDecompressor(src, e.Method)
+	if err != nil {
+		return nil, err
+	}
+	check := br.flags&FlagCompact == 0
+	return &entryReader{ar, dr, int64(e.Size), e.adler, check, nil}, nil
+}
+
+// ReadBlockAt returns a reader for entry data stored at offset in r, as
+// listed by OffsetManifest, without reading the table of the archive. Only
+// data with Method "deflate" of archives that aren't solid can be read.
+// Close verifies the checksum, unless adler is 0 like in the manifest of
+// compact archives.
+func ReadBlockAt(r io.ReaderAt, offset int64, compressedSize uint64,
+	uncompressedSize uint64, adler uint32) (io.ReadCloser, error) {
+	if offset < 0 || compressedSize > math.MaxInt64-uint64(offset) {
+		return nil, ErrInvalidOffset
+	}
+	if uncompressedSize > math.MaxInt64 {
+		return nil, ErrCorruptData
+	}
+
+	ar := newAdlerReader(io.NewSectionReader(r, offset, int64(compressedSize)))
+	fr := newFlateReader(ar)
+	count := int64(uncompressedSize)
+	return &entryReader{ar, fr, count, adler, adler != 0, nil}, nil
+}
+
+// ReadFile returns the data of the named entry. The buffer grows with the
+// data actually read, so a forged entry size can't cause a large
+// allocation.
+func (br *Reader) ReadFile(name string) ([]byte, error) {
+	_, er, err := br.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(er)
+	if err != nil {
+		return nil, err
+	}
+
+	err = er.Close()
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReadFileInto reads the data of the named entry into buf and returns its
+// size. If buf is too small, it returns the size needed and
+// io.ErrShortBuffer.
+func (br *Reader) ReadFileInto(name string, buf []byte) (int, error) {
+	e, er, err := br.openFile(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if e.Size > math.MaxInt {
+		er.Close()
+		return 0, ErrLimitExceeded
+	}
+	if uint64(len(buf)) < e.Size {
+		er.Close()
+		return int(e.Size), io.ErrShortBuffer
+	}
+
+	n, err := io.ReadFull(er, buf[:e.Size])
+	if err != nil {
+		return n, err
+	}
+
+	// Read to the end of the entry so its checksum can be verified.
+	_, err = io.Copy(io.Discard, er)
+	if err != nil {
+		return n, err
+	}
+	return n, er.Close()
+}
+
+func (br *Reader) openFile(name string) (*Entry, io.ReadCloser, error) {
+	e, err := br.Lookup(name)
+	if err == nil {
+		e, err = br.resolve(e)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if br.maxEntrySize > 0 && e.Size > br.maxEntrySize {
+		return nil, nil, ErrLimitExceeded
+	}
+
+	er, err := br.EntryReader(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, er, nil
 }
 
 type entryReader struct {
@@ -129,6 +1078,7 @@ type entryReader struct {
 	r     io.Reader
 	count int64
 	adler uint32
+	check bool
 	err   error
 }
 
@@ -153,7 +1103,18 @@ func (er *entryReader) Read(b []byte) (n int, err error) {
 		er.err = io.ErrUnexpectedEOF
 		return n, er.err
 	case err == nil && er.count == 0:
-		er.err = io.EOF
+		// Consume the end of the flate stream, so Close verifies the
+		// checksum of the whole block. Data past the size of the entry
+		// means the size is wrong.
+		var rest int64
+		rest, err = io.Copy(io.Discard, er.r)
+		switch {
+		case err == nil && rest > 0:
+			err = ErrCorruptData
+		case err == nil:
+			err = io.EOF
+		}
+		er.err = err
 		return n, er.err
 	default:
 		er.err = err
@@ -162,39 +1123,201 @@ func (er *entryReader) Read(b []byte) (n int, err error) {
 }
 
 func (er *entryReader) Close() error {
-	if er.adler != er.ar.Adler() {
+	if er.check && er.adler != er.ar.Adler() {
 		return ErrInvalidChecksum
 	}
 	return nil
 }
 
+// prefixReader presents prefix followed by the data of r from base on as a
+// single stream.
+type prefixReader struct {
+	prefix []byte
+	r      io.ReadSeeker
+	base   int64
+	off    int64
+}
+
+func (pr *prefixReader) Read(b []byte) (int, error) {
+	if pr.off < int64(len(pr.prefix)) {
+		n := copy(b, pr.prefix[pr.off:])
+		pr.off += int64(n)
+		return n, nil
+	}
+
+	_, err := pr.r.Seek(pr.base+pr.off-int64(len(pr.prefix)), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := pr.r.Read(b)
+	pr.off += int64(n)
+	return n, err
+}
+
+func (pr *prefixReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pr.off
+	case io.SeekEnd:
+		end, err := pr.r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(pr.prefix)) + end - pr.base
+	default:
+		return 0, ErrInvalidOffset
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+	pr.off = offset
+	return offset, nil
+}
+
+// sectionReader reads n bytes of r starting at off. It seeks before every
+// read, so it doesn't depend on the position of r.
+type sectionReader struct {
+	r   io.ReadSeeker
+	off int64
+	n   int64
+}
+
+func (sr *sectionReader) Read(b []byte) (int, error) {
+	if sr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > sr.n {
+		b = b[:sr.n]
+	}
+
+	_, err := sr.r.Seek(sr.off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := sr.r.Read(b)
+	sr.off += int64(n)
+	sr.n -= int64(n)
+	return n, err
+}
+
+// flateReader reports corrupt flate streams as ErrCorruptData, so they can
+// be told apart from errors of the underlying reader.
+type flateReader struct {
+	r io.Reader
+}
+
+func newFlateReader(r io.Reader) flateReader {
+	return flateReader{flate.NewReader(r)}
+}
+
+func (fr flateReader) Read(b []byte) (int, error) {
+	n, err := fr.r.Read(b)
+	var ce flate.CorruptInputError
+	if errors.As(err, &ce) {
+		err = fmt.Errorf("%w (%w)", ErrCorruptData, err)
+	}
+	return n, err
+}
+
+// footerLen returns the size of the footer in archives of the given version.
+func footerLen(version byte) int64 {
+	if version < 3 {
+		return footerSizeV2
+	}
+	return footerSize
+}
+
+func readFull(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// adlerReader buffers reads from r and computes the checksum of the bytes
+// consumed. Bytes are hashed in batches when the buffer is refilled, which
+// keeps the checksum off the per-byte path of ReadByte.
 type adlerReader struct {
-	r     *bufio.Reader
+	r     io.Reader
 	adler hash.Hash32
+	buf   []byte
+	start int // start of the consumed bytes not hashed yet
+	pos   int // start of the unread bytes
+	end   int
+	err   error
 }
 
 func newAdlerReader(r io.Reader) *adlerReader {
-	br := bufio.NewReader(r)
-	return &adlerReader{br, adler32.New()}
+	return &adlerReader{r: r, adler: adler32.New(), buf: make([]byte, 4096)}
+}
+
+func (ar *adlerReader) fill() error {
+	ar.flush()
+	if ar.err != nil {
+		return ar.err
+	}
+
+	n, err := ar.r.Read(ar.buf)
+	ar.start, ar.pos, ar.end = 0, 0, n
+	ar.err = err
+	if n == 0 {
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return err
+	}
+	return nil
+}
+
+func (ar *adlerReader) flush() {
+	ar.adler.Write(ar.buf[ar.start:ar.pos])
+	ar.start = ar.pos
 }
 
 func (ar *adlerReader) Read(b []byte) (int, error) {
-	r := io.TeeReader(ar.r, ar.adler)
-	n, err := r.Read(b)
-	return n, err
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if ar.pos == ar.end {
+		// Large reads bypass the buffer.
+		if len(b) >= len(ar.buf) && ar.err == nil {
+			ar.flush()
+			n, err := ar.r.Read(b)
+			ar.adler.Write(b[:n])
+			return n, err
+		}
+
+		err := ar.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, ar.buf[ar.pos:ar.end])
+	ar.pos += n
+	return n, nil
 }
 
 func (ar *adlerReader) ReadByte() (byte, error) {
-	b, err := ar.r.ReadByte()
-	if err != nil {
-		return b, err
+	if ar.pos == ar.end {
+		err := ar.fill()
+		if err != nil {
+			return 0, err
+		}
 	}
-	buf := []byte{b}
-	ar.adler.Write(buf)
-	return b, err
+
+	b := ar.buf[ar.pos]
+	ar.pos++
+	return b, nil
 }
 
 func (ar *adlerReader) Adler() uint32 {
+	ar.flush()
 	return ar.adler.Sum32()
 }
 
@@ -0,0 +1,161 @@
+package bar
+
+import (
+	"io"
+	"math"
+)
+
+// Recompress copies all entries of src to dst, compressing their data at
+// level. Failures are returned as *EntryError. dst is not closed.
+func Recompress(dst *Writer, src *Reader, level int) error {
+	for i := range src.Entries {
+		e := &src.Entries[i]
+		err := recompressEntryAs(dst, src, e, e, level)
+		if err != nil {
+			return &EntryError{src.Entries[i].Name, err}
+		}
+	}
+	return nil
+}
+
+// recompressEntryAs adds the data of e compressed at level, with the name,
+// permissions, modification time, owner, comment and link target of meta,
+// like copyEntryAs.
+func recompressEntryAs(dst *Writer, src *Reader, e, meta *Entry,
+	level int) error {
+	er, err := src.EntryReader(e)
+	if err != nil {
+		return err
+	}
+
+	switch e.Type {
+	case TypeSymlink:
+		err = dst.CreateSymlink(meta.Name, meta.Linkname)
+	case TypeDir:
+		err = dst.CreateDir(meta.Name)
+	case TypeHardlink:
+		err = dst.CreateHardlink(meta.Name, meta.Linkname)
+	default:
+		err = dst.Create(meta.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = dst.SetPerms(meta.Perm)
+	if err != nil {
+		return err
+	}
+
+	err = dst.SetModTime(meta.ModTime)
+	if err != nil {
+		return err
+	}
+
+	err = dst.SetOwner(meta.UID, meta.GID, meta.Uname, meta.Gname)
+	if err != nil {
+		return err
+	}
+
+	err = dst.SetComment(meta.Comment)
+	if err != nil {
+		return err
+	}
+
+	if e.Xattrs != nil && dst.flags&FlagXattrs != 0 {
+		err = dst.SetXattrs(e.Xattrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dst.SetLevel(level)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, er)
+	if err != nil {
+		return err
+	}
+	return er.Close()
+}
+
+// Rewrite copies the entries of src for which keep returns true to dst,
+// without recompressing them. The first hard link kept to a file that isn't
+// kept gets its data, the others point to it. dst is not closed.
+func Rewrite(dst *Writer, src *Reader, keep func(e *Entry) bool) error {
+	moved := make(map[string]string)
+	for i := range src.Entries {
+		e := &src.Entries[i]
+		if !keep(e) {
+			continue
+		}
+
+		t, err := src.resolve(e)
+		switch {
+		case err != nil:
+		case t == e || keep(t):
+			err = dst.CopyEntry(src, e)
+		case moved[t.Name] != "":
+			c := *e
+			c.Linkname = moved[t.Name]
+			err = dst.CopyEntry(src, &c)
+		default:
+			moved[t.Name] = e.Name
+			err = dst.copyEntryAs(src, t, e)
+		}
+		if err != nil {
+			return &EntryError{e.Name, err}
+		}
+	}
+	return nil
+}
+
+// RewriteMetadata writes a copy of src to dst with the settings of src,
+// after fn changed the name, permissions, modification time or owner of
+// each entry. Data is copied without decompressing it, changes to the size
+// are ignored, like changes to the permissions of compact archives or to
+// the modification times and owners of archives without them. Renamed entries are checked
+// with ValidateName, hard links are changed to the new name of their target.
+func RewriteMetadata(dst io.Writer, src *Reader, fn func(e *Entry)) error {
+	bw, err := NewWriter(dst, WithSettingsFrom(src))
+	if err != nil {
+		return err
+	}
+
+	renamed := make(map[string]string)
+	for i := range src.Entries {
+		e := &src.Entries[i]
+		c := *e
+		fn(&c)
+		c.Size = e.Size
+
+		// Hard links follow their renamed target.
+		if name, ok := renamed[c.Linkname]; ok && c.Type == TypeHardlink {
+			c.Linkname = name
+		}
+		if _, ok := renamed[e.Name]; !ok && e.Type == TypeFile {
+			renamed[e.Name] = c.Name
+		}
+
+		err := checkRename(e.Name, c.Name)
+		if err == nil {
+			err = bw.copyEntryAs(src, e, &c)
+		}
+		if err != nil {
+			return &EntryError{e.Name, err}
+		}
+	}
+	return bw.Close()
+}
+
+func checkRename(old, name string) error {
+	switch {
+	case name == old:
+		return nil
+	case len(name) > math.MaxUint16:
+		return ErrNameTooLong
+	}
+	return ValidateName(name)
+}
@@ -0,0 +1,334 @@
+package bar
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLinks writes an archive with a file, a hard link and a symbolic link
+// to it.
+func writeLinks(t *testing.T, opts ...WriterOption) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, append(opts, WithEntryTypes())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.Create("orig.txt")
+	if err == nil {
+		_, err = bw.Write([]byte("hello world"))
+	}
+	if err == nil {
+		err = bw.CreateHardlink("link.txt", "orig.txt")
+	}
+	if err == nil {
+		err = bw.CreateSymlink("sym.txt", "orig.txt")
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRewriteMetadata(t *testing.T) {
+	files := []testFile{{"a.txt", "alpha"}, {"dir/b.txt", "beta"}}
+	tests := []struct {
+		name  string
+		opts  []WriterOption
+		ropts []ReaderOption
+		fn    func(e *Entry)
+		check func(t *testing.T, br *Reader)
+	}{
+		{
+			name: "rename",
+			fn: func(e *Entry) {
+				e.Name = strings.Replace(e.Name, "dir/", "other/", 1)
+			},
+			check: func(t *testing.T, br *Reader) {
+				checkFiles(t, br, []testFile{{"a.txt", "alpha"},
+					{"other/b.txt", "beta"}})
+			},
+		},
+		{
+			name: "perms",
+			fn:   func(e *Entry) { e.Perm = 0600 },
+			check: func(t *testing.T, br *Reader) {
+				checkFiles(t, br, files)
+				for _, e := range br.Entries {
+					if e.Perm != 0600 {
+						t.Errorf("%s: perm %o, want 600", e.Name, e.Perm)
+					}
+				}
+			},
+		},
+		{
+			name: "size ignored",
+			fn:   func(e *Entry) { e.Size = 1 },
+			check: func(t *testing.T, br *Reader) {
+				checkFiles(t, br, files)
+			},
+		},
+		{
+			name: "solid rename",
+			opts: []WriterOption{WithSolid(0)},
+			fn:   func(e *Entry) { e.Name = "new-" + e.Name },
+			check: func(t *testing.T, br *Reader) {
+				checkFiles(t, br, []testFile{{"new-a.txt", "alpha"},
+					{"new-dir/b.txt", "beta"}})
+			},
+		},
+		{
+			name:  "encrypted perms",
+			opts:  []WriterOption{WithKey(testKey)},
+			ropts: []ReaderOption{WithDecryptionKey(testKey)},
+			fn:    func(e *Entry) { e.Perm = 0640 },
+			check: func(t *testing.T, br *Reader) {
+				checkFiles(t, br, files)
+				if br.Entries[0].Perm != 0640 {
+					t.Errorf("perm %o, want 640", br.Entries[0].Perm)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := openArchive(t, writeArchive(t, files, tt.opts...),
+				tt.ropts...)
+
+			var buf bytes.Buffer
+			err := RewriteMetadata(&buf, src, tt.fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, openArchive(t, buf.Bytes(), tt.ropts...))
+		})
+	}
+}
+
+func TestRewriteMetadataRenameLinkTarget(t *testing.T) {
+	for _, solid := range []bool{false, true} {
+		var opts []WriterOption
+		if solid {
+			opts = append(opts, WithSolid(0))
+		}
+		src := openArchive(t, writeLinks(t, opts...))
+
+		var buf bytes.Buffer
+		err := RewriteMetadata(&buf, src, func(e *Entry) {
+			if e.Name == "orig.txt" {
+				e.Name = "renamed.txt"
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		br := openArchive(t, buf.Bytes())
+		data, err := br.ReadFile("link.txt")
+		if err != nil || string(data) != "hello world" {
+			t.Errorf("solid %v: ReadFile(link.txt) = %q, %v", solid, data, err)
+		}
+		for _, e := range br.Entries {
+			want := map[string]string{
+				"link.txt": "renamed.txt",
+				"sym.txt":  "orig.txt",
+			}[e.Name]
+			if e.Linkname != want {
+				t.Errorf("solid %v: %s links to %q, want %q", solid, e.Name,
+					e.Linkname, want)
+			}
+		}
+		if errs := br.Check(); len(errs) != 0 {
+			t.Errorf("solid %v: Check: %v", solid, errs)
+		}
+	}
+}
+
+func TestRewriteMetadataInvalidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"", ErrPathIsNotSimple},
+		{"../a.txt", ErrPathIsNotSimple},
+		{"/abs.txt", ErrPathIsNotSimple},
+		{`dir\a.txt`, ErrPathIsNotSimple},
+		{strings.Repeat("a", 1<<16), ErrNameTooLong},
+	}
+
+	src := openArchive(t, writeArchive(t, []testFile{{"a.txt", "alpha"}}))
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := RewriteMetadata(&buf, src, func(e *Entry) { e.Name = tt.name })
+		var ee *EntryError
+		if !errors.As(err, &ee) || ee.Name != "a.txt" || ee.Err != tt.want {
+			t.Errorf("rename to %.20q: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"dir/data", string(benchData(200 << 10))},
+		{"empty", ""},
+	}
+	mtime := time.Unix(1700000000, 0)
+	write := func(level int) []byte {
+		var buf bytes.Buffer
+		bw, err := NewWriter(&buf, WithModTimes(),
+			WithCompressionLevel(level))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range files {
+			err = bw.Create(f.name)
+			if err == nil {
+				err = bw.SetPerms(0600 + uint16(i))
+			}
+			if err == nil {
+				err = bw.SetModTime(mtime.Add(time.Duration(i) * time.Hour))
+			}
+			if err == nil {
+				_, err = bw.Write([]byte(f.data))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = bw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		from, to int
+		shrinks  bool
+	}{
+		{"speed to best", flate.BestSpeed, flate.BestCompression, true},
+		{"best to speed", flate.BestCompression, flate.BestSpeed, false},
+		{"best to stored", flate.BestCompression, flate.NoCompression, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := write(tt.from)
+			src := openArchive(t, b)
+			var buf bytes.Buffer
+			dst, err := NewWriter(&buf, WithSettingsFrom(src))
+			if err == nil {
+				err = Recompress(dst, src, tt.to)
+			}
+			if err == nil {
+				err = dst.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if shrinks := buf.Len() < len(b); shrinks != tt.shrinks {
+				t.Errorf("recompressed %d bytes to %d", len(b), buf.Len())
+			}
+			br := openArchive(t, buf.Bytes())
+			checkFiles(t, br, files)
+			for i, e := range br.Entries {
+				want := src.Entries[i]
+				if e.Perm != want.Perm || !e.ModTime.Equal(want.ModTime) {
+					t.Errorf("%s: perms %o and time %v, want %o and %v", e.Name,
+						e.Perm, e.ModTime, want.Perm, want.ModTime)
+				}
+			}
+		})
+	}
+
+	// Levels are checked like by SetLevel.
+	src := openArchive(t, write(flate.BestSpeed))
+	dst, err := NewWriter(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Recompress(dst, src, 10)
+	if !errors.Is(err, ErrInvalidLevel) {
+		t.Errorf("got %v, want %v", err, ErrInvalidLevel)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"tmp/b.log", "beta"},
+		{"tmp/c.txt", "gamma"},
+		{"dir/d.log", "delta"},
+	}
+	tests := []struct {
+		name string
+		drop func(name string) bool
+		want []testFile
+	}{
+		{"none", func(string) bool { return false }, files},
+		{"prefix", func(name string) bool { return strings.HasPrefix(name, "tmp/") },
+			[]testFile{files[0], files[3]}},
+		{"suffix", func(name string) bool { return strings.HasSuffix(name, ".log") },
+			[]testFile{files[0], files[2]}},
+		{"all", func(string) bool { return true }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := openArchive(t, writeArchive(t, files))
+			var buf bytes.Buffer
+			dst, err := NewWriter(&buf, WithSettingsFrom(src))
+			if err == nil {
+				err = Rewrite(dst, src, func(e *Entry) bool { return !tt.drop(e.Name) })
+			}
+			if err == nil {
+				err = dst.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			br := openArchive(t, buf.Bytes())
+			checkFiles(t, br, tt.want)
+			err = br.VerifyAll()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	// A hard link to a dropped file gets its data.
+	src := openArchive(t, writeLinks(t))
+	var buf bytes.Buffer
+	dst, err := NewWriter(&buf, WithSettingsFrom(src))
+	if err == nil {
+		err = Rewrite(dst, src, func(e *Entry) bool { return e.Name != "orig.txt" })
+	}
+	if err == nil {
+		err = dst.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := openArchive(t, buf.Bytes())
+	e, err := br.Lookup("link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := br.ReadFile("link.txt")
+	if e.Type != TypeFile || string(data) != "hello world" || err != nil {
+		t.Errorf("link.txt: type %v, %q, %v", e.Type, data, err)
+	}
+}
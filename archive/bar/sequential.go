@@ -0,0 +1,118 @@
+package bar
+
+import (
+	"bufio"
+	"cmp"
+	"compress/flate"
+	"io"
+	"slices"
+)
+
+// SequentialReader returns a function that yields the entries in order of
+// their data, reading the archive once from front to back with a single
+// DEFLATE decompressor. The reader of an entry is valid until the next
+// call, which skips the rest of its data and verifies its checksum. After
+// the last entry it returns io.EOF. Failures are returned as *EntryError
+// and end the iteration.
+func (br *Reader) SequentialReader() (func() (Entry, io.Reader, error), error) {
+	if br.flags&FlagEncrypted != 0 && br.aead == nil {
+		return nil, ErrMissingKey
+	}
+	if br.flags&FlagSolid != 0 {
+		return br.solidSequentialReader(), nil
+	}
+
+	entries := slices.Clone(br.Entries)
+	slices.SortStableFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(a.index, b.index)
+	})
+
+	var pos int64
+	if len(entries) > 0 {
+		pos = int64(entries[0].index)
+	}
+	var section io.Reader = &sectionReader{br.r, pos, br.size - pos}
+	if br.ra != nil {
+		section = io.NewSectionReader(br.ra, pos, br.size-pos)
+	}
+	src := bufio.NewReaderSize(section, 64<<10)
+
+	var (
+		i   int
+		fr  io.ReadCloser
+		raw *io.LimitedReader
+		er  *entryReader
+		err error
+	)
+	next := func() (Entry, io.Reader, error) {
+		if err != nil {
+			return Entry{}, nil, err
+		}
+
+		if er != nil {
+			err = finish(er, raw)
+			if err != nil {
+				err = &EntryError{entries[i-1].Name, err}
+				return Entry{}, nil, err
+			}
+		}
+		if i == len(entries) {
+			err = io.EOF
+			return Entry{}, nil, err
+		}
+		e := &entries[i]
+		i++
+
+		// Only padding is skipped, data is never read twice.
+		if int64(e.index) < pos {
+			err = &EntryError{e.Name, ErrOverlappingData}
+			return Entry{}, nil, err
+		}
+		_, err = src.Discard(int(int64(e.index) - pos))
+		if err != nil {
+			err = &EntryError{e.Name, err}
+			return Entry{}, nil, err
+		}
+		pos = int64(e.index + e.sizeCompressed)
+
+		raw = &io.LimitedReader{R: src, N: int64(e.sizeCompressed)}
+		ar := newAdlerReader(raw)
+		var r io.Reader = ar
+		if br.flags&FlagEncrypted != 0 {
+			r = newGCMReader(ar, br.aead, e.nonce, e.sizeCompressed)
+		}
+		var dr io.Reader
+		switch {
+		case e.Method != MethodDeflate:
+			dr, err = newDecompressor(r, e.Method)
+			if err != nil {
+				err = &EntryError{e.Name, err}
+				return Entry{}, nil, err
+			}
+		case fr == nil:
+			fr = flate.NewReader(r)
+			dr = flateReader{fr}
+		default:
+			fr.(flate.Resetter).Reset(r, nil)
+			dr = flateReader{fr}
+		}
+
+		check := br.flags&FlagCompact == 0
+		er = &entryReader{ar, dr, int64(e.Size), e.adler, check, nil}
+		return *e, er, nil
+	}
+	return next, nil
+}
+
+// finish reads the rest of the data of er and verifies it, then skips what
+// is left of the stored data in raw.
+func finish(er *entryReader, raw *io.LimitedReader) error {
+	_, err := io.Copy(io.Discard, er)
+	if err == nil {
+		err = er.Close()
+	}
+	if err == nil {
+		_, err = io.Copy(io.Discard, raw)
+	}
+	return err
+}
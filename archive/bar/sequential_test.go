@@ -0,0 +1,127 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSequentialReader(t *testing.T) {
+	files := []testFile{
+		{"b.txt", "bravo"},
+		{"empty", ""},
+		{"a.txt", "alpha"},
+		{"data", string(benchData(100 << 10))},
+		{"dir/c.txt", "charlie"},
+	}
+	tests := []struct {
+		name  string
+		opts  []WriterOption
+		ropts []ReaderOption
+	}{
+		{"deflate", nil, nil},
+		{"stored", []WriterOption{WithMethod(MethodStored)}, nil},
+		{"zstd", []WriterOption{WithMethod(MethodZstd)}, nil},
+		{"compact", []WriterOption{WithCompact()}, nil},
+		{"aligned", []WriterOption{WithAlignment(512)}, nil},
+		{"solid", []WriterOption{WithSolid(16 << 10)}, nil},
+		{"encrypted", []WriterOption{WithKey(testKey)},
+			[]ReaderOption{WithDecryptionKey(testKey)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := openArchive(t, writeArchive(t, files, tt.opts...), tt.ropts...)
+			next, err := br.SequentialReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every other entry is left unread, the next call skips it.
+			var n int
+			for ; ; n++ {
+				e, r, err := next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n%2 == 1 {
+					continue
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("%s: %v", e.Name, err)
+				}
+				want, err := br.ReadFile(e.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("%s: got %d bytes, want %d", e.Name, len(got),
+						len(want))
+				}
+			}
+			if n != len(files) {
+				t.Errorf("got %d entries, want %d", n, len(files))
+			}
+			_, _, err = next()
+			if err != io.EOF {
+				t.Errorf("after the end: got %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestSequentialReaderErrors(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"data", string(benchData(50 << 10))},
+		{"b.txt", "bravo"},
+	}
+
+	_, err := openArchive(t, writeArchive(t, files, WithKey(testKey))).
+		SequentialReader()
+	if err != ErrMissingKey {
+		t.Errorf("no key: got %v, want %v", err, ErrMissingKey)
+	}
+
+	br := openArchive(t, writeArchive(t, files))
+	e, err := br.Lookup("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.adler ^= 1
+	next, err := br.SequentialReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		e, _, err := next()
+		if err == io.EOF {
+			t.Fatal("no error for corrupt data")
+		}
+		var ee *EntryError
+		if errors.As(err, &ee) {
+			if ee.Name != "data" || ee.Err != ErrInvalidChecksum {
+				t.Errorf("got %v, want %v for data", err, ErrInvalidChecksum)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, e.Name)
+	}
+
+	// The iteration ends at the error.
+	_, _, err = next()
+	if err == nil || err == io.EOF {
+		t.Errorf("after the error: got %v", err)
+	}
+	if len(names) != 2 || names[1] != "data" {
+		t.Errorf("got %v before the error", names)
+	}
+}
@@ -0,0 +1,46 @@
+package bar
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotClosed        = errors.New("Writer not closed.")
+	ErrInvalidSignature = errors.New("Invalid signature.")
+)
+
+// Sign returns an ed25519 signature of the SHA-256 hash of all bytes
+// written. It must be called after Close. The signature is detached and
+// has to be stored next to the archive.
+func (bw *Writer) Sign(priv ed25519.PrivateKey) ([]byte, error) {
+	if bw.err != ErrWriteAfterClose {
+		return nil, ErrNotClosed
+	}
+	if bw.hash == nil {
+		return nil, ErrSignAppended
+	}
+	return ed25519.Sign(priv, bw.hash.Sum(nil)), nil
+}
+
+// Verify checks a signature created by Writer.Sign against the whole
+// archive.
+func (br *Reader) Verify(pub ed25519.PublicKey, sig []byte) error {
+	_, err := br.r.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, io.LimitReader(br.r, br.size))
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, h.Sum(nil), sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package bar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf)
+	if err == nil {
+		err = bw.Create("a.txt")
+	}
+	if err == nil {
+		_, err = bw.Write([]byte("alpha"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bw.Sign(priv)
+	if err != ErrNotClosed {
+		t.Errorf("Sign before Close: got %v, want %v", err, ErrNotClosed)
+	}
+	err = bw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := bw.Sign(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(b, sig []byte)
+		pub    ed25519.PublicKey
+		want   error
+	}{
+		{"valid", func(b, sig []byte) {}, pub, nil},
+		{"tampered data", func(b, sig []byte) { b[headerSize] ^= 1 }, pub,
+			ErrInvalidSignature},
+		{"tampered signature", func(b, sig []byte) { sig[0] ^= 1 }, pub,
+			ErrInvalidSignature},
+		{"wrong key", func(b, sig []byte) {}, otherPub, ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bytes.Clone(buf.Bytes())
+			sig := bytes.Clone(sig)
+			tt.change(b, sig)
+
+			// The table is still intact, so the archive opens.
+			err := openArchive(t, b).Verify(tt.pub, sig)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
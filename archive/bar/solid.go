@@ -0,0 +1,306 @@
+package bar
+
+import (
+	"cmp"
+	"hash/adler32"
+	"io"
+	"math/bits"
+	"slices"
+)
+
+// DefaultSolidSize is the size of the data of the solid blocks of
+// WithSolid(0).
+const DefaultSolidSize = 16 << 20
+
+// WithSolid compresses the data of consecutive entries as a single stream,
+// a solid block, until it holds at least size bytes, which compresses many
+// small files much better. Zero uses DefaultSolidSize. Reading an entry
+// decompresses its block up to the entry, reading the entries in order
+// decompresses every block once. Entries of solid archives are copied by
+// decompressing and compressing them again, and setting the level or
+// method of an entry starts a new block. With WithAlignment, blocks are
+// aligned instead of entries.
+func WithSolid(size uint64) WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagSolid
+		bw.solidSize = size
+		return nil
+	}
+}
+
+// nextBlock closes the open solid block if it is full, or if its level or
+// method was set for a single entry.
+func (bw *Writer) nextBlock() error {
+	size := bw.solidSize
+	if size == 0 {
+		size = DefaultSolidSize
+	}
+	dw := bw.block
+	if dw == nil || dw.UncompressedCount() < size &&
+		dw.level == bw.level && dw.method == bw.method {
+		return nil
+	}
+	return bw.closeBlock(len(bw.entries))
+}
+
+// joinBlock adds the data of the current entry to the open solid block,
+// opening one if there is none.
+func (bw *Writer) joinBlock() error {
+	i := len(bw.entries) - 1
+	if bw.block == nil {
+		dw, err := newDataWriter(bw.w, bw.method, bw.level, bw.aead,
+			bw.entries[i].nonce)
+		if err != nil {
+			return err
+		}
+		dw.ratio = bw.ratio
+		bw.block, bw.blockFirst = dw, i
+	}
+
+	bw.entries[i].solidOffset = bw.block.UncompressedCount()
+	bw.solidSum = adler32.New()
+	bw.curr = bw.block
+	return nil
+}
+
+// closeBlock finishes the open solid block, which holds the data of the
+// entries from blockFirst to end.
+func (bw *Writer) closeBlock(end int) error {
+	dw := bw.block
+	bw.block = nil
+	err := dw.Close()
+	if err != nil {
+		return err
+	}
+
+	for i := bw.blockFirst; i < end; i++ {
+		bw.entries[i].sizeCompressed = dw.CompressedCount()
+		bw.entries[i].Method = dw.method
+	}
+	bw.index += dw.CompressedCount()
+	return nil
+}
+
+// ownBlock moves the current entry to a new solid block of its own, if it
+// has no data yet, so its level or method can be set.
+func (bw *Writer) ownBlock() error {
+	i := len(bw.entries) - 1
+	if bw.block == nil || bw.blockFirst == i ||
+		bw.block.UncompressedCount() != bw.entries[i].solidOffset {
+		return nil
+	}
+
+	err := bw.closeBlock(i)
+	if err == nil {
+		err = bw.pad()
+	}
+	if err != nil {
+		return err
+	}
+
+	bw.entries[i].index = bw.index
+	if bw.aead != nil {
+		bw.entries[i].nonce, err = newNonce()
+		if err != nil {
+			return err
+		}
+	}
+	return bw.joinBlock()
+}
+
+// setBlockSizes sets the size of the data of the block of every entry of a
+// solid archive, so CompressedSize returns its share of the block.
+func setBlockSizes(entries []Entry) {
+	sizes := make(map[uint64]uint64)
+	for _, e := range entries {
+		sum, carry := bits.Add64(sizes[e.index], e.Size, 0)
+		if carry != 0 {
+			sum = 0
+		}
+		sizes[e.index] = sum
+	}
+	for i := range entries {
+		entries[i].blockSize = sizes[entries[i].index]
+	}
+}
+
+// compareData orders entries by the offset of their data, in the archive
+// and in the data of their solid block.
+func compareData(a, b Entry) int {
+	if c := cmp.Compare(a.index, b.index); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.solidOffset, b.solidOffset)
+}
+
+// solidBlock is the decompressed data of a solid block, read up to pos.
+type solidBlock struct {
+	index uint64
+	r     io.Reader
+	pos   uint64
+}
+
+// blockReader reads the data of an entry of a solid archive from its block,
+// which it opens on the first read. Without raw, it continues reading the
+// block the last entry was read from, if the entry comes after it.
+type blockReader struct {
+	br  *Reader
+	e   *Entry
+	raw io.Reader
+	b   *solidBlock
+	err error
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.b == nil {
+		r.err = r.open()
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	end := r.e.solidOffset + r.e.Size
+	if r.b.pos == end {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > end-r.b.pos {
+		p = p[:end-r.b.pos]
+	}
+	n, err := r.b.r.Read(p)
+	r.b.pos += uint64(n)
+	switch {
+	case err == io.EOF && r.b.pos == end:
+		err = nil
+	case err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+	return n, err
+}
+
+// open finds the block of the entry and skips to its data.
+func (r *blockReader) open() error {
+	e := r.e
+	if e.Size == 0 {
+		r.b = &solidBlock{pos: e.solidOffset}
+		return nil
+	}
+
+	if r.raw == nil {
+		r.br.blockMu.Lock()
+		b := r.br.block
+		r.br.block = nil
+		r.br.blockMu.Unlock()
+		if b != nil && b.index == e.index && b.pos <= e.solidOffset {
+			r.b = b
+		}
+	}
+	if r.b == nil {
+		raw := r.raw
+		if raw == nil {
+			var err error
+			raw, err = r.br.rawReader(e)
+			if err != nil {
+				return err
+			}
+		}
+		if r.br.flags&FlagEncrypted != 0 {
+			raw = newGCMReader(raw, r.br.aead, e.nonce, e.sizeCompressed)
+		}
+		dr, err := newDecompressor(raw, e.Method)
+		if err != nil {
+			return err
+		}
+		r.b = &solidBlock{index: e.index, r: dr}
+	}
+
+	n, err := io.CopyN(io.Discard, r.b.r, int64(e.solidOffset-r.b.pos))
+	r.b.pos += uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// solidReader verifies the data of an entry of a solid archive and keeps
+// its block for the next entry once all of it was read.
+type solidReader struct {
+	*entryReader
+	br *blockReader
+}
+
+func (sr *solidReader) Close() error {
+	b := sr.br.b
+	if sr.br.raw == nil && b != nil && b.r != nil &&
+		b.pos == sr.br.e.solidOffset+sr.br.e.Size {
+		sr.br.br.blockMu.Lock()
+		sr.br.br.block = b
+		sr.br.br.blockMu.Unlock()
+	}
+	sr.br.b = nil
+	return sr.entryReader.Close()
+}
+
+// solidEntryReader returns a reader for the data of e of a solid archive,
+// whose checksum is that of the data. raw is the block of e or nil, see
+// blockReader.
+func (br *Reader) solidEntryReader(e *Entry, raw io.Reader) (io.ReadCloser,
+	error) {
+	if br.flags&FlagEncrypted != 0 && br.aead == nil {
+		return nil, ErrMissingKey
+	}
+	if e.solidOffset > e.solidOffset+e.Size {
+		return nil, ErrCorruptData
+	}
+
+	r := &blockReader{br: br, e: e, raw: raw}
+	ar := newAdlerReader(r)
+	check := br.flags&FlagCompact == 0
+	er := &entryReader{ar, ar, int64(e.Size), e.adler, check, nil}
+	return &solidReader{er, r}, nil
+}
+
+// solidSequentialReader is SequentialReader for solid archives, which reads
+// the entries in order of their data within the blocks.
+func (br *Reader) solidSequentialReader() func() (Entry, io.Reader, error) {
+	entries := slices.Clone(br.Entries)
+	slices.SortStableFunc(entries, compareData)
+
+	var (
+		i   int
+		er  io.ReadCloser
+		err error
+	)
+	return func() (Entry, io.Reader, error) {
+		if err != nil {
+			return Entry{}, nil, err
+		}
+
+		if er != nil {
+			_, err = io.Copy(io.Discard, er)
+			if err == nil {
+				err = er.Close()
+			}
+			if err != nil {
+				err = &EntryError{entries[i-1].Name, err}
+				return Entry{}, nil, err
+			}
+		}
+		if i == len(entries) {
+			err = io.EOF
+			return Entry{}, nil, err
+		}
+		e := &entries[i]
+		i++
+
+		er, err = br.solidEntryReader(e, nil)
+		if err != nil {
+			err = &EntryError{e.Name, err}
+			return Entry{}, nil, err
+		}
+		return *e, er, nil
+	}
+}
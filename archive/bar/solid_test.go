@@ -0,0 +1,263 @@
+package bar
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// sourceFiles returns n small files alike in the way source files are.
+func sourceFiles(n int) []testFile {
+	files := make([]testFile, n)
+	for i := range files {
+		files[i] = testFile{
+			fmt.Sprintf("pkg/f%03d.go", i),
+			fmt.Sprintf("package pkg\n\n// F%d returns %d.\nfunc F%d() int {\n%s\treturn %d\n}\n",
+				i, i, i, strings.Repeat("\t_ = 0\n", i%7), i),
+		}
+	}
+	return files
+}
+
+// solidBlocks returns the number of blocks files are written to with
+// WithSolid(size).
+func solidBlocks(files []testFile, size uint64) int {
+	if size == 0 {
+		size = DefaultSolidSize
+	}
+	var blocks int
+	var n uint64
+	for i, f := range files {
+		if i == 0 || n >= size {
+			blocks++
+			n = 0
+		}
+		n += uint64(len(f.data))
+	}
+	return blocks
+}
+
+func TestSolid(t *testing.T) {
+	files := sourceFiles(200)
+	plain := writeArchive(t, files)
+
+	tests := []struct {
+		name  string
+		size  uint64
+		opts  []WriterOption
+		ropts []ReaderOption
+	}{
+		{"default", 0, nil, nil},
+		{"one entry per block", 1, nil, nil},
+		{"small blocks", 2 << 10, nil, nil},
+		{"stored", 2 << 10, []WriterOption{WithMethod(MethodStored)}, nil},
+		{"zstd", 0, []WriterOption{WithMethod(MethodZstd)}, nil},
+		{"aligned", 2 << 10, []WriterOption{WithAlignment(512)}, nil},
+		{"encrypted", 2 << 10, []WriterOption{WithKey(testKey)},
+			[]ReaderOption{WithDecryptionKey(testKey)}},
+		{"encrypted table", 0,
+			[]WriterOption{WithKey(testKey), WithTableEncryption()},
+			[]ReaderOption{WithDecryptionKey(testKey)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]WriterOption{WithSolid(tt.size)}, tt.opts...)
+			b := writeArchive(t, files, opts...)
+			br := openArchive(t, b, tt.ropts...)
+			checkFiles(t, br, files)
+			if br.Flags()&FlagSolid == 0 {
+				t.Errorf("flags %v, want %v", br.Flags(), FlagSolid)
+			}
+
+			// The entries of a block follow each other in the data of
+			// the block.
+			locs := br.OffsetManifest()
+			slices.SortStableFunc(locs, func(a, b EntryLocation) int {
+				return compareData(Entry{index: a.Offset, solidOffset: a.SolidOffset},
+					Entry{index: b.Offset, solidOffset: b.SolidOffset})
+			})
+			var blocks int
+			for i, l := range locs {
+				if i == 0 || l.Offset != locs[i-1].Offset {
+					blocks++
+					if l.SolidOffset != 0 {
+						t.Errorf("%s: solid offset %d, want 0", l.Name, l.SolidOffset)
+					}
+					if tt.name == "aligned" && l.Offset%512 != 0 {
+						t.Errorf("%s: block at %d", l.Name, l.Offset)
+					}
+					continue
+				}
+				prev := locs[i-1]
+				if l.SolidOffset != prev.SolidOffset+prev.Size {
+					t.Errorf("%s: solid offset %d, want %d", l.Name,
+						l.SolidOffset, prev.SolidOffset+prev.Size)
+				}
+			}
+			if want := solidBlocks(files, tt.size); blocks != want {
+				t.Errorf("got %d blocks, want %d", blocks, want)
+			}
+
+			// Entries are read in any order.
+			rnd := rand.New(rand.NewSource(1))
+			for _, i := range rnd.Perm(len(files)) {
+				got, err := br.ReadFile(files[i].name)
+				if err != nil {
+					t.Fatalf("%s: %v", files[i].name, err)
+				}
+				if string(got) != files[i].data {
+					t.Errorf("%s: got %q, want %q", files[i].name, got,
+						files[i].data)
+				}
+			}
+		})
+	}
+
+	// Sharing a stream compresses the tiny files much better.
+	if solid := writeArchive(t, files, WithSolid(0)); len(solid)*2 > len(plain) {
+		t.Errorf("solid: %d bytes, not solid: %d bytes", len(solid), len(plain))
+	}
+}
+
+func TestSolidReadOrder(t *testing.T) {
+	files := sourceFiles(100)
+	b := writeArchive(t, files, WithSolid(0))
+
+	// Reading the entries in order decompresses the block once, in
+	// reverse order every entry starts over.
+	reads := func(order []testFile) int {
+		r := &countingReaderAt{b: b}
+		br, err := NewReaderAt(r, int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened := r.reads
+		for _, f := range order {
+			got, err := br.ReadFile(f.name)
+			if err != nil {
+				t.Fatalf("%s: %v", f.name, err)
+			}
+			if string(got) != f.data {
+				t.Errorf("%s: got %q, want %q", f.name, got, f.data)
+			}
+		}
+		return r.reads - opened
+	}
+	reversed := slices.Clone(files)
+	slices.Reverse(reversed)
+	inOrder, reverse := reads(files), reads(reversed)
+	if inOrder*2 > reverse {
+		t.Errorf("%d reads in order, %d reads in reverse order", inOrder, reverse)
+	}
+}
+
+func TestSolidLevel(t *testing.T) {
+	files := []testFile{
+		{"a.txt", strings.Repeat("alpha ", 100)},
+		{"b.txt", strings.Repeat("bravo ", 100)},
+		{"c.txt", strings.Repeat("charlie ", 100)},
+		{"d.txt", strings.Repeat("delta ", 100)},
+	}
+	tests := []struct {
+		name   string
+		set    func(bw *Writer) error
+		blocks int
+	}{
+		{"same level", func(bw *Writer) error {
+			return bw.SetLevel(flate.BestCompression)
+		}, 1},
+		{"other level", func(bw *Writer) error {
+			return bw.SetLevel(flate.BestSpeed)
+		}, 3},
+		{"other method", func(bw *Writer) error {
+			return bw.SetMethod(MethodStored)
+		}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, WithSolid(0), WithMethod(MethodDeflate))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The level or method of the second entry is set, the
+			// others share the blocks before and after it.
+			for i, f := range files {
+				err = bw.Create(f.name)
+				if err == nil && i == 1 {
+					err = tt.set(bw)
+				}
+				if err == nil {
+					_, err = bw.Write([]byte(f.data))
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", f.name, err)
+				}
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes())
+			checkFiles(t, br, files)
+			blocks := make(map[uint64]bool)
+			for _, l := range br.OffsetManifest() {
+				blocks[l.Offset] = true
+			}
+			if len(blocks) != tt.blocks {
+				t.Errorf("got %d blocks, want %d", len(blocks), tt.blocks)
+			}
+		})
+	}
+}
+
+func TestSolidCorrupt(t *testing.T) {
+	files := []testFile{
+		{"a.txt", strings.Repeat("alpha ", 100)},
+		{"b.txt", strings.Repeat("bravo ", 100)},
+	}
+	b := writeArchive(t, files, WithSolid(0))
+
+	tests := []struct {
+		name   string
+		modify func(e *Entry)
+		want   error
+	}{
+		{"offset past block", func(e *Entry) { e.solidOffset += 1 << 10 },
+			io.ErrUnexpectedEOF},
+		{"offset overflows", func(e *Entry) { e.solidOffset = math.MaxUint64 },
+			ErrCorruptData},
+		{"offset into other entry", func(e *Entry) { e.solidOffset-- },
+			ErrInvalidChecksum},
+		{"size past block", func(e *Entry) { e.Size++ }, io.ErrUnexpectedEOF},
+		{"checksum", func(e *Entry) { e.adler++ }, ErrInvalidChecksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := openArchive(t, b)
+			e, err := br.Lookup("b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(e)
+			_, err = br.ReadFile("b.txt")
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			got, err := br.ReadFile("a.txt")
+			if err != nil || string(got) != files[0].data {
+				t.Errorf("a.txt: got %q, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package bar
+
+import (
+	"io"
+)
+
+// WithTableWriter writes the table and footer to w instead of the archive,
+// so the header and entry data are only ever appended to and parts of them
+// that were already stored elsewhere never change. Appending the data
+// written to w gives the complete archive, which NewSplitReader reads
+// without copying. The signature of Writer.Sign covers both.
+func WithTableWriter(w io.Writer) WriterOption {
+	return func(bw *Writer) error {
+		bw.table = w
+		if bw.hash != nil {
+			bw.table = io.MultiWriter(w, bw.hash)
+		}
+		return nil
+	}
+}
+
+// NewSplitReader reads an archive written with WithTableWriter, whose first
+// dataSize bytes are stored in data and the rest in table.
+func NewSplitReader(data io.ReaderAt, dataSize int64, table io.ReaderAt,
+	tableSize int64, opts ...ReaderOption) (*Reader, error) {
+	r := &splitReaderAt{data, dataSize, table}
+	return NewReaderAt(r, dataSize+tableSize, opts...)
+}
+
+// splitReaderAt reads the bytes of data followed by the bytes of table.
+type splitReaderAt struct {
+	data     io.ReaderAt
+	dataSize int64
+	table    io.ReaderAt
+}
+
+func (sr *splitReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	if off < sr.dataSize {
+		m := min(int64(len(p)), sr.dataSize-off)
+		k, err := sr.data.ReadAt(p[:m], off)
+		n += k
+		if k < int(m) {
+			return n, err
+		}
+		p, off = p[m:], sr.dataSize
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	k, err := sr.table.ReadAt(p, off-sr.dataSize)
+	return n + k, err
+}
@@ -0,0 +1,98 @@
+package bar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"dir/b.txt", "bravo"},
+		{"data", string(benchData(100 << 10))},
+	}
+	tests := []struct {
+		name  string
+		opts  []WriterOption
+		ropts []ReaderOption
+	}{
+		{"default", nil, nil},
+		{"compact", []WriterOption{WithCompact()}, nil},
+		{"name pool", []WriterOption{WithNamePool()}, nil},
+		{"solid", []WriterOption{WithSolid(16 << 10)}, nil},
+		{"encrypted table", []WriterOption{WithKey(testKey), WithTableEncryption()},
+			[]ReaderOption{WithDecryptionKey(testKey)}},
+	}
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data, table bytes.Buffer
+			opts := append([]WriterOption{WithTableWriter(&table)}, tt.opts...)
+			bw, err := NewWriter(&data, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Data already written never changes.
+			var parts [][]byte
+			for _, f := range files {
+				err = bw.Create(f.name)
+				if err == nil {
+					_, err = bw.Write([]byte(f.data))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				parts = append(parts, bytes.Clone(data.Bytes()))
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, part := range parts {
+				if !bytes.HasPrefix(data.Bytes(), part) {
+					t.Errorf("data of the first %d entries changed", i+1)
+				}
+			}
+			if table.Len() == 0 {
+				t.Fatal("no table written")
+			}
+			sig, err := bw.Sign(priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			whole := append(bytes.Clone(data.Bytes()), table.Bytes()...)
+			br := openArchive(t, whole, tt.ropts...)
+			checkFiles(t, br, files)
+			err = br.Verify(priv.Public().(ed25519.PublicKey), sig)
+			if err != nil {
+				t.Errorf("signature: %v", err)
+			}
+
+			br, err = NewSplitReader(bytes.NewReader(data.Bytes()),
+				int64(data.Len()), bytes.NewReader(table.Bytes()),
+				int64(table.Len()), tt.ropts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, br, files)
+
+			// Reads across the end of the data are joined.
+			sr := &splitReaderAt{bytes.NewReader(data.Bytes()),
+				int64(data.Len()), bytes.NewReader(table.Bytes())}
+			got, err := io.ReadAll(io.NewSectionReader(sr, int64(data.Len())-10,
+				int64(table.Len())+10))
+			if err != nil || !bytes.Equal(got, whole[data.Len()-10:]) {
+				t.Errorf("got %d bytes, %v, want %d", len(got), err,
+					table.Len()+10)
+			}
+		})
+	}
+}
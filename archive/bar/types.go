@@ -0,0 +1,192 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"math"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrNoEntryTypes  = errors.New("Archive doesn't store entry types.")
+	ErrInvalidTarget = errors.New("Invalid link target.")
+	ErrNoEntryData   = errors.New("Entry has no data.")
+	ErrUnsafeLink    = errors.New("Link points outside of the target directory.")
+
+	ErrMissingLinkTarget = errors.New("Hard link target not found.")
+)
+
+// EntryType tells what kind of file an entry is. Archives without
+// FlagEntryTypes only store regular files.
+type EntryType uint8
+
+const (
+	TypeFile     EntryType = iota // regular file
+	TypeSymlink                   // symbolic link to Linkname, without data
+	TypeDir                       // directory, without data
+	TypeHardlink                  // hard link to the file entry Linkname, without data
+)
+
+// WithEntryTypes stores the type of every entry, so symbolic links,
+// directories and hard links can be added with Writer.CreateSymlink,
+// Writer.CreateDir and Writer.CreateHardlink.
+func WithEntryTypes() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagEntryTypes
+		return nil
+	}
+}
+
+// CreateSymlink adds a symbolic link named name pointing to target, which
+// is stored as it is. Like entries added with Create, the link can be given
+// a modification time, but writing data to it fails with ErrNoEntryData.
+// The archive must be written with WithEntryTypes.
+func (bw *Writer) CreateSymlink(name, target string) error {
+	if bw.flags&FlagEntryTypes == 0 {
+		return ErrNoEntryTypes
+	}
+	if target == "" || len(target) > math.MaxUint16 {
+		return ErrInvalidTarget
+	}
+
+	err := bw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	e := &bw.entries[len(bw.entries)-1]
+	e.Type = TypeSymlink
+	e.Linkname = target
+	e.Perm = 0777
+	return nil
+}
+
+// CreateDir adds a directory named name with permissions 0755. Like
+// entries added with Create, its permissions and modification time can be
+// set, but writing data to it fails with ErrNoEntryData. Directories only
+// need to be added for their metadata or if they are empty, ExtractAll
+// creates the directories of the entries anyway. The archive must be
+// written with WithEntryTypes.
+func (bw *Writer) CreateDir(name string) error {
+	if bw.flags&FlagEntryTypes == 0 {
+		return ErrNoEntryTypes
+	}
+
+	err := bw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	e := &bw.entries[len(bw.entries)-1]
+	e.Type = TypeDir
+	e.Perm = 0755
+	return nil
+}
+
+// CreateHardlink adds a hard link named name to the regular file entry
+// target added before, which shares its data and permissions instead of
+// storing them again. Writing data to it fails with ErrNoEntryData. The
+// archive must be written with WithEntryTypes.
+func (bw *Writer) CreateHardlink(name, target string) error {
+	if bw.flags&FlagEntryTypes == 0 {
+		return ErrNoEntryTypes
+	}
+
+	i := len(bw.entries) - 1
+	for i >= 0 && (bw.entries[i].Name != target || bw.entries[i].Type != TypeFile) {
+		i--
+	}
+	if i < 0 {
+		return ErrInvalidTarget
+	}
+	perm := bw.entries[i].Perm
+
+	err := bw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	e := &bw.entries[len(bw.entries)-1]
+	e.Type = TypeHardlink
+	e.Linkname = target
+	e.Perm = perm
+	return nil
+}
+
+// linkTarget returns the file entry the hard link e points to.
+func (br *Reader) linkTarget(e *Entry) (*Entry, error) {
+	for i := range br.Entries {
+		t := &br.Entries[i]
+		if t.Name == e.Linkname && t.Type == TypeFile {
+			return t, nil
+		}
+	}
+	return nil, ErrMissingLinkTarget
+}
+
+// resolve returns the entry holding the data of e, which is the target of
+// hard links and e itself otherwise.
+func (br *Reader) resolve(e *Entry) (*Entry, error) {
+	if e.Type != TypeHardlink {
+		return e, nil
+	}
+	return br.linkTarget(e)
+}
+
+// writeType writes the type of e, followed by the length and target of
+// links.
+func writeType(w io.Writer, e *Entry) error {
+	if e.Type != TypeSymlink && e.Type != TypeHardlink {
+		_, err := w.Write([]byte{byte(e.Type)})
+		return err
+	}
+
+	buf := make([]byte, 3)
+	wb := wBuf(buf)
+	wb.Uint8(uint8(e.Type))
+	wb.Uint16(uint16(len(e.Linkname)))
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, e.Linkname)
+	return err
+}
+
+// readType reads the type of e written by writeType.
+func readType(r io.Reader, e *Entry) error {
+	buf := make([]byte, 1)
+	err := readFull(r, buf)
+	if err != nil {
+		return err
+	}
+
+	e.Type = EntryType(buf[0])
+	switch e.Type {
+	case TypeFile, TypeDir:
+		return nil
+	case TypeSymlink, TypeHardlink:
+	default:
+		return ErrCorruptData
+	}
+
+	e.Linkname, err = readString(r)
+	if err != nil {
+		return err
+	}
+	if e.Linkname == "" {
+		return ErrCorruptData
+	}
+	return nil
+}
+
+// localLink reports whether a link extracted to the local path name
+// points to a path below the directory it is extracted into.
+func localLink(name, target string) bool {
+	if path.IsAbs(target) || strings.ContainsRune(target, '\\') {
+		return false
+	}
+	return filepath.IsLocal(filepath.FromSlash(path.Join(path.Dir(name), target)))
+}
@@ -2,114 +2,697 @@ package bar
 
 import (
 	"compress/flate"
+	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"hash"
 	"hash/adler32"
 	"io"
+	"math"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
 var (
-	ErrNoValidEntry    = errors.New("No valid entry to write")
-	ErrPathIsNotSimple = errors.New("Filepath is not simple")
-	ErrWriteAfterClose = errors.New("Write after close")
+	ErrNoValidEntry      = errors.New("No valid entry to write.")
+	ErrPathIsNotSimple   = errors.New("Filepath is not simple.")
+	ErrNameTooLong       = errors.New("Name too long.")
+	ErrTooManyEntries    = errors.New("Too many entries.")
+	ErrWriteAfterClose   = errors.New("Write after close.")
+	ErrLevelAfterWrite   = errors.New("Compression level set after write.")
+	ErrMethodAfterWrite  = errors.New("Compression method set after write.")
+	ErrInvalidLevel      = errors.New("Invalid compression level.")
+	ErrInvalidAlignment  = errors.New("Invalid alignment.")
+	ErrIncompatibleEntry = errors.New("Entry is incompatible with archive.")
+	ErrProducerTooLong   = errors.New("Producer too long.")
 )
 
 type Writer struct {
-	w       io.Writer
-	index   uint64
-	entries []Entry
-	curr    *dataWriter
-	err     error
+	w         io.Writer
+	index     uint64
+	prev      uint64
+	level     int
+	method    Method
+	ratio     float64
+	flags     uint32
+	alignment uint32
+	aead      cipher.AEAD
+	kdf       kdfParams
+	name      string
+	producer  string
+	meta      metadata
+	validate  func(name string) error
+	hash      hash.Hash
+	table     io.Writer
+	content   hash.Hash
+	entries   []Entry
+	curr      *dataWriter
+	err       error
+
+	// The open solid block and the first of its entries, and the
+	// checksum of the data of the current entry, see WithSolid.
+	solidSize  uint64
+	block      *dataWriter
+	blockFirst int
+	solidSum   hash.Hash32
+
+	// The modification time of every entry, see WithFixedModTime.
+	modTime *time.Time
 }
 
-func NewWriter(w io.Writer) (*Writer, error) {
-	header := make([]byte, headerSize)
-	copy(header[0:3], magicNumber)
-	header[3] = Version
+type WriterOption func(*Writer) error
 
-	n, err := w.Write(header)
-	if err != nil {
-		return nil, err
+// WithAlignment pads the archive so the data of every entry starts at a
+// multiple of n bytes.
+func WithAlignment(n uint32) WriterOption {
+	return func(bw *Writer) error {
+		if n == 0 {
+			return ErrInvalidAlignment
+		}
+		bw.flags |= FlagAligned
+		bw.alignment = n
+		return nil
 	}
-
-	return &Writer{w, uint64(n), nil, nil, ErrNoValidEntry}, nil
 }
 
-func (bw *Writer) Create(name string) error {
-	if bw.err != nil && bw.err != ErrNoValidEntry {
-		return bw.err
+// WithKey encrypts the data of every entry with AES-GCM. The key must be
+// 16, 24 or 32 bytes long, a 32 byte key uses AES-256. Names and other
+// metadata are not encrypted, see WithTableEncryption.
+func WithKey(key []byte) WriterOption {
+	return func(bw *Writer) error {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		bw.flags |= FlagEncrypted
+		bw.aead = aead
+		return nil
 	}
+}
 
-	if bw.err != ErrNoValidEntry {
-		err := bw.finalizeEntry()
+// WithPassword encrypts the data of every entry like WithKey, with a key
+// derived from password using scrypt.
+func WithPassword(password []byte) WriterOption {
+	return func(bw *Writer) error {
+		kdf, err := newKDFParams()
+		if err != nil {
+			return err
+		}
+
+		key, err := kdf.key(password)
+		if err != nil {
+			return err
+		}
+
+		err = WithKey(key)(bw)
 		if err != nil {
-			bw.err = err
 			return err
 		}
+		bw.flags |= FlagPassword
+		bw.kdf = kdf
+		return nil
 	}
-	bw.err = nil
+}
+
+// WithTableEncryption encrypts the table with the key of WithKey or
+// WithPassword, so the names and other metadata of the entries are hidden
+// too. Such archives can only be opened with WithDecryptionKey or
+// WithDecryptionPassword. The header and the metadata section are not
+// encrypted.
+func WithTableEncryption() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagEncryptedTable
+		return nil
+	}
+}
+
+// WithArchiveName stores the name of the archive in its header.
+func WithArchiveName(name string) WriterOption {
+	return func(bw *Writer) error {
+		if len(name) > math.MaxUint16 {
+			return ErrNameTooLong
+		}
+		bw.flags |= FlagName
+		bw.name = name
+		return nil
+	}
+}
+
+// WithProducer stores the name and version of the program writing the
+// archive in its header, e.g. "bar 1.2".
+func WithProducer(producer string) WriterOption {
+	return func(bw *Writer) error {
+		if len(producer) > math.MaxUint16 {
+			return ErrProducerTooLong
+		}
+		bw.flags |= FlagProducer
+		bw.producer = producer
+		return nil
+	}
+}
+
+// WithContentIndex stores the SHA-256 of the data of every entry, see
+// Reader.BlockIndex.
+func WithContentIndex() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagHashed
+		return nil
+	}
+}
+
+// WithCompact leaves the checksum and permissions out of the table entries,
+// which makes the table 6 bytes per entry smaller. Entry data is not
+// verified when reading and entries are read with permissions 0644.
+func WithCompact() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagCompact
+		return nil
+	}
+}
+
+// WithNamePool stores every directory of the entry names once in the
+// table, which makes it smaller if many entries share directories.
+func WithNamePool() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagNamePool
+		return nil
+	}
+}
+
+// WithRawTable writes the table without compressing it, which makes
+// the tables of archives with few entries smaller.
+func WithRawTable() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagRawTable
+		return nil
+	}
+}
+
+// WithModTimes stores the modification time of every entry, see
+// Writer.SetModTime. Entries without one store none.
+func WithModTimes() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagModTime
+		return nil
+	}
+}
 
+// WithFixedModTime stores t as the modification time of every entry,
+// regardless of Writer.SetModTime and of the times of copied entries, so
+// archiving the same files again gives the same archive. It implies
+// WithModTimes.
+func WithFixedModTime(t time.Time) WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagModTime
+		bw.modTime = &t
+		return nil
+	}
+}
+
+// WithCompressionLevel compresses the data of entries at level, from
+// flate.HuffmanOnly to flate.BestCompression, the level of NewWriter. It
+// overrides the level of NewWriterLevel, see Writer.SetLevel for a single
+// entry.
+func WithCompressionLevel(level int) WriterOption {
+	return func(bw *Writer) error {
+		if !validLevel(level) {
+			return ErrInvalidLevel
+		}
+		bw.level = level
+		return nil
+	}
+}
+
+// WithNameValidator replaces ValidateName as the check of entry names in
+// Create. Names are limited to 65535 bytes and must not be empty
+// regardless.
+func WithNameValidator(fn func(name string) error) WriterOption {
+	return func(bw *Writer) error {
+		bw.validate = fn
+		return nil
+	}
+}
+
+// ValidateName accepts local paths without backslashes, so entries can't be
+// extracted outside of the target directory on any platform.
+func ValidateName(name string) error {
 	if !filepath.IsLocal(name) || strings.IndexRune(name, '\\') != -1 {
+		return ErrPathIsNotSimple
+	}
+	return nil
+}
+
+// WithSettingsFrom uses the alignment and encryption settings of r, so its
+// entries can be copied with CopyEntry. New entries can only be added to an
+// encrypted archive if the key of r is set.
+func WithSettingsFrom(r *Reader) WriterOption {
+	return func(bw *Writer) error {
+		bw.flags = r.flags
+		bw.alignment = r.alignment
+		bw.aead = r.aead
+		bw.kdf = r.kdf
+		bw.name = r.name
+		bw.producer = r.producer
+		bw.meta = r.meta
+		return nil
+	}
+}
+
+func NewWriter(w io.Writer, opts ...WriterOption) (*Writer, error) {
+	return NewWriterLevel(w, flate.BestCompression, opts...)
+}
+
+func NewWriterLevel(w io.Writer, level int, opts ...WriterOption) (*Writer, error) {
+	if !validLevel(level) {
+		return nil, ErrInvalidLevel
+	}
+
+	h := sha256.New()
+	bw := &Writer{
+		w:        io.MultiWriter(w, h),
+		hash:     h,
+		level:    level,
+		validate: ValidateName,
+		err:      ErrNoValidEntry,
+	}
+	for _, opt := range opts {
+		err := opt(bw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if bw.flags&FlagEncryptedTable != 0 && bw.aead == nil {
+		return nil, ErrMissingKey
+	}
+
+	err := bw.writeHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	return bw, nil
+}
+
+func (bw *Writer) writeHeader() error {
+	size := headerSize + flagsSize
+	if bw.flags&FlagAligned != 0 {
+		size += 4
+	}
+	if bw.flags&FlagEncrypted != 0 {
+		size += 1
+	}
+	if bw.flags&FlagPassword != 0 {
+		size += kdfSize
+	}
+	if bw.flags&FlagName != 0 {
+		size += 2 + len(bw.name)
+	}
+	if bw.flags&FlagProducer != 0 {
+		size += 2 + len(bw.producer)
+	}
+
+	header := make([]byte, size)
+	copy(header[0:3], magicNumber)
+	header[3] = Version
+
+	wb := wBuf(header[headerSize:])
+	wb.Uint32(bw.flags)
+	if bw.flags&FlagAligned != 0 {
+		wb.Uint32(bw.alignment)
+	}
+	if bw.flags&FlagEncrypted != 0 {
+		wb.Uint8(CipherAESGCM)
+	}
+	if bw.flags&FlagPassword != 0 {
+		wb.Uint8(KDFScrypt)
+		wb.Uint8(bw.kdf.logN)
+		wb.Uint16(bw.kdf.r)
+		wb.Uint16(bw.kdf.p)
+		copy(wb, bw.kdf.salt)
+		wb = wb[saltSize:]
+	}
+	if bw.flags&FlagName != 0 {
+		wb.Uint16(uint16(len(bw.name)))
+		copy(wb, bw.name)
+		wb = wb[len(bw.name):]
+	}
+	if bw.flags&FlagProducer != 0 {
+		wb.Uint16(uint16(len(bw.producer)))
+		copy(wb, bw.producer)
+	}
+
+	n, err := bw.w.Write(header)
+	bw.index += uint64(n)
+	return err
+}
+
+func (bw *Writer) Create(name string) error {
+	err := bw.nextEntry()
+	if err != nil {
+		return err
+	}
+
+	err = bw.validate(name)
+	if err != nil {
+		bw.err = err
+		return err
+	}
+
+	if len(name) > math.MaxUint16 {
+		bw.err = ErrNameTooLong
+		return bw.err
+	}
+	if name == "" {
 		bw.err = ErrPathIsNotSimple
 		return bw.err
 	}
 
+	if bw.flags&FlagEncrypted != 0 && bw.aead == nil {
+		bw.err = ErrMissingKey
+		return bw.err
+	}
+
+	err = bw.nextBlock()
+	if err == nil && bw.block == nil {
+		err = bw.pad()
+	}
+	if err != nil {
+		bw.err = err
+		return err
+	}
+
 	var e Entry
 	e.Name = name
+	e.Method = bw.method
 	e.Perm = 0644
-	e.index = uint64(bw.index)
+	e.UID, e.GID = -1, -1
+	e.index = bw.index
+
+	switch {
+	case bw.block != nil:
+		e.index = bw.entries[bw.blockFirst].index
+		e.nonce = bw.entries[bw.blockFirst].nonce
+	case bw.aead != nil:
+		e.nonce, err = newNonce()
+		if err != nil {
+			bw.err = err
+			return err
+		}
+	}
+
+	if bw.flags&FlagHashed != 0 {
+		bw.content = sha256.New()
+	}
 
 	bw.entries = append(bw.entries, e)
-	var err error
-	bw.curr, err = newDataWriter(bw.w)
+	if bw.flags&FlagSolid != 0 {
+		err = bw.joinBlock()
+		if err != nil {
+			bw.err = err
+		}
+		return err
+	}
+
+	bw.curr, err = newDataWriter(bw.w, bw.method, bw.level, bw.aead, e.nonce)
+	if err != nil {
+		bw.err = err
+		return err
+	}
+	bw.curr.ratio = bw.ratio
+
+	return nil
+}
+
+// CopyEntry adds an entry of src, copying its data without decompressing
+// it. Encrypted entries can only be copied to an archive using the same key,
+// see WithSettingsFrom.
+func (bw *Writer) CopyEntry(src *Reader, e *Entry) error {
+	return bw.copyEntryAs(src, e, e)
+}
+
+// copyEntryAs copies the data of e, storing it with the name, permissions,
+// modification time, owner and comment of meta, and with its link target
+// if e is a link.
+func (bw *Writer) copyEntryAs(src *Reader, e, meta *Entry) error {
+	// The data of solid archives is only stored in blocks.
+	if (src.flags|bw.flags)&FlagSolid != 0 {
+		return recompressEntryAs(bw, src, e, meta, bw.level)
+	}
+
+	if (src.flags^bw.flags)&FlagEncrypted != 0 {
+		return ErrIncompatibleEntry
+	}
+	if bw.flags&FlagHashed != 0 && e.hash == nil {
+		return ErrIncompatibleEntry
+	}
+	if bw.flags&FlagEntryTypes == 0 && e.Type != TypeFile {
+		return ErrIncompatibleEntry
+	}
+	if bw.flags&FlagMethods == 0 && e.Method != MethodDeflate {
+		return ErrIncompatibleEntry
+	}
+
+	err := bw.nextEntry()
+	if err != nil {
+		return err
+	}
+
+	err = bw.pad()
 	if err != nil {
 		bw.err = err
 		return err
 	}
 
+	r, err := src.rawReader(e)
+	if err != nil {
+		return err
+	}
+
+	c := *e
+	c.Name = meta.Name
+	c.Perm = meta.Perm
+	c.ModTime = meta.ModTime
+	c.UID, c.GID = meta.UID, meta.GID
+	c.Uname, c.Gname = meta.Uname, meta.Gname
+	c.Comment = meta.Comment
+	if c.Type == TypeSymlink || c.Type == TypeHardlink {
+		c.Linkname = meta.Linkname
+	}
+	c.index = bw.index
+
+	// Entries of compact archives have no checksum to verify, the copy
+	// gets the checksum of the data as read.
+	aw := newAdlerWriter(bw.w)
+	n, err := io.Copy(aw, r)
+	bw.index += uint64(n)
+	switch {
+	case err != nil:
+		bw.err = err
+	case uint64(n) != e.sizeCompressed:
+		bw.err = io.ErrUnexpectedEOF
+	case src.flags&FlagCompact != 0:
+		c.adler = aw.Sum32()
+	case aw.Sum32() != e.adler:
+		bw.err = ErrInvalidChecksum
+	}
+	if bw.err != nil {
+		return bw.err
+	}
+
+	bw.entries = append(bw.entries, c)
+	return nil
+}
+
+// nextEntry finalizes the current entry, if any, before another is added.
+func (bw *Writer) nextEntry() error {
+	if bw.err != ErrNoValidEntry {
+		err := bw.CloseEntry()
+		if err != nil {
+			return err
+		}
+	}
+	bw.err = nil
+
+	// The entry count is stored in 4 bytes.
+	if uint64(len(bw.entries)) >= math.MaxUint32 {
+		return ErrTooManyEntries
+	}
+	return nil
+}
+
+// CloseEntry finishes the current entry, so errors writing its data are
+// reported before the next entry is created. Create and Close finish an
+// open entry themselves.
+func (bw *Writer) CloseEntry() error {
+	if bw.err != nil {
+		return bw.err
+	}
+
+	err := bw.finalizeEntry()
+	if err != nil {
+		bw.err = err
+		return err
+	}
+	bw.err = ErrNoValidEntry
 	return nil
 }
 
+// Entries returns the entries written so far. The sizes of an entry are set
+// once it is closed.
+func (bw *Writer) Entries() []Entry {
+	return slices.Clone(bw.entries)
+}
+
 func (bw *Writer) SetPerms(perm uint16) error {
 	if bw.err != nil {
 		return bw.err
 	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
 
 	bw.entries[len(bw.entries)-1].Perm = perm
 	return nil
 }
 
+// SetModTime sets the modification time of the current entry, which is
+// stored with nanosecond precision. It is ignored unless the archive is
+// written with WithModTimes, and overridden by WithFixedModTime. Times
+// before 1678 or after 2261 are stored as none.
+func (bw *Writer) SetModTime(t time.Time) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
+
+	bw.entries[len(bw.entries)-1].ModTime = t
+	return nil
+}
+
+func (bw *Writer) SetLevel(level int) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
+
+	if bw.block != nil {
+		if level == bw.block.level {
+			return nil
+		}
+		err := bw.ownBlock()
+		if err != nil {
+			bw.err = err
+			return err
+		}
+	}
+	return bw.curr.SetLevel(level)
+}
+
 func (bw *Writer) Write(p []byte) (int, error) {
 	if bw.err != nil {
 		return 0, bw.err
 	}
+	if bw.curr == nil {
+		return 0, ErrNoValidEntry
+	}
+	if bw.entries[len(bw.entries)-1].Type != TypeFile {
+		return 0, ErrNoEntryData
+	}
 
 	n, err := bw.curr.Write(p)
 	if err != nil {
 		bw.err = err
 	}
+	if bw.content != nil {
+		bw.content.Write(p[:n])
+	}
+	if bw.block != nil {
+		bw.solidSum.Write(p[:n])
+	}
 	return n, err
 }
 
+// Close writes the table and footer. Closing a closed writer does nothing.
 func (bw *Writer) Close() error {
-	if bw.err != nil {
+	if bw.err == ErrWriteAfterClose {
+		return nil
+	}
+	if bw.err != nil && bw.err != ErrNoValidEntry {
 		return bw.err
 	}
 
-	adler, err := bw.writeTable()
+	if bw.block != nil {
+		err := bw.finalizeEntry()
+		if err == nil {
+			err = bw.closeBlock(len(bw.entries))
+		}
+		if err != nil {
+			bw.err = err
+			return err
+		}
+	}
+
+	if bw.table != nil {
+		err := bw.finalizeEntry()
+		if err != nil {
+			bw.err = err
+			return err
+		}
+		bw.w = bw.table
+	}
+
+	var meta uint64
+	if bw.flags&FlagMetadata != 0 {
+		err := bw.finalizeEntry()
+		if err != nil {
+			bw.err = err
+			return err
+		}
+
+		meta = bw.index
+		n, err := writeMetadata(bw.w, &bw.meta)
+		bw.index += uint64(n)
+		if err != nil {
+			bw.err = err
+			return err
+		}
+	}
+
+	adler, size, err := bw.writeTable()
 	if err != nil {
 		bw.err = err
 		return err
 	}
 
-	buf := make([]byte, footerSize)
+	fsize := footerSize
+	if bw.flags&FlagMetadata != 0 {
+		fsize += 8
+	}
+	if bw.flags&FlagJournal != 0 {
+		fsize += journalSize
+	}
+
+	buf := make([]byte, fsize)
 	wb := wBuf(buf)
 	wb.Uint64(bw.index)
+	wb.Uint64(size)
 	wb.Uint32(adler)
 	wb.Uint32(uint32(len(bw.entries)))
+	if bw.flags&FlagMetadata != 0 {
+		wb.Uint64(meta)
+	}
+	if bw.flags&FlagJournal != 0 {
+		wb.Uint64(bw.prev)
+		copy(wb, journalMarker)
+	}
 
 	_, err = bw.w.Write(buf)
 	if err != nil {
@@ -121,47 +704,252 @@ func (bw *Writer) Close() error {
 	return nil
 }
 
-func (bw *Writer) writeTable() (uint32, error) {
+// writeTable writes the entry table and returns its checksum and
+// uncompressed size.
+func (bw *Writer) writeTable() (uint32, uint64, error) {
 	err := bw.finalizeEntry()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	w, err := newDataWriter(bw.w)
-	if err != nil {
-		return 0, err
+	// An encrypted table is preceded by its nonce, which isn't part of
+	// its checksum.
+	var w *dataWriter
+	switch {
+	case bw.flags&FlagEncryptedTable != 0:
+		nonce, err := newNonce()
+		if err == nil {
+			_, err = bw.w.Write(nonce)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		method := MethodDeflate
+		if bw.flags&FlagRawTable != 0 {
+			method = MethodStored
+		}
+		w, err = newDataWriter(bw.w, method, flate.BestCompression, bw.aead, nonce)
+		if err != nil {
+			return 0, 0, err
+		}
+	case bw.flags&FlagRawTable != 0:
+		w = newRawWriter(bw.w)
+	default:
+		w, err = newDataWriter(bw.w, MethodDeflate, flate.BestCompression, nil, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var dirs map[string]uint32
+	if bw.flags&FlagNamePool != 0 {
+		dirs, err = bw.writePool(w)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
+	compact := bw.flags&FlagCompact != 0
 	for _, x := range bw.entries {
+		if bw.modTime != nil {
+			x.ModTime = *bw.modTime
+		}
+		dir, name := path.Split(x.Name)
+		if dirs == nil {
+			name = x.Name
+		}
+
 		buf := make([]byte, entrySize)
+		if compact {
+			buf = buf[:compactSize]
+		}
 		wb := wBuf(buf)
 		wb.Uint64(x.sizeCompressed)
 		wb.Uint64(x.Size)
 		wb.Uint64(x.index)
-		wb.Uint32(x.adler)
-		wb.Uint16(x.Perm)
-		wb.Uint16(uint16(len(x.Name)))
+		if !compact {
+			wb.Uint32(x.adler)
+			wb.Uint16(x.Perm)
+		}
+		wb.Uint16(uint16(len(name)))
 
 		_, err := w.Write(buf)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 
-		_, err = io.WriteString(w, x.Name)
+		_, err = io.WriteString(w, name)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
+		}
+
+		if bw.flags&FlagEncrypted != 0 {
+			_, err = w.Write(x.nonce)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagHashed != 0 {
+			_, err = w.Write(x.hash)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if dirs != nil {
+			buf := make([]byte, 4)
+			wb := wBuf(buf)
+			wb.Uint32(dirs[dir])
+			_, err = w.Write(buf)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagXattrs != 0 {
+			err = writeXattrs(w, x.Xattrs)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagModTime != 0 {
+			buf := make([]byte, 8)
+			wb := wBuf(buf)
+			wb.Uint64(uint64(unixNano(x.ModTime)))
+			_, err = w.Write(buf)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagEntryTypes != 0 {
+			err = writeType(w, &x)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagOwner != 0 {
+			err = writeOwner(w, &x)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagComments != 0 {
+			err = writeComment(w, &x)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagMethods != 0 {
+			_, err = w.Write([]byte{byte(x.Method)})
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if bw.flags&FlagSolid != 0 {
+			buf := make([]byte, 8)
+			wb := wBuf(buf)
+			wb.Uint64(x.solidOffset)
+			_, err = w.Write(buf)
+			if err != nil {
+				return 0, 0, err
+			}
 		}
 	}
 
 	err = w.Close()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	return w.Adler(), w.UncompressedCount(), nil
+}
+
+// unixNano returns t in nanoseconds since 1970, or 0 for the zero time and
+// times that don't fit.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() || t.Year() < 1678 || t.Year() > 2261 {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// writePool writes the directories of the entry names, including the
+// trailing slash, in order of first use and returns their numbers, which
+// start at 1. Names without directory use 0.
+func (bw *Writer) writePool(w io.Writer) (map[string]uint32, error) {
+	dirs := map[string]uint32{"": 0}
+	var pool []string
+	for _, x := range bw.entries {
+		dir, _ := path.Split(x.Name)
+		if _, ok := dirs[dir]; !ok {
+			pool = append(pool, dir)
+			dirs[dir] = uint32(len(pool))
+		}
+	}
+
+	buf := make([]byte, 4)
+	wb := wBuf(buf)
+	wb.Uint32(uint32(len(pool)))
+	_, err := w.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range pool {
+		buf := make([]byte, 2)
+		wb := wBuf(buf)
+		wb.Uint16(uint16(len(dir)))
+		_, err = w.Write(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.WriteString(w, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+func (bw *Writer) pad() error {
+	if bw.alignment <= 1 {
+		return nil
 	}
 
-	return w.Adler(), nil
+	align := uint64(bw.alignment)
+	n, err := bw.w.Write(make([]byte, (align-bw.index%align)%align))
+	bw.index += uint64(n)
+	return err
 }
 
 func (bw *Writer) finalizeEntry() error {
+	if bw.curr == nil {
+		return nil
+	}
+
+	// The data of entries of a solid block ends where the next starts.
+	if bw.block != nil {
+		i := len(bw.entries) - 1
+		bw.entries[i].Size = bw.block.UncompressedCount() -
+			bw.entries[i].solidOffset
+		bw.entries[i].adler = bw.solidSum.Sum32()
+		if bw.content != nil {
+			bw.entries[i].hash = bw.content.Sum(nil)
+			bw.content = nil
+		}
+		bw.curr = nil
+		return nil
+	}
+
 	if err := bw.curr.Close(); err != nil {
 		return err
 	}
@@ -172,11 +960,41 @@ func (bw *Writer) finalizeEntry() error {
 	bw.entries[i].sizeCompressed = bw.curr.CompressedCount()
 	bw.entries[i].adler = bw.curr.Adler()
 	bw.entries[i].Size = bw.curr.UncompressedCount()
+	bw.entries[i].Method = bw.curr.method
+	if bw.content != nil {
+		bw.entries[i].hash = bw.content.Sum(nil)
+		bw.content = nil
+	}
 
 	bw.curr = nil
 	return nil
 }
 
+// EstimateEntrySize returns the number of bytes data would add to an archive
+// when compressed at level, excluding the entry name.
+func EstimateEntrySize(data []byte, level int) (uint64, error) {
+	if !validLevel(level) {
+		return 0, ErrInvalidLevel
+	}
+
+	dw, err := newDataWriter(io.Discard, MethodDeflate, level, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = dw.Write(data)
+	if err != nil {
+		return 0, err
+	}
+
+	err = dw.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return dw.CompressedCount() + entrySize, nil
+}
+
 type adlerWriter struct {
 	w     io.Writer
 	adler hash.Hash32
@@ -191,8 +1009,8 @@ func (aw *adlerWriter) Sum32() uint32 {
 }
 
 func (aw *adlerWriter) Write(p []byte) (int, error) {
-	w := io.MultiWriter(aw.adler, aw.w)
-	n, err := w.Write(p)
+	n, err := aw.w.Write(p)
+	aw.adler.Write(p[:n])
 	return n, err
 }
 
@@ -218,29 +1036,188 @@ type dataWriter struct {
 	uncompCounter *countWriter
 	compCounter   *countWriter
 	adler         *adlerWriter
-	deflate       io.WriteCloser
+	gcm           *gcmWriter
+	comp          io.WriteCloser
+	method        Method
+	level         int
+
+	// With a ratio, the start of the data is held back in sample until
+	// it's known whether the data compresses, see WithAutoStore.
+	ratio   float64
+	sample  []byte
+	sampled bool
 }
 
-func newDataWriter(w io.Writer) (*dataWriter, error) {
+func validLevel(level int) bool {
+	return level >= flate.HuffmanOnly && level <= flate.BestCompression
+}
+
+// newDataWriter returns a writer compressing data to w with method. If
+// aead is not nil, the compressed data is encrypted with it.
+func newDataWriter(w io.Writer, method Method, level int, aead cipher.AEAD,
+	nonce []byte) (*dataWriter, error) {
 	var dw dataWriter
 	dw.adler = newAdlerWriter(w)
 	dw.compCounter = newCountWriter(dw.adler)
-	var err error
-	dw.deflate, err = flate.NewWriter(dw.compCounter, flate.BestCompression)
+	if aead != nil {
+		dw.gcm = newGCMWriter(dw.compCounter, aead, nonce)
+	}
+	err := dw.reset(method, level)
 	if err != nil {
 		return nil, err
 	}
-	dw.uncompCounter = newCountWriter(dw.deflate)
 	return &dw, nil
 }
 
+// newRawWriter returns a dataWriter that writes the data as it is.
+func newRawWriter(w io.Writer) *dataWriter {
+	var dw dataWriter
+	dw.adler = newAdlerWriter(w)
+	dw.compCounter = newCountWriter(dw.adler)
+	dw.comp = nopCloser{dw.compCounter}
+	dw.uncompCounter = newCountWriter(dw.comp)
+	return &dw
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (dw *dataWriter) sink() io.Writer {
+	if dw.gcm != nil {
+		return dw.gcm
+	}
+	return dw.compCounter
+}
+
+func (dw *dataWriter) SetLevel(level int) error {
+	if !validLevel(level) {
+		return ErrInvalidLevel
+	}
+
+	if dw.UncompressedCount() != 0 {
+		return ErrLevelAfterWrite
+	}
+	return dw.reset(dw.method, level)
+}
+
+func (dw *dataWriter) SetMethod(method Method) error {
+	if dw.UncompressedCount() != 0 {
+		return ErrMethodAfterWrite
+	}
+	return dw.reset(method, dw.level)
+}
+
+// reset replaces the compressor, before any data is written.
+func (dw *dataWriter) reset(method Method, level int) error {
+	comp, err := newCompressor(dw.sink(), method, level)
+	if err != nil {
+		return err
+	}
+	dw.comp = comp
+	dw.method, dw.level = method, level
+	dw.uncompCounter = newCountWriter(comp)
+	return nil
+}
+
+// storeCompressed writes the stream compressed with method read from r as
+// it is, instead of compressing data, and writes the decompressed data to
+// content.
+func (dw *dataWriter) storeCompressed(r io.Reader, method Method,
+	content io.Writer) error {
+	if dw.UncompressedCount() != 0 {
+		return ErrMethodAfterWrite
+	}
+	dw.sampled = true
+
+	dr, err := newDecompressor(io.TeeReader(r, dw.sink()), method)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(content, dr)
+	if err != nil {
+		return err
+	}
+
+	// Data after the stream would be stored without ever being read.
+	var b [1]byte
+	_, err = io.ReadFull(r, b[:])
+	if err == nil {
+		return ErrCorruptData
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	// The stream counts as the compressed data of n bytes.
+	dw.comp = nopCloser{dw.sink()}
+	dw.method = method
+	dw.uncompCounter = newCountWriter(dw.comp)
+	dw.uncompCounter.count = uint64(n)
+	return nil
+}
+
 func (dw *dataWriter) Write(p []byte) (int, error) {
-	n, err := dw.uncompCounter.Write(p)
-	return n, err
+	if dw.ratio == 0 || dw.sampled {
+		return dw.uncompCounter.Write(p)
+	}
+
+	n := min(len(p), sampleSize-len(dw.sample))
+	dw.sample = append(dw.sample, p[:n]...)
+	if len(dw.sample) < sampleSize {
+		return n, nil
+	}
+	err := dw.writeSample()
+	if err != nil {
+		return n, err
+	}
+	m, err := dw.uncompCounter.Write(p[n:])
+	return n + m, err
+}
+
+// writeSample stores the data as it is if the sample doesn't compress to
+// less than ratio of its size, and writes the sample.
+func (dw *dataWriter) writeSample() error {
+	dw.sampled = true
+	if dw.method != MethodStored && !compresses(dw.sample, dw.ratio) {
+		err := dw.reset(MethodStored, dw.level)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := dw.uncompCounter.Write(dw.sample)
+	dw.sample = nil
+	return err
+}
+
+// compresses reports whether data compresses to less than ratio of its size
+// with fast DEFLATE.
+func compresses(data []byte, ratio float64) bool {
+	cw := newCountWriter(io.Discard)
+	fw, _ := flate.NewWriter(cw, flate.BestSpeed)
+	fw.Write(data)
+	fw.Close()
+	return float64(cw.count) < ratio*float64(len(data))
 }
 
 func (dw *dataWriter) Close() error {
-	return dw.deflate.Close()
+	if dw.ratio != 0 && !dw.sampled {
+		err := dw.writeSample()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := dw.comp.Close()
+	if err != nil || dw.gcm == nil {
+		return err
+	}
+	return dw.gcm.Close()
 }
 
 func (dw *dataWriter) CompressedCount() uint64 {
@@ -248,7 +1225,7 @@ func (dw *dataWriter) CompressedCount() uint64 {
 }
 
 func (dw *dataWriter) UncompressedCount() uint64 {
-	return dw.uncompCounter.count
+	return dw.uncompCounter.count + uint64(len(dw.sample))
 }
 
 func (dw *dataWriter) Adler() uint32 {
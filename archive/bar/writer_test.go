@@ -0,0 +1,964 @@
+package bar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFile is an entry written by writeArchive.
+type testFile struct {
+	name string
+	data string
+}
+
+// writeArchive writes files to a new archive and returns it.
+func writeArchive(t testing.TB, files []testFile, opts ...WriterOption) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		err = bw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = bw.Write([]byte(f.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// openArchive opens the archive b.
+func openArchive(t testing.TB, b []byte, opts ...ReaderOption) *Reader {
+	t.Helper()
+
+	br, err := NewReader(bytes.NewReader(b), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return br
+}
+
+// checkFiles fails unless br holds exactly files.
+func checkFiles(t testing.TB, br *Reader, files []testFile) {
+	t.Helper()
+
+	if len(br.Entries) != len(files) {
+		t.Fatalf("got %d entries, want %d", len(br.Entries), len(files))
+	}
+	for _, f := range files {
+		data, err := br.ReadFile(f.name)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if string(data) != f.data {
+			t.Errorf("%s: got %q, want %q", f.name, data, f.data)
+		}
+	}
+}
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func TestCreateMissingKey(t *testing.T) {
+	files := []testFile{{"a.txt", "alpha"}}
+	b := writeArchive(t, files, WithKey(testKey))
+
+	// Without the key, the settings of br enable encryption but there
+	// is no key to encrypt new entries with.
+	br := openArchive(t, b)
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithSettingsFrom(br))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bw.Create("b.txt")
+	if err != ErrMissingKey {
+		t.Fatalf("Create: got %v, want %v", err, ErrMissingKey)
+	}
+	err = bw.Create("c.txt")
+	if err != ErrMissingKey {
+		t.Errorf("second Create: got %v, want %v", err, ErrMissingKey)
+	}
+	err = bw.Close()
+	if err != ErrMissingKey {
+		t.Errorf("Close: got %v, want %v", err, ErrMissingKey)
+	}
+}
+
+func TestFixedModTime(t *testing.T) {
+	fixed := time.Unix(1700000000, 0)
+	write := func(mtime time.Time) []byte {
+		var buf bytes.Buffer
+		bw, err := NewWriter(&buf, WithFixedModTime(fixed),
+			WithEntryTypes(), WithMetadata("user", fixed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a.txt", "dir/b.txt"} {
+			err = bw.Create(name)
+			if err == nil {
+				_, err = bw.Write([]byte(name))
+			}
+			if err == nil {
+				err = bw.SetModTime(mtime)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = bw.CreateSymlink("link", "a.txt")
+		if err == nil {
+			err = bw.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	a := write(time.Now())
+	b := write(time.Now().Add(time.Hour))
+	if !bytes.Equal(a, b) {
+		t.Error("archives differ")
+	}
+
+	br := openArchive(t, a)
+	for _, e := range br.Entries {
+		if !e.ModTime.Equal(fixed) {
+			t.Errorf("%s: mtime %v, want %v", e.Name, e.ModTime, fixed)
+		}
+	}
+
+	// Copied entries get the fixed time too.
+	var buf bytes.Buffer
+	other := fixed.Add(time.Minute)
+	bw, err := NewWriter(&buf, WithSettingsFrom(br), WithFixedModTime(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.CopyEntry(br, &br.Entries[0])
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := openArchive(t, buf.Bytes()).Entries[0]; !e.ModTime.Equal(other) {
+		t.Errorf("copy: mtime %v, want %v", e.ModTime, other)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	data := benchData(64 << 10)
+	tests := []struct {
+		name  string
+		level int
+	}{
+		{"best", flate.BestCompression},
+		{"default", flate.DefaultCompression},
+		{"speed", flate.BestSpeed},
+		{"huffman", flate.HuffmanOnly},
+		{"stored", flate.NoCompression},
+	}
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		err = bw.Create(tt.name)
+		if err == nil {
+			err = bw.SetLevel(tt.level)
+		}
+		if err == nil {
+			_, err = bw.Write(data)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+	err = bw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := openArchive(t, buf.Bytes())
+	sizes := make(map[string]uint64)
+	for _, tt := range tests {
+		got, err := br.ReadFile(tt.name)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: wrong data, %v", tt.name, err)
+		}
+		e, _ := br.Lookup(tt.name)
+		sizes[tt.name] = e.CompressedSize()
+	}
+
+	// Each level compresses at least as well as the faster ones, level 0
+	// only frames the data.
+	for _, pair := range [][2]string{
+		{"best", "speed"}, {"speed", "huffman"}, {"huffman", "stored"},
+	} {
+		if sizes[pair[0]] > sizes[pair[1]] {
+			t.Errorf("%s: %d bytes, more than %s: %d bytes", pair[0],
+				sizes[pair[0]], pair[1], sizes[pair[1]])
+		}
+	}
+	if sizes["stored"] <= uint64(len(data)) {
+		t.Errorf("stored: %d bytes for %d", sizes["stored"], len(data))
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	files := []testFile{{"data", string(benchData(64 << 10))}}
+	tests := []struct {
+		name  string
+		level int
+		want  error
+	}{
+		{"best", flate.BestCompression, nil},
+		{"speed", flate.BestSpeed, nil},
+		{"huffman", flate.HuffmanOnly, nil},
+		{"stored", flate.NoCompression, nil},
+		{"too low", flate.HuffmanOnly - 1, ErrInvalidLevel},
+		{"too high", flate.BestCompression + 1, ErrInvalidLevel},
+	}
+
+	sizes := make(map[string]uint64)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWriter(io.Discard, WithCompressionLevel(tt.level))
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			b := writeArchive(t, files, WithCompressionLevel(tt.level))
+			br := openArchive(t, b)
+			checkFiles(t, br, files)
+			sizes[tt.name] = br.Entries[0].CompressedSize()
+		})
+	}
+
+	// The default is the best compression, and the option overrides the
+	// level of NewWriterLevel.
+	b := writeArchive(t, files)
+	if got := openArchive(t, b).Entries[0].CompressedSize(); got != sizes["best"] {
+		t.Errorf("default: %d bytes, want %d", got, sizes["best"])
+	}
+	var buf bytes.Buffer
+	bw, err := NewWriterLevel(&buf, flate.BestCompression,
+		WithCompressionLevel(flate.BestSpeed))
+	if err == nil {
+		err = bw.Create("data")
+	}
+	if err == nil {
+		_, err = bw.Write([]byte(files[0].data))
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := openArchive(t, buf.Bytes()).Entries[0].CompressedSize(); got != sizes["speed"] {
+		t.Errorf("NewWriterLevel: %d bytes, want %d", got, sizes["speed"])
+	}
+	if sizes["best"] > sizes["speed"] || sizes["speed"] > sizes["huffman"] ||
+		sizes["huffman"] > sizes["stored"] {
+		t.Errorf("sizes for best, speed, huffman and stored: %d, %d, %d, %d",
+			sizes["best"], sizes["speed"], sizes["huffman"], sizes["stored"])
+	}
+}
+
+func TestSetLevelErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		write bool
+		level int
+		want  error
+	}{
+		{"too low", false, flate.HuffmanOnly - 1, ErrInvalidLevel},
+		{"too high", false, flate.BestCompression + 1, ErrInvalidLevel},
+		{"after write", true, flate.BestSpeed, ErrLevelAfterWrite},
+		{"before write", false, flate.BestSpeed, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bw, err := NewWriter(io.Discard)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err == nil && tt.write {
+				_, err = bw.Write([]byte("alpha"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.SetLevel(tt.level)
+			if err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateEntrySize(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		level int
+		want  error
+	}{
+		{"empty", nil, flate.DefaultCompression, nil},
+		{"short", []byte("hello"), flate.BestCompression, nil},
+		{"text", benchData(100 << 10), flate.BestSpeed, nil},
+		{"text best", benchData(100 << 10), flate.BestCompression, nil},
+		{"stored", benchData(100 << 10), flate.NoCompression, nil},
+		{"huffman", benchData(100 << 10), flate.HuffmanOnly, nil},
+		{"invalid level", nil, 10, ErrInvalidLevel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := EstimateEntrySize(tt.data, tt.level)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			files := []testFile{{"data", string(tt.data)}}
+			br := openArchive(t, writeArchive(t, files,
+				WithCompressionLevel(tt.level)))
+			if want := br.Entries[0].CompressedSize() + entrySize; size != want {
+				t.Errorf("estimated %d bytes, want %d", size, want)
+			}
+		})
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"empty", ""},
+		{"data", string(benchData(10 << 10))},
+		{"b.txt", "beta"},
+	}
+	tests := []struct {
+		name  string
+		align uint32
+		opts  []WriterOption
+		ropts []ReaderOption
+	}{
+		{"4k", 4096, nil, nil},
+		{"512", 512, nil, nil},
+		{"odd", 3, nil, nil},
+		{"stored", 4096, []WriterOption{WithMethod(MethodStored)}, nil},
+		{"encrypted", 4096, []WriterOption{WithKey(testKey)},
+			[]ReaderOption{WithDecryptionKey(testKey)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append(tt.opts, WithAlignment(tt.align))
+			br := openArchive(t, writeArchive(t, files, opts...), tt.ropts...)
+			if br.Flags()&FlagAligned == 0 {
+				t.Errorf("flags %#x without FlagAligned", br.Flags())
+			}
+			checkFiles(t, br, files)
+			for _, e := range br.Entries {
+				if e.index%uint64(tt.align) != 0 {
+					t.Errorf("%s at %d", e.Name, e.index)
+				}
+			}
+		})
+	}
+
+	_, err := NewWriter(io.Discard, WithAlignment(0))
+	if err != ErrInvalidAlignment {
+		t.Errorf("got %v, want %v", err, ErrInvalidAlignment)
+	}
+}
+
+// failingWriter fails writes past its first n bytes.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+var errWrite = errors.New("write failed")
+
+func TestCloseEntry(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"empty", ""},
+		{"data", string(benchData(100 << 10))},
+	}
+	tests := []struct {
+		name string
+		opts []WriterOption
+	}{
+		{"deflate", nil},
+		{"stored", []WriterOption{WithMethod(MethodStored)}},
+		{"solid", []WriterOption{WithSolid(DefaultSolidSize)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, f := range files {
+				err = bw.Create(f.name)
+				if err == nil {
+					_, err = bw.Write([]byte(f.data))
+				}
+				if err == nil {
+					err = bw.CloseEntry()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				entries := bw.Entries()
+				if len(entries) != i+1 {
+					t.Fatalf("got %d entries, want %d", len(entries), i+1)
+				}
+				if e := entries[i]; e.Size != uint64(len(f.data)) {
+					t.Errorf("%s: size %d, want %d", f.name, e.Size,
+						len(f.data))
+				}
+
+				// Nothing is open until the next Create.
+				_, err = bw.Write([]byte("more"))
+				if err != ErrNoValidEntry {
+					t.Errorf("write after CloseEntry: got %v, want %v", err,
+						ErrNoValidEntry)
+				}
+				err = bw.CloseEntry()
+				if err != ErrNoValidEntry {
+					t.Errorf("second CloseEntry: got %v, want %v", err,
+						ErrNoValidEntry)
+				}
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes())
+			checkFiles(t, br, files)
+			for i, e := range bw.Entries() {
+				if e.Size != br.Entries[i].Size {
+					t.Errorf("%s: size %d, read %d", e.Name, e.Size,
+						br.Entries[i].Size)
+				}
+				if tt.name != "solid" &&
+					e.CompressedSize() != br.Entries[i].CompressedSize() {
+					t.Errorf("%s: compressed size %d, read %d", e.Name,
+						e.CompressedSize(), br.Entries[i].CompressedSize())
+				}
+			}
+		})
+	}
+
+	// Failed writes of the end of the data are reported by CloseEntry.
+	bw, err := NewWriter(&failingWriter{headerSize + 4})
+	if err == nil {
+		err = bw.Create("a.txt")
+	}
+	if err == nil {
+		_, err = bw.Write([]byte("alpha"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.CloseEntry()
+	if err != errWrite {
+		t.Errorf("got %v, want %v", err, errWrite)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []WriterOption
+	}{
+		{"default", nil},
+		{"solid", []WriterOption{WithSolid(1 << 10)}},
+		{"encrypted table", []WriterOption{WithKey(testKey), WithTableEncryption()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err == nil {
+				_, err = bw.Write([]byte("alpha"))
+			}
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := buf.Len()
+
+			err = bw.Close()
+			if err != nil {
+				t.Errorf("second Close: got %v, want nil", err)
+			}
+			if buf.Len() != size {
+				t.Errorf("second Close wrote %d bytes", buf.Len()-size)
+			}
+			err = bw.Create("b.txt")
+			if err != ErrWriteAfterClose {
+				t.Errorf("Create: got %v, want %v", err, ErrWriteAfterClose)
+			}
+			_, err = bw.Write([]byte("beta"))
+			if err != ErrWriteAfterClose {
+				t.Errorf("Write: got %v, want %v", err, ErrWriteAfterClose)
+			}
+		})
+	}
+
+	// A failed Close keeps failing.
+	bw, err := NewWriter(&failingWriter{headerSize + 4})
+	if err == nil {
+		err = bw.Create("a.txt")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = bw.Close()
+		if err != errWrite {
+			t.Errorf("Close %d: got %v, want %v", i+1, err, errWrite)
+		}
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	files := []testFile{{"a.txt", "alpha"}}
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"backup", nil},
+		{"", nil},
+		{strings.Repeat("n", math.MaxUint16), nil},
+		{strings.Repeat("n", math.MaxUint16+1), ErrNameTooLong},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		_, err := NewWriter(&buf, WithArchiveName(tt.name))
+		if err != tt.want {
+			t.Errorf("%d bytes: got %v, want %v", len(tt.name), err, tt.want)
+		}
+		if err != nil {
+			continue
+		}
+		br := openArchive(t, writeArchive(t, files, WithArchiveName(tt.name)))
+		checkFiles(t, br, files)
+		if br.ArchiveName() != tt.name {
+			t.Errorf("got %d bytes, want %d", len(br.ArchiveName()),
+				len(tt.name))
+		}
+	}
+}
+
+func TestProducer(t *testing.T) {
+	files := []testFile{{"a.txt", "alpha"}}
+	tests := []struct {
+		name     string
+		producer string
+		opts     []WriterOption
+		want     error
+	}{
+		{"version", "bar-go 1.0", nil, nil},
+		{"empty", "", nil, nil},
+		{"with name", "bar-go 1.0", []WriterOption{WithArchiveName("backup")}, nil},
+		{"entry types", "bar-go 1.0", []WriterOption{WithEntryTypes()}, nil},
+		{"max", strings.Repeat("p", math.MaxUint16), nil, nil},
+		{"too long", strings.Repeat("p", math.MaxUint16+1), nil,
+			ErrProducerTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]WriterOption{WithProducer(tt.producer)}, tt.opts...)
+			var buf bytes.Buffer
+			_, err := NewWriter(&buf, opts...)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			br := openArchive(t, writeArchive(t, files, opts...))
+			checkFiles(t, br, files)
+			if br.Producer() != tt.producer {
+				t.Errorf("got %d bytes, want %d", len(br.Producer()),
+					len(tt.producer))
+			}
+			if br.Flags()&FlagProducer == 0 {
+				t.Errorf("flags %v, want %v", br.Flags(), FlagProducer)
+			}
+		})
+	}
+
+	br := openArchive(t, writeArchive(t, files))
+	if br.Producer() != "" {
+		t.Errorf("got %q, want no producer", br.Producer())
+	}
+}
+
+// gapReaderAt reads b with gap zero bytes inserted at off.
+type gapReaderAt struct {
+	b        []byte
+	off, gap int64
+}
+
+func (r gapReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		switch pos := off + int64(i); {
+		case pos < r.off:
+			p[i] = r.b[pos]
+		case pos < r.off+r.gap:
+			p[i] = 0
+		case pos-r.gap < int64(len(r.b)):
+			p[i] = r.b[pos-r.gap]
+		default:
+			return i, io.EOF
+		}
+	}
+	return len(p), nil
+}
+
+func TestLargeOffsets(t *testing.T) {
+	files := []testFile{
+		{"a.txt", "alpha"},
+		{"data", string(benchData(100 << 10))},
+	}
+
+	// write counts gap bytes as written before the entries, like entries
+	// too large to keep in memory would be, and returns the archive and
+	// the offset of the gap.
+	write := func(gap int64, opts []WriterOption) ([]byte, int64) {
+		var buf bytes.Buffer
+		bw, err := NewWriter(&buf, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off := int64(buf.Len())
+		bw.index += uint64(gap)
+		for _, f := range files {
+			err = bw.Create(f.name)
+			if err == nil {
+				_, err = bw.Write([]byte(f.data))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = bw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), off
+	}
+
+	tests := []struct {
+		name string
+		gap  int64
+		opts []WriterOption
+	}{
+		{"4 GiB", 1 << 32, nil},
+		{"past 4 GiB", 5<<30 + 3, nil},
+		{"past 4 GiB stored", 5<<30 + 3, []WriterOption{WithMethod(MethodStored)}},
+		{"2^62", 1 << 62, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			small, _ := write(0, tt.opts)
+			b, off := write(tt.gap, tt.opts)
+			table := binary.LittleEndian.Uint64(b[len(b)-footerSize:])
+			want := binary.LittleEndian.Uint64(small[len(small)-footerSize:]) +
+				uint64(tt.gap)
+			if table != want {
+				t.Errorf("table at %d, want %d", table, want)
+			}
+
+			br, err := NewReaderAt(gapReaderAt{b, off, tt.gap},
+				int64(len(b))+tt.gap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, br, files)
+			for i, e := range br.Entries {
+				if e.index < uint64(tt.gap) {
+					t.Errorf("entry %d at %d, want past %d", i, e.index, tt.gap)
+				}
+			}
+		})
+	}
+}
+
+func TestNameValidator(t *testing.T) {
+	errUpper := errors.New("uppercase name")
+	lower := func(name string) error {
+		if strings.ToLower(name) != name {
+			return errUpper
+		}
+		return ValidateName(name)
+	}
+
+	tests := []struct {
+		name     string
+		validate func(string) error // nil for the default
+		want     error
+	}{
+		{"a.txt", lower, nil},
+		{"dir/b.txt", lower, nil},
+		{"A.txt", lower, errUpper},
+		{"dir/B.txt", lower, errUpper},
+		{"../a.txt", lower, ErrPathIsNotSimple},
+		{"A.txt", nil, nil},
+		{"../a.txt", nil, ErrPathIsNotSimple},
+		{`dir\a.txt`, nil, ErrPathIsNotSimple},
+		{"/a.txt", nil, ErrPathIsNotSimple},
+		{"..a.txt", func(string) error { return nil }, nil},
+	}
+
+	for _, tt := range tests {
+		var opts []WriterOption
+		if tt.validate != nil {
+			opts = append(opts, WithNameValidator(tt.validate))
+		}
+		var buf bytes.Buffer
+		bw, err := NewWriter(&buf, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bw.Create(tt.name)
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		if err != nil {
+			continue
+		}
+		err = bw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, openArchive(t, buf.Bytes()), []testFile{{tt.name, ""}})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 100; i++ {
+		files = append(files, testFile{fmt.Sprintf("f%03d", i), fmt.Sprint(i)})
+	}
+	tests := []struct {
+		name string
+		opts []WriterOption
+	}{
+		{"deflate", nil},
+		{"stored", []WriterOption{WithMethod(MethodStored)}},
+		{"solid", []WriterOption{WithSolid(DefaultSolidSize)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append(tt.opts, WithRawTable())
+			plain := writeArchive(t, files, opts...)
+			compact := writeArchive(t, files, append(opts, WithCompact())...)
+
+			br := openArchive(t, compact)
+			checkFiles(t, br, files)
+
+			// The raw tables differ by the checksum and perms of every entry.
+			if d := len(plain) - len(compact); d != len(files)*(entrySize-compactSize) {
+				t.Errorf("%d bytes smaller, want %d", d,
+					len(files)*(entrySize-compactSize))
+			}
+			if got := openArchive(t, plain).TableSize() - br.TableSize(); got !=
+				uint64(len(files)*(entrySize-compactSize)) {
+				t.Errorf("table %d bytes smaller", got)
+			}
+		})
+	}
+
+	// Perms aren't stored and changed data isn't noticed.
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithCompact(), WithMethod(MethodStored))
+	if err == nil {
+		err = bw.Create("a.txt")
+	}
+	if err == nil {
+		err = bw.SetPerms(0755)
+	}
+	if err == nil {
+		_, err = bw.Write([]byte("alpha"))
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	b[bytes.Index(b, []byte("alpha"))] = 'A'
+	if perm := openArchive(t, b).Entries[0].Perm; perm != 0644 {
+		t.Errorf("perm %o, want 644", perm)
+	}
+	data, err := openArchive(t, b).ReadFile("a.txt")
+	if err != nil || string(data) != "Alpha" {
+		t.Errorf("got %q, %v, want %q", data, err, "Alpha")
+	}
+}
+
+func TestNamePool(t *testing.T) {
+	var files []testFile
+	for i := 0; i < 200; i++ {
+		dir := fmt.Sprintf("src/github.com/example/project/internal/pkg%d", i%4)
+		files = append(files, testFile{fmt.Sprintf("%s/file%03d.go", dir, i),
+			fmt.Sprint(i)})
+	}
+	files = append(files, testFile{"README", "readme"})
+
+	tests := []struct {
+		name string
+		opts []WriterOption
+	}{
+		{"raw table", []WriterOption{WithRawTable()}},
+		{"deflated table", nil},
+		{"compact", []WriterOption{WithRawTable(), WithCompact()}},
+		{"solid", []WriterOption{WithRawTable(), WithSolid(DefaultSolidSize)}},
+		{"encrypted table", []WriterOption{WithRawTable(),
+			WithKey(testKey), WithTableEncryption()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ropts []ReaderOption
+			if tt.name == "encrypted table" {
+				ropts = append(ropts, WithDecryptionKey(testKey))
+			}
+			plain := writeArchive(t, files, tt.opts...)
+			pooled := writeArchive(t, files, append(tt.opts, WithNamePool())...)
+
+			br := openArchive(t, pooled, ropts...)
+			checkFiles(t, br, files)
+			if br.Flags()&FlagNamePool == 0 {
+				t.Error("no name pool")
+			}
+
+			// Every name but one has a directory of more than 40 bytes.
+			plainSize := openArchive(t, plain, ropts...).TableSize()
+			if br.TableSize()+uint64(len(files)-1)*40 > plainSize {
+				t.Errorf("table of %d bytes, %d without pool", br.TableSize(),
+					plainSize)
+			}
+			if len(pooled) >= len(plain) {
+				t.Errorf("archive of %d bytes, %d without pool", len(pooled),
+					len(plain))
+			}
+		})
+	}
+}
+
+func TestSetModTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		mtime time.Time
+		opts  []WriterOption
+		want  time.Time
+	}{
+		{"nanoseconds", time.Unix(1700000000, 123456789),
+			[]WriterOption{WithModTimes()}, time.Unix(1700000000, 123456789)},
+		{"before 1970", time.Date(1960, 1, 2, 3, 4, 5, 6, time.UTC),
+			[]WriterOption{WithModTimes()}, time.Date(1960, 1, 2, 3, 4, 5, 6, time.UTC)},
+		{"none", time.Time{}, []WriterOption{WithModTimes()}, time.Time{}},
+		{"too early", time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC),
+			[]WriterOption{WithModTimes()}, time.Time{}},
+		{"too late", time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC),
+			[]WriterOption{WithModTimes()}, time.Time{}},
+		{"compact", time.Unix(1700000000, 0),
+			[]WriterOption{WithModTimes(), WithCompact()}, time.Unix(1700000000, 0)},
+		{"not stored", time.Unix(1700000000, 0), nil, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err == nil {
+				err = bw.SetModTime(tt.mtime)
+			}
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := openArchive(t, buf.Bytes()).Entries[0].ModTime
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	bw, err := NewWriter(io.Discard, WithModTimes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.SetModTime(time.Now())
+	if err != ErrNoValidEntry {
+		t.Errorf("no entry: got %v, want %v", err, ErrNoValidEntry)
+	}
+}
@@ -0,0 +1,128 @@
+package bar
+
+import (
+	"errors"
+	"io"
+	"math"
+	"slices"
+)
+
+var (
+	ErrNoXattrs      = errors.New("Archive doesn't store extended attributes.")
+	ErrInvalidXattrs = errors.New("Invalid extended attributes.")
+)
+
+// maxXattrSize is the largest value of an extended attribute, like on
+// Linux.
+const maxXattrSize = 64 << 10
+
+// WithXattrs stores extended attributes with the entries, see
+// Writer.SetXattrs.
+func WithXattrs() WriterOption {
+	return func(bw *Writer) error {
+		bw.flags |= FlagXattrs
+		return nil
+	}
+}
+
+// SetXattrs sets the extended attributes of the current entry, like the
+// SELinux label in "security.selinux". The archive must be written with
+// WithXattrs.
+func (bw *Writer) SetXattrs(attrs map[string][]byte) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.curr == nil {
+		return ErrNoValidEntry
+	}
+	if bw.flags&FlagXattrs == 0 {
+		return ErrNoXattrs
+	}
+
+	if len(attrs) > math.MaxUint16 {
+		return ErrInvalidXattrs
+	}
+	for name, value := range attrs {
+		if name == "" || len(name) > math.MaxUint16 || len(value) > maxXattrSize {
+			return ErrInvalidXattrs
+		}
+	}
+	bw.entries[len(bw.entries)-1].Xattrs = attrs
+	return nil
+}
+
+// writeXattrs writes the count of attrs, then the name and value of each
+// in order of their names.
+func writeXattrs(w io.Writer, attrs map[string][]byte) error {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	buf := make([]byte, 2)
+	wb := wBuf(buf)
+	wb.Uint16(uint16(len(names)))
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		value := attrs[name]
+		buf := make([]byte, 2+len(name)+4)
+		wb := wBuf(buf)
+		wb.Uint16(uint16(len(name)))
+		wb = wb[copy(wb, name):]
+		wb.Uint32(uint32(len(value)))
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readXattrs(r io.Reader) (map[string][]byte, error) {
+	buf := make([]byte, 4)
+	err := readFull(r, buf[:2])
+	if err != nil {
+		return nil, err
+	}
+	rb := rBuf(buf)
+	count := rb.Uint16()
+	if count == 0 {
+		return nil, nil
+	}
+
+	attrs := make(map[string][]byte)
+	for i := 0; i < int(count); i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		err = readFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		rb := rBuf(buf)
+		size := rb.Uint32()
+		if size > maxXattrSize {
+			return nil, ErrCorruptData
+		}
+
+		value := make([]byte, size)
+		err = readFull(r, value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package bar
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// ReadXattrs returns the extended attributes of the file name, or none if
+// its file system doesn't support them.
+func ReadXattrs(name string) (map[string][]byte, error) {
+	list, err := getList(func(b []byte) (int, error) {
+		return syscall.Listxattr(name, b)
+	})
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+
+	var attrs map[string][]byte
+	for len(list) > 0 {
+		i := 0
+		for i < len(list) && list[i] != 0 {
+			i++
+		}
+		attr := string(list[:i])
+		list = list[min(i+1, len(list)):]
+
+		value, err := getList(func(b []byte) (int, error) {
+			return syscall.Getxattr(name, attr, b)
+		})
+		if errors.Is(err, syscall.ENODATA) {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+
+		if attrs == nil {
+			attrs = make(map[string][]byte)
+		}
+		attrs[attr] = value
+	}
+	return attrs, nil
+}
+
+// getList calls get with a buffer of the size it returns for nil, until the
+// data didn't grow in between.
+func getList(get func(b []byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := get(nil)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n)
+		n, err = get(b)
+		if err != syscall.ERANGE {
+			return b[:n], err
+		}
+	}
+}
+
+func setXattrs(name string, attrs map[string][]byte) error {
+	for attr, value := range attrs {
+		err := syscall.Setxattr(name, attr, value, 0)
+		if err != nil {
+			return &fs.PathError{Op: "setxattr", Path: name, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package bar
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "a.txt")
+	err := os.WriteFile(src, []byte("alpha"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Setxattr(src, "user.comment", []byte("hello"), 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("file system doesn't support user xattrs")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := ReadXattrs(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(attrs["user.comment"]) != "hello" {
+		t.Fatalf("read %q, want %q", attrs["user.comment"], "hello")
+	}
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, WithXattrs())
+	if err == nil {
+		err = bw.Create("a.txt")
+	}
+	if err == nil {
+		err = bw.SetXattrs(attrs)
+	}
+	if err == nil {
+		_, err = bw.Write([]byte("alpha"))
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		xattrs bool
+		want   string
+	}{
+		{"restored", true, "hello"},
+		{"ignored", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := openArchive(t, buf.Bytes()).ExtractAll(dir,
+				ExtractOptions{Xattrs: tt.xattrs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadXattrs(filepath.Join(dir, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got["user.comment"]) != tt.want {
+				t.Errorf("got %q, want %q", got["user.comment"], tt.want)
+			}
+		})
+	}
+}
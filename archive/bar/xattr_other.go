@@ -0,0 +1,18 @@
+//go:build !linux
+
+package bar
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// ReadXattrs returns the extended attributes of the file name. They aren't
+// supported on this platform, so there are none.
+func ReadXattrs(name string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattrs(name string, attrs map[string][]byte) error {
+	return &fs.PathError{Op: "setxattr", Path: name, Err: errors.ErrUnsupported}
+}
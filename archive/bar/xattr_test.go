@@ -0,0 +1,76 @@
+package bar
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetXattrs(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs map[string][]byte
+		opts  []WriterOption
+		want  error
+	}{
+		{"none", nil, []WriterOption{WithXattrs()}, nil},
+		{"user", map[string][]byte{"user.comment": []byte("hello")},
+			[]WriterOption{WithXattrs()}, nil},
+		{"several", map[string][]byte{
+			"user.b":           {0, 1, 2, 0xff},
+			"user.a":           {},
+			"security.selinux": []byte("system_u:object_r:user_home_t:s0\x00"),
+		}, []WriterOption{WithXattrs()}, nil},
+		{"compact", map[string][]byte{"user.comment": []byte("hello")},
+			[]WriterOption{WithXattrs(), WithCompact()}, nil},
+		{"large", map[string][]byte{"user.big": bytes.Repeat([]byte{1}, maxXattrSize)},
+			[]WriterOption{WithXattrs()}, nil},
+		{"not enabled", map[string][]byte{"user.comment": []byte("hello")}, nil,
+			ErrNoXattrs},
+		{"empty name", map[string][]byte{"": []byte("hello")},
+			[]WriterOption{WithXattrs()}, ErrInvalidXattrs},
+		{"too large", map[string][]byte{
+			"user.big": bytes.Repeat([]byte{1}, maxXattrSize+1),
+		}, []WriterOption{WithXattrs()}, ErrInvalidXattrs},
+		{"long name", map[string][]byte{strings.Repeat("n", 1<<16): nil},
+			[]WriterOption{WithXattrs()}, ErrInvalidXattrs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			bw, err := NewWriter(&buf, tt.opts...)
+			if err == nil {
+				err = bw.Create("a.txt")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bw.SetXattrs(tt.attrs)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			err = bw.Create("b.txt")
+			if err == nil {
+				err = bw.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := openArchive(t, buf.Bytes())
+			got := br.Entries[0].Xattrs
+			if len(got) != len(tt.attrs) ||
+				(len(got) > 0 && !reflect.DeepEqual(got, tt.attrs)) {
+				t.Errorf("got %v, want %v", got, tt.attrs)
+			}
+			if br.Entries[1].Xattrs != nil {
+				t.Errorf("b.txt: got %v, want none", br.Entries[1].Xattrs)
+			}
+		})
+	}
+}
@@ -2,6 +2,14 @@ package main
 
 import (
 	"bar/archive/bar"
+	"bufio"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,287 +17,1867 @@ import (
 	"io/fs"
 	"log"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 )
 
 var (
 	versionFlag  = flag.Bool("v", false, "Print version.")
 	listFlag     = flag.Bool("l", false, "List names.")
+	namesFlag    = flag.Bool("names", false, "Print names, one per line.")
+	names0Flag   = flag.Bool("names0", false, "Print names, NUL-delimited.")
+	offsetsFlag  = flag.Bool("offsets", false, "Print entry offsets as JSON.")
+	layoutFlag   = flag.Bool("layout", false, "Print offset, length and method of entry data.")
+	totalFlag    = flag.Bool("total", false, "Print totals after the listing.")
+	sortFlag     = flag.String("sort", "", "Sort listing by name, size, ratio or mtime.")
+	reverseFlag  = flag.Bool("r", false, "Reverse the sort order.")
 	extractFlag  = flag.Bool("x", false, "Extract files.")
+	testFlag     = flag.Bool("t", false, "Test archive integrity.")
+	fsckFlag     = flag.Bool("fsck", false, "Check archive consistency and report every problem.")
+	recompFlag   = flag.Bool("recompress", false, "Recompress an archive.")
+	diffFlag     = flag.Bool("diff", false, "Compare the files of two archives.")
+	deleteFlag   = flag.String("delete", "", "Delete files matching a pattern.")
+	ignoreFlag   = flag.Bool("ignore-missing", false, "Ignore a pattern matching no file.")
 	overrideFlag = flag.Bool("o", false, "Override file.")
+	keepFlag     = flag.Bool("k", false, "Keep existing files when extracting.")
+	renameFlag   = flag.Bool("rename", false, "Extract to a new name if a file exists.")
 	nameFlag     = flag.String("n", "", "Name of the file.")
+	levelFlag    = flag.Int("c", flate.BestCompression, "Compression level.")
+	zlevelFlag   = flag.Int("z", flate.BestCompression, "Compression level, an alias of '-c'.")
+	methodFlag   = flag.String("method", "deflate", "Compression method.")
+	fastFlag     = flag.Bool("fast", false, "Compress fast with LZ4, like '-method lz4'.")
+	storeFlag    = flag.Bool("store", false, "Don't compress, like '-method stored'.")
+	autoFlag     = flag.Bool("auto-store", false, "Don't compress files that barely compress.")
+	solidFlag    = flag.Bool("solid", false, "Compress files together in solid blocks.")
+	alignFlag    = flag.Uint("align", 0, "Align entry data to a multiple of bytes.")
+	signFlag     = flag.String("sign", "", "Sign archive with a private key file.")
+	verifyFlag   = flag.String("verify", "", "Verify archive with a public key file.")
+	passwordFlag = flag.Bool("password", false, "Encrypt or decrypt with a password.")
+	encTableFlag = flag.Bool("encrypt-table", false, "Also encrypt the names of the files, with '-password'.")
+	foldFlag     = flag.Bool("ignore-case", false, "Match '-n' case-insensitively.")
+	dirFlag      = flag.String("C", "", "Extract files into a directory.")
+	dryRunFlag   = flag.Bool("dry-run", false, "Print what extracting would do.")
+	flattenFlag  = flag.Bool("flatten", false, "Extract files without directories.")
+	archNameFlag = flag.String("archive-name", "", "Name stored in the archive header.")
+	skipSpecFlag = flag.Bool("skip-special", false, "Skip files that aren't regular files or directories.")
+	stdinFlag    = flag.String("stdin-name", "", "Archive stdin as a file with this name.")
+	stdinPerm    = flag.Uint("stdin-perm", 0644, "Permissions of the file read from stdin.")
+	noSpecFlag   = flag.Bool("no-special-bits", false, "Don't restore setuid, setgid and sticky bits.")
+	failMetaFlag = flag.Bool("fail-on-metadata", false, "Fail if file metadata can't be restored.")
+	compactFlag  = flag.Bool("compact", false, "Don't store checksums and permissions.")
+	poolFlag     = flag.Bool("pool-names", false, "Store the directories of names once.")
+	rawTableFlag = flag.Bool("raw-table", false, "Don't compress the table.")
+	strictFlag   = flag.Bool("strict", false, "Fail if a file changes size while archiving.")
+	bufferFlag   = flag.Int("buffer", 1<<20, "Size of the buffer for copying file data.")
+	jobsFlag     = flag.Int("j", 1, "Number of files extracted at once.")
+	progressFlag = flag.Bool("progress", false, "Print the progress of archiving to stderr.")
+	xattrsFlag   = flag.Bool("xattrs", false, "Store or restore extended attributes.")
+	mtimeFlag    = flag.Bool("mtime", false, "Store modification times.")
+	fixedFlag    = flag.String("fixed-mtime", "", "Store this modification time for every file, in seconds since 1970.")
+	followFlag   = flag.Bool("L", false, "Archive the files symbolic links point to instead of the links.")
+	ownerFlag    = flag.Bool("owner", false, "Store or restore owners and groups.")
+	commentFlag  = flag.String("archive-comment", "", "Describe the archive in a metadata section.")
+
+	mapDirs dirRules
+	uidMap  = make(idMap)
+	gidMap  = make(idMap)
+
+	// userNames and groupNames cache the names of ids, see ownerNames.
+	userNames  = make(map[int]string)
+	groupNames = make(map[int]string)
 
 	files = make(map[string]FileInfo)
+	pass  []byte
 	warn  = log.New(os.Stderr, "Warning: ", 0)
 
-	errDuplicateFilename   = errors.New("Duplicate filename.")
-	errUnsupportedFiletype = errors.New("Unsupported file type.")
-)
+	// copyBuf is allocated on first use, see copyBuffer.
+	copyBuf []byte
+
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	errDuplicateFilename   = errors.New("Duplicate filename.")
+	errUnsupportedFiletype = errors.New("Unsupported file type.")
+	errInvalidKey          = errors.New("Invalid key.")
+	errUnknownSortKey      = errors.New("Unknown sort key.")
+	errConflictingFlags    = errors.New("Conflicting flags.")
+)
+
+// A Warning reports a problem that doesn't stop the current operation.
+type Warning struct {
+	File    string
+	Message string
+}
+
+// onWarning is called for every warning. main prints them to stderr.
+var onWarning = func(w Warning) {}
+
+func warnf(file string, format string, args ...any) {
+	onWarning(Warning{file, fmt.Sprintf(format, args...)})
+}
+
+type FileInfo struct {
+	Path  string
+	Perm  uint16
+	Size  int64   // when the file was added, for the total size
+	Link  string  // target of symbolic links
+	Dir   bool    // empty directory
+	Inode fileKey // of files with hard links, see inodeOf
+}
+
+// fileKey identifies a file by device and inode.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// inputSize returns the total size of the files to archive, so progress can
+// be reported against it before any file is read. Files with hard links are
+// counted once.
+func inputSize() int64 {
+	var size int64
+	inodes := make(map[fileKey]bool)
+	for _, info := range files {
+		if !inodes[info.Inode] {
+			size += info.Size
+		}
+		if info.Inode != (fileKey{}) {
+			inodes[info.Inode] = true
+		}
+	}
+	return size
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetPrefix("Error: ")
+}
+
+func main() {
+	flag.Var(&mapDirs, "map-dir", "Extract files matching a pattern into a directory, as pattern=dir.")
+	flag.Var(uidMap, "uid-map", "Restore owners with uid old as uid new, as old:new.")
+	flag.Var(gidMap, "gid-map", "Restore groups with gid old as gid new, as old:new.")
+	flag.Parse()
+	onWarning = func(w Warning) {
+		warn.Print(w.Message)
+	}
+
+	args := flag.Args()
+
+	switch {
+	case *versionFlag && len(args) > 0:
+		info(args)
+	case *versionFlag:
+		fmt.Printf("version: %d\n", bar.Version)
+	case *listFlag && *extractFlag:
+		log.Fatalf("Conflictnig flags '-l' and '-x'.\n")
+	case *bufferFlag < 1:
+		log.Fatalf("Invalid buffer size %d.\n", *bufferFlag)
+	case *jobsFlag < 1:
+		log.Fatalf("Invalid number of jobs %d.\n", *jobsFlag)
+	case *listFlag:
+		list(args)
+	case *namesFlag || *names0Flag:
+		names(args)
+	case *offsetsFlag:
+		offsets(args)
+	case *layoutFlag:
+		layout(args)
+	case *testFlag:
+		test(args)
+	case *fsckFlag:
+		fsck(args)
+	case *verifyFlag != "":
+		verify(args)
+	case *recompFlag:
+		recompress(args)
+	case *diffFlag:
+		diff(args)
+	case *deleteFlag != "":
+		deleteFiles(args)
+	case *extractFlag:
+		extract(args)
+	default:
+		create(args)
+	}
+}
+
+func list(args []string) {
+	if *overrideFlag != false {
+		log.Printf("Conflicting flag '-o'\n")
+		return
+	}
+
+	if len(args) != 1 {
+		log.Println("Invalid number of arguments.")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	entries := r.Entries
+	if *nameFlag != "" {
+		var ok bool
+		entries, ok = lookup(r, *nameFlag)
+		if !ok {
+			return
+		}
+	}
+
+	entries, err = sortEntries(entries)
+	if err != nil {
+		log.Printf("Unknown sort key '%s'.\n", *sortFlag)
+		return
+	}
+
+	comments := r.Flags()&bar.FlagComments != 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if comments {
+		fmt.Fprintf(w, "NAME\tPERM\tSAVED\tCOMMENT\n")
+	} else {
+		fmt.Fprintf(w, "NAME\tPERM\tSAVED\n")
+	}
+	for _, e := range entries {
+		name := e.Name
+		switch e.Type {
+		case bar.TypeSymlink:
+			name += " -> " + e.Linkname
+		case bar.TypeDir:
+			name += "/"
+		case bar.TypeHardlink:
+			name += " => " + e.Linkname
+		}
+		if comments {
+			// Quoted, so tabs and newlines don't break the columns.
+			comment := e.Comment
+			if comment != "" {
+				comment = strconv.Quote(comment)
+			}
+			fmt.Fprintf(w, "%s\t0%o\t%.2f%%\t%s\n", name, e.Perm,
+				e.SavedPercent(), comment)
+		} else {
+			fmt.Fprintf(w, "%s\t0%o\t%.2f%%\n", name, e.Perm, e.SavedPercent())
+		}
+	}
+	w.Flush()
+
+	if *totalFlag {
+		printTotal(entries)
+	}
+}
+
+// printTotal prints the number of entries, their total size and the space
+// saved by compressing them.
+func printTotal(entries []bar.Entry) {
+	var size, compressed uint64
+	for _, e := range entries {
+		size += e.Size
+		compressed += e.CompressedSize()
+	}
+
+	saved := 0.0
+	if compressed < size {
+		saved = (1 - float64(compressed)/float64(size)) * 100
+	}
+	fmt.Printf("%d files, %d bytes, %d compressed, %.2f%% saved\n",
+		len(entries), size, compressed, saved)
+}
+
+// sortEntries returns a copy of entries in the order given by '-sort' and
+// '-r'. Entries with equal keys keep their order in the table.
+func sortEntries(entries []bar.Entry) ([]bar.Entry, error) {
+	var fn func(a, b bar.Entry) int
+	switch *sortFlag {
+	case "":
+	case "name":
+		fn = func(a, b bar.Entry) int { return cmp.Compare(a.Name, b.Name) }
+	case "size":
+		fn = func(a, b bar.Entry) int { return cmp.Compare(a.Size, b.Size) }
+	case "ratio":
+		fn = func(a, b bar.Entry) int { return cmp.Compare(a.Ratio(), b.Ratio()) }
+	case "mtime":
+		fn = func(a, b bar.Entry) int { return a.ModTime.Compare(b.ModTime) }
+	default:
+		return nil, errUnknownSortKey
+	}
+
+	entries = slices.Clone(entries)
+	if fn != nil {
+		slices.SortStableFunc(entries, fn)
+	}
+	if *reverseFlag {
+		slices.Reverse(entries)
+	}
+	return entries, nil
+}
+
+func names(args []string) {
+	if *namesFlag && *names0Flag {
+		log.Printf("Conflicting flags '-names' and '-names0'.\n")
+		return
+	}
+
+	if *nameFlag != "" {
+		log.Printf("Conflicting flag '-n'\n")
+		return
+	}
+
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	delim := "\n"
+	if *names0Flag {
+		delim = "\x00"
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	for _, name := range r.EntryNames() {
+		w.WriteString(name)
+		w.WriteString(delim)
+	}
+	w.Flush()
+}
+
+func offsets(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	b, err := json.MarshalIndent(r.OffsetManifest(), "", "  ")
+	if err != nil {
+		log.Printf("Unable to encode offsets.\n")
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// info prints the format version of an archive, the program that wrote it
+// and its metadata section, if any.
+func info(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fmt.Printf("version: %d\n", r.Version())
+	if p := r.Producer(); p != "" {
+		fmt.Printf("producer: %s\n", p)
+	}
+	if c := r.ArchiveCreator(); c != "" {
+		fmt.Printf("creator: %s\n", c)
+	}
+	if t := r.ArchiveCreated(); !t.IsZero() {
+		fmt.Printf("created: %s\n", t.Format(time.RFC3339))
+	}
+	if c := r.ArchiveComment(); c != "" {
+		fmt.Printf("comment: %s\n", c)
+	}
+}
+
+// layout prints where the data of each entry is stored, so it can be cut
+// out of the archive with other tools.
+func layout(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "OFFSET\tLENGTH\tMETHOD\tNAME\n")
+	for _, loc := range r.OffsetManifest() {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", loc.Offset, loc.CompressedSize,
+			loc.Method, loc.Name)
+	}
+	w.Flush()
+}
+
+func test(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	err = r.VerifyAll()
+	var ee *bar.EntryError
+	switch {
+	case errors.As(err, &ee) && ee.Err == bar.ErrInvalidChecksum:
+		log.Fatalf("Invalid checksum for file '%s'.\n", ee.Name)
+	case errors.As(err, &ee) && ee.Err == bar.ErrMissingKey:
+		log.Fatalf("Archive is encrypted, use '-password'.\n")
+	case errors.As(err, &ee) && ee.Err == bar.ErrDecryptionFailed:
+		log.Fatalf("Unable to decrypt file '%s'. Wrong password?\n", ee.Name)
+	case errors.As(err, &ee) && errors.Is(ee.Err, bar.ErrCorruptData):
+		log.Fatalf("Corrupt data for file '%s'.\n", ee.Name)
+	case errors.As(err, &ee):
+		log.Fatalf("Unable to read file '%s' in archive.\n", ee.Name)
+	}
+}
+
+// diff prints the files added (+), removed (-) and changed (~) in the
+// second archive and exits nonzero if there are any.
+func diff(args []string) {
+	if len(args) != 2 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	a, fileA, err := openArchive(args[0])
+	if err != nil {
+		os.Exit(2)
+	}
+	defer fileA.Close()
+
+	b, fileB, err := openArchive(args[1])
+	if err != nil {
+		os.Exit(2)
+	}
+	defer fileB.Close()
+
+	diffs, err := bar.Diff(a, b)
+	var ee *bar.EntryError
+	switch {
+	case errors.As(err, &ee) && ee.Err == bar.ErrInvalidChecksum:
+		log.Printf("Invalid checksum for file '%s'.\n", ee.Name)
+		os.Exit(2)
+	case errors.As(err, &ee) && ee.Err == bar.ErrMissingKey:
+		log.Printf("Archive is encrypted, use '-password'.\n")
+		os.Exit(2)
+	case errors.As(err, &ee):
+		log.Printf("Unable to compare file '%s'.\n", ee.Name)
+		os.Exit(2)
+	}
+
+	for _, d := range diffs {
+		switch d.Kind {
+		case bar.Added:
+			fmt.Printf("+ %s\n", d.Name)
+		case bar.Removed:
+			fmt.Printf("- %s\n", d.Name)
+		case bar.Changed:
+			fmt.Printf("~ %s (%s)\n", d.Name, strings.Join(d.Fields, ", "))
+		}
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// fsck prints every problem of an archive and exits nonzero if there are
+// any. Problems of the header, footer and table are reported by
+// openArchive, they stop the check.
+func fsck(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		os.Exit(1)
+	}
+	defer file.Close()
+	fmt.Printf("header, footer and table: ok\n")
+
+	errs := r.Check()
+	for _, err := range errs {
+		var ee *bar.EntryError
+		if errors.As(err, &ee) {
+			fmt.Printf("%s: %s\n", ee.Name, ee.Err)
+		}
+	}
+	fmt.Printf("%d files, %d problems\n", len(r.Entries), len(errs))
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func openArchive(filename string) (*bar.Reader, *os.File, error) {
+	_, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No such file '%s'.\n", filename)
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Printf("Unable to read file '%s'.\n", filename)
+		return nil, nil, err
+	}
+
+	file, err = unwrapGzip(file)
+	if err != nil {
+		log.Printf("Unable to decompress file '%s'.\n", filename)
+		return nil, nil, err
+	}
+
+	var opts []bar.ReaderOption
+	if *foldFlag {
+		opts = append(opts, bar.WithCaseFold())
+	}
+	if *passwordFlag {
+		pass, err := password()
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		opts = append(opts, bar.WithDecryptionPassword(pass))
+	}
+
+	r, err := bar.NewReader(file, opts...)
+	switch {
+	case err == bar.ErrNoPassword:
+		log.Printf("Archive is not password protected.\n")
+	case err == bar.ErrMissingKey:
+		log.Printf("Archive is encrypted, use '-password'.\n")
+	case err == bar.ErrDecryptionFailed:
+		log.Printf("Unable to decrypt the file names. Wrong password?\n")
+	case err == bar.ErrUnknownFormat:
+		log.Printf("Unknown file format.\n")
+	case err == bar.ErrUnsupportedVersion:
+		log.Printf("Unsupported version.\n")
+	case err == io.ErrUnexpectedEOF:
+		log.Printf("Truncated archive '%s'.\n", filename)
+	case errors.Is(err, bar.ErrUnsupportedFeature):
+		log.Printf("%s The archive needs a newer version of bar.\n", err)
+	case err == bar.ErrInvalidChecksum:
+		log.Printf("Invalid checksum.\n")
+	case errors.Is(err, bar.ErrCorruptData):
+		log.Printf("Corrupt entry table.\n")
+	case err == bar.ErrEmptyName:
+		log.Printf("File with an empty name in archive '%s'.\n", filename)
+	case err != nil:
+		log.Printf("Unable to read file '%s'.\n", filename)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return r, file, nil
+}
+
+// password returns the password from the BAR_PASSWORD environment variable,
+// or reads it from stdin.
+func password() ([]byte, error) {
+	if pass != nil {
+		return pass, nil
+	}
+
+	if env := os.Getenv("BAR_PASSWORD"); env != "" {
+		pass = []byte(env)
+		return pass, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Printf("Unable to read password.\n")
+		return nil, err
+	}
+	pass = []byte(strings.TrimRight(line, "\r\n"))
+	return pass, nil
+}
+
+// unwrapGzip decompresses a gzipped archive into a temporary file, since
+// the reader needs to seek. Other files are returned unchanged.
+func unwrapGzip(file *os.File) (*os.File, error) {
+	magic := make([]byte, len(gzipMagic))
+	_, err := io.ReadFull(file, magic)
+	_, serr := file.Seek(0, io.SeekStart)
+	if serr != nil {
+		file.Close()
+		return nil, serr
+	}
+	if err != nil || !slices.Equal(magic, gzipMagic) {
+		return file, nil
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "bar-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays readable through the open descriptor.
+	os.Remove(tmp.Name())
+
+	_, err = copyBuffer(tmp, zr)
+	if err == nil {
+		err = zr.Close()
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+func extract(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	policy, ok := overwritePolicy()
+	if !ok {
+		os.Exit(1)
+	}
+
+	opts := bar.ExtractOptions{
+		Overwrite:      policy,
+		Flatten:        *flattenFlag,
+		NoSpecialBits:  *noSpecFlag,
+		Xattrs:         *xattrsFlag,
+		Owner:          *ownerFlag,
+		FailOnMetadata: *failMetaFlag,
+		OnWarning:      extractWarning,
+		Buffer:         make([]byte, *bufferFlag),
+		Workers:        *jobsFlag,
+	}
+	if len(mapDirs) > 0 {
+		opts.Route = mapRoute(mapDirs, *dirFlag)
+	}
+
+	entries := r.Entries
+	if *nameFlag != "" {
+		var ok bool
+		entries, ok = lookup(r, *nameFlag)
+		if !ok {
+			return
+		}
+	}
+	if *ownerFlag {
+		if os.Geteuid() != 0 {
+			warnf("", "Not running as root, owners may not be restored.\n")
+		}
+		entries = mapOwners(entries)
+	}
+	opts.Entries = entries
+
+	if *dryRunFlag {
+		dryRun(entries, &opts)
+		return
+	}
+
+	err = r.ExtractAll(*dirFlag, opts)
+	if failed := warnChecksums(err); failed != nil {
+		log.Fatalf("%d of %d files have an invalid checksum: %s\n",
+			len(failed), len(entries), strings.Join(failed, ", "))
+	}
+	if err != nil {
+		logExtractError(err)
+		os.Exit(1)
+	}
+}
+
+// warnChecksums warns about every file with an invalid checksum, if err
+// is the error ExtractAll returns for them, and returns their names.
+func warnChecksums(err error) []string {
+	errs, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return nil
+	}
+
+	var failed []string
+	for _, err := range errs.Unwrap() {
+		name := err.(*bar.EntryError).Name
+		warnf(name, "Invalid checksum for file '%s'.\n", name)
+		failed = append(failed, name)
+	}
+	return failed
+}
+
+// overwritePolicy returns the policy chosen by '-o', '-k' or '-rename'.
+func overwritePolicy() (bar.OverwritePolicy, bool) {
+	policy := bar.FailExisting
+	var n int
+	for _, f := range []struct {
+		set    bool
+		policy bar.OverwritePolicy
+	}{
+		{*overrideFlag, bar.ReplaceExisting},
+		{*keepFlag, bar.SkipExisting},
+		{*renameFlag, bar.RenameExisting},
+	} {
+		if f.set {
+			policy = f.policy
+			n++
+		}
+	}
+	if n > 1 {
+		log.Printf("Conflicting flags '-o', '-k' and '-rename'.\n")
+		return 0, false
+	}
+	return policy, true
+}
+
+// logExtractError prints the error that stopped an extraction.
+func logExtractError(err error) {
+	var ee *bar.EntryError
+	errors.As(err, &ee)
+	name := ee.Name
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		name = pe.Path
+	}
+
+	switch {
+	case errors.Is(err, bar.ErrMissingKey):
+		log.Printf("Archive is encrypted, use '-password'.\n")
+	case errors.Is(err, bar.ErrDecryptionFailed):
+		log.Printf("Unable to decrypt file '%s'. Wrong password?\n", ee.Name)
+	case errors.Is(err, bar.ErrCorruptData):
+		log.Printf("Corrupt data for file '%s'.\n", ee.Name)
+	case errors.Is(err, bar.ErrPathIsNotSimple):
+		log.Printf("Unsafe file name '%s' in archive.\n", ee.Name)
+	case errors.Is(err, bar.ErrMissingLinkTarget):
+		log.Printf("Hard link '%s' points to a file that isn't extracted.\n", ee.Name)
+	case errors.Is(err, bar.ErrUnsafeLink):
+		log.Printf("Link '%s' in archive points outside of the target directory.\n", ee.Name)
+	case errors.Is(err, bar.ErrLinkInPath):
+		log.Printf("File '%s' would be extracted through the link '%s'.\n",
+			ee.Name, name)
+	case errors.Is(err, bar.ErrDuplicatePath):
+		log.Printf("File '%s' and another file both extract to '%s'.\n",
+			ee.Name, name)
+	case errors.Is(err, bar.ErrIsDir):
+		log.Printf("Unable to override. '%s' is a directory.\n", name)
+	case errors.Is(err, fs.ErrExist):
+		log.Printf("File '%s' allready exists.\n", name)
+	case pe != nil && pe.Op == "chmod":
+		log.Printf("Unable to restore metadata of '%s'.\n", name)
+	default:
+		log.Printf("Unable to write file '%s'.\n", name)
+	}
+}
+
+// extractWarning prints the warnings of an extraction.
+func extractWarning(err error) {
+	var pe *fs.PathError
+	if !errors.As(err, &pe) {
+		warnf("", "%s\n", err)
+		return
+	}
+
+	switch {
+	case errors.Is(err, fs.ErrExist) && pe.Op == "skip":
+		warnf(pe.Path, "Keeping existing file '%s'.\n", pe.Path)
+	case errors.Is(err, fs.ErrExist) && pe.Op == "rename":
+		warnf(pe.Path, "File exists, extracting to '%s'.\n", pe.Path)
+	case errors.Is(err, fs.ErrExist):
+		warnf(pe.Path, "Overriding file '%s'.\n", pe.Path)
+	case errors.Is(err, bar.ErrSpecialBits):
+		warnf(pe.Path, "Restoring setuid/setgid bits of '%s'.\n", pe.Path)
+	case pe.Op == "setxattr":
+		warnf(pe.Path, "Unable to restore extended attributes of '%s'.\n", pe.Path)
+	default:
+		warnf(pe.Path, "Unable to restore metadata of '%s'.\n", pe.Path)
+	}
+}
+
+// lookup returns the entry named by '-n', honoring '-ignore-case'. If no
+// entry has that name and it is a pattern, the entries matching it are
+// returned, see matchGlob.
+func lookup(r *bar.Reader, name string) ([]bar.Entry, bool) {
+	e, err := r.Lookup(name)
+	switch {
+	case err == nil:
+		return []bar.Entry{*e}, true
+	case err == bar.ErrAmbiguousName:
+		log.Printf("Multiple files match '%s' in archive.\n", name)
+		return nil, false
+	case !strings.ContainsAny(name, "*?["):
+		log.Printf("No such file '%s' in archive.\n", name)
+		return nil, false
+	}
+
+	if _, err := matchGlob(name, ""); err != nil {
+		log.Printf("Invalid pattern '%s'.\n", name)
+		return nil, false
+	}
+
+	var entries []bar.Entry
+	for _, e := range r.Entries {
+		if ok, _ := matchGlob(name, e.Name); ok {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		log.Printf("No files match '%s' in archive.\n", name)
+		return nil, false
+	}
+	return entries, true
+}
+
+// matchGlob reports whether name matches pattern. Patterns are matched
+// like with path.Match, except that a '**' element matches any number of
+// path elements, including none.
+func matchGlob(pattern, name string) (bool, error) {
+	elems := strings.Split(pattern, "/")
+	for _, elem := range elems {
+		if _, err := path.Match(elem, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchElems(elems, strings.Split(name, "/")), nil
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try to match the rest of the pattern at every position.
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// mapRoute extracts entries to the directory of the first rule matching
+// their name, and all others to dir.
+func mapRoute(rules dirRules, dir string) func(e *bar.Entry) (string, bool) {
+	return func(e *bar.Entry) (string, bool) {
+		for _, rule := range rules {
+			if ok, _ := matchGlob(rule.pattern, e.Name); ok {
+				return rule.dir, true
+			}
+		}
+		return dir, true
+	}
+}
+
+// mapOwners returns a copy of entries with the owners to restore. Ids
+// given by '-uid-map' and '-gid-map' are changed first, the other owners and
+// groups are restored by name if it exists on this system, otherwise by id.
+func mapOwners(entries []bar.Entry) []bar.Entry {
+	users := make(map[string]string)
+	groups := make(map[string]string)
+	lookup := func(cache map[string]string, name string,
+		fn func(name string) (string, error)) (int, bool) {
+		id, ok := cache[name]
+		if !ok {
+			id, _ = fn(name)
+			cache[name] = id
+		}
+		n, err := strconv.Atoi(id)
+		return n, err == nil
+	}
+	userID := func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	}
+	groupID := func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	}
+
+	entries = slices.Clone(entries)
+	for i := range entries {
+		e := &entries[i]
+		if id, ok := uidMap[e.UID]; ok {
+			e.UID = id
+		} else if id, ok := lookup(users, e.Uname, userID); ok && e.Uname != "" {
+			e.UID = id
+		}
+		if id, ok := gidMap[e.GID]; ok {
+			e.GID = id
+		} else if id, ok := lookup(groups, e.Gname, groupID); ok && e.Gname != "" {
+			e.GID = id
+		}
+	}
+	return entries
+}
+
+// idMap holds the '-uid-map' or '-gid-map' flags.
+type idMap map[int]int
+
+func (m idMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for old, id := range m {
+		pairs = append(pairs, fmt.Sprintf("%d:%d", old, id))
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (m idMap) Set(s string) error {
+	old, id, ok := strings.Cut(s, ":")
+	if !ok {
+		return errors.New("expected old:new")
+	}
+	o, err := strconv.Atoi(old)
+	if err != nil || o < 0 {
+		return errors.New("invalid id " + old)
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 {
+		return errors.New("invalid id " + id)
+	}
+	m[o] = n
+	return nil
+}
+
+// dirRules are the '-map-dir' flags, in the order given.
+type dirRules []dirRule
+
+type dirRule struct {
+	pattern string
+	dir     string
+}
+
+func (dr *dirRules) String() string {
+	rules := make([]string, len(*dr))
+	for i, rule := range *dr {
+		rules[i] = rule.pattern + "=" + rule.dir
+	}
+	return strings.Join(rules, " ")
+}
+
+func (dr *dirRules) Set(s string) error {
+	pattern, dir, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		return errors.New("expected pattern=dir")
+	}
+	if _, err := matchGlob(pattern, ""); err != nil {
+		return err
+	}
+	*dr = append(*dr, dirRule{pattern, dir})
+	return nil
+}
+
+// dryRun prints what extracting entries would do to each file.
+func dryRun(entries []bar.Entry, opts *bar.ExtractOptions) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	seen := make(map[string]bool)
+	for i := range entries {
+		e := &entries[i]
+		name, ok := opts.TargetPath(*dirFlag, e)
+		action := "create"
+		s, err := os.Stat(name)
+		switch {
+		case !ok:
+			name, action = e.Name, "skip"
+		case seen[name]:
+			action = "duplicate"
+		case err != nil:
+		case e.Type == bar.TypeDir && s.IsDir():
+			action = "merge"
+		case opts.Overwrite == bar.SkipExisting:
+			action = "keep"
+		case opts.Overwrite == bar.RenameExisting:
+			action = "rename"
+		case s.IsDir():
+			action = "is a directory"
+		case opts.Overwrite == bar.ReplaceExisting:
+			action = "override"
+		default:
+			action = "exists"
+		}
+		seen[name] = true
+		fmt.Fprintf(w, "%s\t%s\n", name, action)
+	}
+	w.Flush()
+}
+
+// unixPerm converts mode to Perm, see bar.Entry.Mode.
+func unixPerm(mode fs.FileMode) uint16 {
+	perm := uint16(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+func create(args []string) {
+	if *nameFlag != "" {
+		log.Printf("Conflicting flag '-n'\n")
+		return
+	}
+
+	if *stdinFlag != "" {
+		createFromStdin(args)
+		return
+	}
+
+	if len(args) < 2 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	var (
+		outFile    = args[0]
+		inputFiles = args[1:]
+	)
+
+	err := addNames(inputFiles)
+	if err != nil {
+		return
+	}
+	excludeFile(outFile)
+
+	var opts []bar.WriterOption
+	if needEntryTypes() {
+		opts = append(opts, bar.WithEntryTypes())
+	}
+
+	w, file, err := createArchive(outFile, opts...)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// Files are added in order of their names, so the same inputs always
+	// give the same archive.
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	total := inputSize()
+	if *progressFlag {
+		fmt.Fprintf(os.Stderr, "%d files, %d bytes\n", len(names), total)
+	}
+
+	// The first name of a file with hard links stores its data.
+	linked := make(map[fileKey]string)
+
+	var done int64
+	for _, name := range names {
+		info := files[name]
+		if first, ok := linked[info.Inode]; ok {
+			err := w.CreateHardlink(name, first)
+			if err == nil {
+				err = w.CloseEntry()
+			}
+			if err != nil {
+				log.Printf("Unable to archive '%s'.\n", info.Path)
+				return
+			}
+			continue
+		}
+		if info.Inode != (fileKey{}) {
+			linked[info.Inode] = name
+		}
+
+		if info.Link != "" || info.Dir {
+			err := archiveWithoutData(w, name, info)
+			if err != nil {
+				log.Printf("Unable to archive '%s'.\n", info.Path)
+				return
+			}
+			continue
+		}
+
+		err := w.Create(name)
+		if err != nil {
+			log.Printf("Unable to write file.\n")
+			return
+		}
+		w.SetPerms(info.Perm)
+		if *xattrsFlag {
+			storeXattrs(w, info.Path)
+		}
+		if *ownerFlag {
+			storeOwner(w, info.Path)
+		}
+
+		ifile, err := os.Open(info.Path)
+		if err != nil {
+			log.Printf("Unable to read file '%s'.\n", info.Path)
+			return
+		}
+		n, s, err := copyFile(w, ifile)
+		ifile.Close()
+		if err == nil && *mtimeFlag {
+			err = w.SetModTime(s.ModTime())
+		}
+		if err != nil {
+			log.Printf("Unable to archive file '%s'.\n", info.Path)
+			return
+		}
+		// With '-strict', the archive missing part of the file is
+		// removed, unless it was written to stdout.
+		if n != s.Size() && *strictFlag {
+			log.Printf("File '%s' changed size while archiving.\n", info.Path)
+			file.Close()
+			if outFile != "-" {
+				os.Remove(outFile)
+			}
+			os.Exit(1)
+		}
+		if n != s.Size() {
+			warnf(info.Path, "File '%s' changed size while archiving, "+
+				"archived %d of %d bytes.\n", info.Path, n, s.Size())
+		}
+
+		err = w.CloseEntry()
+		if err != nil {
+			log.Printf("Unable to write file '%s'.\n", name)
+			return
+		}
+
+		done += n
+		if *progressFlag {
+			printProgress(name, done, total)
+		}
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.Printf("Unable to write file.\n")
+		return
+	}
+
+	if *signFlag != "" {
+		sign(w, outFile)
+	}
+}
+
+// needEntryTypes reports whether any of the files to archive is a link or
+// a directory, which need entry types to be stored.
+func needEntryTypes() bool {
+	inodes := make(map[fileKey]bool)
+	for _, info := range files {
+		if info.Link != "" || info.Dir || inodes[info.Inode] {
+			return true
+		}
+		if info.Inode != (fileKey{}) {
+			inodes[info.Inode] = true
+		}
+	}
+	return false
+}
+
+// archiveWithoutData adds the symbolic link or directory info.Path to w as
+// name.
+func archiveWithoutData(w *bar.Writer, name string, info FileInfo) error {
+	var err error
+	if info.Dir {
+		err = w.CreateDir(name)
+		if err == nil {
+			err = w.SetPerms(info.Perm)
+		}
+		if err == nil && *xattrsFlag {
+			storeXattrs(w, info.Path)
+		}
+	} else {
+		err = w.CreateSymlink(name, info.Link)
+	}
+	if err == nil && *ownerFlag {
+		storeOwner(w, info.Path)
+	}
+	if err == nil && *mtimeFlag {
+		var s fs.FileInfo
+		s, err = os.Lstat(info.Path)
+		if err == nil {
+			err = w.SetModTime(s.ModTime())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return w.CloseEntry()
+}
+
+// createFromStdin writes an archive with a single file read from stdin.
+func createFromStdin(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	if *passwordFlag && os.Getenv("BAR_PASSWORD") == "" {
+		log.Printf("'-stdin-name' requires the password in BAR_PASSWORD.\n")
+		return
+	}
+
+	if *stdinPerm > 0777 {
+		log.Printf("Invalid permissions '%o'.\n", *stdinPerm)
+		return
+	}
+
+	// Checked before the archive is created, so it isn't left empty.
+	name := *stdinFlag
+	if bar.ValidateName(name) != nil {
+		log.Printf("Invalid file name '%s'.\n", name)
+		return
+	}
+
+	w, file, err := createArchive(args[0])
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = w.Create(name)
+	if err != nil {
+		log.Printf("Unable to write file.\n")
+		return
+	}
+	w.SetPerms(uint16(*stdinPerm))
+
+	_, err = copyBuffer(w, os.Stdin)
+	if err != nil {
+		log.Printf("Unable to read stdin.\n")
+		return
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.Printf("Unable to write file.\n")
+		return
+	}
+
+	if *signFlag != "" {
+		sign(w, args[0])
+	}
+}
+
+// storeXattrs sets the extended attributes of the current entry to those of
+// the file. Files whose attributes can't be read are archived without them.
+func storeXattrs(w *bar.Writer, path string) {
+	attrs, err := bar.ReadXattrs(path)
+	if err == nil && attrs != nil {
+		err = w.SetXattrs(attrs)
+	}
+	if err != nil {
+		warnf(path, "Unable to archive extended attributes of '%s'.\n", path)
+	}
+}
+
+// storeOwner sets the owner of the current entry to that of the file,
+// with the names of its owner and group.
+func storeOwner(w *bar.Writer, path string) {
+	s, err := os.Lstat(path)
+	if err == nil {
+		uid, gid := ownerOf(s)
+		user, group := ownerNames(uid, gid)
+		err = w.SetOwner(uid, gid, user, group)
+	}
+	if err != nil {
+		warnf(path, "Unable to archive the owner of '%s'.\n", path)
+	}
+}
+
+// ownerNames returns the names of the user uid and the group gid, or ""
+// if they have none.
+func ownerNames(uid, gid int) (string, string) {
+	name, ok := userNames[uid]
+	if !ok && uid >= 0 {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		userNames[uid] = name
+	}
+
+	group, ok := groupNames[gid]
+	if !ok && gid >= 0 {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			group = g.Name
+		}
+		groupNames[gid] = group
+	}
+	return name, group
+}
+
+// printProgress prints the share of the total size archived after a file.
+func printProgress(name string, done, total int64) {
+	percent := int64(100)
+	if total > 0 && done < total {
+		percent = done * 100 / total
+	}
+	fmt.Fprintf(os.Stderr, "%3d%% %s\n", percent, name)
+}
+
+// sign writes the signature of an archive to a file next to it.
+func sign(w *bar.Writer, filename string) {
+	key, err := readKey(*signFlag)
+	if err != nil {
+		return
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		log.Printf("'%s' is not an ed25519 private key.\n", *signFlag)
+		return
+	}
+
+	sig, err := w.Sign(priv)
+	if err == nil {
+		err = os.WriteFile(filename+".sig", sig, 0666)
+	}
+	if err != nil {
+		log.Printf("Unable to write signature.\n")
+	}
+}
+
+func verify(args []string) {
+	if len(args) != 1 {
+		log.Printf("Invalid number of arguments.\n")
+		return
+	}
+
+	key, err := readKey(*verifyFlag)
+	if err != nil {
+		os.Exit(1)
+	}
 
-type FileInfo struct {
-	Path string
-	Perm uint16
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		log.Fatalf("'%s' is not an ed25519 public key.\n", *verifyFlag)
+	}
+
+	r, file, err := openArchive(args[0])
+	if err != nil {
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	sig, err := os.ReadFile(args[0] + ".sig")
+	if err != nil {
+		log.Fatalf("Unable to read signature '%s'.\n", args[0]+".sig")
+	}
+
+	err = r.Verify(pub, sig)
+	switch {
+	case err == bar.ErrInvalidSignature:
+		log.Fatalf("Invalid signature.\n")
+	case err != nil:
+		log.Fatalf("Unable to read file '%s'.\n", args[0])
+	}
 }
 
-func init() {
-	log.SetFlags(0)
-	log.SetPrefix("Error: ")
+// readKey reads a PEM encoded PKCS #8 private key or PKIX public key.
+func readKey(filename string) (any, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		log.Printf("Unable to read key '%s'.\n", filename)
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		log.Printf("Invalid key '%s'.\n", filename)
+		return nil, errInvalidKey
+	}
+
+	var key any
+	if block.Type == "PUBLIC KEY" {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		log.Printf("Invalid key '%s'.\n", filename)
+		return nil, err
+	}
+	return key, nil
 }
 
-func main() {
-	flag.Parse()
-	args := flag.Args()
+// createArchive creates filename, or writes to stdout if it is "-", and
+// returns a writer using opts and the options set by flags like '-o', '-c', '-align', '-password' and
+// '-archive-name'.
+func createArchive(filename string, opts ...bar.WriterOption) (*bar.Writer, *os.File, error) {
+	level, err := compressionLevel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	method, err := compressionMethod()
+	if err != nil {
+		return nil, nil, err
+	}
+	if method != bar.MethodDeflate {
+		opts = append(opts, bar.WithMethod(method))
+	}
+	if *autoFlag {
+		opts = append(opts, bar.WithAutoStore(bar.DefaultStoreRatio))
+	}
+	if *solidFlag {
+		opts = append(opts, bar.WithSolid(bar.DefaultSolidSize))
+	}
+
+	// The archive is written to stdout if filename is "-".
+	stdout := filename == "-"
+	if stdout && *signFlag != "" {
+		log.Printf("Conflicting flag '-sign', the archive is written to stdout.\n")
+		return nil, nil, errConflictingFlags
+	}
+
+	_, err = os.Stat(filename)
+	if err == nil && !stdout {
+		if *overrideFlag {
+			warnf(filename, "Overriing file '%s'.\n", filename)
+		} else {
+			log.Printf("File '%s' allready exits.\n", filename)
+			return nil, nil, os.ErrExist
+		}
+	}
+
+	if *alignFlag != 0 {
+		opts = append(opts, bar.WithAlignment(uint32(*alignFlag)))
+	}
+	if *passwordFlag {
+		pass, err := password()
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, bar.WithPassword(pass))
+	}
+	if *encTableFlag {
+		opts = append(opts, bar.WithTableEncryption())
+	}
+	if *archNameFlag != "" {
+		opts = append(opts, bar.WithArchiveName(*archNameFlag))
+	}
+	opts = append(opts, bar.WithProducer(producer()))
+	if *compactFlag {
+		opts = append(opts, bar.WithCompact())
+	}
+	if *poolFlag {
+		opts = append(opts, bar.WithNamePool())
+	}
+	if *rawTableFlag {
+		opts = append(opts, bar.WithRawTable())
+	}
+	if *xattrsFlag {
+		opts = append(opts, bar.WithXattrs())
+	}
+	if *mtimeFlag {
+		opts = append(opts, bar.WithModTimes())
+	}
+	fixed, ok, err := fixedModTime()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		opts = append(opts, bar.WithFixedModTime(fixed))
+	}
+	if *ownerFlag {
+		opts = append(opts, bar.WithOwner())
+	}
+	if *commentFlag != "" {
+		var creator string
+		if u, err := user.Current(); err == nil {
+			creator = u.Username
+		}
+		created := time.Now()
+		if ok {
+			created = fixed
+		}
+		opts = append(opts, bar.WithMetadata(creator, created))
+	}
+
+	file := os.Stdout
+	if !stdout {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		file, err = os.OpenFile(filename, flags, 0666)
+		if err != nil {
+			log.Printf("Unable to create file.\n")
+			return nil, nil, err
+		}
+	}
 
+	opts = append(opts, bar.WithCompressionLevel(level))
+	w, err := bar.NewWriter(file, opts...)
+	if err == nil && *commentFlag != "" {
+		err = w.SetArchiveComment(*commentFlag)
+	}
 	switch {
-	case *versionFlag:
-		fmt.Printf("version: %d\n", bar.Version)
-	case *listFlag && *extractFlag:
-		log.Fatalf("Conflictnig flags '-l' and '-x'.\n")
-	case *listFlag:
-		list(args)
-	case *extractFlag:
-		extract(args)
-	default:
-		create(args)
+	case err == bar.ErrMissingKey:
+		log.Printf("'-encrypt-table' requires '-password'.\n")
+	case err != nil:
+		log.Printf("Unable to write file.\n")
 	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return w, file, nil
 }
 
-func list(args []string) {
-	if *nameFlag != "" {
-		log.Println("Conflicting flag '-n'\n")
+func recompress(args []string) {
+	if len(args) != 2 {
+		log.Printf("Invalid number of arguments.\n")
 		return
 	}
 
-	if *overrideFlag != false {
-		log.Println("Conflicting flag '-o'\n")
+	level, err := compressionLevel()
+	if err != nil {
 		return
 	}
 
-	if len(args) != 1 {
-		log.Println("Invalid number of arguments.")
+	r, in, err := openArchive(args[0])
+	if err != nil {
 		return
 	}
+	defer in.Close()
 
-	filename := args[0]
-
-	_, err := os.Stat(filename)
-	if errors.Is(err, os.ErrNotExist) {
-		log.Printf("No such file '%s'.\n", filename)
-		return
+	var opts []bar.WriterOption
+	if r.Flags()&bar.FlagEntryTypes != 0 {
+		opts = append(opts, bar.WithEntryTypes())
+	}
+	if r.Flags()&bar.FlagOwner != 0 {
+		opts = append(opts, bar.WithOwner())
+	}
+	if r.Flags()&bar.FlagXattrs != 0 {
+		opts = append(opts, bar.WithXattrs())
+	}
+	if r.Flags()&bar.FlagComments != 0 {
+		opts = append(opts, bar.WithComments())
+	}
+	keepMeta := r.Flags()&bar.FlagMetadata != 0 && *commentFlag == ""
+	if keepMeta {
+		opts = append(opts, bar.WithMetadata(r.ArchiveCreator(), r.ArchiveCreated()))
 	}
 
-	file, err := os.Open(filename)
+	w, out, err := createArchive(args[1], opts...)
 	if err != nil {
-		log.Printf("Unable to read file '%s'.\n", filename)
 		return
 	}
-	defer file.Close()
+	defer out.Close()
 
-	r, err := bar.NewReader(file)
+	if keepMeta {
+		w.SetArchiveComment(r.ArchiveComment())
+	}
+
+	err = bar.Recompress(w, r, level)
+	var ee *bar.EntryError
 	switch {
-	case err == bar.ErrUnknownFormat:
-		log.Printf("Unknown file format.\n")
+	case errors.As(err, &ee) && ee.Err == bar.ErrInvalidChecksum:
+		log.Printf("Invalid checksum for file '%s'.\n", ee.Name)
 		return
-	case err == bar.ErrUnsupportedVersion:
-		log.Printf("Unsupported version.\n")
+	case errors.As(err, &ee) && ee.Err == bar.ErrMissingKey:
+		log.Printf("Archive is encrypted, use '-password'.\n")
 		return
-	case err == bar.ErrInvalidChecksum:
-		log.Printf("Invalid checksum.\n")
+	case errors.As(err, &ee):
+		log.Printf("Unable to recompress file '%s'.\n", ee.Name)
 		return
 	case err != nil:
-		log.Printf("Unable to read file '%s'.", filename)
+		log.Printf("Unable to write file.\n")
 		return
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	for _, e := range r.Entries {
-		fmt.Fprintf(w, "%s\t0%o\t%.2f%%\n", e.Name, e.Perm, e.Ratio()*100)
+	err = w.Close()
+	if err != nil {
+		log.Printf("Unable to write file.\n")
 	}
-	w.Flush()
 }
 
-func extract(args []string) {
+func deleteFiles(args []string) {
 	if len(args) != 1 {
 		log.Printf("Invalid number of arguments.\n")
 		return
 	}
 
 	filename := args[0]
-
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Printf("Unable to read file '%s'.\n", filename)
+	pattern := *deleteFlag
+	if _, err := matchGlob(pattern, ""); err != nil {
+		log.Printf("Invalid pattern '%s'.\n", pattern)
 		return
 	}
-	defer file.Close()
 
-	r, err := bar.NewReader(file)
-	switch {
-	case err == bar.ErrUnknownFormat:
-		log.Printf("Unknown file format.\n")
-		return
-	case err == bar.ErrUnsupportedVersion:
-		log.Printf("Unsupported version.\n")
-		return
-	case err != nil:
-		log.Printf("Unable to read file '%s'.", filename)
+	r, file, err := openArchive(filename)
+	if err != nil {
 		return
 	}
+	defer file.Close()
 
-	if *nameFlag == "" {
-		extractEntries(r, r.Entries)
-	} else {
-		name := *nameFlag
-		cmp := func(r bar.Entry) bool { return r.Name == name }
-		if i := slices.IndexFunc(r.Entries, cmp); i != -1 {
-			es := []bar.Entry{r.Entries[i]}
-			extractEntries(r, es[:])
-		} else {
-			log.Printf("No such file '%s' in archive.\n", name)
-			return
-		}
+	match := func(e *bar.Entry) bool {
+		ok, _ := matchGlob(pattern, e.Name)
+		return ok
 	}
-}
-
-func extractEntries(r *bar.Reader, entries []bar.Entry) {
-	for _, e := range entries {
-		s, err := os.Stat(e.Name)
-		if err == nil {
-			if *overrideFlag {
-				if s.IsDir() {
-					log.Printf("Unable to override. '%s' is a directory.\n",
-						e.Name)
-					return
-				}
-				warn.Printf("Overriding file '%s'.\n", e.Name)
-			} else {
-				log.Printf("File '%s' allready exists.\n", e.Name)
-				return
-			}
+	if !slices.ContainsFunc(r.Entries, func(e bar.Entry) bool { return match(&e) }) {
+		if !*ignoreFlag {
+			log.Printf("No file matching '%s' in archive.\n", pattern)
+			os.Exit(1)
 		}
+		return
 	}
 
-	for i, e := range entries {
-		err := os.MkdirAll(filepath.Dir(e.Name), 0755)
-		if err != nil {
-			log.Printf("Unable to create file '%s'.\n", e.Name)
-			return
-		}
-		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-		file, err := os.OpenFile(e.Name, flags, fs.FileMode(e.Perm))
-		if err != nil {
-			log.Printf("Unable to create file '%s'.\n", e.Name)
-			return
-		}
-
-		er, err := r.EntryReader(&entries[i])
+	err = replaceFile(filename, func(f *os.File) error {
+		w, err := bar.NewWriter(f, bar.WithSettingsFrom(r),
+			bar.WithProducer(producer()))
 		if err != nil {
-			log.Printf("Unable to create file '%s'.\n", e.Name)
-			return
+			return err
 		}
 
-		_, err = io.Copy(file, er)
+		err = bar.Rewrite(w, r, func(e *bar.Entry) bool { return !match(e) })
 		if err != nil {
-			log.Printf("Unable to write file '%s'.\n", e.Name)
-			return
-		}
-		err = er.Close()
-		if err == bar.ErrInvalidChecksum {
-			warn.Printf("Invalid checksum for file '%s'.\n", e.Name)
+			return err
 		}
-
-		file.Close()
+		return w.Close()
+	})
+	if err != nil {
+		log.Printf("Unable to write file '%s'.\n", filename)
 	}
 }
 
-func create(args []string) {
-	if *nameFlag != "" {
-		log.Printf("Conflicting flag '-n'\n")
-		return
+// replaceFile writes a temporary file with fn and renames it to filename
+// on success.
+func replaceFile(filename string, fn func(f *os.File) error) error {
+	s, err := os.Stat(filename)
+	if err != nil {
+		return err
 	}
 
-	if len(args) < 2 {
-		log.Printf("Invalid number of arguments.\n")
-		return
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".bar-*")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	var (
-		outFile    = args[0]
-		inputFiles = args[1:]
-	)
-
-	_, err := os.Stat(outFile)
+	err = fn(tmp)
 	if err == nil {
-		if *overrideFlag {
-			warn.Printf("Overriing file '%s'.\n", outFile)
-		} else {
-			log.Printf("File '%s' allready exits.\n", outFile)
-			return
-		}
+		err = tmp.Chmod(s.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
 	}
-
-	err = addNames(inputFiles)
 	if err != nil {
-		return
+		return err
 	}
+	return os.Rename(tmp.Name(), filename)
+}
 
-	file, err := os.OpenFile(outFile, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Printf("Unable to create file.\n")
-		return
+// copyBuffer is like io.Copy, but copies through a buffer of the size given
+// by '-buffer'. The buffer is shared, copies must not run concurrently.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	if copyBuf == nil {
+		copyBuf = make([]byte, *bufferFlag)
 	}
-	defer file.Close()
+	// Hide ReadFrom and WriteTo, they would ignore the buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, copyBuf)
+}
 
-	w, err := bar.NewWriter(file)
+// copyFile copies the data of f to w and returns the bytes copied and the
+// stat of f from before. The size is compared to the data read, so files
+// changing while they are archived don't go unnoticed.
+func copyFile(w io.Writer, f fs.File) (int64, fs.FileInfo, error) {
+	s, err := f.Stat()
 	if err != nil {
-		log.Printf("Unable to write file.\n")
-		return
+		return 0, nil, err
 	}
+	n, err := copyBuffer(w, f)
+	return n, s, err
+}
 
-	for name, info := range files {
-		err := w.Create(name)
-		if err != nil {
-			log.Printf("Unable to write file.\n")
-			return
+// producer names this program in the archives it writes.
+func producer() string {
+	version := "(devel)"
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		version = bi.Main.Version
+	}
+	return "bar " + version
+}
+
+// compressionMethod returns the method given by '-method', '-fast' or
+// '-store'.
+func compressionMethod() (bar.Method, error) {
+	from := ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "method" {
+			from = "method"
 		}
-		w.SetPerms(info.Perm)
+	})
 
-		ifile, err := os.Open(info.Path)
+	name := *methodFlag
+	for _, short := range []struct {
+		set          bool
+		flag, method string
+	}{
+		{*fastFlag, "fast", "lz4"},
+		{*storeFlag, "store", "stored"},
+	} {
+		if !short.set {
+			continue
+		}
+		if from != "" && name != short.method {
+			log.Printf("Conflicting flags '-%s' and '-%s'.\n", short.flag, from)
+			return 0, errConflictingFlags
+		}
+		name, from = short.method, short.flag
+	}
+
+	method, err := bar.ParseMethod(name)
+	if err != nil {
+		log.Printf("Unsupported compression method '%s'.\n", name)
+	}
+	return method, err
+}
+
+// compressionLevel returns the level given by '-c' or '-z', or by the
+// BAR_LEVEL environment variable if neither flag is set.
+func compressionLevel() (int, error) {
+	var c, z bool
+	flag.Visit(func(f *flag.Flag) {
+		c = c || f.Name == "c"
+		z = z || f.Name == "z"
+	})
+	set := c || z
+
+	level := *levelFlag
+	switch {
+	case c && z && *levelFlag != *zlevelFlag:
+		log.Printf("Conflicting flags '-c' and '-z'.\n")
+		return 0, errConflictingFlags
+	case z:
+		level = *zlevelFlag
+	}
+	if env := os.Getenv("BAR_LEVEL"); !set && env != "" {
+		var err error
+		level, err = strconv.Atoi(env)
 		if err != nil {
-			log.Printf("Unable to read file '%s'.\n", info.Path)
-			return
+			log.Printf("Invalid BAR_LEVEL '%s'.\n", env)
+			return 0, err
 		}
-		io.Copy(w, ifile)
-		ifile.Close()
 	}
 
-	err = w.Close()
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		log.Printf("Invalid compression level %d.\n", level)
+		return 0, bar.ErrInvalidLevel
+	}
+	return level, nil
+}
+
+// fixedModTime returns the time given by '-fixed-mtime', or by the
+// SOURCE_DATE_EPOCH environment variable if the flag isn't set, and false
+// if neither is.
+func fixedModTime() (time.Time, bool, error) {
+	value, from := *fixedFlag, "'-fixed-mtime'"
+	if value == "" {
+		value, from = os.Getenv("SOURCE_DATE_EPOCH"), "SOURCE_DATE_EPOCH"
+	}
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	sec, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		log.Printf("Unable to write file.\n")
+		log.Printf("Invalid time '%s' of %s, expected seconds since 1970.\n",
+			value, from)
+		return time.Time{}, false, err
 	}
+	return time.Unix(sec, 0).UTC(), true, nil
 }
 
 func addNames(names []string) error {
+	stat := os.Lstat
+	if *followFlag {
+		stat = os.Stat
+	}
+
 	for _, e := range names {
-		s, err := os.Stat(e)
+		s, err := stat(e)
 		if errors.Is(err, os.ErrNotExist) {
 			log.Printf("File '%s' does not exits.", e)
 			return err
 		}
 
 		if s.IsDir() {
-			err := addDirectory(e)
+			err := addDirectory(e, unixPerm(s.Mode()))
 			if err != nil {
 				return err
 			}
 		} else if s.Mode().IsRegular() {
-			err := addFile(e, uint16(s.Mode()&fs.ModePerm))
+			err := addFile(e, FileInfo{Perm: unixPerm(s.Mode()), Size: s.Size(),
+				Inode: inodeOf(s)})
+			if err != nil {
+				return err
+			}
+		} else if s.Mode()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(e)
+			if err != nil {
+				log.Printf("Unable to read link '%s'.\n", e)
+				return err
+			}
+			err = addFile(e, FileInfo{Perm: 0777, Link: filepath.ToSlash(link)})
 			if err != nil {
 				return err
 			}
+		} else if *skipSpecFlag {
+			warnf(e, "Skipping '%s', not a regular file or directory.\n", e)
 		} else {
 			log.Printf("'%s' is not a regular file or directory.\n", e)
 			return errUnsupportedFiletype
@@ -298,7 +1886,25 @@ func addNames(names []string) error {
 	return nil
 }
 
-func addDirectory(dirname string) error {
+// excludeFile removes a file from the files to archive, so an archive that
+// is overridden isn't added to itself.
+func excludeFile(filename string) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return
+	}
+
+	for name, info := range files {
+		if info.Path == path {
+			warnf(filename, "Skipping output file '%s'.\n", filename)
+			delete(files, name)
+		}
+	}
+}
+
+// addDirectory adds the files below dirname, or dirname itself with perm
+// if it is empty.
+func addDirectory(dirname string, perm uint16) error {
 	entries, err := os.ReadDir(dirname)
 	switch {
 	case errors.Is(err, os.ErrPermission):
@@ -308,6 +1914,10 @@ func addDirectory(dirname string) error {
 		return err
 	}
 
+	if len(entries) == 0 {
+		return addFile(dirname, FileInfo{Perm: perm, Dir: true})
+	}
+
 	var names []string
 	for _, e := range entries {
 		names = append(names, filepath.Join(dirname, e.Name()))
@@ -315,7 +1925,9 @@ func addDirectory(dirname string) error {
 	return addNames(names)
 }
 
-func addFile(file string, perm uint16) error {
+// addFile adds file to the files to archive, with the path of info set to
+// the absolute path of file.
+func addFile(file string, info FileInfo) error {
 	var (
 		name string
 		path string
@@ -324,7 +1936,7 @@ func addFile(file string, perm uint16) error {
 	file = filepath.Clean(file)
 	file = filepath.ToSlash(file)
 	if filepath.IsAbs(file) {
-		warn.Printf("'%s' => '%s'\n", file, file[1:])
+		warnf(file, "'%s' => '%s'\n", file, file[1:])
 		path = file
 		name = file[1:]
 	} else {
@@ -343,7 +1955,7 @@ func addFile(file string, perm uint16) error {
 			name = name[3:]
 		}
 		if b {
-			warn.Printf("'%s' => '%s'\n", file, name)
+			warnf(file, "'%s' => '%s'\n", file, name)
 		}
 	}
 
@@ -352,6 +1964,12 @@ func addFile(file string, perm uint16) error {
 		log.Printf("Duplicate filename '%s' (%s).\n", name, path)
 		return errDuplicateFilename
 	}
-	files[name] = FileInfo{path, perm}
+	link := info.Link
+	if link != "" && (filepath.IsAbs(link) ||
+		!filepath.IsLocal(filepath.Join(filepath.Dir(name), link))) {
+		warnf(file, "Link '%s' points outside of the archive, it can't be extracted.\n", file)
+	}
+	info.Path = path
+	files[name] = info
 	return nil
 }
@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestChangingSize archives a file of /proc, whose size is 0 until it is
+// read, as a file that grows while it is archived.
+func TestChangingSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"warning", nil, 0,
+			"status' changed size while archiving, archived "},
+		{"strict", []string{"-strict"}, 1,
+			"status' changed size while archiving.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.Symlink("/proc/self/status", filepath.Join(dir, "status"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			args := append(tt.args, "-L", "a.bar", "status")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != tt.code || !strings.Contains(stderr, tt.stderr) {
+				t.Fatalf("exit %d, want %d: %q, want %q", code, tt.code, stderr,
+					tt.stderr)
+			}
+			_, err = os.Stat(filepath.Join(dir, "a.bar"))
+			if tt.code == 0 && err != nil {
+				t.Errorf("archive not written: %v", err)
+			}
+			if tt.code != 0 && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("partial archive left: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,2002 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"bar/archive/bar"
+)
+
+// TestMain runs main instead of the tests if BAR_TEST_MAIN is set, so the
+// tests can run the command with fresh flags and see it exit.
+func TestMain(m *testing.M) {
+	if os.Getenv("BAR_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runBar runs the command with args in dir and returns its output and exit
+// code.
+func runBar(t *testing.T, dir, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "BAR_TEST_MAIN=1")
+	cmd.Stdin = bytes.NewBufferString(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// writeTree writes files, by their slash separated names, into a new
+// directory and returns it.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = os.WriteFile(name, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMapOwners(t *testing.T) {
+	root, err := user.LookupId("0")
+	if err != nil {
+		t.Skip("no user 0:", err)
+	}
+	uidMap[1000] = 1001
+	gidMap[100] = 50
+	defer func() {
+		delete(uidMap, 1000)
+		delete(gidMap, 100)
+	}()
+
+	tests := []struct {
+		name     string
+		uid, gid int
+		uname    string
+		wantUID  int
+		wantGID  int
+	}{
+		{"mapped", 1000, 100, "", 1001, 50},
+		{"mapped over name", 1000, 100, root.Username, 1001, 50},
+		{"by name", 1234, 4321, root.Username, 0, 4321},
+		{"unmapped", 1234, 4321, "no-such-user-bar", 1234, 4321},
+		{"none", -1, -1, "", -1, -1},
+	}
+
+	var entries []bar.Entry
+	for _, tt := range tests {
+		entries = append(entries, bar.Entry{Name: tt.name, UID: tt.uid,
+			GID: tt.gid, Uname: tt.uname})
+	}
+	mapped := mapOwners(entries)
+	for i, tt := range tests {
+		e := mapped[i]
+		if e.UID != tt.wantUID || e.GID != tt.wantGID {
+			t.Errorf("%s: got %d:%d, want %d:%d", tt.name, e.UID, e.GID,
+				tt.wantUID, tt.wantGID)
+		}
+	}
+	if entries[0].UID != 1000 {
+		t.Error("entries were changed")
+	}
+}
+
+func TestNames(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"b.txt":      "b",
+		"a.txt":      "a",
+		"dir/c.txt":  "c",
+		"new\nline":  "n",
+		"with space": "s",
+	})
+	_, stderr, code := runBar(t, dir, "", "a.bar", "a.txt", "b.txt", "dir",
+		"new\nline", "with space")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{"-names", "a.txt\nb.txt\ndir/c.txt\nnew\nline\nwith space\n"},
+		{"-names0", "a.txt\x00b.txt\x00dir/c.txt\x00new\nline\x00with space\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			stdout, stderr, code := runBar(t, dir, "", tt.flag, "a.bar")
+			if code != 0 || stderr != "" {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+
+	_, stderr, _ = runBar(t, dir, "", "-names", "-names0", "a.bar")
+	if stderr == "" {
+		t.Error("conflicting flags accepted")
+	}
+}
+
+func TestGzippedArchive(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+	_, stderr, code := runBar(t, dir, "", "a.bar", "a.txt", "b.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "a.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = zw.Write(b)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "a.bar.gz"), buf.Bytes(), 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "short.bar.gz"),
+			buf.Bytes()[:buf.Len()/2], 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+		fail bool
+	}{
+		{"names", []string{"-names", "a.bar"}, "a.txt\nb.txt\n", false},
+		{"gzip names", []string{"-names", "a.bar.gz"}, "a.txt\nb.txt\n", false},
+		{"gzip list", []string{"-l", "-n", "b.txt", "a.bar.gz"},
+			"NAME   PERM  SAVED\nb.txt  0644  0.00%\n", false},
+		{"gzip extract", []string{"-x", "-C", "out", "a.bar.gz"}, "", false},
+		{"truncated gzip", []string{"-names", "short.bar.gz"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, _ := runBar(t, dir, "", tt.args...)
+			if fail := stderr != ""; fail != tt.fail {
+				t.Fatalf("stderr %q", stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "out", "a.txt"))
+	if err != nil || string(got) != "alpha" {
+		t.Errorf("extracted %q, %v", got, err)
+	}
+}
+
+func TestLevelEnv(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"data": strings.Repeat("some text, some more text and numbers 1234\n", 2000),
+	})
+
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		fail bool
+	}{
+		{"default", "", nil, false},
+		{"env 1", "1", nil, false},
+		{"env 9", "9", nil, false},
+		{"env 0", "0", nil, false},
+		{"flag over env", "0", []string{"-c", "9"}, false},
+		{"alias over env", "0", []string{"-z", "1"}, false},
+		{"same level twice", "0", []string{"-c", "1", "-z", "1"}, false},
+		{"conflicting levels", "", []string{"-c", "1", "-z", "9"}, true},
+		{"flag out of range", "", []string{"-z", "10"}, true},
+		{"invalid env", "fast", nil, true},
+		{"env out of range", "12", nil, true},
+	}
+
+	sizes := make(map[string]int64)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BAR_LEVEL", tt.env)
+			name := tt.name + ".bar"
+			args := append(tt.args[:len(tt.args):len(tt.args)], name, "data")
+			_, stderr, _ := runBar(t, dir, "", args...)
+			if fail := stderr != ""; fail != tt.fail {
+				t.Fatalf("stderr %q", stderr)
+			}
+			info, err := os.Stat(filepath.Join(dir, name))
+			if tt.fail {
+				if err == nil && info.Size() > 0 {
+					t.Errorf("archive written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[tt.name] = info.Size()
+		})
+	}
+
+	if sizes["env 1"] <= sizes["env 9"] || sizes["env 0"] <= sizes["env 1"] {
+		t.Errorf("sizes for BAR_LEVEL 0, 1 and 9: %d, %d, %d", sizes["env 0"],
+			sizes["env 1"], sizes["env 9"])
+	}
+	if sizes["default"] != sizes["env 9"] || sizes["flag over env"] != sizes["env 9"] {
+		t.Errorf("default and '-c 9' give %d and %d bytes, want %d",
+			sizes["default"], sizes["flag over env"], sizes["env 9"])
+	}
+	if sizes["alias over env"] != sizes["env 1"] {
+		t.Errorf("'-z 1' gives %d bytes, want %d", sizes["alias over env"],
+			sizes["env 1"])
+	}
+	if sizes["same level twice"] != sizes["env 1"] {
+		t.Errorf("'-c 1 -z 1' gives %d bytes, want %d",
+			sizes["same level twice"], sizes["env 1"])
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.txt": "alpha", "b/c.txt": "gamma"})
+	_, stderr, code := runBar(t, dir, "", "a.bar", "a.txt", "b")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	stdout, stderr, code := runBar(t, dir, "", "-offsets", "a.bar")
+	if code != 0 || stderr != "" {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	var got []bar.EntryLocation
+	err := json.Unmarshal([]byte(stdout), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "a.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := bar.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := r.OffsetManifest(); !slices.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.txt": "secret alpha"})
+	t.Setenv("BAR_PASSWORD", "correct horse")
+	_, stderr, code := runBar(t, dir, "", "-password", "a.bar", "a.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	t.Setenv("BAR_PASSWORD", "")
+
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		want  string // error message, or "" for success
+	}{
+		{"right password", []string{"-password"}, "correct horse\n", ""},
+		{"wrong password", []string{"-password"}, "battery staple\n",
+			"Wrong password?"},
+		{"no password", nil, "", "use '-password'"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := fmt.Sprint("out", i)
+			args := append(tt.args, "-x", "-C", out, "a.bar")
+			_, stderr, code := runBar(t, dir, tt.stdin, args...)
+			if (code == 0) != (tt.want == "") || !strings.Contains(stderr, tt.want) {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, out, "a.txt"))
+			if tt.want == "" && (err != nil || string(got) != "secret alpha") {
+				t.Errorf("extracted %q, %v", got, err)
+			}
+			if tt.want != "" && err == nil {
+				t.Errorf("extracted %q", got)
+			}
+		})
+	}
+}
+
+func TestEncryptTableFlag(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stderr string // if no archive is written
+	}{
+		{"password", []string{"-password"}, ""},
+		{"encrypted table", []string{"-password", "-encrypt-table"}, ""},
+		{"no password", []string{"-encrypt-table"},
+			"'-encrypt-table' requires '-password'."},
+	}
+
+	t.Setenv("BAR_PASSWORD", "correct horse")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"secret-name.txt": "alpha"})
+			args := append(tt.args, "a.bar", "secret-name.txt")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if tt.stderr != "" {
+				if !strings.Contains(stderr, tt.stderr) {
+					t.Errorf("stderr %q, want %q", stderr, tt.stderr)
+				}
+				info, err := os.Stat(filepath.Join(dir, "a.bar"))
+				if err == nil && info.Size() > 0 {
+					t.Errorf("archive written")
+				}
+				return
+			}
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			b, err := os.ReadFile(filepath.Join(dir, "a.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Without the password, only the names of the files of
+			// archives without an encrypted table can be listed.
+			encrypted := slices.Contains(tt.args, "-encrypt-table")
+			r, err := bar.NewReader(bytes.NewReader(b))
+			switch {
+			case encrypted && err != bar.ErrMissingKey:
+				t.Errorf("open without password: got %v, want %v", err,
+					bar.ErrMissingKey)
+			case !encrypted && err != nil:
+				t.Errorf("open without password: %v", err)
+			case !encrypted && r.Entries[0].Name != "secret-name.txt":
+				t.Errorf("got %q, want %q", r.Entries[0].Name, "secret-name.txt")
+			}
+
+			args = []string{"-password", "-x", "-C", "out", "a.bar"}
+			_, stderr, code = runBar(t, dir, "", args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("extract: exit %d: %s", code, stderr)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "out", "secret-name.txt"))
+			if err != nil || string(got) != "alpha" {
+				t.Errorf("extracted %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSignature(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.txt": "alpha"})
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"key.pem": {Type: "PRIVATE KEY", Bytes: privDER},
+		"pub.pem": {Type: "PUBLIC KEY", Bytes: pubDER},
+	} {
+		err = os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block),
+			0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, stderr, code := runBar(t, dir, "", "-sign", "key.pem", "-store", "a.bar",
+		"a.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "a.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		change func(b []byte)
+		want   string // error message, or "" for success
+	}{
+		{"valid", "pub.pem", func(b []byte) {}, ""},
+		{"tampered", "pub.pem", func(b []byte) {
+			b[bytes.Index(b, []byte("alpha"))] = 'A'
+		}, "Invalid signature."},
+		{"private key", "key.pem", func(b []byte) {}, "not an ed25519 public key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bytes.Clone(b)
+			tt.change(b)
+			err := os.WriteFile(filepath.Join(dir, "b.bar"), b, 0644)
+			if err == nil {
+				err = os.Link(filepath.Join(dir, "a.bar.sig"),
+					filepath.Join(dir, "b.bar.sig"))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(filepath.Join(dir, "b.bar.sig"))
+
+			_, stderr, code := runBar(t, dir, "", "-verify", tt.key, "b.bar")
+			if (code == 0) != (tt.want == "") || !strings.Contains(stderr, tt.want) {
+				t.Errorf("exit %d: %s", code, stderr)
+			}
+		})
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.txt": strings.Repeat("some text, some more text and numbers 1234\n", 2000),
+		"b.txt": "beta",
+	})
+	_, stderr, code := runBar(t, dir, "", "-c", "1", "fast.bar", "a.txt", "b.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	_, stderr, code = runBar(t, dir, "", "-recompress", "-c", "9", "fast.bar",
+		"best.bar")
+	if code != 0 || stderr != "" {
+		t.Fatalf("recompress: exit %d: %s", code, stderr)
+	}
+
+	fast, err := os.Stat(filepath.Join(dir, "fast.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	best, err := os.Stat(filepath.Join(dir, "best.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Size() >= fast.Size() {
+		t.Errorf("recompressed %d bytes to %d", fast.Size(), best.Size())
+	}
+	_, stderr, code = runBar(t, dir, "", "-x", "-C", "out", "best.bar")
+	if code != 0 || stderr != "" {
+		t.Fatalf("extract: exit %d: %s", code, stderr)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		got, err := os.ReadFile(filepath.Join(dir, "out", name))
+		want, _ := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: extracted %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	files := map[string]string{
+		"a.txt":         "alpha",
+		"tmp/b.log":     "beta",
+		"tmp/c.txt":     "gamma",
+		"tmp/sub/d.txt": "delta",
+	}
+	all := "a.txt\ntmp/b.log\ntmp/c.txt\ntmp/sub/d.txt\n"
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string // names left
+		code    int
+		message string
+	}{
+		{"glob", []string{"-delete", "tmp/*"}, "a.txt\ntmp/sub/d.txt\n", 0, ""},
+		{"any depth", []string{"-delete", "tmp/**"}, "a.txt\n", 0, ""},
+		{"suffix", []string{"-delete", "**/*.txt"}, "tmp/b.log\n", 0, ""},
+		{"no match", []string{"-delete", "*.log"}, all, 1, "No file matching"},
+		{"ignore missing", []string{"-delete", "*.log", "-ignore-missing"}, all,
+			0, ""},
+		{"invalid pattern", []string{"-delete", "["}, all, 0, "Invalid pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, files)
+			_, stderr, code := runBar(t, dir, "", "a.bar", "a.txt", "tmp")
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			_, stderr, code = runBar(t, dir, "", append(tt.args, "a.bar")...)
+			if code != tt.code {
+				t.Errorf("exit %d, want %d", code, tt.code)
+			}
+			if tt.message == "" && stderr != "" ||
+				!strings.Contains(stderr, tt.message) {
+				t.Errorf("stderr %q, want %q", stderr, tt.message)
+			}
+			stdout, stderr, code := runBar(t, dir, "", "-names", "a.bar")
+			if code != 0 || stderr != "" {
+				t.Fatalf("names: exit %d: %s", code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+			_, stderr, code = runBar(t, dir, "", "-t", "a.bar")
+			if code != 0 || stderr != "" {
+				t.Errorf("test: exit %d: %s", code, stderr)
+			}
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := bar.NewWriter(&buf, bar.WithMethod(bar.MethodStored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		err = w.Create(name)
+		if err == nil {
+			_, err = w.Write([]byte("data of " + name))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		corrupt  []string
+		existing []string
+		want     []Warning
+	}{
+		{"none", nil, nil, nil},
+		{"checksum", []string{"b.txt"}, nil, []Warning{
+			{"b.txt", "Invalid checksum for file 'b.txt'.\n"},
+		}},
+		{"checksums", []string{"a.txt", "c.txt"}, nil, []Warning{
+			{"a.txt", "Invalid checksum for file 'a.txt'.\n"},
+			{"c.txt", "Invalid checksum for file 'c.txt'.\n"},
+		}},
+		{"override", nil, []string{"c.txt"}, []Warning{
+			{"DIR/c.txt", "Overriding file 'DIR/c.txt'.\n"},
+		}},
+	}
+
+	defer func() { onWarning = func(w Warning) {} }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bytes.Clone(buf.Bytes())
+			for _, name := range tt.corrupt {
+				b[bytes.Index(b, []byte("data of "+name))] ^= 1
+			}
+			r, err := bar.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				err = os.WriteFile(filepath.Join(dir, name), nil, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []Warning
+			onWarning = func(w Warning) {
+				w.File = strings.ReplaceAll(w.File, dir, "DIR")
+				w.Message = strings.ReplaceAll(w.Message, dir, "DIR")
+				got = append(got, w)
+			}
+			err = r.ExtractAll(dir, bar.ExtractOptions{
+				Overwrite: bar.ReplaceExisting,
+				OnWarning: extractWarning,
+			})
+			failed := warnChecksums(err)
+			if len(failed) != len(tt.corrupt) {
+				t.Errorf("failed %v, want %v", failed, tt.corrupt)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortListing(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.txt": "0123456789",
+		"b.txt": strings.Repeat("a", 5000),
+		"c.txt": strings.Repeat("abc", 100),
+		"d.txt": "abcdefghij",
+	})
+	for name, sec := range map[string]int64{
+		"a.txt": 2000, "b.txt": 3000, "c.txt": 1000, "d.txt": 1000,
+	} {
+		mtime := time.Unix(sec, 0)
+		err := os.Chtimes(filepath.Join(dir, name), mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, stderr, code := runBar(t, dir, "", "-mtime", "a.bar", "a.txt", "b.txt",
+		"c.txt", "d.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"a.txt", "b.txt", "c.txt", "d.txt"}},
+		{[]string{"-sort", "name"}, []string{"a.txt", "b.txt", "c.txt", "d.txt"}},
+		{[]string{"-sort", "name", "-r"}, []string{"d.txt", "c.txt", "b.txt", "a.txt"}},
+		{[]string{"-sort", "size"}, []string{"a.txt", "d.txt", "c.txt", "b.txt"}},
+		{[]string{"-sort", "size", "-r"}, []string{"b.txt", "c.txt", "d.txt", "a.txt"}},
+		{[]string{"-sort", "ratio"}, []string{"b.txt", "c.txt", "a.txt", "d.txt"}},
+		{[]string{"-sort", "mtime"}, []string{"c.txt", "d.txt", "a.txt", "b.txt"}},
+		{[]string{"-sort", "mtime", "-r"}, []string{"b.txt", "a.txt", "d.txt", "c.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			args := append(tt.args, "-l", "a.bar")
+			stdout, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			var got []string
+			for _, line := range strings.Split(stdout, "\n")[1:] {
+				if fields := strings.Fields(line); len(fields) > 0 {
+					got = append(got, fields[0])
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, stderr, _ = runBar(t, dir, "", "-l", "-sort", "color", "a.bar")
+	if !strings.Contains(stderr, "Unknown sort key") {
+		t.Errorf("stderr %q", stderr)
+	}
+}
+
+func TestStdinName(t *testing.T) {
+	data := strings.Repeat("log line\n", 1000)
+	tests := []struct {
+		name string
+		args []string
+		perm fs.FileMode
+		msg  string
+	}{
+		{"default", []string{"-stdin-name", "output.log"}, 0644, ""},
+		{"level", []string{"-stdin-name", "output.log", "-c", "0"}, 0644, ""},
+		{"perm", []string{"-stdin-name", "output.log", "-stdin-perm", "0600"},
+			0600, ""},
+		{"directory", []string{"-stdin-name", "logs/output.log"}, 0644, ""},
+		{"invalid name", []string{"-stdin-name", "../output.log"}, 0,
+			"Invalid file name"},
+		{"invalid perm", []string{"-stdin-name", "output.log", "-stdin-perm",
+			"7777"}, 0, "Invalid permissions"},
+	}
+
+	sizes := make(map[string]int64)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, stderr, _ := runBar(t, dir, data, append(tt.args, "a.bar")...)
+			if tt.msg != "" || stderr != "" {
+				if !strings.Contains(stderr, tt.msg) || tt.msg == "" {
+					t.Errorf("stderr %q, want %q", stderr, tt.msg)
+				}
+				_, err := os.Stat(filepath.Join(dir, "a.bar"))
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("archive created: %v", err)
+				}
+				return
+			}
+
+			file, err := os.Open(filepath.Join(dir, "a.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			r, err := bar.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Entries) != 1 {
+				t.Fatalf("got %d entries, want 1", len(r.Entries))
+			}
+			e := r.Entries[0]
+			got, err := r.ReadFile(e.Name)
+			if err != nil || string(got) != data {
+				t.Errorf("read %d bytes, %v", len(got), err)
+			}
+			if e.Name != tt.args[1] || e.Mode().Perm() != tt.perm {
+				t.Errorf("got %s %v, want %s %v", e.Name, e.Mode().Perm(),
+					tt.args[1], tt.perm)
+			}
+			sizes[tt.name] = int64(e.CompressedSize())
+		})
+	}
+
+	if sizes["level"] <= sizes["default"] {
+		t.Errorf("'-c 0' gives %d bytes, default %d", sizes["level"],
+			sizes["default"])
+	}
+}
+
+func TestOutputInInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool // the output exists before
+		output   string
+		inputs   []string
+		want     string
+	}{
+		{"new", false, "data/out.bar", []string{"data"}, "data/a.txt\n"},
+		{"existing", true, "data/out.bar", []string{"data"}, "data/a.txt\n"},
+		{"nested", true, "data/sub/out.bar", []string{"data"},
+			"data/a.txt\n"},
+		{"named", true, "data/out.bar", []string{"data/a.txt", "data/out.bar"},
+			"data/a.txt\n"},
+		{"dot", true, "out.bar", []string{"."}, "data/a.txt\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"data/a.txt": "alpha"}
+			if tt.existing {
+				files[tt.output] = "old archive"
+			}
+			dir := writeTree(t, files)
+			args := append([]string{"-o", tt.output}, tt.inputs...)
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+			skipped := strings.Contains(stderr, "Skipping output file '"+
+				tt.output+"'")
+			if skipped != tt.existing {
+				t.Errorf("stderr %q", stderr)
+			}
+
+			stdout, stderr, code := runBar(t, dir, "", "-names", tt.output)
+			if code != 0 || stderr != "" {
+				t.Fatalf("names: exit %d: %s", code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidChecksums(t *testing.T) {
+	files := map[string]string{
+		"a.txt": "alpha alpha",
+		"b.txt": "bravo bravo",
+		"c.txt": "charlie charlie",
+	}
+	tests := []struct {
+		name    string
+		corrupt []string
+		summary string
+	}{
+		{"none", nil, ""},
+		{"one", []string{"b.txt"},
+			"1 of 3 files have an invalid checksum: b.txt"},
+		{"two", []string{"a.txt", "c.txt"},
+			"2 of 3 files have an invalid checksum: a.txt, c.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, files)
+			_, stderr, code := runBar(t, dir, "", "-store", "a.bar", "a.txt",
+				"b.txt", "c.txt")
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			name := filepath.Join(dir, "a.bar")
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tt.corrupt {
+				b[bytes.Index(b, []byte(files[f]))] ^= 1
+			}
+			err = os.WriteFile(name, b, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := t.TempDir()
+			_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+			if failed := code != 0; failed != (tt.corrupt != nil) {
+				t.Errorf("exit %d: %s", code, stderr)
+			}
+			if !strings.Contains(stderr, tt.summary) {
+				t.Errorf("stderr %q, want %q", stderr, tt.summary)
+			}
+			for _, f := range tt.corrupt {
+				msg := fmt.Sprintf("Invalid checksum for file '%s'.", f)
+				if !strings.Contains(stderr, msg) {
+					t.Errorf("stderr %q, want %q", stderr, msg)
+				}
+			}
+
+			for f, data := range files {
+				if slices.Contains(tt.corrupt, f) {
+					continue
+				}
+				got, err := os.ReadFile(filepath.Join(out, f))
+				if err != nil || string(got) != data {
+					t.Errorf("%s: got %q, %v, want %q", f, got, err, data)
+				}
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	src := writeTree(t, map[string]string{
+		"a.txt":     "alpha",
+		"b.txt":     "bravo",
+		"dir/c.txt": "charlie",
+	})
+	archive := filepath.Join(src, "a.bar")
+	_, stderr, code := runBar(t, src, "", archive, "a.txt", "b.txt", "dir")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"default", nil, "a.txt exists\nb.txt create\ndir/c.txt create\n"},
+		{"override", []string{"-o"},
+			"a.txt override\nb.txt create\ndir/c.txt create\n"},
+		{"keep", []string{"-k"}, "a.txt keep\nb.txt create\ndir/c.txt create\n"},
+		{"rename", []string{"-rename"},
+			"a.txt rename\nb.txt create\ndir/c.txt create\n"},
+		{"name", []string{"-n", "a.txt"}, "a.txt exists\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"a.txt": "old"})
+			args := append([]string{"-x", "-dry-run"}, tt.args...)
+			stdout, stderr, code := runBar(t, dir, "", append(args, archive)...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			var got strings.Builder
+			for _, line := range strings.SplitAfter(stdout, "\n") {
+				if line != "" {
+					fmt.Fprintln(&got, strings.Join(strings.Fields(line), " "))
+				}
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %q, want %q", got.String(), tt.want)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("got %d files, want 1", len(entries))
+			}
+			b, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+			if err != nil || string(b) != "old" {
+				t.Errorf("a.txt: got %q, %v, want %q", b, err, "old")
+			}
+		})
+	}
+}
+
+func TestArchiveNameStdout(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.txt": "alpha"})
+	tests := []struct {
+		name string
+		args []string
+		want string // archive name
+	}{
+		{"named", []string{"-archive-name", "backup", "-", "a.txt"}, "backup"},
+		{"unnamed", []string{"-", "a.txt"}, ""},
+		{"stdin", []string{"-archive-name", "logs", "-stdin-name", "a.log", "-"},
+			"logs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runBar(t, dir, "alpha", tt.args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			br, err := bar.NewReader(strings.NewReader(stdout))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if br.ArchiveName() != tt.want {
+				t.Errorf("got %q, want %q", br.ArchiveName(), tt.want)
+			}
+			data, err := br.ReadFile(br.Entries[0].Name)
+			if err != nil || string(data) != "alpha" {
+				t.Errorf("got %q, %v, want %q", data, err, "alpha")
+			}
+		})
+	}
+
+	_, err := os.Stat(filepath.Join(dir, "-"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file '-' created: %v", err)
+	}
+	_, stderr, _ := runBar(t, dir, "", "-sign", "key.pem", "-", "a.txt")
+	if !strings.Contains(stderr, "Conflicting flag '-sign'") {
+		t.Errorf("stderr %q", stderr)
+	}
+}
+
+func TestTotal(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.txt":  "alpha",
+		"b.txt":  "bravo",
+		"text":   strings.Repeat("hello, hello ", 1000),
+		"sub/c":  "charlie",
+		"sub/d0": "",
+	})
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"stored", []string{"-store"}},
+		{"deflate", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "a.bar")
+			args := append(tt.args, archive, "a.txt", "b.txt", "text", "sub")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			file, err := os.Open(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			r, err := bar.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var compressed uint64
+			for _, e := range r.Entries {
+				compressed += e.CompressedSize()
+			}
+			size := uint64(5 + 5 + 13000 + 7)
+			saved := 0.0
+			if compressed < size {
+				saved = 100 - float64(compressed)*100/float64(size)
+			}
+			want := fmt.Sprintf("5 files, %d bytes, %d compressed, %.2f%% saved\n",
+				size, compressed, saved)
+
+			stdout, stderr, code := runBar(t, dir, "", "-l", "-total", archive)
+			if code != 0 || stderr != "" {
+				t.Fatalf("list: exit %d: %s", code, stderr)
+			}
+			if !strings.HasSuffix(stdout, want) {
+				t.Errorf("got %q, want it to end with %q", stdout, want)
+			}
+			switch {
+			case tt.args != nil && !strings.HasSuffix(stdout,
+				"13017 bytes, 13017 compressed, 0.00% saved\n"):
+				t.Errorf("stored: got %q", stdout)
+			case tt.args == nil && saved < 90:
+				t.Errorf("deflate: %.2f%% saved", saved)
+			}
+
+			stdout, _, _ = runBar(t, dir, "", "-l", archive)
+			if strings.Contains(stdout, "files,") {
+				t.Errorf("total without '-total': %q", stdout)
+			}
+		})
+	}
+}
+
+func TestListName(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.txt":     "alpha",
+		"dir/b.txt": "bravo",
+		"dir/c.log": "charlie",
+	})
+	_, stderr, code := runBar(t, dir, "", "a.bar", "a.txt", "dir")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		want  []string // names listed
+		error string
+	}{
+		{"file", []string{"-n", "a.txt"}, []string{"a.txt"}, ""},
+		{"nested", []string{"-n", "dir/b.txt"}, []string{"dir/b.txt"}, ""},
+		{"ignore case", []string{"-ignore-case", "-n", "A.TXT"},
+			[]string{"a.txt"}, ""},
+		{"glob", []string{"-n", "dir/*"}, []string{"dir/b.txt", "dir/c.log"}, ""},
+		{"total", []string{"-n", "a.txt", "-total"},
+			[]string{"a.txt", "1"}, ""},
+		{"missing", []string{"-n", "b.txt"}, nil, "No such file 'b.txt'"},
+		{"no match", []string{"-n", "*.md"}, nil, "No files match '*.md'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-l"}, tt.args...)
+			stdout, stderr, _ := runBar(t, dir, "", append(args, "a.bar")...)
+			if tt.error == "" && stderr != "" ||
+				!strings.Contains(stderr, tt.error) {
+				t.Errorf("stderr %q, want %q", stderr, tt.error)
+			}
+			var names []string
+			for i, line := range strings.Split(stdout, "\n") {
+				if i > 0 && line != "" {
+					names = append(names, strings.Fields(line)[0])
+				}
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("got %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "src/main.go", false},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/pkg/main.go", false},
+		{"src/*", "src/pkg/main.go", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/pkg/main.go", true},
+		{"src/**/*.go", "src/pkg/sub/main.go", true},
+		{"src/**/*.go", "src/pkg/main.c", false},
+		{"src/**/*.go", "lib/main.go", false},
+		{"src/**", "src", true},
+		{"src/**", "src/pkg/main.go", true},
+		{"**", "a/b/c", true},
+		{"**/main.go", "main.go", true},
+		{"**/main.go", "a/b/main.go", true},
+		{"**/main.go", "a/b/main.go.orig", false},
+		{"a/**/b/**/c", "a/x/b/y/z/c", true},
+		{"a/**/b/**/c", "a/x/y/z/c", false},
+		{"?.txt", "a.txt", true},
+		{"[ab].txt", "c.txt", false},
+		{"a/**b", "a/xb", true},
+		{"a/**b", "a/x/b", false},
+	}
+
+	for _, tt := range tests {
+		got, err := matchGlob(tt.pattern, tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, %v, want %v", tt.pattern, tt.name,
+				got, err, tt.want)
+		}
+	}
+
+	_, err := matchGlob("src/[", "src/a")
+	if err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestListGlob(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"main.go":             "package main",
+		"src/a.go":            "package src",
+		"src/a_test.go":       "package src",
+		"src/pkg/b.go":        "package pkg",
+		"src/pkg/sub/c.go":    "package sub",
+		"src/pkg/sub/doc.txt": "doc",
+	})
+	_, stderr, code := runBar(t, dir, "", "a.bar", "main.go", "src")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"src/**/*.go",
+			"src/a.go\nsrc/a_test.go\nsrc/pkg/b.go\nsrc/pkg/sub/c.go\n"},
+		{"src/*.go", "src/a.go\nsrc/a_test.go\n"},
+		{"**/*_test.go", "src/a_test.go\n"},
+		{"*.go", "main.go\n"},
+	}
+
+	for _, tt := range tests {
+		stdout, stderr, code := runBar(t, dir, "", "-l", "-n", tt.pattern,
+			"a.bar")
+		if code != 0 || stderr != "" {
+			t.Fatalf("%s: exit %d: %s", tt.pattern, code, stderr)
+		}
+		var got strings.Builder
+		for _, line := range strings.Split(stdout, "\n")[1:] {
+			if line != "" {
+				fmt.Fprintln(&got, strings.Fields(line)[0])
+			}
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.pattern, got.String(), tt.want)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "alpha",
+		"dir/b.txt": strings.Repeat("bravo ", 1000),
+		"empty":     "",
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		method string
+	}{
+		{"stored", []string{"-store"}, "stored"},
+		{"deflate", nil, "deflate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, files)
+			args := append(tt.args, "a.bar", "a.txt", "dir", "empty")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+			stdout, stderr, code := runBar(t, dir, "", "-layout", "a.bar")
+			if code != 0 || stderr != "" {
+				t.Fatalf("layout: exit %d: %s", code, stderr)
+			}
+			b, err := os.ReadFile(filepath.Join(dir, "a.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+			if len(lines) != len(files)+1 ||
+				strings.Join(strings.Fields(lines[0]), " ") !=
+					"OFFSET LENGTH METHOD NAME" {
+				t.Fatalf("got %q", stdout)
+			}
+			for _, line := range lines[1:] {
+				var off, n int
+				var method, name string
+				_, err := fmt.Sscan(line, &off, &n, &method, &name)
+				if err != nil {
+					t.Fatalf("%q: %v", line, err)
+				}
+				if method != tt.method {
+					t.Errorf("%s: method %s, want %s", name, method, tt.method)
+				}
+
+				// The data carved out at the offsets is the file.
+				block := b[off : off+n]
+				if method == "deflate" {
+					block, err = io.ReadAll(flate.NewReader(bytes.NewReader(block)))
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+				}
+				if string(block) != files[name] {
+					t.Errorf("%s: got %q, want %q", name, block, files[name])
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyArchive(t *testing.T) {
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "empty.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := bar.NewWriter(file)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		stdout string
+		stderr string
+	}{
+		{"extract", []string{"-x"}, "", ""},
+		{"extract name", []string{"-x", "-n", "a.txt"}, "",
+			"No such file 'a.txt' in archive."},
+		{"extract glob", []string{"-x", "-n", "*.txt"}, "",
+			"No files match '*.txt' in archive."},
+		{"dry run", []string{"-x", "-dry-run"}, "", ""},
+		{"names", []string{"-names"}, "", ""},
+		{"test", []string{"-t"}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			args := append(tt.args, filepath.Join(dir, "empty.bar"))
+			stdout, stderr, code := runBar(t, out, "", args...)
+			if code != 0 || !strings.Contains(stderr, tt.stderr) ||
+				tt.stderr == "" && stderr != "" {
+				t.Errorf("exit %d: %q, want %q", code, stderr, tt.stderr)
+			}
+			if tt.name != "test" && stdout != tt.stdout {
+				t.Errorf("got %q, want %q", stdout, tt.stdout)
+			}
+			entries, err := os.ReadDir(out)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("got %d files, %v", len(entries), err)
+			}
+		})
+	}
+}
+
+func TestMapDir(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"etc/hosts":    "hosts",
+		"etc/conf/x":   "x",
+		"var/log/sys":  "sys",
+		"readme":       "readme",
+		"var/lib/data": "data",
+	})
+	_, stderr, code := runBar(t, dir, "", "a.bar", "etc", "var", "readme")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string // file: data, relative to the output
+	}{
+		{"two rules", []string{"-map-dir", "etc/*=etc-root", "-map-dir",
+			"var/**=var-root", "-C", "default"}, map[string]string{
+			"etc-root/etc/hosts":    "hosts",
+			"default/etc/conf/x":    "x",
+			"var-root/var/log/sys":  "sys",
+			"var-root/var/lib/data": "data",
+			"default/readme":        "readme",
+		}},
+		{"first match wins", []string{"-map-dir", "etc/**=first", "-map-dir",
+			"etc/hosts=second"}, map[string]string{
+			"first/etc/hosts":  "hosts",
+			"first/etc/conf/x": "x",
+			"var/log/sys":      "sys",
+			"var/lib/data":     "data",
+			"readme":           "readme",
+		}},
+		{"no match", []string{"-map-dir", "usr/**=usr-root"}, map[string]string{
+			"etc/hosts":    "hosts",
+			"etc/conf/x":   "x",
+			"var/log/sys":  "sys",
+			"var/lib/data": "data",
+			"readme":       "readme",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			args := append([]string{"-x"}, tt.args...)
+			args = append(args, filepath.Join(dir, "a.bar"))
+			_, stderr, code := runBar(t, out, "", args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+
+			got := make(map[string]string)
+			filepath.WalkDir(out, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					b, err := os.ReadFile(p)
+					if err != nil {
+						return err
+					}
+					rel, _ := filepath.Rel(out, p)
+					got[filepath.ToSlash(rel)] = string(b)
+				}
+				return err
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, stderr, _ = runBar(t, dir, "", "-x", "-map-dir", "etc", "a.bar")
+	if !strings.Contains(stderr, "expected pattern=dir") {
+		t.Errorf("stderr %q", stderr)
+	}
+}
+
+func TestOverwriteFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		flags  []string
+		code   int
+		want   map[string]string // path below the output: data
+		stderr string
+	}{
+		{"default", nil, 1, map[string]string{"a.txt": "old"}, ""},
+		{"override", []string{"-o"}, 0,
+			map[string]string{"a.txt": "alpha", "b.txt": "bravo"},
+			"Overriding file"},
+		{"keep", []string{"-k"}, 0,
+			map[string]string{"a.txt": "old", "b.txt": "bravo"},
+			"Keeping existing file"},
+		{"rename", []string{"-rename"}, 0,
+			map[string]string{"a.txt": "old", "a.txt.1": "alpha", "b.txt": "bravo"},
+			"File exists, extracting to"},
+		{"conflict", []string{"-o", "-k"}, 1,
+			map[string]string{"a.txt": "old"},
+			"Conflicting flags '-o', '-k' and '-rename'."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{
+				"a.txt":     "alpha",
+				"b.txt":     "bravo",
+				"out/a.txt": "old",
+			})
+			_, stderr, code := runBar(t, dir, "", "a.bar", "a.txt", "b.txt")
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			args := append([]string{"-x", "-C", "out"}, tt.flags...)
+			_, stderr, code = runBar(t, dir, "", append(args, "a.bar")...)
+			if code != tt.code {
+				t.Errorf("exit %d, want %d: %s", code, tt.code, stderr)
+			}
+			if !strings.Contains(stderr, tt.stderr) {
+				t.Errorf("stderr %q, want %q", stderr, tt.stderr)
+			}
+
+			des, err := os.ReadDir(filepath.Join(dir, "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(des) != len(tt.want) {
+				t.Errorf("got %d files, want %d", len(des), len(tt.want))
+			}
+			for name, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, "out", name))
+				if err != nil || string(got) != want {
+					t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+// changingFile changes the size of its file to size on the first read.
+type changingFile struct {
+	*os.File
+	size int64
+	done bool
+}
+
+func (f *changingFile) Read(p []byte) (int, error) {
+	if !f.done {
+		f.done = true
+		err := f.File.Truncate(f.size)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return f.File.Read(p)
+}
+
+func TestCopyFile(t *testing.T) {
+	data := strings.Repeat("data ", 1000)
+	tests := []struct {
+		name string
+		size int64 // of the file once reading starts
+	}{
+		{"unchanged", int64(len(data))},
+		{"shrunk", 100},
+		{"emptied", 0},
+		{"grown", int64(len(data)) + 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"a.txt": data})
+			f, err := os.OpenFile(filepath.Join(dir, "a.txt"), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var buf bytes.Buffer
+			n, s, err := copyFile(&buf, &changingFile{File: f, size: tt.size})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.size || int64(buf.Len()) != tt.size {
+				t.Errorf("copied %d, %d bytes, want %d", n, buf.Len(), tt.size)
+			}
+			if s.Size() != int64(len(data)) {
+				t.Errorf("size %d, want %d", s.Size(), len(data))
+			}
+		})
+	}
+}
+
+func TestDiffFlag(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string // of the second archive
+		code  int
+		want  string
+	}{
+		{"same", map[string]string{"a.txt": "alpha", "b.txt": "bravo"}, 0, ""},
+		{"changed", map[string]string{"a.txt": "alpha", "b.txt": "brave"}, 1,
+			"~ b.txt (data)\n"},
+		{"added and removed", map[string]string{"a.txt": "alpha", "c.txt": "c"},
+			1, "- b.txt\n+ c.txt\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := writeTree(t, map[string]string{"a.txt": "alpha", "b.txt": "bravo"})
+			b := writeTree(t, tt.files)
+			for _, dir := range []string{a, b} {
+				_, stderr, code := runBar(t, dir, "", "x.bar", ".")
+				if code != 0 {
+					t.Fatalf("create: exit %d: %s", code, stderr)
+				}
+			}
+
+			stdout, stderr, code := runBar(t, a, "", "-diff", "x.bar",
+				filepath.Join(b, "x.bar"))
+			if code != tt.code || stderr != "" {
+				t.Errorf("exit %d, want %d: %s", code, tt.code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgressTotal(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"one", map[string]string{"a.txt": "alpha"}},
+		{"empty", map[string]string{"a.txt": "alpha", "empty": ""}},
+		{"nested", map[string]string{
+			"a.txt":     "alpha",
+			"dir/b.txt": "bravo",
+			"dir/sub/c": strings.Repeat("charlie ", 1000),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, tt.files)
+			var size int
+			for _, data := range tt.files {
+				size += len(data)
+			}
+			archive := filepath.Join(t.TempDir(), "a.bar")
+			_, stderr, code := runBar(t, dir, "", "-progress", archive, ".")
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+			want := fmt.Sprintf("%d files, %d bytes\n", len(tt.files), size)
+			if !strings.HasPrefix(stderr, want) {
+				t.Errorf("got %q, want it to start with %q", stderr, want)
+			}
+			if !strings.HasSuffix(stderr, "100% "+sortedLast(tt.files)+"\n") {
+				t.Errorf("got %q, want it to end at 100%%", stderr)
+			}
+		})
+	}
+}
+
+// sortedLast returns the last name of files in sorted order.
+func sortedLast(files map[string]string) string {
+	var last string
+	for name := range files {
+		last = max(last, name)
+	}
+	return last
+}
+
+func TestFsck(t *testing.T) {
+	files := map[string]string{"a.txt": "alpha alpha", "b.txt": "bravo bravo"}
+	tests := []struct {
+		name   string
+		change func(b []byte)
+		code   int
+		want   string
+	}{
+		{"ok", func(b []byte) {}, 0,
+			"header, footer and table: ok\n2 files, 0 problems\n"},
+		{"data", func(b []byte) {
+			b[bytes.Index(b, []byte(files["b.txt"]))] ^= 1
+		}, 1, "header, footer and table: ok\nb.txt: Invalid checksum.\n" +
+			"2 files, 1 problems\n"},
+		{"footer", func(b []byte) { b[len(b)-8] ^= 1 }, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, files)
+			_, stderr, code := runBar(t, dir, "", "-store", "a.bar", "a.txt",
+				"b.txt")
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+			name := filepath.Join(dir, "a.bar")
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(b)
+			err = os.WriteFile(name, b, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stdout, stderr, code := runBar(t, dir, "", "-fsck", "a.bar")
+			if code != tt.code {
+				t.Errorf("exit %d, want %d: %s", code, tt.code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestModTimeFlag(t *testing.T) {
+	mtime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	tests := []struct {
+		name     string
+		args     []string
+		restored bool
+	}{
+		{"stored", []string{"-mtime"}, true},
+		{"not stored", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"})
+			for _, name := range []string{"a.txt", "sub/b.txt", "sub"} {
+				err := os.Chtimes(filepath.Join(dir, name), mtime, mtime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			args := append(tt.args, "a.bar", "a.txt", "sub")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			out := t.TempDir()
+			_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+			if code != 0 {
+				t.Fatalf("extract: exit %d: %s", code, stderr)
+			}
+			for _, name := range []string{"a.txt", "sub/b.txt"} {
+				s, err := os.Stat(filepath.Join(out, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.ModTime().Equal(mtime) != tt.restored {
+					t.Errorf("%s: mtime %v", name, s.ModTime())
+				}
+			}
+		})
+	}
+}
+
+func TestRecompressXattrs(t *testing.T) {
+	attrs := map[string][]byte{"user.comment": []byte("hello")}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"kept", nil},
+		{"with flag", []string{"-xattrs"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := bar.NewWriter(&buf, bar.WithXattrs())
+			if err == nil {
+				err = w.Create("a.txt")
+			}
+			if err == nil {
+				err = w.SetXattrs(attrs)
+			}
+			if err == nil {
+				_, err = w.Write([]byte("alpha"))
+			}
+			if err == nil {
+				err = w.Create("b.txt")
+			}
+			if err == nil {
+				err = w.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := writeTree(t, map[string]string{"a.bar": buf.String()})
+
+			args := append([]string{"-recompress", "-c", "9"}, tt.args...)
+			_, stderr, code := runBar(t, dir, "", append(args, "a.bar", "b.bar")...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("recompress: exit %d: %s", code, stderr)
+			}
+
+			b, err := os.ReadFile(filepath.Join(dir, "b.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := bar.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range r.Entries {
+				want := attrs
+				if e.Name != "a.txt" {
+					want = nil
+				}
+				if !reflect.DeepEqual(e.Xattrs, want) {
+					t.Errorf("%s: got %v, want %v", e.Name, e.Xattrs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestListComments(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []bar.WriterOption
+		want string
+	}{
+		{"comments", []bar.WriterOption{bar.WithComments()},
+			"NAME   PERM  SAVED  COMMENT\n" +
+				"a.txt  0644  0.00%  \"build 1234\"\n" +
+				"b.txt  0644  0.00%  \"two\\nlines\"\n" +
+				"c.txt  0644  0.00%  \n"},
+		{"none", nil,
+			"NAME   PERM  SAVED\n" +
+				"a.txt  0644  0.00%\n" +
+				"b.txt  0644  0.00%\n" +
+				"c.txt  0644  0.00%\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := bar.NewWriter(&buf, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []struct{ name, comment string }{
+				{"a.txt", "build 1234"},
+				{"b.txt", "two\nlines"},
+				{"c.txt", ""},
+			} {
+				err = w.Create(f.name)
+				if err == nil {
+					err = w.SetPerms(0644)
+				}
+				if err == nil {
+					err = w.SetComment(f.comment)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := writeTree(t, map[string]string{"a.bar": buf.String()})
+
+			stdout, stderr, code := runBar(t, dir, "", "-l", "a.bar")
+			if code != 0 || stderr != "" {
+				t.Fatalf("list: exit %d: %s", code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveComment(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.txt": "alpha"})
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	_, stderr, code := runBar(t, dir, "", "-archive-comment", "nightly build",
+		"a.bar", "a.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	_, stderr, code = runBar(t, dir, "", "-recompress", "a.bar", "b.bar")
+	if code != 0 || stderr != "" {
+		t.Fatalf("recompress: exit %d: %s", code, stderr)
+	}
+	_, stderr, code = runBar(t, dir, "", "c.bar", "a.txt")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	created := time.Unix(1700000000, 0).Format(time.RFC3339)
+	tests := []struct {
+		archive string
+		want    []string
+		not     []string
+	}{
+		{"a.bar", []string{"created: " + created, "comment: nightly build"}, nil},
+		{"b.bar", []string{"created: " + created, "comment: nightly build"}, nil},
+		{"c.bar", nil, []string{"created:", "comment:"}},
+	}
+
+	for _, tt := range tests {
+		stdout, stderr, code := runBar(t, dir, "", "-v", tt.archive)
+		if code != 0 || stderr != "" {
+			t.Fatalf("%s: exit %d: %s", tt.archive, code, stderr)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(stdout, want+"\n") {
+				t.Errorf("%s: got %q, want %q", tt.archive, stdout, want)
+			}
+		}
+		for _, not := range tt.not {
+			if strings.Contains(stdout, not) {
+				t.Errorf("%s: got %q", tt.archive, stdout)
+			}
+		}
+	}
+}
+
+func TestMethodFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		method bar.Method
+		stderr string // if no archive is written
+	}{
+		{"default", nil, bar.MethodDeflate, ""},
+		{"fast", []string{"-fast"}, bar.MethodLZ4, ""},
+		{"method", []string{"-method", "lz4"}, bar.MethodLZ4, ""},
+		{"fast and method", []string{"-fast", "-method", "lz4"}, bar.MethodLZ4, ""},
+		{"xz", []string{"-method", "xz"}, bar.MethodXZ, ""},
+		{"store", []string{"-store"}, bar.MethodStored, ""},
+		{"store and method", []string{"-store", "-method", "stored"},
+			bar.MethodStored, ""},
+		{"fast and store", []string{"-fast", "-store"}, 0,
+			"Conflicting flags '-store' and '-fast'."},
+		{"conflict", []string{"-fast", "-method", "gzip"}, 0,
+			"Conflicting flags '-fast' and '-method'."},
+		{"unknown", []string{"-method", "rar"}, 0,
+			"Unsupported compression method 'rar'."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := strings.Repeat("some text, some more text\n", 1000)
+			dir := writeTree(t, map[string]string{"a.txt": data, "b.txt": "bravo"})
+			args := append(tt.args, "a.bar", "a.txt", "b.txt")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if tt.stderr != "" {
+				if !strings.Contains(stderr, tt.stderr) {
+					t.Errorf("stderr %q, want %q", stderr, tt.stderr)
+				}
+				_, err := os.Stat(filepath.Join(dir, "a.bar"))
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("archive written: %v", err)
+				}
+				return
+			}
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			file, err := os.Open(filepath.Join(dir, "a.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			r, err := bar.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range r.Entries {
+				if e.Method != tt.method {
+					t.Errorf("%s: method %v, want %v", e.Name, e.Method, tt.method)
+				}
+			}
+
+			// Stored data is kept as it is, in the archive.
+			b, err := os.ReadFile(filepath.Join(dir, "a.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := bytes.Contains(b, []byte(data)); stored !=
+				(tt.method == bar.MethodStored) {
+				t.Errorf("data stored as it is: %v", stored)
+			}
+
+			out := t.TempDir()
+			_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+			if code != 0 {
+				t.Fatalf("extract: exit %d: %s", code, stderr)
+			}
+			got, err := os.ReadFile(filepath.Join(out, "a.txt"))
+			if err != nil || string(got) != data {
+				t.Errorf("a.txt: got %d bytes, %v, want %d", len(got), err, len(data))
+			}
+		})
+	}
+}
+
+func TestSolidFlag(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("src/f%02d.go", i)] = fmt.Sprintf(
+			"package src\n\n// F%d returns %d.\nfunc F%d() int { return %d }\n",
+			i, i, i, i)
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		solid  bool
+		method bar.Method
+	}{
+		{"default", nil, false, bar.MethodDeflate},
+		{"solid", []string{"-solid"}, true, bar.MethodDeflate},
+		{"solid and store", []string{"-solid", "-store"}, true, bar.MethodStored},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, files)
+			args := append(tt.args, "a.bar", "src")
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 || stderr != "" {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			file, err := os.Open(filepath.Join(dir, "a.bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			r, err := bar.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if solid := r.Flags()&bar.FlagSolid != 0; solid != tt.solid {
+				t.Errorf("solid %v, want %v", solid, tt.solid)
+			}
+			for _, e := range r.Entries {
+				if e.Method != tt.method {
+					t.Errorf("%s: method %v, want %v", e.Name, e.Method, tt.method)
+				}
+			}
+
+			out := filepath.Join(dir, "out")
+			_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+			if code != 0 || stderr != "" {
+				t.Fatalf("extract: exit %d: %s", code, stderr)
+			}
+			for name, want := range files {
+				got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+				if err != nil || string(got) != want {
+					t.Errorf("%s: got %q, %v", name, got, err)
+				}
+			}
+		})
+	}
+}
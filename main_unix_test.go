@@ -0,0 +1,366 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bar/archive/bar"
+)
+
+func TestExtractUIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring owners requires root")
+	}
+	uidMap[1000] = 1001
+	defer delete(uidMap, 1000)
+
+	var buf bytes.Buffer
+	w, err := bar.NewWriter(&buf, bar.WithOwner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Create("a.txt")
+	if err == nil {
+		err = w.SetOwner(1000, 1000, "root", "")
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := bar.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = br.ExtractAll(dir, bar.ExtractOptions{
+		Entries: mapOwners(br.Entries),
+		Owner:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.Sys().(*syscall.Stat_t)
+	if st.Uid != 1001 || st.Gid != 1000 {
+		t.Errorf("owner %d:%d, want 1001:1000", st.Uid, st.Gid)
+	}
+}
+
+func TestSkipSpecial(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		inputs []string
+		want   string // names archived, or none if creation fails
+		msg    string
+	}{
+		{"in directory", nil, []string{"data"}, "",
+			"'data/fifo' is not a regular file or directory."},
+		{"named", nil, []string{"data/a.txt", "data/fifo"}, "",
+			"'data/fifo' is not a regular file or directory."},
+		{"skip in directory", []string{"-skip-special"}, []string{"data"},
+			"data/a.txt\n", "Skipping 'data/fifo'"},
+		{"skip named", []string{"-skip-special"},
+			[]string{"data/a.txt", "data/fifo"}, "data/a.txt\n",
+			"Skipping 'data/fifo'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"data/a.txt": "alpha"})
+			err := syscall.Mkfifo(filepath.Join(dir, "data", "fifo"), 0644)
+			if err != nil {
+				t.Skip("no named pipes:", err)
+			}
+
+			args := append(tt.args, "a.bar")
+			_, stderr, _ := runBar(t, dir, "", append(args, tt.inputs...)...)
+			if !strings.Contains(stderr, tt.msg) {
+				t.Errorf("stderr %q, want %q", stderr, tt.msg)
+			}
+			if tt.want == "" {
+				_, err := os.Stat(filepath.Join(dir, "a.bar"))
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("archive created: %v", err)
+				}
+				return
+			}
+
+			stdout, stderr, code := runBar(t, dir, "", "-names", "a.bar")
+			if code != 0 || stderr != "" {
+				t.Fatalf("names: exit %d: %s", code, stderr)
+			}
+			if stdout != tt.want {
+				t.Errorf("got %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetuidWarning(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.sh": "#!/bin/sh\n"})
+	err := os.Chmod(filepath.Join(dir, "a.sh"), 0755|os.ModeSetuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runBar(t, dir, "", "a.bar", "a.sh")
+	if code != 0 || stderr != "" {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want os.FileMode
+		msg  string
+	}{
+		{"restore", nil, 0755 | os.ModeSetuid, "Restoring setuid/setgid bits of"},
+		{"no special bits", []string{"-no-special-bits"}, 0755, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			args := append([]string{"-x", "-C", out}, tt.args...)
+			_, stderr, code := runBar(t, dir, "", append(args, "a.bar")...)
+			if code != 0 {
+				t.Fatalf("exit %d: %s", code, stderr)
+			}
+			if tt.msg == "" && stderr != "" || !strings.Contains(stderr, tt.msg) {
+				t.Errorf("stderr %q, want %q", stderr, tt.msg)
+			}
+			s, err := os.Stat(filepath.Join(out, "a.sh"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Mode() != tt.want {
+				t.Errorf("mode %v, want %v", s.Mode(), tt.want)
+			}
+		})
+	}
+}
+
+func TestProgressTotalHardlink(t *testing.T) {
+	data := strings.Repeat("alpha ", 100)
+	dir := writeTree(t, map[string]string{"a.txt": data, "b.txt": "bravo"})
+	err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "a.bar")
+	_, stderr, code := runBar(t, dir, "", "-progress", archive, ".")
+	if code != 0 {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	want := fmt.Sprintf("3 files, %d bytes\n", len(data)+len("bravo"))
+	if !strings.HasPrefix(stderr, want) {
+		t.Errorf("got %q, want it to start with %q", stderr, want)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		links  map[string]string // name: target
+		args   []string
+		code   int
+		want   map[string]string // name: data or "-> target"
+		stderr string
+	}{
+		{
+			name:  "links",
+			links: map[string]string{"link": "a.txt", "dir/up": "../a.txt"},
+			code:  0,
+			want: map[string]string{
+				"a.txt":  "alpha",
+				"link":   "-> a.txt",
+				"dir/up": "-> ../a.txt",
+			},
+		},
+		{
+			name:  "followed",
+			links: map[string]string{"link": "a.txt"},
+			args:  []string{"-L"},
+			code:  0,
+			want:  map[string]string{"a.txt": "alpha", "link": "alpha"},
+		},
+		{
+			name:   "outside",
+			links:  map[string]string{"link": "../../etc/passwd"},
+			code:   1,
+			stderr: "Link 'link' in archive points outside of the target directory.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"a.txt": "alpha", "dir/b": "b"})
+			for name, target := range tt.links {
+				err := os.Symlink(target, filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			args := append(tt.args, "a.bar", "a.txt", "dir")
+			for name := range tt.links {
+				if filepath.Dir(name) == "." {
+					args = append(args, name)
+				}
+			}
+			_, stderr, code := runBar(t, dir, "", args...)
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+
+			out := t.TempDir()
+			_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+			if code != tt.code || !strings.Contains(stderr, tt.stderr) {
+				t.Fatalf("extract: exit %d, want %d: %s", code, tt.code, stderr)
+			}
+			for name, want := range tt.want {
+				name = filepath.Join(out, name)
+				if target, ok := strings.CutPrefix(want, "-> "); ok {
+					got, err := os.Readlink(name)
+					if err != nil || got != target {
+						t.Errorf("%s: link to %q, %v, want %q", name, got, err,
+							target)
+					}
+					continue
+				}
+				s, err := os.Lstat(name)
+				if err != nil || !s.Mode().IsRegular() {
+					t.Fatalf("%s: not a regular file, %v", name, err)
+				}
+				got, err := os.ReadFile(name)
+				if err != nil || string(got) != want {
+					t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyDirs(t *testing.T) {
+	tests := []struct {
+		name  string
+		dirs  map[string]fs.FileMode // created empty
+		names string
+		want  map[string]fs.FileMode
+	}{
+		{"one", map[string]fs.FileMode{"src/empty": 0750}, "src/a.txt\nsrc/empty\n",
+			map[string]fs.FileMode{"src/empty": 0750}},
+		{"private", map[string]fs.FileMode{"src/private": 0700},
+			"src/a.txt\nsrc/private\n", map[string]fs.FileMode{"src/private": 0700}},
+		{"nested", map[string]fs.FileMode{"src/x/y": 0755},
+			"src/a.txt\nsrc/x/y\n", map[string]fs.FileMode{"src/x/y": 0755}},
+		{"none", nil, "src/a.txt\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTree(t, map[string]string{"src/a.txt": "alpha"})
+			for name, perm := range tt.dirs {
+				name = filepath.Join(dir, name)
+				err := os.MkdirAll(name, 0755)
+				if err == nil {
+					err = os.Chmod(name, perm)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, stderr, code := runBar(t, dir, "", "a.bar", "src")
+			if code != 0 {
+				t.Fatalf("create: exit %d: %s", code, stderr)
+			}
+			stdout, _, _ := runBar(t, dir, "", "-names", "a.bar")
+			if stdout != tt.names {
+				t.Errorf("got %q, want %q", stdout, tt.names)
+			}
+
+			out := t.TempDir()
+			_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+			if code != 0 {
+				t.Fatalf("extract: exit %d: %s", code, stderr)
+			}
+			for name, want := range tt.want {
+				s, err := os.Stat(filepath.Join(out, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !s.IsDir() || s.Mode().Perm() != want {
+					t.Errorf("%s: mode %v, want %v", name, s.Mode(), fs.ModeDir|want)
+				}
+				des, err := os.ReadDir(filepath.Join(out, name))
+				if err != nil || len(des) != 0 {
+					t.Errorf("%s: %d entries, %v, want none", name, len(des), err)
+				}
+			}
+		})
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	data := strings.Repeat("alpha ", 1000)
+	dir := writeTree(t, map[string]string{"a.txt": data, "b.txt": data})
+	err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The linked files are stored once, the copy with the same data isn't.
+	_, stderr, code := runBar(t, dir, "", "-store", "a.bar", "a.txt", "b.txt",
+		"link.txt")
+	if code != 0 {
+		t.Fatalf("create: exit %d: %s", code, stderr)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "a.bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte(data)); n != 2 {
+		t.Errorf("data stored %d times, want 2", n)
+	}
+
+	out := t.TempDir()
+	_, stderr, code = runBar(t, dir, "", "-x", "-C", out, "a.bar")
+	if code != 0 {
+		t.Fatalf("extract: exit %d: %s", code, stderr)
+	}
+	stat := func(name string) fs.FileInfo {
+		s, err := os.Stat(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if !os.SameFile(stat("a.txt"), stat("link.txt")) {
+		t.Error("a.txt and link.txt aren't linked")
+	}
+	if os.SameFile(stat("a.txt"), stat("b.txt")) {
+		t.Error("a.txt and b.txt are linked")
+	}
+	for _, name := range []string{"a.txt", "b.txt", "link.txt"} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil || string(got) != data {
+			t.Errorf("%s: got %d bytes, %v, want %d", name, len(got), err, len(data))
+		}
+	}
+}
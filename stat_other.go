@@ -0,0 +1,17 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import "io/fs"
+
+// inodeOf returns the zero key, hard links aren't detected on this
+// platform.
+func inodeOf(s fs.FileInfo) fileKey {
+	return fileKey{}
+}
+
+// ownerOf returns -1 for the uid and gid, owners aren't stored on this
+// platform.
+func ownerOf(s fs.FileInfo) (int, int) {
+	return -1, -1
+}
@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// inodeOf returns the device and inode of the file described by s, or the
+// zero key if it has no other hard links.
+func inodeOf(s fs.FileInfo) fileKey {
+	st, ok := s.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileKey{}
+	}
+	return fileKey{uint64(st.Dev), uint64(st.Ino)}
+}
+
+// ownerOf returns the uid and gid of the file described by s.
+func ownerOf(s fs.FileInfo) (int, int) {
+	st, ok := s.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(st.Uid), int(st.Gid)
+}